@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/filestore"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"os"
+)
+
+// runFsck runs the fsck command, verifying the files of a persistent storage and optionally repairing them.
+// It returns the exit code of the command: 1 if unrepaired issues are left.
+func runFsck(args []string) int {
+	flags := pflag.NewFlagSet("fsck", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s fsck [flags]\n\nVerify the bucket files, the object blobs and leftover temporary files.\nThe server must not be running on the data path.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	verbose := flags.BoolP("verbose", "v", false, "Print verbose output")
+	dataPath := flags.String("data-path", ".", "Path to folder of persistent data")
+	repair := flags.Bool("repair", false, "Truncate bucket files at their last valid record and remove temporary files")
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	logger := getLogger(*verbose)
+
+	result, err := filestore.Check(*dataPath, *repair)
+	if err != nil {
+		logger.Errorf("Cannot check storage in %q: %v", *dataPath, err)
+		return 1
+	}
+
+	for _, issue := range result.Issues {
+		entry := logger.WithFields(logrus.Fields{"kind": issue.Kind, "file": issue.Path})
+		if issue.Offset >= 0 {
+			entry = entry.WithField("offset", issue.Offset)
+		}
+		if issue.Object != "" {
+			entry = entry.WithField("object", issue.Object)
+		}
+		if issue.Version != "" {
+			entry = entry.WithField("version", issue.Version)
+		}
+		switch {
+		case issue.Kind == filestore.IssueDuplicate:
+			entry.Debug(issue.Message)
+		case issue.Repaired:
+			entry.Warnf("Repaired: %s", issue.Message)
+		default:
+			entry.Error(issue.Message)
+		}
+	}
+	logger.Infof("Checked %d bucket files with %d records in %q", result.BucketFiles, result.Records, *dataPath)
+
+	if !result.Healthy() {
+		logger.Error("Storage has issues")
+		return 1
+	}
+	return 0
+}
@@ -4,12 +4,12 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"github.com/flaviopicci/simple-objectstore-restapi/internals/filestore"
-	"github.com/flaviopicci/simple-objectstore-restapi/internals/memstore"
 	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/storage"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"io"
 	"net/http"
 	"os"
 	"os/signal"
@@ -26,14 +26,39 @@ const defaultListenPort = 8080
 
 var listenAddrRe = regexp.MustCompile(`([\w.-]+:)?([0-9]+)?`)
 
+// legacyOptions are the storage options set at the top level of the configuration before the storage backends had
+// their own section, by name, along with the env variables setting them. They apply to the chosen persistent backend.
+var legacyOptions = map[string][]string{
+	"data_path": {"OBJSTORE_DATA_PATH", "OBJSTORE__DATA_PATH"},
+}
+
+// commands are the maintenance commands run instead of the server, given as first argument
+var commands = map[string]func(args []string) int{
+	"fsck":    runFsck,
+	"migrate": runMigrate,
+}
+
 func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
+
 	// Define command line parameters
 	pflag.BoolP("verbose", "v", false, "Print verbose output")
 	pflag.StringP("config", "c", "", "Path to the configuration file")
 
 	pflag.StringP("listen-address", "l", "", "Address to listen to in the form of <port> or <address>:<port>")
 	pflag.BoolP("persist", "p", false, "Whether to use persistent storage to store objects")
-	pflag.String("data-path", "", "Path to folder of persistent data")
+	pflag.String("storage", "", "Storage backend: "+strings.Join(storage.Backends(), ", ")+" (default memory, file with --persist)")
+	pflag.StringSlice("allowed-content-types", nil, "Content types allowed for the stored objects, like `image/*` (default any)")
+
+	// The storage options, of all the backends, are defined by the storage package
+	if err := storage.AddFlags(pflag.CommandLine); err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot define storage flags: %v\n", err)
+		os.Exit(2)
+	}
 
 	pflag.Parse()
 
@@ -41,14 +66,14 @@ func main() {
 	v := viper.NewWithOptions(viper.EnvKeyReplacer(envReplacer{old: ".", new: "_"}))
 	v.SetDefault("config", "config")
 	v.SetDefault("listen_address", fmt.Sprintf("%s:%d", defaultListenAddr, defaultListenPort))
-	v.SetDefault("data_path", ".")
 
 	_ = v.BindPFlag("verbose", pflag.Lookup("verbose"))
 	_ = v.BindPFlag("config", pflag.Lookup("config"))
 
 	_ = v.BindPFlag("listen_address", pflag.Lookup("listen-address"))
 	_ = v.BindPFlag("persist", pflag.Lookup("persist"))
-	_ = v.BindPFlag("data_path", pflag.Lookup("data-path"))
+	_ = v.BindPFlag("storage.type", pflag.Lookup("storage"))
+	_ = v.BindPFlag("allowed_content_types", pflag.Lookup("allowed-content-types"))
 
 	// Bind Viper parameters with env variables prefixed with `OBJSTORE_`
 	v.SetEnvPrefix("objstore_")
@@ -73,25 +98,32 @@ func main() {
 		}
 	}
 
-	// Choose storage type, in memory or persistent
-	var store rest.ObjectStore
-	if v.GetBool("persist") {
-		dataPath := v.GetString("data_path")
-		err := os.MkdirAll(dataPath, 0755)
-		if err != nil {
-			logger.Fatalf("Cannot create storage folder: %v", err)
-		}
-		if store, err = filestore.NewStore(v.GetString("data_path")); err != nil {
-			logger.Fatalf("Cannot initialize file storage: %v", err)
+	// Open the storage backend, in memory unless persist is set
+	storageType := v.GetString("storage.type")
+	if storageType == "" {
+		storageType = "memory"
+		if v.GetBool("persist") {
+			storageType = "file"
 		}
-		logger.Infof("Use persistent storage in %q", dataPath)
-	} else {
-		store = memstore.NewStore()
-		logger.Info("Using in memory store")
 	}
+	// The storage flags override the options of the chosen backend
+	if err := storage.BindFlags(v, pflag.CommandLine, storageType); err != nil {
+		logger.Fatalf("Cannot bind storage flags: %v", err)
+	}
+	if err := applyLegacyOptions(v, storageType, logger); err != nil {
+		logger.Fatalf("Cannot initialize storage: %v", err)
+	}
+	store, err := storage.Open(v, storageType, logger)
+	if err != nil {
+		logger.Fatalf("Cannot initialize storage: %v", err)
+	}
+	if closer, ok := store.(io.Closer); ok {
+		defer closer.Close()
+	}
+	logger.Infof("Using %s storage", storageType)
 
 	// Create HTTP router
-	r := rest.NewRouter(store, 0, logger)
+	r := rest.NewRouter(store, 0, v.GetStringSlice("allowed_content_types"), logger)
 
 	// Get listen address
 	rawListenAddress := v.GetString("listen_address")
@@ -141,6 +173,32 @@ func main() {
 	logger.Info("Bye.")
 }
 
+// applyLegacyOptions sets the options of the storage backend `storageType` in `v` from the legacy options set at the
+// top level of the configuration, logging a warning, unless they are set in the backend section as well.
+// Legacy options are ignored by the memory backend, which did not use them, and an error is returned if the backend
+// has no such option.
+func applyLegacyOptions(v *viper.Viper, storageType string, logger logrus.FieldLogger) error {
+	for option, envs := range legacyOptions {
+		_ = v.BindEnv(append([]string{option}, envs...)...)
+		if !v.IsSet(option) {
+			continue
+		}
+		key := "storage." + storageType + "." + option
+		switch {
+		case storageType == "memory":
+			logger.Warnf("Ignoring legacy option %s: set %s to persist the memory storage", option, key)
+		case !storage.HasOption(storageType, option):
+			return fmt.Errorf("legacy option %s is not an option of %s storage, remove it", option, storageType)
+		case v.IsSet(key):
+			logger.Warnf("Ignoring legacy option %s, overridden by %s", option, key)
+		default:
+			logger.Warnf("Legacy option %s is deprecated, use %s instead", option, key)
+			v.Set(key, v.Get(option))
+		}
+	}
+	return nil
+}
+
 // envReplacer utility to replace character when binding env variables to viper variables
 type envReplacer struct {
 	old string
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/filestore"
+	"github.com/spf13/pflag"
+	"os"
+)
+
+// runMigrate runs the migrate command, upgrading the bucket files of a persistent storage to the current format
+// version. It returns the exit code of the command.
+func runMigrate(args []string) int {
+	flags := pflag.NewFlagSet("migrate", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s migrate [flags]\n\nUpgrade the bucket files in place to the current format.\nThe server must not be running on the data path.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	verbose := flags.BoolP("verbose", "v", false, "Print verbose output")
+	dataPath := flags.String("data-path", ".", "Path to folder of persistent data")
+	dryRun := flags.BoolP("dry-run", "n", false, "Only report the bucket files to upgrade, without changing them")
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+
+	logger := getLogger(*verbose)
+
+	migrations, err := filestore.Migrate(*dataPath, *dryRun)
+	if err != nil {
+		logger.Errorf("Cannot migrate storage in %q: %v", *dataPath, err)
+		return 1
+	}
+
+	for _, m := range migrations {
+		entry := logger.WithField("bucket", m.Bucket)
+		if *dryRun {
+			entry.Infof("Bucket file to upgrade from format version %d (%d records)", m.Version, m.Records)
+		} else {
+			entry.Infof("Upgraded bucket file from format version %d (%d records)", m.Version, m.Records)
+		}
+	}
+	if len(migrations) == 0 {
+		logger.Infof("Storage in %q is up to date", *dataPath)
+	}
+
+	return 0
+}
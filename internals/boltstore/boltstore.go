@@ -0,0 +1,602 @@
+package boltstore
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	bolt "go.etcd.io/bbolt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// dbFileName is the name of the database file in the store path
+const dbFileName = "objects.db"
+
+// openTimeout is the time to wait for the lock on the database file, held by any other process using it
+const openTimeout = 5 * time.Second
+
+var (
+	bucketsKey    = []byte("buckets")    // Top level bucket holding a nested bucket per object bucket
+	versioningKey = []byte("versioning") // Top level bucket holding the IDs of the buckets with versioning enabled
+	objectsKey    = []byte("objects")    // Nested bucket holding the information of the current object versions
+	versionsKey   = []byte("versions")   // Nested bucket holding the information of the previous object versions
+	dataKey       = []byte("data")       // Nested bucket holding the data of all the object versions
+)
+
+// now returns the current time, it is a variable to be replaced in tests
+var now = time.Now
+
+// newVersionId returns a new version ID, it is a variable to be replaced in tests
+var newVersionId = rest.NewVersionId
+
+// castagnoli is the CRC-32C table used to compute the checksums of the object data
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BoltStore implements ObjectStore and stores objects in a bbolt database, a B+tree key-value store in a single file
+// <storePath>/objects.db.
+// Each object bucket is a nested bucket of the `buckets` bucket, in turn holding three nested buckets:
+// - objects: the JSON encoded objectInfo of the current version of each object, by object ID
+// - versions: the JSON encoded objectInfo of the previous versions of each object, by version key
+// - data: the data of all the object versions, by version key
+// where the version key is <objId>\x00<seq>, with seq the sequence number of the version as 8 bytes big-endian,
+// incremented by each new version of the object. So the versions of an object are sorted from the oldest one.
+// The buckets with versioning enabled are listed in the `versioning` bucket, and they keep a previous version for
+// each replaced object.
+//
+// Every operation is a database transaction, so changes are atomic and, with Fsync, durable once acknowledged.
+// Objects are read in memory before storing them, so that slow clients do not hold the write transaction, and they
+// are copied out of the database when retrieved: the store fits many small objects rather than large ones.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// Options holds the options of a BoltStore
+type Options struct {
+	// Fsync syncs the database file on each commit, so that an acknowledged write survives a crash
+	Fsync bool
+}
+
+// objectInfo holds the information about an object version stored in the database
+type objectInfo struct {
+	Size         int64             `json:"size"`                    // Size in bytes of the object
+	ETag         string            `json:"etag"`                    // Hex encoded SHA-256 hash of the object data
+	Modified     time.Time         `json:"modified"`                // Time of the last change to the object
+	Checksum     string            `json:"crc32c,omitempty"`        // Hex encoded CRC-32C checksum of the object data
+	ContentType  string            `json:"content_type,omitempty"`  // Media type of the object
+	Metadata     map[string]string `json:"metadata,omitempty"`      // User-defined metadata of the object
+	VersionId    string            `json:"version_id,omitempty"`    // ID of the object version, if versioned
+	DeleteMarker bool              `json:"delete_marker,omitempty"` // Whether the version marks the object as deleted
+	Seq          uint64            `json:"seq"`                     // Sequence number of the version of the object
+}
+
+// objectBucket holds the nested buckets of an object bucket within a transaction
+type objectBucket struct {
+	objects  *bolt.Bucket
+	versions *bolt.Bucket
+	data     *bolt.Bucket
+}
+
+func NewStore(storePath string, opts Options) (*BoltStore, error) {
+	// Check store folder
+	if _, err := os.Stat(storePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("store folder does not exist")
+		}
+		return nil, errors.New("cannot access store folder: " + err.Error())
+	}
+
+	db, err := bolt.Open(filepath.Join(storePath, dbFileName), 0644, &bolt.Options{
+		Timeout: openTimeout,
+		NoSync:  !opts.Fsync,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open database: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, key := range [][]byte{bucketsKey, versioningKey} {
+			if _, err := tx.CreateBucketIfNotExists(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database. The store must not be used after closing it.
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+// Store stores the object read from `r` with ID `objId` in bucket `bucketId`.
+// Returns the stored object information and whether the object has been replaced along with any error encountered.
+// The preconditions in `opts` are checked within the write transaction, so no other change can happen in the meantime.
+func (s *BoltStore) Store(r io.Reader, objId, bucketId string, opts rest.StoreOptions) (rest.ObjectInfo, bool, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	etag := sha256.Sum256(data)
+	info := objectInfo{
+		Size:        int64(len(data)),
+		ETag:        hex.EncodeToString(etag[:]),
+		Modified:    now().UTC(),
+		Checksum:    fmt.Sprintf("%08x", crc32.Checksum(data, castagnoli)),
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+	}
+
+	var replaced bool
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b, err := createObjectBucket(tx, bucketId)
+		if err != nil {
+			return err
+		}
+		current, found, err := b.current(objId)
+		if err != nil {
+			return err
+		}
+		replaced = found && !current.DeleteMarker
+		var oldETag string
+		if replaced {
+			oldETag = current.ETag
+		}
+		if err = opts.CheckPreconditions(oldETag, replaced); err != nil {
+			return err
+		}
+
+		info.Seq = current.Seq + 1
+		if isVersioned(tx, bucketId) {
+			// Keep the current version, delete marker included
+			info.VersionId = newVersionId()
+			if found {
+				if err = b.putVersion(objId, current); err != nil {
+					return err
+				}
+			}
+		} else if found {
+			if err = b.data.Delete(versionKey(objId, current.Seq)); err != nil {
+				return err
+			}
+		}
+		if err = b.data.Put(versionKey(objId, info.Seq), data); err != nil {
+			return err
+		}
+		return b.putCurrent(objId, info)
+	})
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+
+	return info.objectInfo(objId), replaced, nil
+}
+
+// Retrieve retrieves the version `versionId` of the object `objId` in bucket `bucketId`, the current one if empty.
+// It returns a reader of a copy of the object data, the object information and whether the object has been found or
+// not, along with any error.
+func (s *BoltStore) Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, rest.ObjectInfo, bool, error) {
+	var data []byte
+	var info objectInfo
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, ok := getObjectBucket(tx, bucketId)
+		if !ok {
+			return nil
+		}
+		var err error
+		if info, found, err = b.object(objId, versionId); !found || err != nil {
+			return err
+		}
+		// The data is valid only within the transaction
+		stored := b.data.Get(versionKey(objId, info.Seq))
+		if stored == nil {
+			return fmt.Errorf("%w: data of object %s is missing", rest.ErrCorruptedObject, objId)
+		}
+		data = append([]byte{}, stored...)
+		return nil
+	})
+	if !found || err != nil {
+		return nil, rest.ObjectInfo{}, false, err
+	}
+	if int64(len(data)) != info.Size || fmt.Sprintf("%08x", crc32.Checksum(data, castagnoli)) != info.Checksum {
+		return nil, rest.ObjectInfo{}, false, fmt.Errorf("%w: data of object %s does not match its checksum",
+			rest.ErrCorruptedObject, objId)
+	}
+
+	return readSeekNopCloser{bytes.NewReader(data)}, info.objectInfo(objId), true, nil
+}
+
+// Stat returns the information about the version `versionId` of the object `objId` in bucket `bucketId`,
+// the current one if empty, and whether it has been found or not, along with any error.
+func (s *BoltStore) Stat(objId, bucketId, versionId string) (rest.ObjectInfo, bool, error) {
+	var info objectInfo
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, ok := getObjectBucket(tx, bucketId)
+		if !ok {
+			return nil
+		}
+		var err error
+		info, found, err = b.object(objId, versionId)
+		return err
+	})
+	if !found || err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+
+	return info.objectInfo(objId), true, nil
+}
+
+// Delete deletes the version `versionId` of the object `objId` in bucket `bucketId`. If `versionId` is empty
+// it deletes the current version or, if versioning is enabled on the bucket, it stores a delete marker.
+// Deleting the current version makes the most recent previous version, if any, the current one.
+// If the bucket is emptied it is removed.
+// It returns whether the object has been deleted or not along with any error.
+func (s *BoltStore) Delete(objId, bucketId, versionId string) (bool, error) {
+	var deleted bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, ok := getObjectBucket(tx, bucketId)
+		if !ok {
+			return nil
+		}
+		current, found, err := b.current(objId)
+		if !found || err != nil {
+			return err
+		}
+
+		if versionId == "" {
+			if isVersioned(tx, bucketId) {
+				if current.DeleteMarker {
+					return nil
+				}
+				// Mark the object as deleted keeping its versions
+				if err = b.putVersion(objId, current); err != nil {
+					return err
+				}
+				deleted = true
+				return b.putCurrent(objId, objectInfo{
+					Modified:     now().UTC(),
+					VersionId:    newVersionId(),
+					DeleteMarker: true,
+					Seq:          current.Seq + 1,
+				})
+			}
+			versionId = rest.NullVersionId
+		}
+
+		if !rest.VersionMatches(current.VersionId, versionId) {
+			previous, err := b.previous(objId)
+			if err != nil {
+				return err
+			}
+			for _, info := range previous {
+				if rest.VersionMatches(info.VersionId, versionId) {
+					deleted = true
+					return b.deleteVersion(objId, info.Seq)
+				}
+			}
+			return nil
+		}
+
+		// Replace the current version with the most recent previous one, if any
+		deleted = true
+		if err = b.data.Delete(versionKey(objId, current.Seq)); err != nil {
+			return err
+		}
+		previous, err := b.previous(objId)
+		if err != nil {
+			return err
+		}
+		if len(previous) > 0 {
+			latest := previous[len(previous)-1]
+			if err = b.versions.Delete(versionKey(objId, latest.Seq)); err != nil {
+				return err
+			}
+			return b.putCurrent(objId, latest)
+		}
+		if err = b.objects.Delete([]byte(objId)); err != nil {
+			return err
+		}
+		// if bucket has been emptied, delete it
+		if k, _ := b.objects.Cursor().First(); k == nil {
+			return tx.Bucket(bucketsKey).DeleteBucket([]byte(bucketId))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// Versions returns all the versions of the object `objId` in bucket `bucketId`, from the most recent one,
+// and whether the object has been found or not, along with any error.
+func (s *BoltStore) Versions(objId, bucketId string) ([]rest.ObjectInfo, bool, error) {
+	var versions []rest.ObjectInfo
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, ok := getObjectBucket(tx, bucketId)
+		if !ok {
+			return nil
+		}
+		current, found, err := b.current(objId)
+		if !found || err != nil {
+			return err
+		}
+		previous, err := b.previous(objId)
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, current.objectInfo(objId))
+		for i := len(previous) - 1; i >= 0; i-- {
+			versions = append(versions, previous[i].objectInfo(objId))
+		}
+		return nil
+	})
+	if versions == nil || err != nil {
+		return nil, false, err
+	}
+
+	return versions, true, nil
+}
+
+// EnableVersioning enables versioning on bucket `bucketId`, adding it to the versioning bucket
+func (s *BoltStore) EnableVersioning(bucketId string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(versioningKey).Put([]byte(bucketId), []byte{})
+	})
+}
+
+// List lists the objects in bucket `bucketId` filtered according to `opts`, sorted by object ID.
+// It returns the listed objects and whether the bucket has been found or not, along with any error.
+// Objects are sorted by key in the database, so listing seeks the first listed object and reads only the listed ones.
+func (s *BoltStore) List(bucketId string, opts rest.ListOptions) ([]rest.ObjectInfo, bool, error) {
+	var objects []rest.ObjectInfo
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b, ok := getObjectBucket(tx, bucketId)
+		if !ok {
+			return nil
+		}
+		found = true
+
+		start := opts.Prefix
+		if opts.StartAfter >= start {
+			start = opts.StartAfter
+		}
+		c := b.objects.Cursor()
+		for k, v := c.Seek([]byte(start)); k != nil && strings.HasPrefix(string(k), opts.Prefix); k, v = c.Next() {
+			if opts.Limit > 0 && len(objects) == opts.Limit {
+				break
+			}
+			if string(k) <= opts.StartAfter {
+				continue
+			}
+			info, err := decodeInfo(v)
+			if err != nil {
+				return err
+			}
+			if !info.DeleteMarker {
+				objects = append(objects, info.objectInfo(string(k)))
+			}
+		}
+		return nil
+	})
+	if !found || err != nil {
+		return nil, false, err
+	}
+
+	return objects, true, nil
+}
+
+// Buckets returns the information about all buckets in the store sorted by bucket ID, along with any error.
+// It reads the information of all the objects and their versions.
+func (s *BoltStore) Buckets() ([]rest.BucketInfo, error) {
+	buckets := make([]rest.BucketInfo, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketsKey).ForEach(func(k, _ []byte) error {
+			b, _ := getObjectBucket(tx, string(k))
+			bucketInfo := rest.BucketInfo{Id: string(k), Versioning: isVersioned(tx, string(k))}
+			err := b.objects.ForEach(func(_, v []byte) error {
+				info, err := decodeInfo(v)
+				if err != nil {
+					return err
+				}
+				if !info.DeleteMarker {
+					bucketInfo.Objects++
+				}
+				bucketInfo.Size += info.Size
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			err = b.versions.ForEach(func(_, v []byte) error {
+				info, err := decodeInfo(v)
+				if err != nil {
+					return err
+				}
+				bucketInfo.Size += info.Size
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			buckets = append(buckets, bucketInfo)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return buckets, nil
+}
+
+// getObjectBucket returns the nested buckets of bucket `bucketId` and whether it exists
+func getObjectBucket(tx *bolt.Tx, bucketId string) (objectBucket, bool) {
+	bucket := tx.Bucket(bucketsKey).Bucket([]byte(bucketId))
+	if bucket == nil {
+		return objectBucket{}, false
+	}
+	return objectBucket{
+		objects:  bucket.Bucket(objectsKey),
+		versions: bucket.Bucket(versionsKey),
+		data:     bucket.Bucket(dataKey),
+	}, true
+}
+
+// createObjectBucket returns the nested buckets of bucket `bucketId`, creating them if it does not exist
+func createObjectBucket(tx *bolt.Tx, bucketId string) (objectBucket, error) {
+	bucket, err := tx.Bucket(bucketsKey).CreateBucketIfNotExists([]byte(bucketId))
+	if err != nil {
+		return objectBucket{}, err
+	}
+	var nested [3]*bolt.Bucket
+	for i, key := range [][]byte{objectsKey, versionsKey, dataKey} {
+		if nested[i], err = bucket.CreateBucketIfNotExists(key); err != nil {
+			return objectBucket{}, err
+		}
+	}
+	return objectBucket{objects: nested[0], versions: nested[1], data: nested[2]}, nil
+}
+
+// isVersioned returns whether versioning is enabled on bucket `bucketId`
+func isVersioned(tx *bolt.Tx, bucketId string) bool {
+	return tx.Bucket(versioningKey).Get([]byte(bucketId)) != nil
+}
+
+// current returns the information about the current version of the object `objId`, delete markers included,
+// and whether it has been found, along with any error
+func (b objectBucket) current(objId string) (objectInfo, bool, error) {
+	v := b.objects.Get([]byte(objId))
+	if v == nil {
+		return objectInfo{}, false, nil
+	}
+	info, err := decodeInfo(v)
+	if err != nil {
+		return objectInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+// previous returns the information about the previous versions of the object `objId`, from the oldest one
+func (b objectBucket) previous(objId string) ([]objectInfo, error) {
+	var versions []objectInfo
+	prefix := append([]byte(objId), 0)
+	c := b.versions.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		info, err := decodeInfo(v)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, info)
+	}
+	return versions, nil
+}
+
+// object returns the information about the version `versionId` of the object `objId`, the current one if empty,
+// and whether it has been found, along with any error. Delete markers are never returned.
+func (b objectBucket) object(objId, versionId string) (objectInfo, bool, error) {
+	info, found, err := b.current(objId)
+	if !found || err != nil {
+		return objectInfo{}, false, err
+	}
+	if versionId != "" && !rest.VersionMatches(info.VersionId, versionId) {
+		previous, err := b.previous(objId)
+		if err != nil {
+			return objectInfo{}, false, err
+		}
+		found = false
+		for _, info = range previous {
+			if found = rest.VersionMatches(info.VersionId, versionId); found {
+				break
+			}
+		}
+	}
+	if !found || info.DeleteMarker {
+		return objectInfo{}, false, nil
+	}
+	return info, true, nil
+}
+
+// putCurrent stores `info` as the current version of the object `objId`
+func (b objectBucket) putCurrent(objId string, info objectInfo) error {
+	v, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return b.objects.Put([]byte(objId), v)
+}
+
+// putVersion stores `info` as a previous version of the object `objId`
+func (b objectBucket) putVersion(objId string, info objectInfo) error {
+	v, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	return b.versions.Put(versionKey(objId, info.Seq), v)
+}
+
+// deleteVersion deletes the previous version of the object `objId` with sequence number `seq`, along with its data
+func (b objectBucket) deleteVersion(objId string, seq uint64) error {
+	if err := b.versions.Delete(versionKey(objId, seq)); err != nil {
+		return err
+	}
+	return b.data.Delete(versionKey(objId, seq))
+}
+
+// versionKey returns the key of the version of the object `objId` with sequence number `seq`
+func versionKey(objId string, seq uint64) []byte {
+	key := make([]byte, len(objId)+1+8)
+	copy(key, objId)
+	binary.BigEndian.PutUint64(key[len(objId)+1:], seq)
+	return key
+}
+
+// decodeInfo decodes the JSON encoded object information `v`
+func decodeInfo(v []byte) (objectInfo, error) {
+	var info objectInfo
+	if err := json.Unmarshal(v, &info); err != nil {
+		return objectInfo{}, fmt.Errorf("%w: cannot parse object info: %v", rest.ErrCorruptedObject, err)
+	}
+	return info, nil
+}
+
+// objectInfo returns the rest.ObjectInfo of the object `objId`
+func (i objectInfo) objectInfo(objId string) rest.ObjectInfo {
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         i.Size,
+		ETag:         i.ETag,
+		LastModified: i.Modified,
+		ContentType:  i.ContentType,
+		Metadata:     i.Metadata,
+		VersionId:    i.VersionId,
+		DeleteMarker: i.DeleteMarker,
+	}
+}
+
+// readSeekNopCloser wraps an io.ReadSeeker adding a no-op Close method
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,341 @@
+package boltstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest/storetest"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var testTime = time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func init() {
+	now = func() time.Time {
+		return testTime
+	}
+	var versions int
+	newVersionId = func() string {
+		versions++
+		return fmt.Sprintf("v%d", versions)
+	}
+}
+
+func newTestStore(t *testing.T) *BoltStore {
+	s, err := NewStore(t.TempDir(), Options{Fsync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = s.Close()
+	})
+	return s
+}
+
+func testObjectInfo(objId, data, versionId string) rest.ObjectInfo {
+	etag := sha256.Sum256([]byte(data))
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         int64(len(data)),
+		ETag:         hex.EncodeToString(etag[:]),
+		LastModified: testTime,
+		VersionId:    versionId,
+	}
+}
+
+func readObject(t *testing.T, s *BoltStore, objId, bucketId, versionId string) string {
+	r, _, ok, err := s.Retrieve(objId, bucketId, versionId)
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestNewStore(t *testing.T) {
+	_, err := NewStore(filepath.Join(t.TempDir(), "missing"), Options{})
+	assert.Error(t, err)
+
+	// Objects are kept when reopening the database
+	storePath := t.TempDir()
+	s, err := NewStore(storePath, Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.FileExists(t, filepath.Join(storePath, dbFileName))
+	_, _, err = s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+
+	s, err = NewStore(storePath, Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.Equal(t, "test obj", readObject(t, s, "oid", "bid", ""))
+}
+
+func TestDirStore_Store(t *testing.T) {
+	s := newTestStore(t)
+
+	info, replaced, err := s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, testObjectInfo("oid", "test obj", ""), info)
+
+	info, replaced, err = s.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"k": "v"},
+	})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, "new obj", readObject(t, s, "oid", "bid", ""))
+	stat, ok, err := s.Stat("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, info, stat)
+	assert.Equal(t, "text/plain", stat.ContentType)
+	assert.Equal(t, map[string]string{"k": "v"}, stat.Metadata)
+	assertKeys(t, s, "bid", dataKey, versionKey("oid", 2))
+
+	// Preconditions are checked against the current object
+	_, _, err = s.Store(strings.NewReader("other obj"), "oid", "bid", rest.StoreOptions{IfNoneMatch: []string{"*"}})
+	assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+
+	// A read error stores nothing
+	readErr := errors.New("read error")
+	_, _, err = s.Store(iotest.ErrReader(readErr), "oid", "bid", rest.StoreOptions{})
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, "new obj", readObject(t, s, "oid", "bid", ""))
+}
+
+func TestDirStore_Retrieve(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+
+	r, info, ok, err := s.Retrieve("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, testObjectInfo("oid", "test obj", ""), info)
+
+	// The reader is not affected by later changes
+	_, _, _ = s.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{})
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "test obj", string(data))
+	assert.NoError(t, r.Close())
+
+	for _, missing := range [][3]string{{"oid2", "bid", ""}, {"oid", "bid2", ""}, {"oid", "bid", "v1"}, {"oid", "bid", "../oid"}} {
+		_, _, ok, err = s.Retrieve(missing[0], missing[1], missing[2])
+		assert.NoError(t, err)
+		assert.False(t, ok, missing)
+	}
+
+	// Corrupted data is not retrieved
+	_ = s.db.Update(func(tx *bolt.Tx) error {
+		b, _ := getObjectBucket(tx, "bid")
+		return b.data.Put(versionKey("oid", 2), []byte("xew obj"))
+	})
+	_, _, ok, err = s.Retrieve("oid", "bid", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+	assert.False(t, ok)
+
+	_ = s.db.Update(func(tx *bolt.Tx) error {
+		b, _ := getObjectBucket(tx, "bid")
+		return b.objects.Put([]byte("oid"), []byte("{"))
+	})
+	_, _, err = s.Stat("oid", "bid", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+}
+
+func TestDirStore_Delete(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+	_, _, _ = s.Store(strings.NewReader("test obj 2"), "oid2", "bid", rest.StoreOptions{})
+
+	deleted, err := s.Delete("oid3", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	deleted, err = s.Delete("oid", "bid", "v1")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+
+	deleted, err = s.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, ok, _ := s.Stat("oid", "bid", "")
+	assert.False(t, ok)
+	assertKeys(t, s, "bid", objectsKey, []byte("oid2"))
+	assertKeys(t, s, "bid", dataKey, versionKey("oid2", 1))
+
+	// Emptying the bucket removes it
+	deleted, err = s.Delete("oid2", "bid", rest.NullVersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		_, ok = getObjectBucket(tx, "bid")
+		return nil
+	})
+	assert.False(t, ok)
+	_, ok, err = s.List("bid", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDirStore_Versioning(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("null obj"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, s.EnableVersioning("bid"))
+
+	info, replaced, err := s.Store(strings.NewReader("obj v1"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	v1 := info.VersionId
+	info, _, _ = s.Store(strings.NewReader("obj v2"), "oid", "bid", rest.StoreOptions{})
+	v2 := info.VersionId
+
+	versions, ok, err := s.Versions("oid", "bid")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []rest.ObjectInfo{
+		testObjectInfo("oid", "obj v2", v2),
+		testObjectInfo("oid", "obj v1", v1),
+		testObjectInfo("oid", "null obj", ""),
+	}, versions)
+	assert.Equal(t, "null obj", readObject(t, s, "oid", "bid", rest.NullVersionId))
+	assert.Equal(t, "obj v1", readObject(t, s, "oid", "bid", v1))
+	assert.Equal(t, "obj v2", readObject(t, s, "oid", "bid", ""))
+
+	// Deleting the object stores a delete marker
+	deleted, err := s.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, ok, _ = s.Stat("oid", "bid", "")
+	assert.False(t, ok)
+	deleted, err = s.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	versions, _, _ = s.Versions("oid", "bid")
+	if assert.Len(t, versions, 4) {
+		assert.True(t, versions[0].DeleteMarker)
+	}
+	objects, ok, err := s.List("bid", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, objects)
+
+	// Deleting the delete marker restores the previous version
+	deleted, err = s.Delete("oid", "bid", versions[0].VersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, "obj v2", readObject(t, s, "oid", "bid", ""))
+
+	// and deleting a previous version keeps the current one
+	deleted, err = s.Delete("oid", "bid", v1)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	versions, _, _ = s.Versions("oid", "bid")
+	assert.Equal(t, []rest.ObjectInfo{
+		testObjectInfo("oid", "obj v2", v2),
+		testObjectInfo("oid", "null obj", ""),
+	}, versions)
+
+	for _, versionId := range []string{v2, rest.NullVersionId} {
+		deleted, err = s.Delete("oid", "bid", versionId)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	}
+	_, ok, _ = s.Versions("oid", "bid")
+	assert.False(t, ok)
+	// The versions and their data are deleted along with the bucket, which stays versioned
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		_, ok = getObjectBucket(tx, "bid")
+		assert.True(t, isVersioned(tx, "bid"))
+		return nil
+	})
+	assert.False(t, ok)
+}
+
+func TestDirStore_List(t *testing.T) {
+	s := newTestStore(t)
+	for _, objId := range []string{"c", "a", "b2", "b1"} {
+		_, _, _ = s.Store(strings.NewReader("obj "+objId), objId, "bid", rest.StoreOptions{})
+	}
+
+	tests := []struct {
+		name string
+		opts rest.ListOptions
+		want []string
+	}{
+		{"all", rest.ListOptions{}, []string{"a", "b1", "b2", "c"}},
+		{"prefix", rest.ListOptions{Prefix: "b"}, []string{"b1", "b2"}},
+		{"start after", rest.ListOptions{StartAfter: "b1"}, []string{"b2", "c"}},
+		{"limit", rest.ListOptions{Limit: 3}, []string{"a", "b1", "b2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, ok, err := s.List("bid", tt.opts)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			var want []rest.ObjectInfo
+			for _, objId := range tt.want {
+				want = append(want, testObjectInfo(objId, "obj "+objId, ""))
+			}
+			assert.Equal(t, want, objects)
+		})
+	}
+
+	_, ok, err := s.List("bid2", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDirStore_Buckets(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("test obj"), "oid", "bid2", rest.StoreOptions{})
+	_, _, _ = s.Store(strings.NewReader("obj"), "oid", "bid1", rest.StoreOptions{})
+	assert.NoError(t, s.EnableVersioning("bid1"))
+	_, _, _ = s.Store(strings.NewReader("obj v1"), "oid", "bid1", rest.StoreOptions{})
+	_, _ = s.Delete("oid", "bid1", "")
+	// Versioned buckets without objects are not listed
+	assert.NoError(t, s.EnableVersioning("bid3"))
+
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []rest.BucketInfo{
+		{Id: "bid1", Objects: 0, Size: 9, Versioning: true},
+		{Id: "bid2", Objects: 1, Size: 8},
+	}, buckets)
+}
+
+// assertKeys asserts that the nested bucket `key` of bucket `bucketId` holds exactly the keys `want`
+func assertKeys(t *testing.T, s *BoltStore, bucketId string, key []byte, want ...[]byte) {
+	var keys [][]byte
+	_ = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketsKey).Bucket([]byte(bucketId)).Bucket(key).ForEach(func(k, _ []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+	})
+	assert.Equal(t, want, keys)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+		s, err := NewStore(dataPath, Options{Fsync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, storetest.Options{Durable: true})
+}
@@ -0,0 +1,339 @@
+package cachestore
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"io"
+	"sync"
+)
+
+// defaultMaxObjectFraction is the fraction of the cache size which is the default maximum size of the cached objects
+const defaultMaxObjectFraction = 8
+
+// entryOverhead is the estimated size in bytes of a cache entry in memory, its data and strings excluded
+const entryOverhead = 200
+
+// CacheStore implements ObjectStore wrapping another store, caching in memory the data and the information of the
+// objects retrieved from it, so that retrieving the same objects again does not reach the wrapped store.
+// The cache is bounded by size: when it is full, the least recently retrieved objects are evicted.
+// Objects larger than the maximum object size in the Options are never cached.
+//
+// Each version of an object is cached as retrieved, so the current version and the versions retrieved by ID are cached
+// separately. Storing or deleting an object invalidates all its cached versions, before and after changing it in the
+// wrapped store, while the other methods are passed through. Objects being retrieved from the wrapped store while they
+// are invalidated are not cached, so that the cache never holds an object older than a completed change.
+// The wrapped store must not be changed other than through the CacheStore, but by removing objects on its own as an
+// Evicter, which tells the CacheStore to invalidate them.
+type CacheStore struct {
+	store   rest.ObjectStore
+	opts    Options
+	mu      sync.Mutex                 // Mutex to handle concurrent access to the cache
+	entries map[entryKey]*list.Element // Elements of the cached object versions in lru
+	objects map[objectKey][]entryKey   // Cached versions of each object
+	fills   map[objectKey][]*fill      // Objects being retrieved from the wrapped store to be cached
+	lru     *list.List                 // Cached object versions, from the least recently used one
+	size    int64                      // Estimated memory in bytes taken by the cached object versions
+	stats   map[string]int64           // Statistics of the cache, see Stats
+}
+
+// Options holds the options of a CacheStore
+type Options struct {
+	// Size is the memory in bytes available to the cached objects
+	Size int64
+	// MaxObjectSize is the size in bytes of the largest object cached. If 0, it is an eighth of the cache size.
+	MaxObjectSize int64
+}
+
+// Evicter is implemented by the object stores removing objects on their own, like a memory store evicting objects to
+// stay within its memory budget.
+//
+// OnEvict sets the function called with each object removed, all its versions included. The function is called while
+// the object is being removed, so it must not call the store.
+type Evicter interface {
+	OnEvict(evicted func(objId, bucketId string))
+}
+
+// objectKey identifies an object
+type objectKey struct {
+	bucketId string
+	objId    string
+}
+
+// entryKey identifies a version of an object as retrieved, the current one if versionId is empty
+type entryKey struct {
+	objectKey
+	versionId string
+}
+
+// entry is a cached object version
+type entry struct {
+	key  entryKey
+	data []byte
+	info rest.ObjectInfo
+	size int64 // Estimated memory in bytes taken by the entry
+}
+
+// fill is an object version being retrieved from the wrapped store to be cached
+type fill struct {
+	stale bool // Whether the object has been invalidated in the meantime
+}
+
+func NewStore(store rest.ObjectStore, opts Options) (*CacheStore, error) {
+	if opts.Size <= 0 {
+		return nil, errors.New("cache size must be positive")
+	}
+	if opts.MaxObjectSize < 0 {
+		return nil, errors.New("maximum object size must not be negative")
+	}
+	if opts.MaxObjectSize == 0 {
+		opts.MaxObjectSize = opts.Size / defaultMaxObjectFraction
+	}
+
+	c := &CacheStore{
+		store:   store,
+		opts:    opts,
+		entries: make(map[entryKey]*list.Element),
+		objects: make(map[objectKey][]entryKey),
+		fills:   make(map[objectKey][]*fill),
+		lru:     list.New(),
+		stats:   make(map[string]int64),
+	}
+	if evicter, ok := store.(Evicter); ok {
+		evicter.OnEvict(func(objId, bucketId string) {
+			c.invalidate(objectKey{bucketId: bucketId, objId: objId})
+		})
+	}
+	return c, nil
+}
+
+// Close closes the wrapped store, if it has to be closed
+func (c *CacheStore) Close() error {
+	if closer, ok := c.store.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Store stores the object in the wrapped store, invalidating its cached versions
+func (c *CacheStore) Store(r io.Reader, objId, bucketId string, opts rest.StoreOptions) (rest.ObjectInfo, bool, error) {
+	key := objectKey{bucketId: bucketId, objId: objId}
+	c.invalidate(key)
+	defer c.invalidate(key)
+
+	return c.store.Store(r, objId, bucketId, opts)
+}
+
+// Retrieve retrieves the object version from the cache or, if not cached, from the wrapped store, caching it unless
+// it is too large
+func (c *CacheStore) Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, rest.ObjectInfo, bool, error) {
+	key := entryKey{objectKey: objectKey{bucketId: bucketId, objId: objId}, versionId: versionId}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToBack(e)
+		c.stats["cache_hits"]++
+		cached := e.Value.(*entry)
+		c.mu.Unlock()
+		return readSeekNopCloser{bytes.NewReader(cached.data)}, cached.info, true, nil
+	}
+	c.stats["cache_misses"]++
+	f := &fill{}
+	c.fills[key.objectKey] = append(c.fills[key.objectKey], f)
+	c.mu.Unlock()
+	defer c.endFill(key.objectKey, f)
+
+	r, info, ok, err := c.store.Retrieve(objId, bucketId, versionId)
+	if err != nil || !ok || info.Size > c.opts.MaxObjectSize {
+		return r, info, ok, err
+	}
+
+	data, err := io.ReadAll(r)
+	_ = r.Close()
+	if err != nil {
+		return nil, rest.ObjectInfo{}, false, err
+	}
+	c.add(key, f, data, info)
+	return readSeekNopCloser{bytes.NewReader(data)}, info, true, nil
+}
+
+// Stat returns the information about the object version from the cache or, if not cached, from the wrapped store
+func (c *CacheStore) Stat(objId, bucketId, versionId string) (rest.ObjectInfo, bool, error) {
+	key := entryKey{objectKey: objectKey{bucketId: bucketId, objId: objId}, versionId: versionId}
+
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok {
+		c.lru.MoveToBack(e)
+		c.stats["cache_hits"]++
+		info := e.Value.(*entry).info
+		c.mu.Unlock()
+		return info, true, nil
+	}
+	c.stats["cache_misses"]++
+	c.mu.Unlock()
+
+	return c.store.Stat(objId, bucketId, versionId)
+}
+
+// Delete deletes the object version from the wrapped store, invalidating the cached versions of the object
+func (c *CacheStore) Delete(objId, bucketId, versionId string) (bool, error) {
+	key := objectKey{bucketId: bucketId, objId: objId}
+	c.invalidate(key)
+	defer c.invalidate(key)
+
+	return c.store.Delete(objId, bucketId, versionId)
+}
+
+func (c *CacheStore) Versions(objId, bucketId string) ([]rest.ObjectInfo, bool, error) {
+	return c.store.Versions(objId, bucketId)
+}
+
+func (c *CacheStore) EnableVersioning(bucketId string) error {
+	return c.store.EnableVersioning(bucketId)
+}
+
+func (c *CacheStore) List(bucketId string, opts rest.ListOptions) ([]rest.ObjectInfo, bool, error) {
+	return c.store.List(bucketId, opts)
+}
+
+func (c *CacheStore) Buckets() ([]rest.BucketInfo, error) {
+	return c.store.Buckets()
+}
+
+// Quarantined returns the buckets in quarantine in the wrapped store, if it quarantines buckets
+func (c *CacheStore) Quarantined() ([]rest.QuarantinedBucket, error) {
+	if q, ok := c.store.(rest.Quarantiner); ok {
+		return q.Quarantined()
+	}
+	return nil, nil
+}
+
+// Stats returns the statistics of the cache, along with the ones of the wrapped store if it reports any:
+//   - cache_hits, cache_misses: the retrievals and the stats served from the cache, and from the wrapped store
+//   - cache_evictions: the object versions evicted from the cache to make room for other ones
+//   - cache_invalidations: the object versions removed from the cache because the object changed, or was evicted
+//     from the wrapped store
+//   - cache_objects, cache_size_bytes: the cached object versions, and their estimated memory
+//   - cache_budget_bytes: the cache size
+func (c *CacheStore) Stats() map[string]int64 {
+	var stats map[string]int64
+	if sr, ok := c.store.(rest.StatsReporter); ok {
+		stats = sr.Stats()
+	}
+	if stats == nil {
+		stats = make(map[string]int64)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, name := range []string{"cache_hits", "cache_misses", "cache_evictions", "cache_invalidations"} {
+		stats[name] = c.stats[name]
+	}
+	stats["cache_objects"] = int64(len(c.entries))
+	stats["cache_size_bytes"] = c.size
+	stats["cache_budget_bytes"] = c.opts.Size
+	return stats
+}
+
+// add caches the object version `key` retrieved by `f`, unless it has been invalidated in the meantime, evicting the
+// least recently used versions to make room for it
+func (c *CacheStore) add(key entryKey, f *fill, data []byte, info rest.ObjectInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f.stale {
+		return
+	}
+	if e, ok := c.entries[key]; ok {
+		// Cached by a concurrent retrieval
+		c.lru.MoveToBack(e)
+		return
+	}
+
+	size := int64(entryOverhead+len(data)+len(key.bucketId)+len(key.objId)+len(key.versionId)) + infoSize(info)
+	if size > c.opts.Size {
+		return
+	}
+	for c.size+size > c.opts.Size && c.lru.Len() > 0 {
+		c.remove(c.lru.Front().Value.(*entry).key)
+		c.stats["cache_evictions"]++
+	}
+	c.entries[key] = c.lru.PushBack(&entry{key: key, data: data, info: info, size: size})
+	c.objects[key.objectKey] = append(c.objects[key.objectKey], key)
+	c.size += size
+}
+
+// remove removes the object version `key` from the cache.
+// The caller must hold the mutex.
+func (c *CacheStore) remove(key entryKey) {
+	e := c.entries[key]
+	c.size -= e.Value.(*entry).size
+	c.lru.Remove(e)
+	delete(c.entries, key)
+
+	versions := c.objects[key.objectKey]
+	for i, k := range versions {
+		if k == key {
+			versions = append(versions[:i], versions[i+1:]...)
+			break
+		}
+	}
+	if len(versions) == 0 {
+		delete(c.objects, key.objectKey)
+	} else {
+		c.objects[key.objectKey] = versions
+	}
+}
+
+// invalidate removes the cached versions of object `key`, and prevents the ones being retrieved from being cached
+func (c *CacheStore) invalidate(key objectKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range c.fills[key] {
+		f.stale = true
+	}
+	for _, versionKey := range append([]entryKey(nil), c.objects[key]...) {
+		c.remove(versionKey)
+		c.stats["cache_invalidations"]++
+	}
+}
+
+// endFill stops tracking the retrieval `f` of object `key`
+func (c *CacheStore) endFill(key objectKey, f *fill) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fills := c.fills[key]
+	for i, other := range fills {
+		if other == f {
+			fills = append(fills[:i], fills[i+1:]...)
+			break
+		}
+	}
+	if len(fills) == 0 {
+		delete(c.fills, key)
+	} else {
+		c.fills[key] = fills
+	}
+}
+
+// infoSize returns the estimated memory in bytes taken by the strings of the object information
+func infoSize(info rest.ObjectInfo) int64 {
+	size := len(info.Id) + len(info.ETag) + len(info.ContentType) + len(info.VersionId)
+	for key, value := range info.Metadata {
+		size += len(key) + len(value)
+	}
+	return int64(size)
+}
+
+// readSeekNopCloser wraps an io.ReadSeeker adding a no-op Close method
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,270 @@
+package cachestore
+
+import (
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/filestore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/memstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest/storetest"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// countingStore is a MemStore counting the calls to Retrieve and Stat, optionally blocking Retrieve
+type countingStore struct {
+	*memstore.MemStore
+	mu         sync.Mutex
+	retrieves  int
+	stats      int
+	retrieving chan struct{} // If not nil, receives when Retrieve is called, which then waits for a receive
+}
+
+func newCountingStore(t *testing.T) *countingStore {
+	s, err := memstore.NewStore(memstore.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &countingStore{MemStore: s}
+}
+
+func (s *countingStore) Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, rest.ObjectInfo, bool, error) {
+	s.mu.Lock()
+	s.retrieves++
+	s.mu.Unlock()
+	r, info, ok, err := s.MemStore.Retrieve(objId, bucketId, versionId)
+	if s.retrieving != nil {
+		s.retrieving <- struct{}{}
+		<-s.retrieving
+	}
+	return r, info, ok, err
+}
+
+func (s *countingStore) Stat(objId, bucketId, versionId string) (rest.ObjectInfo, bool, error) {
+	s.mu.Lock()
+	s.stats++
+	s.mu.Unlock()
+	return s.MemStore.Stat(objId, bucketId, versionId)
+}
+
+func newTestStore(t *testing.T, store rest.ObjectStore, opts Options) *CacheStore {
+	c, err := NewStore(store, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func store(t *testing.T, s rest.ObjectStore, objId, bucketId, data string) rest.ObjectInfo {
+	info, _, err := s.Store(strings.NewReader(data), objId, bucketId, rest.StoreOptions{})
+	assert.NoError(t, err)
+	return info
+}
+
+func readObject(t *testing.T, s rest.ObjectStore, objId, bucketId, versionId string) string {
+	r, _, ok, err := s.Retrieve(objId, bucketId, versionId)
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestNewStore(t *testing.T) {
+	_, err := NewStore(newCountingStore(t), Options{})
+	assert.Error(t, err)
+	_, err = NewStore(newCountingStore(t), Options{Size: 1024, MaxObjectSize: -1})
+	assert.Error(t, err)
+	c, err := NewStore(newCountingStore(t), Options{Size: 1024})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(128), c.opts.MaxObjectSize)
+}
+
+func TestCacheStore_Retrieve(t *testing.T) {
+	backend := newCountingStore(t)
+	c := newTestStore(t, backend, Options{Size: 1 << 20})
+	info := store(t, c, "oid", "bid", "test obj")
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "test obj", readObject(t, c, "oid", "bid", ""))
+	}
+	assert.Equal(t, 1, backend.retrieves)
+	stat, ok, err := c.Stat("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, info, stat)
+	assert.Equal(t, 0, backend.stats)
+
+	// Versions are cached as retrieved
+	assert.Equal(t, "test obj", readObject(t, c, "oid", "bid", rest.NullVersionId))
+	assert.Equal(t, 2, backend.retrieves)
+
+	// Missing objects are not cached
+	for i := 0; i < 2; i++ {
+		_, _, ok, err = c.Retrieve("oid2", "bid", "")
+		assert.NoError(t, err)
+		assert.False(t, ok)
+	}
+	assert.Equal(t, 4, backend.retrieves)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(3), stats["cache_hits"])
+	assert.Equal(t, int64(4), stats["cache_misses"])
+	assert.Equal(t, int64(2), stats["cache_objects"])
+
+	// Stats of objects not cached are misses too
+	_, ok, err = c.Stat("oid2", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 1, backend.stats)
+	assert.Equal(t, int64(5), c.Stats()["cache_misses"])
+}
+
+func TestCacheStore_Invalidation(t *testing.T) {
+	backend := newCountingStore(t)
+	c := newTestStore(t, backend, Options{Size: 1 << 20})
+	store(t, c, "oid", "bid", "test obj")
+	store(t, c, "oid2", "bid", "other obj")
+	assert.Equal(t, "test obj", readObject(t, c, "oid", "bid", ""))
+	assert.Equal(t, "test obj", readObject(t, c, "oid", "bid", rest.NullVersionId))
+	assert.Equal(t, "other obj", readObject(t, c, "oid2", "bid", ""))
+
+	// Storing an object invalidates all its versions
+	store(t, c, "oid", "bid", "new obj")
+	assert.Equal(t, "new obj", readObject(t, c, "oid", "bid", ""))
+	assert.Equal(t, "new obj", readObject(t, c, "oid", "bid", rest.NullVersionId))
+	assert.Equal(t, "other obj", readObject(t, c, "oid2", "bid", ""))
+	assert.Equal(t, 5, backend.retrieves)
+
+	// as deleting it does
+	deleted, err := c.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, _, ok, err := c.Retrieve("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, ok, err = c.Stat("oid", "bid", rest.NullVersionId)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	stats := c.Stats()
+	assert.Equal(t, int64(4), stats["cache_invalidations"])
+	assert.Equal(t, int64(1), stats["cache_objects"])
+}
+
+func TestCacheStore_InvalidationWhileRetrieving(t *testing.T) {
+	backend := newCountingStore(t)
+	c := newTestStore(t, backend, Options{Size: 1 << 20})
+	store(t, c, "oid", "bid", "test obj")
+
+	// The object is replaced while it is being retrieved, after reading it from the wrapped store
+	backend.retrieving = make(chan struct{})
+	done := make(chan string)
+	go func() {
+		done <- readObject(t, c, "oid", "bid", "")
+	}()
+	<-backend.retrieving
+	store(t, c, "oid", "bid", "new obj")
+	backend.retrieving <- struct{}{}
+	assert.Equal(t, "test obj", <-done)
+	backend.retrieving = nil
+
+	// The retrieved object has not been cached
+	assert.Equal(t, "new obj", readObject(t, c, "oid", "bid", ""))
+	assert.Equal(t, 2, backend.retrieves)
+	assert.Empty(t, c.fills)
+}
+
+func TestCacheStore_Eviction(t *testing.T) {
+	backend := newCountingStore(t)
+	data := strings.Repeat("x", 1000)
+	c := newTestStore(t, backend, Options{Size: 3000, MaxObjectSize: 2000})
+	for _, objId := range []string{"o1", "o2", "o3", "o4"} {
+		store(t, c, objId, "bid", data)
+	}
+
+	// Two objects fit in the cache
+	for _, objId := range []string{"o1", "o2", "o1", "o3"} {
+		readObject(t, c, objId, "bid", "")
+	}
+	assert.Equal(t, 3, backend.retrieves)
+	readObject(t, c, "o1", "bid", "")
+	assert.Equal(t, 3, backend.retrieves)
+	readObject(t, c, "o2", "bid", "")
+	assert.Equal(t, 4, backend.retrieves)
+	stats := c.Stats()
+	assert.Equal(t, int64(2), stats["cache_evictions"])
+	assert.Equal(t, int64(2), stats["cache_objects"])
+	assert.LessOrEqual(t, stats["cache_size_bytes"], int64(3000))
+
+	// Objects larger than the maximum object size are not cached
+	store(t, c, "large", "bid", strings.Repeat("x", 2001))
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, 2001, len(readObject(t, c, "large", "bid", "")))
+	}
+	assert.Equal(t, 6, backend.retrieves)
+	assert.Equal(t, int64(2), c.Stats()["cache_objects"])
+}
+
+func TestCacheStore_WrappedStoreEviction(t *testing.T) {
+	backend, err := memstore.NewStore(memstore.Options{MemoryBudget: 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestStore(t, backend, Options{Size: 1 << 20})
+	data := strings.Repeat("x", 1000)
+	store(t, c, "o1", "bid", data)
+	assert.Equal(t, data, readObject(t, c, "o1", "bid", ""))
+
+	// Storing another object evicts the first one from the wrapped store, and from the cache
+	store(t, c, "o2", "bid", data)
+	_, _, ok, err := c.Retrieve("o1", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, ok, err = c.Stat("o1", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, data, readObject(t, c, "o2", "bid", ""))
+
+	stats := c.Stats()
+	assert.Equal(t, int64(1), stats["evicted_objects"])
+	assert.Equal(t, int64(1), stats["cache_invalidations"])
+	assert.Equal(t, int64(1), stats["cache_objects"])
+}
+
+func TestCacheStore_Stats(t *testing.T) {
+	backend, err := memstore.NewStore(memstore.Options{MemoryBudget: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestStore(t, backend, Options{Size: 1 << 20})
+	store(t, c, "oid", "bid", "test obj")
+	readObject(t, c, "oid", "bid", "")
+
+	// The statistics of the wrapped store are reported too
+	stats := c.Stats()
+	assert.Equal(t, int64(1<<20), stats["cache_budget_bytes"])
+	assert.Equal(t, int64(1), stats["cache_misses"])
+	assert.Equal(t, int64(1<<20), stats["memory_budget_bytes"])
+	assert.Contains(t, stats, "bucket_used_bytes.bid")
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+			return newTestStore(t, newCountingStore(t), Options{Size: 1 << 20})
+		}, storetest.Options{})
+	})
+	t.Run("file", func(t *testing.T) {
+		storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+			s, err := filestore.NewStore(dataPath, filestore.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return newTestStore(t, s, Options{Size: 16 << 20})
+		}, storetest.Options{Durable: true})
+	})
+}
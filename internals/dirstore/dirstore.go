@@ -0,0 +1,811 @@
+package dirstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"hash/crc32"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const numMutexes = 100
+
+// tmpDirName is the name of the folder in the store path holding the temporary files, written before renaming them
+const tmpDirName = ".tmp"
+
+// versioningFileName is the name of the empty file marking a bucket folder with versioning enabled
+const versioningFileName = ".versioning"
+
+// versionsDirExt is the extension of the folder holding the previous versions of an object, next to the object file
+const versionsDirExt = ".versions"
+
+// infoFileExt is the extension of the file holding the information of an object, next to the object file
+const infoFileExt = ".info"
+
+// now returns the current time, it is a variable to be replaced in tests
+var now = time.Now
+
+// newVersionId returns a new version ID, it is a variable to be replaced in tests
+var newVersionId = rest.NewVersionId
+
+// versionIdRe matches the version IDs which can name a version file, both the generated ones and NullVersionId
+var versionIdRe = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// castagnoli is the CRC-32C table used to compute the checksums of the object data
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// DirStore implements ObjectStore and stores each object in its own file on disk, at
+// <storePath>/<bucketId>/<fan-out>/<objId>
+// where fan-out is two levels of folders named after the hash of the object ID, so that no folder holds too many files.
+// The object file holds only the object data, and the JSON encoded objectInfo of the object is in the <objId>.info file
+// next to it, so the object files can be read, copied and verified with standard tools.
+//
+// Objects are written to a temporary file, which is renamed in place of the object file once complete: readers see
+// either the previous or the new object, and a crash never leaves a partially written object. Since the information
+// file cannot be replaced along with the object file, it is replaced first, holding the information of both the new
+// and the previous object, each with the modification time of its object file: the information of the object file in
+// place is the one matching its size and modification time (see objectInfoFile). Deleting an object removes its
+// object file and then its information file, so neither storing nor deleting depend on the number of objects in the
+// bucket. An information file left without object file by a crash is ignored, and replaced by the next store.
+//
+// In buckets with versioning enabled (marked by a <bucketId>/.versioning file) the previous versions of an object are
+// kept in the <objId>.versions folder next to the object file, one file per version named after its version ID, with
+// its information file. Storing a new version first links the current one in that folder, then renames the new one in
+// place. Delete markers have an empty object file.
+// The versions are ordered by a sequence number in their information, incremented by each new version.
+//
+// DirStore holds no state in memory: listing the objects and the buckets reads the folders on disk, so their time
+// depends on the number of objects, and the data path can be inspected, backed up or restored with standard tools.
+//
+// To allow concurrent access to multiple objects, it is used an array of `numMutexes` mutexes, hashed by bucket and
+// object ID. The global mutex is taken for writing only to remove the folders emptied by a deletion.
+type DirStore struct {
+	storePath string
+	opts      Options
+	mu        sync.RWMutex             // Global mutex to handle the creation and removal of folders
+	objectsMu [numMutexes]sync.RWMutex // Array of numMutexes mutexes to handle concurrent access to each object
+}
+
+// Options holds the options of a DirStore
+type Options struct {
+	// Fsync syncs each object file before renaming it in place, and its folder after, so that an acknowledged write
+	// survives a crash
+	Fsync bool
+}
+
+// objectInfo holds the information about an object stored in its information file
+type objectInfo struct {
+	Size         int64             `json:"size"`                    // Size in bytes of the object
+	ETag         string            `json:"etag"`                    // Hex encoded SHA-256 hash of the object data
+	Modified     time.Time         `json:"modified"`                // Time of the last change to the object
+	Checksum     string            `json:"crc32c,omitempty"`        // Hex encoded CRC-32C checksum of the object data
+	ContentType  string            `json:"content_type,omitempty"`  // Media type of the object
+	Metadata     map[string]string `json:"metadata,omitempty"`      // User-defined metadata of the object
+	VersionId    string            `json:"version_id,omitempty"`    // ID of the object version, if versioned
+	DeleteMarker bool              `json:"delete_marker,omitempty"` // Whether the version marks the object as deleted
+	Seq          int64             `json:"seq"`                     // Sequence number of the version of the object
+	DataModTime  int64             `json:"data_mtime"`              // Modification time of the object file, in Unix nanoseconds
+}
+
+// objectInfoFile is the content of an information file
+type objectInfoFile struct {
+	Info     objectInfo  `json:"info"`               // Information of the object
+	Previous *objectInfo `json:"previous,omitempty"` // Information of the object replaced, if any
+}
+
+// version is a previous version of an object
+type version struct {
+	path string
+	info objectInfo
+}
+
+func NewStore(storePath string, opts Options) (*DirStore, error) {
+	storePath = filepath.Clean(storePath)
+	// Check store folder
+	if _, err := os.Stat(storePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("store folder does not exist")
+		}
+		return nil, errors.New("cannot access store folder: " + err.Error())
+	}
+
+	// Remove the temporary files left by a crash
+	tmpDir := filepath.Join(storePath, tmpDirName)
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(tmpDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &DirStore{
+		storePath: storePath,
+		opts:      opts,
+	}, nil
+}
+
+// Store stores the object read from `r` with ID `objId` in bucket `bucketId`.
+// Returns the stored object information and whether the object has been replaced along with any error encountered.
+// The preconditions in `opts` are checked holding the object lock, so no other change can happen in the meantime.
+//
+// The object is first copied to a temporary file, before locking the object so slow clients do not block other
+// operations, then its information file is written and the file is renamed in place of the object file.
+func (s *DirStore) Store(r io.Reader, objId, bucketId string, opts rest.StoreOptions) (rest.ObjectInfo, bool, error) {
+	obj, objSize, etag, checksum, err := s.spoolObject(r, bucketId)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(obj)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	objMu := s.objectMutex(bucketId, objId)
+	objMu.Lock()
+	defer objMu.Unlock()
+
+	objPath := s.objectPath(bucketId, objId)
+	current, found, err := readObjectInfo(objPath)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	replaced := found && !current.DeleteMarker
+	var oldETag string
+	if replaced {
+		oldETag = current.ETag
+	}
+	if err = opts.CheckPreconditions(oldETag, replaced); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+
+	versioned, err := s.isVersioned(bucketId)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	info := objectInfo{
+		Size:        objSize,
+		ETag:        etag,
+		Modified:    now().UTC(),
+		Checksum:    checksum,
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
+		Seq:         current.Seq + 1,
+	}
+	if versioned {
+		info.VersionId = newVersionId()
+	}
+	if err = s.replaceObject(obj, objPath, info, current, found, found && versioned); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+
+	return info.objectInfo(objId), replaced, nil
+}
+
+// Retrieve retrieves the version `versionId` of the object `objId` in bucket `bucketId`, the current one if empty.
+// It returns a reader of the object data, the object information and whether the object has been found or not,
+// along with any error. The object file is opened holding the object lock, then it is not affected by later changes.
+// The object data is verified against its checksum by the reader while it is read, rather than before returning it,
+// so that retrieving an object reads its file only once.
+func (s *DirStore) Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, rest.ObjectInfo, bool, error) {
+	objMu := s.objectMutex(bucketId, objId)
+	objMu.RLock()
+	defer objMu.RUnlock()
+
+	f, info, ok, err := s.openVersion(s.objectPath(bucketId, objId), versionId)
+	if !ok || err != nil {
+		return nil, rest.ObjectInfo{}, false, err
+	}
+
+	return rest.NewChecksumReader(f, f, objId, info.Size, info.Checksum), info.objectInfo(objId), true, nil
+}
+
+// Stat returns the information about the version `versionId` of the object `objId` in bucket `bucketId`,
+// the current one if empty, and whether it has been found or not, along with any error.
+func (s *DirStore) Stat(objId, bucketId, versionId string) (rest.ObjectInfo, bool, error) {
+	objMu := s.objectMutex(bucketId, objId)
+	objMu.RLock()
+	defer objMu.RUnlock()
+
+	f, info, ok, err := s.openVersion(s.objectPath(bucketId, objId), versionId)
+	if !ok || err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	_ = f.Close()
+
+	return info.objectInfo(objId), true, nil
+}
+
+// Delete deletes the version `versionId` of the object `objId` in bucket `bucketId`. If `versionId` is empty
+// it deletes the current version or, if versioning is enabled on the bucket, it stores a delete marker.
+// Deleting the current version moves the most recent previous version, if any, in place of the object file.
+// The folders emptied by the deletion are removed, the bucket folder included.
+// It returns whether the object has been deleted or not along with any error.
+func (s *DirStore) Delete(objId, bucketId, versionId string) (bool, error) {
+	s.mu.RLock()
+	objMu := s.objectMutex(bucketId, objId)
+	objMu.Lock()
+	deleted, emptied, err := s.deleteVersion(objId, bucketId, versionId)
+	objMu.Unlock()
+	s.mu.RUnlock()
+
+	if emptied {
+		s.removeEmptyDirs(filepath.Dir(s.objectPath(bucketId, objId)))
+	}
+	return deleted, err
+}
+
+// Versions returns all the versions of the object `objId` in bucket `bucketId`, from the most recent one,
+// and whether the object has been found or not, along with any error.
+func (s *DirStore) Versions(objId, bucketId string) ([]rest.ObjectInfo, bool, error) {
+	objMu := s.objectMutex(bucketId, objId)
+	objMu.RLock()
+	defer objMu.RUnlock()
+
+	objPath := s.objectPath(bucketId, objId)
+	current, found, err := readObjectInfo(objPath)
+	if !found || err != nil {
+		return nil, false, err
+	}
+	previous, err := readVersions(objPath, current)
+	if err != nil {
+		return nil, false, err
+	}
+
+	versions := []rest.ObjectInfo{current.objectInfo(objId)}
+	for _, v := range previous {
+		versions = append(versions, v.info.objectInfo(objId))
+	}
+	return versions, true, nil
+}
+
+// EnableVersioning enables versioning on bucket `bucketId`, creating its folder with the file marking it as versioned
+func (s *DirStore) EnableVersioning(bucketId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucketPath := filepath.Join(s.storePath, bucketId)
+	if err := os.MkdirAll(bucketPath, 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(bucketPath, versioningFileName), os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// List lists the objects in bucket `bucketId` filtered according to `opts`, sorted by object ID.
+// It returns the listed objects and whether the bucket has been found or not, along with any error.
+// The objects IDs are read from the bucket folder, and the information only of the listed objects from their files.
+func (s *DirStore) List(bucketId string, opts rest.ListOptions) ([]rest.ObjectInfo, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	found := false
+	objPaths := make(map[string]string)
+	err := walkObjects(filepath.Join(s.storePath, bucketId), func(objId, objPath string) error {
+		found = true
+		if strings.HasPrefix(objId, opts.Prefix) && objId > opts.StartAfter {
+			objPaths[objId] = objPath
+		}
+		return nil
+	})
+	if !found || err != nil {
+		return nil, false, err
+	}
+	objIds := make([]string, 0, len(objPaths))
+	for objId := range objPaths {
+		objIds = append(objIds, objId)
+	}
+	sort.Strings(objIds)
+
+	var objects []rest.ObjectInfo
+	for _, objId := range objIds {
+		if opts.Limit > 0 && len(objects) == opts.Limit {
+			break
+		}
+		info, ok, err := readObjectInfo(objPaths[objId])
+		if err != nil {
+			return nil, false, err
+		}
+		if ok && !info.DeleteMarker {
+			objects = append(objects, info.objectInfo(objId))
+		}
+	}
+	return objects, true, nil
+}
+
+// Buckets returns the information about all buckets in the store sorted by bucket ID, along with any error.
+// It reads the information of all the objects and their versions.
+func (s *DirStore) Buckets() ([]rest.BucketInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.storePath)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]rest.BucketInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		bucketInfo := rest.BucketInfo{Id: entry.Name()}
+		found := false
+		err = walkObjects(filepath.Join(s.storePath, entry.Name()), func(objId, objPath string) error {
+			current, ok, err := readObjectInfo(objPath)
+			if !ok || err != nil {
+				return err
+			}
+			previous, err := readVersions(objPath, current)
+			if err != nil {
+				return err
+			}
+			found = true
+			if !current.DeleteMarker {
+				bucketInfo.Objects++
+			}
+			bucketInfo.Size += current.Size
+			for _, v := range previous {
+				bucketInfo.Size += v.info.Size
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			continue
+		}
+		if bucketInfo.Versioning, err = s.isVersioned(entry.Name()); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, bucketInfo)
+	}
+
+	return buckets, nil
+}
+
+// deleteVersion deletes the version `versionId` of the object `objId` in bucket `bucketId`, as Delete does.
+// It returns whether the object has been deleted and whether its file has been removed, along with any error.
+// The caller must hold the object lock.
+func (s *DirStore) deleteVersion(objId, bucketId, versionId string) (bool, bool, error) {
+	objPath := s.objectPath(bucketId, objId)
+	current, found, err := readObjectInfo(objPath)
+	if !found || err != nil {
+		return false, false, err
+	}
+
+	if versionId == "" {
+		versioned, err := s.isVersioned(bucketId)
+		if err != nil {
+			return false, false, err
+		}
+		if versioned {
+			if current.DeleteMarker {
+				return false, false, nil
+			}
+			// Mark the object as deleted keeping its versions
+			err = s.storeDeleteMarker(objPath, current, objectInfo{
+				Modified:     now().UTC(),
+				VersionId:    newVersionId(),
+				DeleteMarker: true,
+				Seq:          current.Seq + 1,
+			})
+			return err == nil, false, err
+		}
+		versionId = rest.NullVersionId
+	}
+
+	versionsPath := objPath + versionsDirExt
+	if !rest.VersionMatches(current.VersionId, versionId) {
+		vPath, ok := versionPath(objPath, versionId)
+		if !ok {
+			return false, false, nil
+		}
+		if err = os.Remove(vPath); err != nil {
+			if os.IsNotExist(err) {
+				err = nil
+			}
+			return false, false, err
+		}
+		_ = os.Remove(vPath + infoFileExt)
+		// Removed only if emptied
+		_ = os.Remove(versionsPath)
+		return true, false, nil
+	}
+
+	// Replace the current version with the most recent previous one, if any
+	previous, err := readVersions(objPath, current)
+	if err != nil {
+		return false, false, err
+	}
+	if len(previous) == 0 {
+		if err = os.Remove(objPath); err != nil {
+			return false, false, err
+		}
+		_ = os.Remove(objPath + infoFileExt)
+		// Left by a crash while storing a new version, if any
+		_ = os.RemoveAll(versionsPath)
+		return true, true, s.syncDir(filepath.Dir(objPath))
+	}
+	if err = s.writeInfoFile(objPath, objectInfoFile{Info: previous[0].info, Previous: &current}); err != nil {
+		return false, false, err
+	}
+	if err = os.Rename(previous[0].path, objPath); err != nil {
+		return false, false, err
+	}
+	_ = os.Remove(previous[0].path + infoFileExt)
+	_ = os.Remove(versionsPath)
+	return true, false, s.syncDir(filepath.Dir(objPath))
+}
+
+// storeDeleteMarker stores the delete marker `marker` as the current version of the object at `objPath`,
+// keeping the `current` one. The caller must hold the object lock.
+func (s *DirStore) storeDeleteMarker(objPath string, current, marker objectInfo) error {
+	tmpFile, err := ioutil.TempFile(filepath.Join(s.storePath, tmpDirName), filepath.Base(objPath)+"_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	return s.replaceObject(tmpFile, objPath, marker, current, true, true)
+}
+
+// replaceObject renames the complete object file `obj`, with information `info`, in place of the object file at
+// `objPath`, after writing its information file. `found` tells whether the `current` version exists: if `keep` is true
+// it is kept, linking it with its information file in the versions folder of the object first.
+// The caller must hold the object lock.
+func (s *DirStore) replaceObject(obj *os.File, objPath string, info, current objectInfo, found, keep bool) error {
+	if err := os.MkdirAll(filepath.Dir(objPath), 0755); err != nil {
+		return err
+	}
+	if keep {
+		versionsPath := objPath + versionsDirExt
+		if err := os.MkdirAll(versionsPath, 0755); err != nil {
+			return err
+		}
+		// Links left by a crash before renaming the new version are the same version
+		vPath, _ := versionPath(objPath, current.VersionId)
+		for _, ext := range []string{infoFileExt, ""} {
+			if err := os.Link(objPath+ext, vPath+ext); err != nil && !os.IsExist(err) {
+				return err
+			}
+		}
+		if err := s.syncDir(versionsPath); err != nil {
+			return err
+		}
+	}
+
+	if s.opts.Fsync {
+		if err := obj.Sync(); err != nil {
+			return err
+		}
+	}
+	fi, err := obj.Stat()
+	if err != nil {
+		return err
+	}
+	if err = obj.Close(); err != nil {
+		return err
+	}
+	info.DataModTime = fi.ModTime().UnixNano()
+	infoFile := objectInfoFile{Info: info}
+	if found {
+		infoFile.Previous = &current
+	}
+	if err = s.writeInfoFile(objPath, infoFile); err != nil {
+		return err
+	}
+	if err = os.Rename(obj.Name(), objPath); err != nil {
+		return err
+	}
+	return s.syncDir(filepath.Dir(objPath))
+}
+
+// writeInfoFile writes `infoFile` to the information file of the object file at `objPath`, renaming a temporary file
+// in its place. The caller must hold the object lock.
+func (s *DirStore) writeInfoFile(objPath string, infoFile objectInfoFile) error {
+	data, err := json.Marshal(infoFile)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Join(s.storePath, tmpDirName), filepath.Base(objPath)+"_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	if _, err = tmpFile.Write(data); err != nil {
+		return err
+	}
+	if s.opts.Fsync {
+		if err = tmpFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile.Name(), objPath+infoFileExt); err != nil {
+		return err
+	}
+	return s.syncDir(filepath.Dir(objPath))
+}
+
+// removeEmptyDirs removes the folder `dir` and its parents up to the store path, as long as they are empty
+func (s *DirStore) removeEmptyDirs(dir string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ; dir != s.storePath; dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+	}
+}
+
+// syncDir syncs the folder `dir`, making the renames in it durable, if Fsync is enabled
+func (s *DirStore) syncDir(dir string) error {
+	if !s.opts.Fsync {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// spoolObject copies the object read from `r` to a temporary file in the temporary folder.
+// It returns the temporary file, positioned at its end, the object size, its ETag and its checksum along with any
+// error. The caller is in charge of closing and removing the returned file.
+func (s *DirStore) spoolObject(r io.Reader, bucketId string) (*os.File, int64, string, string, error) {
+	tmpFile, err := ioutil.TempFile(filepath.Join(s.storePath, tmpDirName), bucketId+"_*.tmp")
+	if err != nil {
+		return nil, 0, "", "", err
+	}
+
+	h := sha256.New()
+	c := crc32.New(castagnoli)
+	size, err := io.Copy(io.MultiWriter(tmpFile, h, c), r)
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return nil, 0, "", "", err
+	}
+
+	return tmpFile, size, hex.EncodeToString(h.Sum(nil)), fmt.Sprintf("%08x", c.Sum32()), nil
+}
+
+// isVersioned returns whether versioning is enabled on bucket `bucketId`
+func (s *DirStore) isVersioned(bucketId string) (bool, error) {
+	_, err := os.Stat(filepath.Join(s.storePath, bucketId, versioningFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// objectPath returns the path of the file of the object `objId` in bucket `bucketId`
+func (s *DirStore) objectPath(bucketId, objId string) string {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(objId))
+	fanOut := fmt.Sprintf("%08x", h.Sum32())
+	return filepath.Join(s.storePath, bucketId, fanOut[:2], fanOut[2:4], objId)
+}
+
+// objectMutex returns the mutex of the object `objId` in bucket `bucketId`
+func (s *DirStore) objectMutex(bucketId, objId string) *sync.RWMutex {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(bucketId + "/" + objId))
+	return &s.objectsMu[h.Sum32()%numMutexes]
+}
+
+// openVersion opens the file of the version `versionId` of the object file at `objPath`, the current one if empty.
+// It returns the opened file, the version information and whether it has been found, along with any error.
+// Delete markers are never returned. The caller must hold the object lock and close the returned file.
+func (s *DirStore) openVersion(objPath, versionId string) (*os.File, objectInfo, bool, error) {
+	f, info, found, err := openObject(objPath)
+	if !found || err != nil {
+		return nil, objectInfo{}, false, err
+	}
+	if versionId != "" && !rest.VersionMatches(info.VersionId, versionId) {
+		_ = f.Close()
+		vPath, ok := versionPath(objPath, versionId)
+		if !ok {
+			return nil, objectInfo{}, false, nil
+		}
+		if f, info, found, err = openObject(vPath); !found || err != nil {
+			return nil, objectInfo{}, false, err
+		}
+	}
+	if info.DeleteMarker {
+		_ = f.Close()
+		return nil, objectInfo{}, false, nil
+	}
+	return f, info, true, nil
+}
+
+// versionPath returns the path of the file of the version `versionId` of the object file at `objPath`,
+// and whether `versionId` is a valid version ID
+func versionPath(objPath, versionId string) (string, bool) {
+	if versionId == "" {
+		versionId = rest.NullVersionId
+	}
+	if !versionIdRe.MatchString(versionId) {
+		return "", false
+	}
+	return filepath.Join(objPath+versionsDirExt, versionId), true
+}
+
+// readVersions returns the previous versions of the object file at `objPath`, whose `current` version is excluded,
+// sorted from the most recent one
+func readVersions(objPath string, current objectInfo) ([]version, error) {
+	entries, err := os.ReadDir(objPath + versionsDirExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	currentPath, _ := versionPath(objPath, current.VersionId)
+	var versions []version
+	for _, entry := range entries {
+		vPath := filepath.Join(objPath+versionsDirExt, entry.Name())
+		if vPath == currentPath || strings.HasSuffix(vPath, infoFileExt) {
+			continue
+		}
+		info, found, err := readObjectInfo(vPath)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			versions = append(versions, version{path: vPath, info: info})
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].info.Seq > versions[j].info.Seq
+	})
+	return versions, nil
+}
+
+// walkObjects calls `fn` with the ID and the file path of each object in the bucket folder at `bucketPath`.
+// A missing bucket folder has no objects.
+func walkObjects(bucketPath string, fn func(objId, objPath string) error) error {
+	err := filepath.WalkDir(bucketPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Object IDs never contain dots, unlike the versions folders, the information files and the versioning file
+		if strings.Contains(d.Name(), ".") && path != bucketPath {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return fn(d.Name(), path)
+	})
+	return err
+}
+
+// openObject opens the object file at `path`, reading its information.
+// It returns the opened file, the object information and whether the file exists, along with any error.
+func openObject(path string) (*os.File, objectInfo, bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, objectInfo{}, false, nil
+		}
+		return nil, objectInfo{}, false, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, objectInfo{}, false, err
+	}
+	info, err := readInfo(path, fi)
+	if err != nil {
+		_ = f.Close()
+		return nil, objectInfo{}, false, err
+	}
+	return f, info, true, nil
+}
+
+// readObjectInfo reads the information of the object file at `path`.
+// It returns the object information and whether the file exists, along with any error.
+func readObjectInfo(path string) (objectInfo, bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return objectInfo{}, false, nil
+		}
+		return objectInfo{}, false, err
+	}
+	info, err := readInfo(path, fi)
+	if err != nil {
+		return objectInfo{}, false, err
+	}
+	return info, true, nil
+}
+
+// readInfo reads the information of the object file at `path`, described by `fi`, from its information file.
+// The returned information has the modification time of the object file.
+func readInfo(path string, fi os.FileInfo) (objectInfo, error) {
+	data, err := ioutil.ReadFile(path + infoFileExt)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return objectInfo{}, fmt.Errorf("%w: object file %s has no information file", rest.ErrCorruptedObject, path)
+		}
+		return objectInfo{}, err
+	}
+	var infoFile objectInfoFile
+	if err = json.Unmarshal(data, &infoFile); err != nil {
+		return objectInfo{}, fmt.Errorf("%w: object file %s: cannot parse object info: %v", rest.ErrCorruptedObject, path, err)
+	}
+
+	// The previous object is still in place if the object file was not renamed after writing the information file
+	info := infoFile.Info
+	if infoFile.Previous != nil && !info.describes(fi) && infoFile.Previous.describes(fi) {
+		info = *infoFile.Previous
+	}
+	if info.Size != fi.Size() {
+		return objectInfo{}, fmt.Errorf("%w: object file %s has size %d instead of %d", rest.ErrCorruptedObject,
+			path, fi.Size(), info.Size)
+	}
+	info.DataModTime = fi.ModTime().UnixNano()
+	return info, nil
+}
+
+// describes reports whether the information is of the object file described by `fi`, by its size and modification
+// time
+func (i objectInfo) describes(fi os.FileInfo) bool {
+	return i.Size == fi.Size() && i.DataModTime == fi.ModTime().UnixNano()
+}
+
+// objectInfo returns the rest.ObjectInfo of the object `objId`
+func (i objectInfo) objectInfo(objId string) rest.ObjectInfo {
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         i.Size,
+		ETag:         i.ETag,
+		LastModified: i.Modified,
+		ContentType:  i.ContentType,
+		Metadata:     i.Metadata,
+		VersionId:    i.VersionId,
+		DeleteMarker: i.DeleteMarker,
+	}
+}
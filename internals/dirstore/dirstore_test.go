@@ -0,0 +1,342 @@
+package dirstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest/storetest"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+var testTime = time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func init() {
+	now = func() time.Time {
+		return testTime
+	}
+	var versions int
+	newVersionId = func() string {
+		versions++
+		return fmt.Sprintf("v%d", versions)
+	}
+}
+
+func newTestStore(t *testing.T) *DirStore {
+	s, err := NewStore(t.TempDir(), Options{Fsync: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func testObjectInfo(objId, data, versionId string) rest.ObjectInfo {
+	etag := sha256.Sum256([]byte(data))
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         int64(len(data)),
+		ETag:         hex.EncodeToString(etag[:]),
+		LastModified: testTime,
+		VersionId:    versionId,
+	}
+}
+
+func readObject(t *testing.T, s *DirStore, objId, bucketId, versionId string) string {
+	r, _, ok, err := s.Retrieve(objId, bucketId, versionId)
+	if !assert.NoError(t, err) || !assert.True(t, ok) {
+		return ""
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	return string(data)
+}
+
+func TestNewStore(t *testing.T) {
+	_, err := NewStore(filepath.Join(t.TempDir(), "missing"), Options{})
+	assert.Error(t, err)
+
+	// Temporary files left by a crash are removed
+	storePath := t.TempDir()
+	_ = os.Mkdir(filepath.Join(storePath, tmpDirName), 0755)
+	_ = os.WriteFile(filepath.Join(storePath, tmpDirName, "bid_123.tmp"), []byte("partial"), 0644)
+	_, err = NewStore(storePath, Options{})
+	assert.NoError(t, err)
+	assert.NoFileExists(t, filepath.Join(storePath, tmpDirName, "bid_123.tmp"))
+	assert.DirExists(t, filepath.Join(storePath, tmpDirName))
+}
+
+func TestDirStore_Store(t *testing.T) {
+	s := newTestStore(t)
+
+	info, replaced, err := s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, testObjectInfo("oid", "test obj", ""), info)
+
+	// The object file holds the object data only, the information is in the file next to it
+	objPath := s.objectPath("bid", "oid")
+	assert.Equal(t, filepath.Join(s.storePath, "bid"), filepath.Dir(filepath.Dir(filepath.Dir(objPath))))
+	data, _ := os.ReadFile(objPath)
+	assert.Equal(t, "test obj", string(data))
+	assert.FileExists(t, objPath+infoFileExt)
+	fi, _ := os.Stat(objPath)
+
+	info, replaced, err = s.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{
+		ContentType: "text/plain",
+		Metadata:    map[string]string{"k": "v"},
+	})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, "new obj", readObject(t, s, "oid", "bid", ""))
+	stat, ok, err := s.Stat("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, info, stat)
+	assert.Equal(t, "text/plain", stat.ContentType)
+	assert.Equal(t, map[string]string{"k": "v"}, stat.Metadata)
+	assert.NoDirExists(t, objPath+versionsDirExt)
+
+	// Preconditions are checked against the current object
+	_, _, err = s.Store(strings.NewReader("other obj"), "oid", "bid", rest.StoreOptions{IfNoneMatch: []string{"*"}})
+	assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+
+	// A read error stores nothing
+	readErr := errors.New("read error")
+	_, _, err = s.Store(iotest.ErrReader(readErr), "oid", "bid", rest.StoreOptions{})
+	assert.ErrorIs(t, err, readErr)
+	assert.Equal(t, "new obj", readObject(t, s, "oid", "bid", ""))
+
+	// A crash before renaming the new object file, after writing its information file, leaves the previous object
+	_ = os.WriteFile(objPath, []byte("test obj"), 0644)
+	_ = os.Chtimes(objPath, fi.ModTime(), fi.ModTime())
+	assert.Equal(t, "test obj", readObject(t, s, "oid", "bid", ""))
+	stat, ok, err = s.Stat("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, testObjectInfo("oid", "test obj", ""), stat)
+
+	tmpFiles, _ := os.ReadDir(filepath.Join(s.storePath, tmpDirName))
+	assert.Empty(t, tmpFiles)
+}
+
+func TestDirStore_Retrieve(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+
+	r, info, ok, err := s.Retrieve("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, testObjectInfo("oid", "test obj", ""), info)
+
+	// The reader is not affected by later changes
+	_, _, _ = s.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{})
+	data, _ := io.ReadAll(r)
+	assert.Equal(t, "test obj", string(data))
+	assert.NoError(t, r.Close())
+
+	for _, missing := range [][3]string{{"oid2", "bid", ""}, {"oid", "bid2", ""}, {"oid", "bid", "v1"}, {"oid", "bid", "../oid"}} {
+		_, _, ok, err = s.Retrieve(missing[0], missing[1], missing[2])
+		assert.NoError(t, err)
+		assert.False(t, ok, missing)
+	}
+
+	// Corrupted data is detected while reading it, before its end
+	objPath := s.objectPath("bid", "oid")
+	data, _ = os.ReadFile(objPath)
+	data[0] = 'x'
+	_ = os.WriteFile(objPath, data, 0644)
+	r, _, ok, err = s.Retrieve("oid", "bid", "")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		read, err := io.ReadAll(r)
+		assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+		assert.Less(t, len(read), len("new obj"))
+		// reading it again from the beginning verifies it again
+		_, _ = r.Seek(0, io.SeekStart)
+		_, err = io.ReadAll(r)
+		assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+		// while range reads are not verified
+		_, _ = r.Seek(1, io.SeekStart)
+		read = make([]byte, 2)
+		_, err = io.ReadFull(r, read)
+		assert.NoError(t, err)
+		assert.Equal(t, "ew", string(read))
+		assert.NoError(t, r.Close())
+	}
+
+	_ = os.WriteFile(objPath, data[:len(data)-3], 0644)
+	_, _, err = s.Stat("oid", "bid", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+	_ = os.Remove(objPath + infoFileExt)
+	_, _, err = s.Stat("oid", "bid", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+}
+
+func TestDirStore_Delete(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{})
+	_, _, _ = s.Store(strings.NewReader("test obj 2"), "oid2", "bid", rest.StoreOptions{})
+
+	deleted, err := s.Delete("oid3", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	deleted, err = s.Delete("oid", "bid", "v1")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+
+	deleted, err = s.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, ok, _ := s.Stat("oid", "bid", "")
+	assert.False(t, ok)
+	assert.NoDirExists(t, filepath.Dir(s.objectPath("bid", "oid")))
+	assert.DirExists(t, filepath.Join(s.storePath, "bid"))
+
+	// Emptying the bucket removes its folder
+	deleted, err = s.Delete("oid2", "bid", rest.NullVersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.NoDirExists(t, filepath.Join(s.storePath, "bid"))
+	_, ok, err = s.List("bid", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDirStore_Versioning(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("null obj"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, s.EnableVersioning("bid"))
+
+	info, replaced, err := s.Store(strings.NewReader("obj v1"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	v1 := info.VersionId
+	info, _, _ = s.Store(strings.NewReader("obj v2"), "oid", "bid", rest.StoreOptions{})
+	v2 := info.VersionId
+
+	versions, ok, err := s.Versions("oid", "bid")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []rest.ObjectInfo{
+		testObjectInfo("oid", "obj v2", v2),
+		testObjectInfo("oid", "obj v1", v1),
+		testObjectInfo("oid", "null obj", ""),
+	}, versions)
+	assert.Equal(t, "null obj", readObject(t, s, "oid", "bid", rest.NullVersionId))
+	assert.Equal(t, "obj v1", readObject(t, s, "oid", "bid", v1))
+	assert.Equal(t, "obj v2", readObject(t, s, "oid", "bid", ""))
+
+	// Deleting the object stores a delete marker
+	deleted, err := s.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, ok, _ = s.Stat("oid", "bid", "")
+	assert.False(t, ok)
+	deleted, err = s.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	versions, _, _ = s.Versions("oid", "bid")
+	if assert.Len(t, versions, 4) {
+		assert.True(t, versions[0].DeleteMarker)
+	}
+	objects, ok, err := s.List("bid", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Empty(t, objects)
+
+	// Deleting the delete marker restores the previous version
+	deleted, err = s.Delete("oid", "bid", versions[0].VersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, "obj v2", readObject(t, s, "oid", "bid", ""))
+
+	// and deleting a previous version keeps the current one
+	deleted, err = s.Delete("oid", "bid", v1)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	versions, _, _ = s.Versions("oid", "bid")
+	assert.Equal(t, []rest.ObjectInfo{
+		testObjectInfo("oid", "obj v2", v2),
+		testObjectInfo("oid", "null obj", ""),
+	}, versions)
+
+	for _, versionId := range []string{v2, rest.NullVersionId} {
+		deleted, err = s.Delete("oid", "bid", versionId)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	}
+	_, ok, _ = s.Versions("oid", "bid")
+	assert.False(t, ok)
+	// The versioned bucket folder is kept
+	assert.FileExists(t, filepath.Join(s.storePath, "bid", versioningFileName))
+}
+
+func TestDirStore_List(t *testing.T) {
+	s := newTestStore(t)
+	for _, objId := range []string{"c", "a", "b2", "b1"} {
+		_, _, _ = s.Store(strings.NewReader("obj "+objId), objId, "bid", rest.StoreOptions{})
+	}
+
+	tests := []struct {
+		name string
+		opts rest.ListOptions
+		want []string
+	}{
+		{"all", rest.ListOptions{}, []string{"a", "b1", "b2", "c"}},
+		{"prefix", rest.ListOptions{Prefix: "b"}, []string{"b1", "b2"}},
+		{"start after", rest.ListOptions{StartAfter: "b1"}, []string{"b2", "c"}},
+		{"limit", rest.ListOptions{Limit: 3}, []string{"a", "b1", "b2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, ok, err := s.List("bid", tt.opts)
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			var want []rest.ObjectInfo
+			for _, objId := range tt.want {
+				want = append(want, testObjectInfo(objId, "obj "+objId, ""))
+			}
+			assert.Equal(t, want, objects)
+		})
+	}
+
+	_, ok, err := s.List("bid2", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestDirStore_Buckets(t *testing.T) {
+	s := newTestStore(t)
+	_, _, _ = s.Store(strings.NewReader("test obj"), "oid", "bid2", rest.StoreOptions{})
+	_, _, _ = s.Store(strings.NewReader("obj"), "oid", "bid1", rest.StoreOptions{})
+	assert.NoError(t, s.EnableVersioning("bid1"))
+	_, _, _ = s.Store(strings.NewReader("obj v1"), "oid", "bid1", rest.StoreOptions{})
+	_, _ = s.Delete("oid", "bid1", "")
+	// Versioned buckets without objects are not listed
+	assert.NoError(t, s.EnableVersioning("bid3"))
+
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []rest.BucketInfo{
+		{Id: "bid1", Objects: 0, Size: 9, Versioning: true},
+		{Id: "bid2", Objects: 1, Size: 8},
+	}, buckets)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+		s, err := NewStore(dataPath, Options{Fsync: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, storetest.Options{Durable: true})
+}
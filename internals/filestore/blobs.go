@@ -0,0 +1,99 @@
+package filestore
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// blobsDir is the folder, within the store folder, where the object data is stored
+const blobsDir = "blobs"
+
+// Object data is content-addressed: the data of each object is stored once in a blob file named after its ETag,
+// the hex encoded SHA-256 hash of the data, and it is shared by all the objects (and versions) with the same data.
+// Blobs are stored in <blobsDir>/<first 2 ETag chars>/<ETag> to avoid folders with too many files.
+//
+// FileStore counts the valid object records referring to each blob: the count is incremented before writing a record and
+// decremented after removing or replacing it, when the count gets to zero the blob is deleted.
+// Blobs are never modified, so readers keep reading a blob even if it is deleted in the meantime.
+// The reference counts are saved to the store catalog when closing the store (see catalog.go). If the catalog cannot be
+// used, they are computed from the bucket files at startup, deleting the blobs not referenced anymore (like the ones
+// left by a crash before their record was written).
+
+// blobPath returns the path of the blob file with the given ETag
+func (f *FileStore) blobPath(etag string) string {
+	return blobFilePath(f.storePath, etag)
+}
+
+// blobFilePath returns the path of the blob file with the given ETag in the store path
+func blobFilePath(storePath, etag string) string {
+	return filepath.Join(storePath, blobsDir, etag[:2], etag)
+}
+
+// putBlob adds a reference to the blob with the given ETag. If the blob does not exist yet, the spooled object
+// file `obj` (in the store folder) becomes the blob. Otherwise the object data is deduplicated and `obj` is left
+// to the caller to be removed.
+func (f *FileStore) putBlob(obj *os.File, etag string) error {
+	f.blobsMu.Lock()
+	defer f.blobsMu.Unlock()
+
+	if f.blobRefs[etag] == 0 {
+		blobPath := f.blobPath(etag)
+		if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(obj.Name(), blobPath); err != nil {
+			return err
+		}
+		if f.wal != nil {
+			// The blob must be durable before the record referring to it
+			for _, dir := range []string{filepath.Dir(blobPath), filepath.Dir(filepath.Dir(blobPath))} {
+				if err := syncFile(dir); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	f.blobRefs[etag]++
+
+	return nil
+}
+
+// releaseBlob removes a reference to the blob with the given ETag and deletes it if not referenced anymore
+func (f *FileStore) releaseBlob(etag string) {
+	f.blobsMu.Lock()
+	defer f.blobsMu.Unlock()
+
+	f.blobRefs[etag]--
+	if f.blobRefs[etag] <= 0 {
+		delete(f.blobRefs, etag)
+		_ = os.Remove(f.blobPath(etag))
+	}
+}
+
+// countBlobRefs adds the references to each blob by the records of the given bucket to `refs`
+func countBlobRefs(refs map[string]int, bucketMeta *bucketMetadata) {
+	for _, current := range bucketMeta.objects {
+		for objMeta := current; objMeta != nil; objMeta = objMeta.older {
+			if !objMeta.info.DeleteMarker {
+				refs[objMeta.info.ETag]++
+			}
+		}
+	}
+}
+
+// removeUnreferencedBlobs deletes the blob files in the store path that are not referenced according to `refs`
+func removeUnreferencedBlobs(storePath string, refs map[string]int) error {
+	return filepath.WalkDir(filepath.Join(storePath, blobsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && refs[d.Name()] == 0 {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,179 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// catalogFileName is the name of the catalog file in the store folder
+const catalogFileName = "buckets.catalog"
+
+// catalogMagic is the magic string starting the catalog file, followed by its format version
+const catalogMagic = "#OBJSTORE-CATALOG 1\n"
+
+// Counting the references to the blobs requires the records of all the buckets, so that loading them at startup
+// would take the time and the memory of loading every bucket. Instead, the reference counts are saved along with the
+// summary of each bucket to the catalog file when the store is closed: the gob encoded storeCatalog, preceded by
+// catalogMagic and followed by its CRC-32C checksum (4 bytes, big-endian), as the index files (see index.go).
+// The catalog holds the size and modification time of each bucket file it was saved for, so it is used only if the
+// bucket files are exactly the ones it describes and none of them has changed since. Then the buckets start evicted,
+// and each one is loaded when first used (see eviction.go). Otherwise, or if it cannot be read, all the bucket files are
+// loaded to count the references to the blobs.
+// The catalog file is removed once read, so that it never describes bucket files changed by a later run of the store.
+
+// storeCatalog is the content of the catalog file
+type storeCatalog struct {
+	Buckets  []catalogEntry // Summaries of the buckets
+	BlobRefs map[string]int // Number of records referring to each blob by ETag
+}
+
+// catalogEntry is the summary of a bucket in the catalog file
+type catalogEntry struct {
+	BucketId    string
+	DataSize    int64 // Size of the bucket file when cataloged
+	DataModTime int64 // Modification time of the bucket file when cataloged, in Unix nanoseconds
+	Version     int   // Format version of the bucket file
+	Garbage     int64 // Size of the garbage records in the bucket file
+	NumObjects  int   // Number of objects in the bucket
+	ObjectsSize int64 // Total size of the objects in the bucket
+}
+
+// loadCatalog loads the evicted metadata of the buckets in the store path, and the references to the blobs, from the
+// catalog file, removing it. It returns the bucket metadata and the blob references along with any error, including
+// the catalog not matching the bucket files.
+func loadCatalog(storePath string) (map[string]*bucketMetadata, map[string]int, error) {
+	catalogPath := path.Join(storePath, catalogFileName)
+	data, err := ioutil.ReadFile(catalogPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = os.Remove(catalogPath); err != nil {
+		return nil, nil, err
+	}
+	if len(data) < len(catalogMagic)+4 || string(data[:len(catalogMagic)]) != catalogMagic {
+		return nil, nil, errors.New("invalid catalog file header")
+	}
+	payload := data[len(catalogMagic) : len(data)-4]
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, nil, errors.New("catalog file checksum mismatch")
+	}
+
+	var catalog storeCatalog
+	if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&catalog); err != nil {
+		return nil, nil, err
+	}
+
+	bucketFiles, err := filepath.Glob(path.Join(storePath, "*.dat"))
+	if err != nil {
+		return nil, nil, err
+	}
+	buckets := make(map[string]*bucketMetadata, len(catalog.Buckets))
+	for _, entry := range catalog.Buckets {
+		bfPath := path.Join(storePath, entry.BucketId+".dat")
+		fi, err := os.Stat(bfPath)
+		if err != nil || fi.Size() != entry.DataSize || fi.ModTime().UnixNano() != entry.DataModTime {
+			return nil, nil, errors.New("stale catalog file")
+		}
+		muIndex, err := bucketIdToMutexIndex(entry.BucketId)
+		if err != nil {
+			return nil, nil, err
+		}
+		buckets[entry.BucketId] = &bucketMetadata{
+			filePath:   bfPath,
+			muIndex:    muIndex,
+			version:    entry.Version,
+			size:       entry.DataSize,
+			garbage:    entry.Garbage,
+			numObjects: entry.NumObjects,
+			dataSize:   entry.ObjectsSize,
+		}
+	}
+	if len(buckets) != len(bucketFiles) {
+		return nil, nil, errors.New("stale catalog file")
+	}
+	if err = removeOrphanIndexes(storePath); err != nil {
+		return nil, nil, err
+	}
+	if catalog.BlobRefs == nil {
+		catalog.BlobRefs = make(map[string]int)
+	}
+	return buckets, catalog.BlobRefs, nil
+}
+
+// saveCatalog saves the summaries of the buckets and the references to the blobs to the catalog file.
+// The store must not be changed afterwards, so it is called when closing the store.
+func (f *FileStore) saveCatalog() error {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	catalog := storeCatalog{Buckets: make([]catalogEntry, 0, len(f.buckets))}
+	for bucketId, bucketMeta := range f.buckets {
+		bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+		bucketMu.RLock()
+		entry, err := catalogBucket(bucketId, bucketMeta)
+		bucketMu.RUnlock()
+		if err != nil {
+			return err
+		}
+		catalog.Buckets = append(catalog.Buckets, entry)
+	}
+	f.blobsMu.Lock()
+	catalog.BlobRefs = f.blobRefs
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(&catalog)
+	f.blobsMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// temporary catalog file to replace the catalog file with
+	tmpFile, err := ioutil.TempFile(f.storePath, "catalog_*.tmp")
+	if err != nil {
+		return err
+	}
+	// delete tmp file if anything goes wrong
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	w := bufio.NewWriter(tmpFile)
+	_, _ = w.WriteString(catalogMagic)
+	_, _ = w.Write(payload.Bytes())
+	_ = binary.Write(w, binary.BigEndian, crc32.Checksum(payload.Bytes(), castagnoli))
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path.Join(f.storePath, catalogFileName))
+}
+
+// catalogBucket returns the catalog entry of bucket `bucketId`. The caller must hold the bucket lock.
+func catalogBucket(bucketId string, bucketMeta *bucketMetadata) (catalogEntry, error) {
+	fi, err := os.Stat(bucketMeta.filePath)
+	if err != nil {
+		return catalogEntry{}, err
+	}
+	if fi.Size() != bucketMeta.size {
+		return catalogEntry{}, errors.New("bucket file size does not match its metadata")
+	}
+	entry := catalogEntry{
+		BucketId:    bucketId,
+		DataSize:    fi.Size(),
+		DataModTime: fi.ModTime().UnixNano(),
+		Version:     bucketMeta.version,
+		Garbage:     bucketMeta.garbage,
+	}
+	entry.NumObjects, entry.ObjectsSize, _ = bucketMeta.summary()
+	return entry, nil
+}
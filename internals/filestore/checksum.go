@@ -0,0 +1,100 @@
+package filestore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"hash/crc32"
+	"io"
+	"os"
+	"strconv"
+)
+
+// Records are protected by a CRC-32C (Castagnoli) checksum of the record header, appended to it as 8 hex digits:
+// <objId> <obj len in bytes> <info len in bytes> <info> <checksum>\n
+// and the object info holds the checksum of the object data, so that both the records and the blobs are verified.
+// Records written before checksums were introduced have no checksum and they are read without verification.
+//
+// Records are verified when loading the bucket files and when retrieving an object, whose data is verified while it
+// is read (see rest.NewChecksumReader): a verification failure is reported with an error wrapping rest.ErrCorruptedObject.
+
+// checksumSize is the size of the checksum field of a record, leading space included
+const checksumSize = 1 + 8
+
+// castagnoli is the CRC-32C table used to compute the checksums
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// formatChecksum formats a checksum as 8 hex digits
+func formatChecksum(checksum uint32) string {
+	return fmt.Sprintf("%08x", checksum)
+}
+
+// dataChecksum computes the checksum of the data read from `r` until EOF.
+// It returns the checksum and the size of the data along with any error.
+func dataChecksum(r io.Reader) (string, int64, error) {
+	h := crc32.New(castagnoli)
+	n, err := io.Copy(h, r)
+	return formatChecksum(h.Sum32()), n, err
+}
+
+// readChecksum reads the checksum field of a record following its header, if any, along with the record separator.
+// It returns the checksum, whether the record has one and the length of the field along with any error.
+func readChecksum(r *bufio.Reader) (uint32, bool, int64, error) {
+	sep, err := r.ReadByte()
+	if err == nil && sep == separator {
+		return 0, false, 0, nil
+	}
+	if err != nil {
+		return 0, false, 0, fmt.Errorf("error parsing object record: %w", truncatedRecordError(err))
+	}
+	if sep != ' ' {
+		return 0, false, 0, errors.New("error parsing object record: missing separator")
+	}
+
+	field := make([]byte, checksumSize)
+	if _, err = io.ReadFull(r, field); err != nil {
+		return 0, false, 0, fmt.Errorf("error reading record checksum: %w", truncatedRecordError(err))
+	}
+	if field[checksumSize-1] != separator {
+		return 0, false, 0, errors.New("error parsing object record: missing separator")
+	}
+	checksum, err := strconv.ParseUint(string(field[:checksumSize-1]), 16, 32)
+	if err != nil {
+		return 0, false, 0, fmt.Errorf("error parsing record checksum: %v", err)
+	}
+
+	return uint32(checksum), true, checksumSize, nil
+}
+
+// verifyRecord reads back the record of the object `objId` described by `objMeta` from the bucket file,
+// verifying its checksum and that it is the expected record. The caller must hold the bucket lock.
+func verifyRecord(bucketMeta *bucketMetadata, objId string, objMeta *objectMetadata) error {
+	bf, err := os.Open(bucketMeta.filePath)
+	if err != nil {
+		return err
+	}
+	defer bf.Close()
+
+	r := bufio.NewReader(io.NewSectionReader(bf, objMeta.offset, objMeta.recordSize()))
+	recordObjId, recordMeta, err := readRecord(r)
+	if err != nil {
+		return fmt.Errorf("%w: record of object %s at offset %d: %v", rest.ErrCorruptedObject, objId, objMeta.offset, err)
+	}
+	if recordObjId != objId || recordMeta.size != objMeta.size || recordMeta.info.ETag != objMeta.info.ETag {
+		return fmt.Errorf("%w: record of object %s at offset %d does not match", rest.ErrCorruptedObject, objId, objMeta.offset)
+	}
+	return nil
+}
+
+// verifyBlobSize verifies that the size of the blob matches the size of the object in its record
+func verifyBlobSize(blob *os.File, objId string, objMeta *objectMetadata) error {
+	fi, err := blob.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() != objMeta.size {
+		return fmt.Errorf("%w: data of object %s has size %d instead of %d", rest.ErrCorruptedObject, objId, fi.Size(), objMeta.size)
+	}
+	return nil
+}
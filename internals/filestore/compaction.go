@@ -0,0 +1,143 @@
+package filestore
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+)
+
+// defaultCompactionRatio is the default fraction of a bucket file taken by garbage records above which it is compacted
+const defaultCompactionRatio = 0.5
+
+// defaultCompactionMinGarbage is the default minimum size of the garbage records in a bucket file to compact it
+const defaultCompactionMinGarbage = 1 << 20 // 1MiB
+
+// Records of replaced and deleted object versions, along with the tombstones, are garbage left in the bucket files.
+// FileStore keeps track of the garbage size of each bucket and, when it exceeds both the minimum size and the ratio
+// in the Options, it requests the compactor goroutine to compact the bucket.
+// Compacting a bucket rewrites its file to a temporary file with only the valid records, which then replaces the
+// bucket file. The bucket lock is held in the meantime, but records hold no object data so it takes a time
+// proportional to the number of objects in the bucket, not to their size.
+// Compaction requests are dropped if the compactor is too busy: the bucket is requested again by its next change.
+
+// checkCompaction requests the compaction of the bucket `bucketId` if its garbage exceeds the thresholds.
+// The caller must hold the bucket lock.
+func (f *FileStore) checkCompaction(bucketId string, bucketMeta *bucketMetadata) {
+	if bucketMeta.compactionPending || bucketMeta.garbage < f.opts.CompactionMinGarbage ||
+		float64(bucketMeta.garbage) < f.opts.CompactionRatio*float64(bucketMeta.size) {
+		return
+	}
+	select {
+	case f.compactions <- bucketId:
+		bucketMeta.compactionPending = true
+	default:
+	}
+}
+
+// compactor compacts the requested buckets until the store is closed
+func (f *FileStore) compactor() {
+	defer f.workers.Done()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case bucketId := <-f.compactions:
+			if err := f.compact(bucketId); err != nil {
+				f.logger.WithField("bucket", bucketId).Errorf("Cannot compact bucket file: %v", err)
+			}
+		}
+	}
+}
+
+// compact rewrites the file of bucket `bucketId` with only the records of the current object versions.
+// The records of each object are written from its oldest version, so they are loaded back in the same order.
+// The compacted file is written in the current format version, upgrading the bucket files of older versions.
+func (f *FileStore) compact(bucketId string) error {
+	f.mu.RLock()
+
+	bucketMeta, ok := f.buckets[bucketId]
+	if !ok {
+		// Bucket emptied in the meantime
+		f.mu.RUnlock()
+		return nil
+	}
+
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.Lock()
+	defer bucketMu.Unlock()
+
+	f.mu.RUnlock()
+
+	bucketMeta.compactionPending = false
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		return err
+	}
+	if bucketMeta.garbage == 0 && bucketMeta.version == formatVersion {
+		return nil
+	}
+
+	// temporary bucket file to write the compacted bucket to
+	tmpFile, err := ioutil.TempFile(f.storePath, bucketId+"_*.tmp")
+	if err != nil {
+		return err
+	}
+	// delete tmp file if anything goes wrong
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	// Offsets and record sizes are updated only once the compacted file replaced the bucket file
+	type location struct{ offset, metaSize int64 }
+	locations := make(map[*objectMetadata]location)
+	w := bufio.NewWriter(tmpFile)
+	header := fileHeader()
+	if _, err = w.Write(header); err != nil {
+		return err
+	}
+	offset := int64(len(header))
+	for objId, current := range bucketMeta.objects {
+		var versions []*objectMetadata
+		for objMeta := current; objMeta != nil; objMeta = objMeta.older {
+			versions = append(versions, objMeta)
+		}
+		for i := len(versions) - 1; i >= 0; i-- {
+			// Legacy records get their checksum, so their size may change
+			record, metaSize, err := encodeRecord(versions[i].size, objId, versions[i].info)
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(record); err != nil {
+				return err
+			}
+			locations[versions[i]] = location{offset, metaSize}
+			offset += int64(len(record))
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if f.wal != nil {
+		// The bucket file is synced only at checkpoints, so its replacement must be durable before renaming it
+		if err = tmpFile.Sync(); err != nil {
+			return err
+		}
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile.Name(), bucketMeta.filePath); err != nil {
+		return err
+	}
+
+	for objMeta, loc := range locations {
+		objMeta.offset, objMeta.metaSize = loc.offset, loc.metaSize
+	}
+	f.logger.WithField("bucket", bucketId).Debugf("Compacted bucket file from %d to %d bytes", bucketMeta.size, offset)
+	bucketMeta.version = formatVersion
+	bucketMeta.indexed = false
+	bucketMeta.size = offset
+	bucketMeta.garbage = 0
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package filestore
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+)
+
+// objectMetaOverhead is the estimated size in bytes of the metadata of an object version in memory,
+// its strings excluded
+const objectMetaOverhead = 200
+
+// FileStore holds the metadata of the buckets in memory, and with a metadata budget in the Options it keeps only the
+// metadata of the most recently used buckets within the budget: the metadata of the other buckets is evicted from
+// memory, saving their index file (see index.go), and it is loaded back from the index file when the bucket is used.
+// Evicted buckets only keep the summary needed to list the buckets without loading them.
+//
+// The memory taken by the metadata is estimated from the number of object versions and the size of their strings.
+// When a bucket is used, its estimate is updated and, if the total exceeds the budget, the evictor goroutine is
+// requested to evict the least recently used buckets. The budget is then a soft limit: it is exceeded until the evictor
+// catches up, and the most recently used bucket is never evicted even if it exceeds the budget alone.
+//
+// At startup, buckets start evicted if the store catalog can be used (see catalog.go). Otherwise buckets are loaded one
+// at a time to count the references to the blobs: the buckets exceeding the budget are evicted right after loading them.
+
+// metadataCache tracks the memory taken by the buckets with their metadata loaded, in least recently used order
+type metadataCache struct {
+	mu      sync.Mutex
+	budget  int64                             // Memory budget in bytes, no limit if 0
+	used    int64                             // Estimated memory in bytes taken by the loaded buckets
+	lru     *list.List                        // Loaded buckets, from the least recently used one
+	entries map[*bucketMetadata]*list.Element // Elements of the loaded buckets in lru
+}
+
+// cacheEntry is a loaded bucket in a metadataCache
+type cacheEntry struct {
+	bucketId   string
+	bucketMeta *bucketMetadata
+	memSize    int64 // Estimated memory taken by the bucket metadata when last used
+}
+
+// newMetadataCache creates a metadataCache with the given budget, no limit if 0
+func newMetadataCache(budget int64) *metadataCache {
+	return &metadataCache{
+		budget:  budget,
+		lru:     list.New(),
+		entries: make(map[*bucketMetadata]*list.Element),
+	}
+}
+
+// touch marks bucket `bucketId` as the most recently used one, updating the memory it takes.
+// It returns whether the memory used exceeds the budget. The caller must hold the bucket lock.
+func (c *metadataCache) touch(bucketId string, bucketMeta *bucketMetadata) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[bucketMeta]; ok {
+		entry := e.Value.(*cacheEntry)
+		c.used += bucketMeta.memSize - entry.memSize
+		entry.memSize = bucketMeta.memSize
+		c.lru.MoveToBack(e)
+	} else {
+		c.entries[bucketMeta] = c.lru.PushBack(&cacheEntry{bucketId: bucketId, bucketMeta: bucketMeta, memSize: bucketMeta.memSize})
+		c.used += bucketMeta.memSize
+	}
+	return c.budget > 0 && c.used > c.budget
+}
+
+// remove stops tracking the bucket, once evicted or removed
+func (c *metadataCache) remove(bucketMeta *bucketMetadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[bucketMeta]; ok {
+		c.used -= e.Value.(*cacheEntry).memSize
+		c.lru.Remove(e)
+		delete(c.entries, bucketMeta)
+	}
+}
+
+// victim returns the least recently used bucket to evict, if the memory used exceeds the budget
+func (c *metadataCache) victim() (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.budget == 0 || c.used <= c.budget || c.lru.Len() <= 1 {
+		return nil, false
+	}
+	return c.lru.Front().Value.(*cacheEntry), true
+}
+
+// useBucket loads the metadata of bucket `bucketId`, if evicted, and marks it as used. With the Quarantine option,
+// the bucket is requested to be moved to quarantine if its metadata cannot be loaded.
+// The caller must hold the bucket lock, for reading or writing.
+func (f *FileStore) useBucket(bucketId string, bucketMeta *bucketMetadata) error {
+	if err := bucketMeta.load(); err != nil {
+		if f.opts.Quarantine {
+			select {
+			case f.quarantines <- bucketId:
+			default:
+				// Quarantiner too busy, the bucket is requested again by its next use
+			}
+		}
+		return err
+	}
+	if f.cache.touch(bucketId, bucketMeta) {
+		select {
+		case f.evictions <- struct{}{}:
+		default:
+			// Eviction already requested
+		}
+	}
+	return nil
+}
+
+// evictor evicts the least recently used buckets when requested until the store is closed
+func (f *FileStore) evictor() {
+	defer f.workers.Done()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-f.evictions:
+			for {
+				entry, ok := f.cache.victim()
+				if !ok {
+					break
+				}
+				f.evictBucket(entry.bucketId, entry.bucketMeta)
+			}
+		}
+	}
+}
+
+// evictBucket evicts the metadata of bucket `bucketId` from memory, saving its index file
+func (f *FileStore) evictBucket(bucketId string, bucketMeta *bucketMetadata) {
+	defer f.cache.remove(bucketMeta)
+
+	f.mu.RLock()
+	if f.buckets[bucketId] != bucketMeta {
+		// Bucket emptied in the meantime
+		f.mu.RUnlock()
+		return
+	}
+
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.Lock()
+	defer bucketMu.Unlock()
+
+	f.mu.RUnlock()
+
+	logger := f.logger.WithField("bucket", bucketId)
+	if err := saveIndex(bucketId, bucketMeta); err != nil {
+		logger.Warnf("Cannot save bucket index before evicting it: %v", err)
+	}
+	logger.Debugf("Evicted bucket metadata of %d bytes", bucketMeta.memSize)
+	bucketMeta.evict()
+}
+
+// load loads the metadata of the bucket from its index or bucket file, if evicted.
+// The caller must hold the bucket lock, for reading or writing.
+func (b *bucketMetadata) load() error {
+	b.loadMu.Lock()
+	defer b.loadMu.Unlock()
+
+	if b.objects != nil {
+		return nil
+	}
+	loaded, err := loadBucketFile(b.filePath)
+	if err != nil {
+		return fmt.Errorf("error loading bucket file %s: %w", b.filePath, err)
+	}
+	b.objects = loaded.objects
+	b.memSize = loaded.memSize
+	b.indexed = loaded.indexed
+	return nil
+}
+
+// evict drops the objects metadata of the bucket from memory, keeping its summary.
+// The caller must hold the bucket lock.
+func (b *bucketMetadata) evict() {
+	b.numObjects, b.dataSize, _ = b.summary()
+	b.objects = nil
+	b.memSize = 0
+}
+
+// summary returns the number of objects in the bucket, previous versions and delete markers excluded,
+// and their total size in bytes, previous versions included, and whether the bucket is empty, evicted buckets never
+// being empty. The caller must hold the bucket lock, for reading or writing: the load mutex is taken since the bucket
+// may be loaded meanwhile by another reader.
+func (b *bucketMetadata) summary() (int, int64, bool) {
+	b.loadMu.Lock()
+	defer b.loadMu.Unlock()
+
+	if b.objects == nil {
+		return b.numObjects, b.dataSize, false
+	}
+
+	var numObjects int
+	var dataSize int64
+	for _, current := range b.objects {
+		if !current.info.DeleteMarker {
+			numObjects++
+		}
+		for objMeta := current; objMeta != nil; objMeta = objMeta.older {
+			dataSize += objMeta.size
+		}
+	}
+	return numObjects, dataSize, len(b.objects) == 0
+}
+
+// memSize returns the estimated size in bytes of the metadata of the version of the object `objId` in memory
+func (m *objectMetadata) memSize(objId string) int64 {
+	size := objectMetaOverhead + len(objId) + len(m.info.ETag) + len(m.info.Checksum) + len(m.info.ContentType) +
+		len(m.info.VersionId)
+	for k, v := range m.info.Metadata {
+		size += len(k) + len(v)
+	}
+	return int64(size)
+}
@@ -2,63 +2,151 @@ package filestore
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"hash/crc32"
 	"hash/fnv"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 const numMutexes = 100
 const separator = byte('\n')
 
+// maxInfoSize is the maximum size of the object information in an object record
+const maxInfoSize = 1 << 20 // 1MiB
+
+// versioningFileExt is the extension of the empty files marking the buckets with versioning enabled
+const versioningFileExt = ".versioning"
+
+// now returns the current time, it is a variable to be replaced in tests
+var now = time.Now
+
+// newVersionId returns a new version ID, it is a variable to be replaced in tests
+var newVersionId = rest.NewVersionId
+
 // FileStore implements ObjectStore and stores objects in files on disk.
-// It uses one file per bucket named <bucketId>.dat and in each file it stores data with the following format:
-// <objId> <obj len in bytes> <obj data>\n
+// It uses one file per bucket named <bucketId>.dat, starting with a header holding its format version (see format.go),
+// and in each file it stores a record per object with the following format:
+// <objId> <obj len in bytes> <info len in bytes> <info> <checksum>\n
+// where info is the JSON encoded objectInfo of the object (ETag, modification time, content type and user metadata)
+// and checksum protects the record (see checksum.go).
+// The object data is stored in blob files shared by all the objects with the same data (see blobs.go).
+//
+// Bucket files are append-only logs: storing an object appends its record, and deleting it appends a tombstone record
+// (with no data) removing the object version with the same version ID. A record replaces the one of the same object
+// version written before, so the last record of each object version is the valid one.
+// In buckets with versioning enabled (marked by a <bucketId>.versioning file) each store appends a new version, so the
+// last record of an object is its current version. Deleting an object appends a delete marker record, with no data.
+// Because of this Store and deletion times only depend on the size of the object, not on the size of the bucket.
+// Replaced and removed records are left in the bucket file as garbage, until the bucket file is compacted in
+// background (see compaction.go).
+//
+// Writes are made durable by a write-ahead log, according to the durability mode in the Options (see wal.go).
+// The metadata of the buckets is saved to index files when closing the store, to load it faster (see index.go), and
+// the summaries of the buckets to a catalog file, to load each bucket only when used (see catalog.go).
+//
 // In order to retrieve data faster, FileStore holds some metadata about buckets and objects in memory.
-// In particular, it retains each object offset in its bucket file and its size in bytes.
+// In particular, it retains each object record offset in its bucket file, its size in bytes and its information.
+// The retrieving time is bucket size independent because of the metadata stored in maps in memory.
 //
 // To allow concurrent access to multiple buckets, it is used an array of `numMutexes` mutexes. Instead of having
 // a mutex per bucket, these mutexes are in a fixed number to avoid:
 // 1. to have too many mutexes which can use a lot of memory and decrease performances
 // 2. to have maximum 2*numMutexes open files at the same time and avoid errors related to too many open files
-//
-// Every change to a bucket file is performed in three steps
-// 1. copy old data to a temporary file writing new data if needed (like add or replace and object)
-// 2. move the temp file and overwrite the actual bucket file
-// 3. update bucket's objects metadata if needed
-// This mitigates the possibility of data corruption or mismatch between data on file and metadata in memory
-// Because of this Store and deletion times depend on the size of the bucket (the whole bucket is copied).
-// The retrieving time is bucket size independent because of the metadata stored in maps in memory.
 type FileStore struct {
-	storePath string
-	mu        sync.RWMutex               // Global mutex to handle concurrent access to buckets metadata map
-	buckets   map[string]*bucketMetadata // Map to store each bucket metadata
-	bucketsMu [numMutexes]sync.RWMutex   // Array of numMutexes mutexes to handle concurrent access to each bucket
+	storePath   string
+	opts        Options                    // Options of the store, defaults applied
+	logger      log.FieldLogger            // Logger of the background operations
+	mu          sync.RWMutex               // Global mutex to handle concurrent access to buckets metadata map
+	buckets     map[string]*bucketMetadata // Map to store each bucket metadata
+	versioned   map[string]bool            // Buckets with versioning enabled, guarded by the global mutex
+	bucketsMu   [numMutexes]sync.RWMutex   // Array of numMutexes mutexes to handle concurrent access to each bucket
+	blobsMu     sync.Mutex                 // Mutex to handle concurrent access to the blobs, taken after the others
+	blobRefs    map[string]int             // Number of records referring to each blob by ETag
+	wal         *writeAheadLog             // Write-ahead log, nil if durability is DurabilityNone
+	compactions chan string                // Buckets to be compacted by the compactor
+	checkpoints chan struct{}              // Requests to checkpoint the write-ahead log
+	quit        chan struct{}              // Closed when the store is closed to stop the background workers
+	closeOnce   sync.Once                  // Closes quit once
+	cache       *metadataCache             // Buckets with their metadata loaded in memory (see eviction.go)
+	evictions   chan struct{}              // Requests to evict the least recently used buckets
+	quarantines chan string                // Buckets to be moved to quarantine by the quarantiner
+	workers     sync.WaitGroup             // Background workers, compactor, checkpointer, evictor and quarantiner
+}
+
+// Options holds the options of a FileStore
+type Options struct {
+	// CompactionRatio is the fraction of a bucket file taken by garbage records above which the bucket file is
+	// compacted. If 0, defaultCompactionRatio is used.
+	CompactionRatio float64
+	// CompactionMinGarbage is the minimum size in bytes of the garbage records in a bucket file for it to be compacted.
+	// If 0, defaultCompactionMinGarbage is used.
+	CompactionMinGarbage int64
+	// Durability is the durability mode of the writes. If empty, DurabilityNone is used.
+	Durability Durability
+	// CheckpointSize is the size in bytes of the write-ahead log above which it is checkpointed.
+	// If 0, defaultCheckpointSize is used.
+	CheckpointSize int64
+	// MetadataBudget is the memory in bytes available to the metadata of the buckets: the metadata of the least recently
+	// used buckets is evicted from memory to stay within the budget (see eviction.go). If 0, there is no limit.
+	MetadataBudget int64
+	// Quarantine moves the bucket files which cannot be loaded to quarantine, at startup loading the other buckets
+	// instead of failing, and later removing the buckets whose evicted metadata cannot be loaded back (see quarantine.go)
+	Quarantine bool
+	// Logger logs the background operations of the store, nothing is logged if nil
+	Logger log.FieldLogger
 }
 
 type bucketMetadata struct {
-	filePath   string
-	muIndex    uint32                     // Index of the mutex in the bucketsMu
-	lastObject *objectMetadata            // Last object in the buckets file
-	objects    map[string]*objectMetadata // Map to store each object metadata
+	filePath          string
+	muIndex           uint32                     // Index of the mutex in the bucketsMu
+	version           int                        // Format version of the bucket file
+	size              int64                      // Size in bytes of the bucket file
+	garbage           int64                      // Size in bytes of the replaced and removed records in the bucket file
+	compactionPending bool                       // Whether the bucket is waiting to be compacted
+	indexed           bool                       // Whether the index file matches the bucket file (see index.go)
+	loadMu            sync.Mutex                 // Mutex to load the evicted objects metadata holding the bucket read lock
+	objects           map[string]*objectMetadata // Map to store each object current version metadata, nil if evicted
+	memSize           int64                      // Estimated size in bytes of the objects metadata in memory
+	numObjects        int                        // Number of objects in the bucket when evicted
+	dataSize          int64                      // Total size in bytes of the objects in the bucket when evicted
 }
 
 type objectMetadata struct {
-	offset   int64           // Offset in bytes of the object within the bucket file
+	offset   int64           // Offset in bytes of the object record within the bucket file
 	size     int64           // Size in bytes of the object
-	metaSize int64           // Size of the object metadata (<objId> <obj size>)
-	prev     *objectMetadata // Previous object in the bucket file
-	next     *objectMetadata // Following object in the bucket file
+	metaSize int64           // Size of the object record header (<objId> <obj size> <info size> <info> <checksum>)
+	info     objectInfo      // Information about the object
+	older    *objectMetadata // Previous version of the object
 }
 
-func NewStore(storePath string) (*FileStore, error) {
+// objectInfo holds the information about an object stored in its record header
+type objectInfo struct {
+	ETag         string            `json:"etag"`                    // Hex encoded SHA-256 hash of the object data
+	Modified     time.Time         `json:"modified"`                // Time of the last change to the object
+	Checksum     string            `json:"crc32c,omitempty"`        // Hex encoded CRC-32C checksum of the object data
+	ContentType  string            `json:"content_type,omitempty"`  // Media type of the object
+	Metadata     map[string]string `json:"metadata,omitempty"`      // User-defined metadata of the object
+	VersionId    string            `json:"version_id,omitempty"`    // ID of the object version, if versioned
+	DeleteMarker bool              `json:"delete_marker,omitempty"` // Whether the record marks the object as deleted
+	Removed      bool              `json:"removed,omitempty"`       // Whether the record removes the object version
+}
+
+func NewStore(storePath string, opts Options) (*FileStore, error) {
 	storePath = filepath.Clean(storePath)
 	// Check store folder
 	if _, err := os.Stat(storePath); err != nil {
@@ -68,45 +156,207 @@ func NewStore(storePath string) (*FileStore, error) {
 		return nil, errors.New("cannot access store folder: " + err.Error())
 	}
 
-	// Load metadata of existing buckets
-	buckets, err := loadDataFromDisk(storePath)
+	if opts.Durability == "" {
+		opts.Durability = DurabilityNone
+	} else if _, err := ParseDurability(string(opts.Durability)); err != nil {
+		return nil, err
+	}
+	if opts.CompactionRatio == 0 {
+		opts.CompactionRatio = defaultCompactionRatio
+	}
+	if opts.CompactionMinGarbage == 0 {
+		opts.CompactionMinGarbage = defaultCompactionMinGarbage
+	}
+	if opts.CheckpointSize == 0 {
+		opts.CheckpointSize = defaultCheckpointSize
+	}
+	logger := opts.Logger
+	if logger == nil {
+		discard := log.New()
+		discard.SetOutput(ioutil.Discard)
+		logger = discard
+	}
+
+	// Apply the writes left in the write-ahead log by a crash
+	replayed, err := replayWAL(storePath)
+	if err != nil {
+		return nil, errors.New("cannot replay write-ahead log: " + err.Error())
+	}
+	if replayed > 0 {
+		logger.Infof("Replayed %d records from the write-ahead log", replayed)
+	}
+
+	// Load the buckets evicted, with the references to the blobs, from the catalog saved when the store was closed.
+	// Otherwise load metadata of existing buckets, counting the references to the blobs and evicting the buckets over
+	// budget.
+	cache := newMetadataCache(opts.MetadataBudget)
+	buckets, blobRefs, err := loadCatalog(storePath)
+	fromCatalog := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		logger.Warnf("Cannot use the store catalog, loading all the buckets: %v", err)
+	}
+	if !fromCatalog {
+		blobRefs = make(map[string]int)
+		var newQuarantined []rest.QuarantinedBucket
+		buckets, newQuarantined, err = loadDataFromDisk(storePath, opts.Quarantine, logger, func(bucketId string, bucketMeta *bucketMetadata) {
+			countBlobRefs(blobRefs, bucketMeta)
+			if cache.touch(bucketId, bucketMeta) {
+				if err := saveIndex(bucketId, bucketMeta); err != nil {
+					logger.WithField("bucket", bucketId).Warnf("Cannot save bucket index before evicting it: %v", err)
+				}
+				cache.remove(bucketMeta)
+				bucketMeta.evict()
+			}
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, qBucket := range newQuarantined {
+			logger.WithField("bucket", qBucket.Id).Errorf("Moved corrupt bucket file to quarantine in %s: %s", qBucket.Path, qBucket.Reason)
+		}
+	}
+	quarantined, err := loadQuarantined(storePath)
+	if err != nil {
+		return nil, err
+	}
+	if len(quarantined) > 0 {
+		logger.Warnf("%d bucket files in quarantine, unreferenced blobs are kept", len(quarantined))
+	}
+	versioned, err := loadVersionedBuckets(storePath)
 	if err != nil {
 		return nil, err
 	}
+	// The references in the catalog are the ones left when the store was closed, with no unreferenced blob
+	if len(quarantined) == 0 && !fromCatalog {
+		if err = removeUnreferencedBlobs(storePath, blobRefs); err != nil {
+			return nil, err
+		}
+	}
+
+	var wal *writeAheadLog
+	if opts.Durability != DurabilityNone {
+		if wal, err = openWAL(storePath); err != nil {
+			return nil, errors.New("cannot open write-ahead log: " + err.Error())
+		}
+	}
+
 	store := FileStore{
-		storePath: storePath,
-		buckets:   buckets,
+		storePath:   storePath,
+		opts:        opts,
+		logger:      logger,
+		buckets:     buckets,
+		versioned:   versioned,
+		blobRefs:    blobRefs,
+		wal:         wal,
+		compactions: make(chan string, numMutexes),
+		checkpoints: make(chan struct{}, 1),
+		cache:       cache,
+		evictions:   make(chan struct{}, 1),
+		quarantines: make(chan string, numMutexes),
+		quit:        make(chan struct{}),
+	}
+	store.workers.Add(3)
+	go store.compactor()
+	go store.evictor()
+	go store.quarantiner()
+	if wal != nil {
+		store.workers.Add(1)
+		go store.checkpointer()
+	}
+	// Compact the buckets left with too much garbage
+	for bucketId, bucketMeta := range buckets {
+		store.checkCompaction(bucketId, bucketMeta)
 	}
 	return &store, nil
 }
 
-// Store stores the given object with ID `objId` in bucket `bucketId`.
-// Returns whether the object has been replaced along with any error encountered.
+// Close stops the background compaction, waiting for the running one to complete, saves the index files of the buckets,
+// checkpoints the write-ahead log and saves the catalog of the buckets (see catalog.go).
+// The store must not be used after closing it.
+func (f *FileStore) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.quit)
+	})
+	f.workers.Wait()
+	f.saveIndexes()
+
+	var err error
+	if f.wal != nil {
+		err = f.checkpoint()
+		if closeErr := f.wal.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err == nil {
+		if err := f.saveCatalog(); err != nil {
+			f.logger.Warnf("Cannot save store catalog: %v", err)
+		}
+	}
+	return err
+}
+
+// Store stores the object read from `r` with ID `objId` in bucket `bucketId`.
+// Returns the stored object information and whether the object has been replaced along with any error encountered.
 // If `bucketId` is a new bucket it gets created.
-func (f *FileStore) Store(obj []byte, objId, bucketId string) (bool, error) {
+// The preconditions in `opts` are checked holding the bucket lock, so no other change can happen in the meantime.
+// The object record is appended to the bucket file: if versioning is enabled on the bucket it is a new version,
+// otherwise it replaces the record of the object.
+//
+// Since the object size and hash are needed before writing the object record, the object is first copied to a
+// temporary file. This is done before locking the bucket, so slow clients do not block other bucket operations.
+// The temporary file then becomes the object blob, unless a blob with the same data already exists.
+// If the first store into a new bucket fails, the bucket is removed, as if it had never been created.
+func (f *FileStore) Store(r io.Reader, objId, bucketId string, opts rest.StoreOptions) (rest.ObjectInfo, bool, error) {
+	info, replaced, err := f.store(r, objId, bucketId, opts)
+	if err != nil {
+		f.removeEmptyBucket(bucketId)
+	}
+	return info, replaced, err
+}
+
+// store stores the object read from `r` with ID `objId` in bucket `bucketId`, see Store
+func (f *FileStore) store(r io.Reader, objId, bucketId string, opts rest.StoreOptions) (rest.ObjectInfo, bool, error) {
+	obj, objSize, etag, checksum, err := f.spoolObject(r, bucketId)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(obj)
+
 	f.mu.Lock()
 
+	versioned := f.versioned[bucketId]
 	bucketMeta, bucketOk := f.buckets[bucketId]
 	if !bucketOk {
+		// Check preconditions before creating the bucket
+		if err := opts.CheckPreconditions("", false); err != nil {
+			f.mu.Unlock()
+			return rest.ObjectInfo{}, false, err
+		}
+
 		// New bucket, create its metadata
 		muIndex, err := bucketIdToMutexIndex(bucketId)
 		if err != nil {
 			f.mu.Unlock()
-			return false, err
+			return rest.ObjectInfo{}, false, err
 		}
 		bucketFilePath := path.Join(f.storePath, bucketId+".dat")
+		header := fileHeader()
 		bucketMeta = &bucketMetadata{
 			filePath: bucketFilePath,
 			muIndex:  muIndex,
+			version:  formatVersion,
+			size:     int64(len(header)),
 			objects:  make(map[string]*objectMetadata),
 		}
-		f.buckets[bucketId] = bucketMeta
-		// and create new empty bucket file
-		bf, err := os.OpenFile(bucketFilePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			return false, err
+		// and create new bucket file with just the header
+		if err = ioutil.WriteFile(bucketFilePath, header, 0644); err != nil {
+			f.mu.Unlock()
+			return rest.ObjectInfo{}, false, err
 		}
-		_ = bf.Close()
+		f.buckets[bucketId] = bucketMeta
 	}
 
 	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
@@ -114,85 +364,72 @@ func (f *FileStore) Store(obj []byte, objId, bucketId string) (bool, error) {
 	f.mu.Unlock()
 	defer bucketMu.Unlock()
 
-	// temporary bucket file to write changes to
-	tmpFile, err := ioutil.TempFile(f.storePath, bucketId+"_*.tmp")
-	if err != nil {
-		return false, err
+	if err = f.useBucket(bucketId, bucketMeta); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	current, objOk := bucketMeta.objects[objId]
+	found := objOk && !current.info.DeleteMarker
+	var oldETag string
+	if found {
+		oldETag = current.info.ETag
+	}
+	if err = opts.CheckPreconditions(oldETag, found); err != nil {
+		return rest.ObjectInfo{}, false, err
 	}
-	// delete tmp file if anything goes wrong
-	defer func(f *os.File) {
-		_ = f.Close()
-		_ = os.Remove(f.Name())
-	}(tmpFile)
 
-	var newObjMetaSize int64
-	var newObjSize int64
-	objMeta, objOk := bucketMeta.objects[objId]
-	if !objOk {
-		// New object, append it to the temp file
-		if bucketOk {
-			// Copy bucket data to temp file
-			bf, err := os.Open(bucketMeta.filePath)
-			if err != nil {
-				return false, err
-			}
-			_, err = io.Copy(tmpFile, bf)
-			_ = bf.Close()
-			if err != nil {
-				return false, err
-			}
+	// Store the object data before the record referring to it
+	if err = f.putBlob(obj, etag); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	stored := false
+	defer func() {
+		// A record left in a failed write-ahead log is applied on restart, so its blob must be kept
+		if !stored && !f.wal.failed() {
+			f.releaseBlob(etag)
 		}
+	}()
 
-		objMeta = &objectMetadata{
-			prev: bucketMeta.lastObject,
-		}
-		if objMeta.offset, objMeta.metaSize, objMeta.size, err = appendObjectToBucketFile(obj, objId, tmpFile, -1); err != nil {
-			return false, err
-		}
-	} else {
-		newObjMetaSize, newObjSize, err = replaceObjectInBucketFile(obj, objId, objMeta, bucketMeta.filePath, tmpFile)
-		if err != nil {
-			return false, err
-		}
+	info := objectInfo{
+		ETag:        etag,
+		Checksum:    checksum,
+		Modified:    now().UTC(),
+		ContentType: opts.ContentType,
+		Metadata:    opts.Metadata,
 	}
-
-	_ = tmpFile.Close()
-	if err = os.Rename(tmpFile.Name(), bucketMeta.filePath); err != nil {
-		return false, err
+	if versioned {
+		info.VersionId = newVersionId()
 	}
-
-	// Store ok, update metadata
-	if objOk && newObjSize != objMeta.size {
-		// Object has been replaced, need to update other objects metadata
-		offsetShift := newObjMetaSize + newObjSize - objMeta.metaSize - objMeta.size
-		for nextObj := objMeta.next; nextObj != nil; nextObj = nextObj.next {
-			nextObj.offset += offsetShift
-		}
-		objMeta.metaSize = newObjMetaSize
-		objMeta.size = newObjSize
+	objMeta, err := f.appendRecord(bucketId, bucketMeta, objSize, objId, info)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
 	}
-	// Else new object has the same size of the old one, no need to update metadata
+	stored = true
 
-	if !objOk {
-		bucketMeta.objects[objId] = objMeta
-		if bucketMeta.lastObject != nil {
-			bucketMeta.lastObject.next = objMeta
-		}
-		bucketMeta.lastObject = objMeta
+	// The current version is kept, delete marker included, unless it has the same version ID
+	if replaced := bucketMeta.addVersion(objId, objMeta); replaced != nil {
+		bucketMeta.garbage += replaced.recordSize()
+		f.releaseObjectBlob(replaced)
 	}
+	f.checkCompaction(bucketId, bucketMeta)
 
-	return objOk, nil
+	return objMeta.objectInfo(objId), found, nil
 }
 
-// Retrieve retrieves the object `objId` in bucket `bucketId`.
-// It returns the object in bytes (or nil if it was not found), whether it has been found or not, along with any error.
-func (f *FileStore) Retrieve(objId, bucketId string) ([]byte, bool, error) {
+// Retrieve retrieves the version `versionId` of the object `objId` in bucket `bucketId`, the current one if empty.
+// It returns a reader of the object (or nil if it was not found), its information and whether it has been found or not,
+// along with any error.
+// The reader holds the object blob file open: since blobs are never modified,
+// it keeps reading the retrieved object even if the bucket is changed in the meantime.
+// The object record and the size of the data are verified before returning the reader: if they are corrupted,
+// an error wrapping rest.ErrCorruptedObject is returned. The data is verified by the reader while it is read, so
+// that retrieving an object only reads its blob once, and range requests only the requested bytes.
+func (f *FileStore) Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, rest.ObjectInfo, bool, error) {
 	f.mu.RLock()
 
 	bucketMeta, ok := f.buckets[bucketId]
 	if !ok {
 		f.mu.RUnlock()
-		return nil, false, nil
+		return nil, rest.ObjectInfo{}, false, nil
 	}
 
 	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
@@ -201,30 +438,68 @@ func (f *FileStore) Retrieve(objId, bucketId string) ([]byte, bool, error) {
 
 	f.mu.RUnlock()
 
-	objMeta, ok := bucketMeta.objects[objId]
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		return nil, rest.ObjectInfo{}, false, err
+	}
+	objMeta, ok := bucketMeta.getObject(objId, versionId)
 	if !ok {
-		return nil, false, nil
+		return nil, rest.ObjectInfo{}, false, nil
 	}
 
-	bf, err := os.Open(bucketMeta.filePath)
-	if err != nil {
-		return nil, false, err
+	if err := verifyRecord(bucketMeta, objId, objMeta); err != nil {
+		return nil, rest.ObjectInfo{}, false, err
 	}
-	defer bf.Close()
 
-	obj := make([]byte, objMeta.size)
-	_, err = bf.ReadAt(obj, objMeta.offset+objMeta.metaSize+1)
+	// The blob is opened holding the bucket lock, so it cannot be deleted before
+	blob, err := os.Open(f.blobPath(objMeta.info.ETag))
 	if err != nil {
-		return nil, false, errors.New("error reading object from bucket file: " + err.Error())
+		if os.IsNotExist(err) {
+			err = fmt.Errorf("%w: data of object %s is missing", rest.ErrCorruptedObject, objId)
+		}
+		return nil, rest.ObjectInfo{}, false, err
+	}
+	if err = verifyBlobSize(blob, objId, objMeta); err != nil {
+		_ = blob.Close()
+		return nil, rest.ObjectInfo{}, false, err
 	}
 
-	return obj, true, nil
+	return rest.NewChecksumReader(blob, blob, objId, objMeta.size, objMeta.info.Checksum), objMeta.objectInfo(objId), true, nil
 }
 
-// Delete deletes the object `objId` in bucket `bucketId`. If the bucket is emptied it removes both the bucket file
-// and metadata from the bucket metadata map.
+// Stat returns the information about the version `versionId` of the object `objId` in bucket `bucketId`,
+// the current one if empty, and whether it has been found or not, along with any error.
+func (f *FileStore) Stat(objId, bucketId, versionId string) (rest.ObjectInfo, bool, error) {
+	f.mu.RLock()
+
+	bucketMeta, ok := f.buckets[bucketId]
+	if !ok {
+		f.mu.RUnlock()
+		return rest.ObjectInfo{}, false, nil
+	}
+
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.RLock()
+	defer bucketMu.RUnlock()
+
+	f.mu.RUnlock()
+
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	objMeta, ok := bucketMeta.getObject(objId, versionId)
+	if !ok {
+		return rest.ObjectInfo{}, false, nil
+	}
+
+	return objMeta.objectInfo(objId), true, nil
+}
+
+// Delete deletes the version `versionId` of the object `objId` in bucket `bucketId`. If `versionId` is empty
+// it deletes the current version or, if versioning is enabled on the bucket, it appends a delete marker.
+// A deleted version is removed by appending a tombstone record to the bucket file.
+// If the bucket is emptied it removes both the bucket file and metadata from the bucket metadata map.
 // It returns whether the object has been deleted or not along with any error.
-func (f *FileStore) Delete(objId, bucketId string) (bool, error) {
+func (f *FileStore) Delete(objId, bucketId, versionId string) (bool, error) {
 	f.mu.Lock()
 
 	bucketMeta, bucketOk := f.buckets[bucketId]
@@ -236,235 +511,650 @@ func (f *FileStore) Delete(objId, bucketId string) (bool, error) {
 	bucketMu.Lock()
 	defer bucketMu.Unlock()
 
-	objMeta, objOk := bucketMeta.objects[objId]
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		f.mu.Unlock()
+		return false, err
+	}
+	current, objOk := bucketMeta.objects[objId]
 	if !objOk {
 		f.mu.Unlock()
 		return false, nil
 	}
 
-	// if bucket will be emptied remove its metadata and file
-	if len(bucketMeta.objects) == 1 {
-		if err := os.Remove(bucketMeta.filePath); err == nil {
-			delete(f.buckets, bucketId)
+	if versionId == "" {
+		if f.versioned[bucketId] {
+			f.mu.Unlock()
+			if current.info.DeleteMarker {
+				return false, nil
+			}
+
+			// Mark the object as deleted keeping its versions
+			info := objectInfo{Modified: now().UTC(), VersionId: newVersionId(), DeleteMarker: true}
+			marker, err := f.appendRecord(bucketId, bucketMeta, 0, objId, info)
+			if err != nil {
+				return false, err
+			}
+			if replaced := bucketMeta.addVersion(objId, marker); replaced != nil {
+				bucketMeta.garbage += replaced.recordSize()
+				f.releaseObjectBlob(replaced)
+			}
+			f.checkCompaction(bucketId, bucketMeta)
+			return true, nil
 		}
+		versionId = rest.NullVersionId
+	}
+
+	objMeta, ok := bucketMeta.getVersion(objId, versionId)
+	if !ok {
 		f.mu.Unlock()
+		return false, nil
+	}
+
+	info := objectInfo{Modified: now().UTC(), VersionId: objMeta.info.VersionId, Removed: true}
+
+	// if bucket will be emptied remove its metadata and file
+	if len(bucketMeta.objects) == 1 && objMeta == current && objMeta.older == nil {
+		defer f.mu.Unlock()
+
+		// The tombstone is only written to the write-ahead log, to remove the object if the log is replayed
+		record, _, err := encodeRecord(0, objId, info)
+		if err != nil {
+			return false, err
+		}
+		err = f.writeRecord(bucketId, record, func() error {
+			if err := os.Remove(indexPath(bucketMeta.filePath)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			return os.Remove(bucketMeta.filePath)
+		})
+		if err != nil {
+			return false, err
+		}
+		delete(f.buckets, bucketId)
+		delete(bucketMeta.objects, objId)
+		f.cache.remove(bucketMeta)
+		f.releaseObjectBlob(objMeta)
 		return true, nil
 	}
 
 	f.mu.Unlock()
 
-	// temporary bucket file to write changes to
-	tmpFile, err := ioutil.TempFile("", bucketId+"_*.dat")
+	tombstone, err := f.appendRecord(bucketId, bucketMeta, 0, objId, info)
 	if err != nil {
 		return false, err
 	}
-	// delete tmp file if anything goes wrong
-	defer func(f *os.File) {
-		_ = f.Close()
-		_ = os.Remove(f.Name())
-	}(tmpFile)
+	bucketMeta.removeVersion(objId, objMeta.info.VersionId)
+	// Both the removed record and the tombstone are garbage now
+	bucketMeta.garbage += objMeta.recordSize() + tombstone.recordSize()
+	f.releaseObjectBlob(objMeta)
+	f.checkCompaction(bucketId, bucketMeta)
+
+	return true, nil
+}
+
+// Versions returns the information about all the versions of the object `objId` in bucket `bucketId`, from the
+// current one, whether the object has been found or not, along with any error.
+func (f *FileStore) Versions(objId, bucketId string) ([]rest.ObjectInfo, bool, error) {
+	f.mu.RLock()
+
+	bucketMeta, ok := f.buckets[bucketId]
+	if !ok {
+		f.mu.RUnlock()
+		return nil, false, nil
+	}
+
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.RLock()
+	defer bucketMu.RUnlock()
+
+	f.mu.RUnlock()
+
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		return nil, false, err
+	}
+	current, ok := bucketMeta.objects[objId]
+	if !ok {
+		return nil, false, nil
+	}
+
+	var versions []rest.ObjectInfo
+	for objMeta := current; objMeta != nil; objMeta = objMeta.older {
+		versions = append(versions, objMeta.objectInfo(objId))
+	}
 
-	_, _, err = replaceObjectInBucketFile(nil, objId, objMeta, bucketMeta.filePath, tmpFile)
+	return versions, true, nil
+}
+
+// EnableVersioning enables versioning on bucket `bucketId` creating its versioning file
+func (f *FileStore) EnableVersioning(bucketId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.versioned[bucketId] {
+		return nil
+	}
+	vf, err := os.OpenFile(path.Join(f.storePath, bucketId+versioningFileExt), os.O_RDWR|os.O_CREATE, 0644)
 	if err != nil {
-		return false, err
+		return err
 	}
+	if err = vf.Close(); err != nil {
+		return err
+	}
+	if f.wal != nil {
+		if err = syncFile(f.storePath); err != nil {
+			return err
+		}
+	}
+	f.versioned[bucketId] = true
 
-	// move the tmp file to the actual bucket file
-	_ = tmpFile.Close()
-	if err = os.Rename(tmpFile.Name(), bucketMeta.filePath); err != nil {
-		return false, err
+	return nil
+}
+
+// List lists the objects in bucket `bucketId` matching the given options, sorted by object ID.
+// It returns the listed objects, whether the bucket has been found or not, along with any error.
+// Objects are listed from the metadata in memory, bucket files are not accessed unless the bucket has been evicted.
+func (f *FileStore) List(bucketId string, opts rest.ListOptions) ([]rest.ObjectInfo, bool, error) {
+	f.mu.RLock()
+
+	bucketMeta, ok := f.buckets[bucketId]
+	if !ok {
+		f.mu.RUnlock()
+		return nil, false, nil
+	}
+
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.RLock()
+	defer bucketMu.RUnlock()
+
+	f.mu.RUnlock()
+
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		return nil, false, err
+	}
+	var objects []rest.ObjectInfo
+	for objId, objMeta := range bucketMeta.objects {
+		if !objMeta.info.DeleteMarker && strings.HasPrefix(objId, opts.Prefix) && objId > opts.StartAfter {
+			objects = append(objects, objMeta.objectInfo(objId))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Id < objects[j].Id
+	})
+	if opts.Limit > 0 && len(objects) > opts.Limit {
+		objects = objects[:opts.Limit]
 	}
 
-	delete(bucketMeta.objects, objId)
-	if objMeta.prev != nil {
-		objMeta.prev.next = objMeta.next
+	return objects, true, nil
+}
+
+// Buckets returns the information about all the buckets in the store sorted by bucket ID along with any error.
+// It only reads the metadata in memory, using the summary of the evicted buckets.
+func (f *FileStore) Buckets() ([]rest.BucketInfo, error) {
+	f.mu.RLock()
+	bucketsMeta := make(map[string]*bucketMetadata, len(f.buckets))
+	versioned := make(map[string]bool, len(f.buckets))
+	for bucketId, bucketMeta := range f.buckets {
+		bucketsMeta[bucketId] = bucketMeta
+		versioned[bucketId] = f.versioned[bucketId]
 	}
+	f.mu.RUnlock()
 
-	if objMeta.next == nil {
-		bucketMeta.lastObject = objMeta.prev
-	} else {
-		objMeta.next.prev = objMeta.prev
-		// update metadata
-		removedBytes := objMeta.metaSize + objMeta.size + 2
-		for nextObj := objMeta.next; nextObj != nil; nextObj = nextObj.next {
-			nextObj.offset -= removedBytes
+	buckets := make([]rest.BucketInfo, 0, len(bucketsMeta))
+	for bucketId, bucketMeta := range bucketsMeta {
+		bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+		bucketMu.RLock()
+		bucketInfo := rest.BucketInfo{Id: bucketId, Versioning: versioned[bucketId]}
+		var empty bool
+		bucketInfo.Objects, bucketInfo.Size, empty = bucketMeta.summary()
+		bucketMu.RUnlock()
+
+		// Skip buckets emptied in the meantime
+		if !empty {
+			buckets = append(buckets, bucketInfo)
 		}
 	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Id < buckets[j].Id
+	})
 
-	return true, nil
+	return buckets, nil
 }
 
-// appendObjectToBucketFile appends the object `obj` to the end of the file `file`.
-// If `offset` parameter is < 0 calculate and return the new object offset.
-// Returns the actual object offset and its metadata and object length along with any error.
-func appendObjectToBucketFile(obj []byte, objId string, file *os.File, offset int64) (int64, int64, int64, error) {
-	if offset < 0 {
-		f, err := file.Stat()
+// removeEmptyBucket removes bucket `bucketId`, with its file, if it has no objects
+func (f *FileStore) removeEmptyBucket(bucketId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucketMeta, ok := f.buckets[bucketId]
+	if !ok {
+		return
+	}
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.Lock()
+	defer bucketMu.Unlock()
+
+	// Evicted buckets are never empty
+	if bucketMeta.objects == nil || len(bucketMeta.objects) > 0 {
+		return
+	}
+	if err := os.Remove(bucketMeta.filePath); err != nil && !os.IsNotExist(err) {
+		f.logger.WithField("bucket", bucketId).Warnf("Cannot remove empty bucket file: %v", err)
+		return
+	}
+	_ = os.Remove(indexPath(bucketMeta.filePath))
+	delete(f.buckets, bucketId)
+	f.cache.remove(bucketMeta)
+}
+
+// appendRecord appends the record of the object of `objSize` bytes to the file of bucket `bucketId` with a single
+// write, after writing it to the write-ahead log. It returns the metadata of the appended record along with any error.
+// The caller must hold the bucket lock and add the record to the versions of the object.
+func (f *FileStore) appendRecord(bucketId string, bucketMeta *bucketMetadata, objSize int64, objId string, info objectInfo) (*objectMetadata, error) {
+	record, metaSize, err := encodeRecord(objSize, objId, info)
+	if err != nil {
+		return nil, err
+	}
+
+	bucketMeta.indexed = false
+	err = f.writeRecord(bucketId, record, func() error {
+		bf, err := os.OpenFile(bucketMeta.filePath, os.O_WRONLY|os.O_APPEND, 0644)
 		if err != nil {
-			return 0, 0, 0, err
+			return err
 		}
-		offset = f.Size()
-	}
-	metaStr := fmt.Sprintf("%s %d ", objId, len(obj))
-	if _, err := file.Write([]byte(metaStr)); err != nil {
-		return 0, 0, 0, err
+		_, err = bf.Write(record)
+		if closeErr := bf.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			// Drop any partially written record
+			_ = os.Truncate(bucketMeta.filePath, bucketMeta.size)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
-	if _, err := file.Write(obj); err != nil {
-		return 0, 0, 0, err
+
+	objMeta := &objectMetadata{
+		offset:   bucketMeta.size,
+		size:     objSize,
+		metaSize: metaSize,
+		info:     info,
 	}
-	if _, err := file.Write([]byte{separator}); err != nil {
-		return 0, 0, 0, err
+	bucketMeta.size += int64(len(record))
+
+	return objMeta, nil
+}
+
+// encodeRecord encodes the record of the object of `objSize` bytes, separator included.
+// Returns the record and its header length along with any error.
+func encodeRecord(objSize int64, objId string, info objectInfo) ([]byte, int64, error) {
+	infoBytes, err := json.Marshal(info)
+	if err != nil {
+		return nil, 0, err
 	}
+	metaStr := fmt.Sprintf("%s %d %d %s", objId, objSize, len(infoBytes), infoBytes)
+	metaStr += " " + formatChecksum(crc32.Checksum([]byte(metaStr), castagnoli))
 
-	return offset, int64(len(metaStr) - 1), int64(len(obj)), nil
+	return append([]byte(metaStr), separator), int64(len(metaStr)), nil
 }
 
-// replaceObjectInBucketFile replaces an object `obj` in the position defined by the `objMeta`
-// by copying data from original bucket file `bf` to temporary file `tf`.
-// If the new object is nil, this function deletes the object at the position defined by the `objMeta`.
-// Returns the new metadata and object length along with any error encountered in the process.
-func replaceObjectInBucketFile(obj []byte, objId string, objMeta *objectMetadata, bfName string, file *os.File) (int64, int64, error) {
-	bf, err := os.Open(bfName)
+// spoolObject copies the object read from `r` to a temporary file in the store folder.
+// It returns the temporary file, positioned at its beginning, the object size, its ETag and its checksum along with
+// any error.
+// The caller is in charge of closing and removing the returned file.
+func (f *FileStore) spoolObject(r io.Reader, bucketId string) (*os.File, int64, string, string, error) {
+	tmpFile, err := ioutil.TempFile(f.storePath, bucketId+"_*.tmp")
 	if err != nil {
-		return 0, 0, err
+		return nil, 0, "", "", err
 	}
-	defer bf.Close()
 
-	// copy old bucket file content up to the object to be replaced to tmp file
-	firstHalf := objMeta.offset
-	if _, err = io.CopyN(file, bf, firstHalf); err != nil {
-		return 0, 0, err
+	h := sha256.New()
+	c := crc32.New(castagnoli)
+	size, err := io.Copy(io.MultiWriter(tmpFile, h, c), r)
+	if err == nil && f.wal != nil {
+		// The object data must be durable before its record
+		err = tmpFile.Sync()
+	}
+	if err == nil {
+		_, err = tmpFile.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		_ = tmpFile.Close()
+		_ = os.Remove(tmpFile.Name())
+		return nil, 0, "", "", err
 	}
 
-	newObjSize := int64(len(obj))
-	var newMetaSize int64
-	if obj != nil {
-		if newObjSize != objMeta.size {
-			// Insert new object
-			if _, newMetaSize, _, err = appendObjectToBucketFile(obj, objId, file, objMeta.offset); err != nil {
-				return 0, 0, err
-			}
-		} else {
-			// Just copy the old metadata and replace the object
-			if _, err = io.CopyN(file, bf, objMeta.metaSize+1); err != nil {
-				return 0, 0, err
-			}
-			_, err = file.Write(obj)
-			if err != nil {
-				return 0, 0, err
-			}
-			_, err = file.Write([]byte{separator})
-			if err != nil {
-				return 0, 0, err
-			}
-		}
+	return tmpFile, size, hex.EncodeToString(h.Sum(nil)), formatChecksum(c.Sum32()), nil
+}
+
+// releaseObjectBlob releases the blob of the object record described by `objMeta`, if any
+func (f *FileStore) releaseObjectBlob(objMeta *objectMetadata) {
+	if !objMeta.info.DeleteMarker {
+		f.releaseBlob(objMeta.info.ETag)
 	}
+}
 
-	// copy the remaining objects if any
-	offset := objMeta.offset + objMeta.metaSize + objMeta.size + 2
-	if offset > 0 {
-		if _, err = bf.Seek(offset, 0); err != nil {
-			return 0, 0, err
-		}
+// getObject returns the metadata of the version `versionId` of the object `objId`, the current one if empty,
+// and whether it has been found. Delete markers are never returned.
+// The caller must hold the bucket lock.
+func (b *bucketMetadata) getObject(objId, versionId string) (*objectMetadata, bool) {
+	objMeta, ok := b.getVersion(objId, versionId)
+	if !ok || objMeta.info.DeleteMarker {
+		return nil, false
+	}
+	return objMeta, true
+}
+
+// getVersion returns the metadata of the version `versionId` of the object `objId`, the current one if empty,
+// and whether it has been found. Unlike getObject, it returns delete markers too.
+// The caller must hold the bucket lock.
+func (b *bucketMetadata) getVersion(objId, versionId string) (*objectMetadata, bool) {
+	objMeta, ok := b.objects[objId]
+	for ok && versionId != "" && !rest.VersionMatches(objMeta.info.VersionId, versionId) {
+		objMeta = objMeta.older
+		ok = objMeta != nil
 	}
-	if _, err = io.Copy(file, bf); err != nil {
-		return 0, 0, err
+	return objMeta, ok
+}
+
+// addVersion makes `objMeta` the current version of the object `objId`, replacing the version with the same ID if any.
+// It returns the metadata of the replaced version, or nil.
+func (b *bucketMetadata) addVersion(objId string, objMeta *objectMetadata) *objectMetadata {
+	replaced := b.removeVersion(objId, objMeta.info.VersionId)
+	objMeta.older = b.objects[objId]
+	b.objects[objId] = objMeta
+	b.memSize += objMeta.memSize(objId)
+	return replaced
+}
+
+// removeVersion removes the version of the object `objId` with ID exactly `versionId` from the versions of the object.
+// It returns the metadata of the removed version, or nil if not found.
+func (b *bucketMetadata) removeVersion(objId, versionId string) *objectMetadata {
+	var newer *objectMetadata
+	for objMeta := b.objects[objId]; objMeta != nil; newer, objMeta = objMeta, objMeta.older {
+		if objMeta.info.VersionId != versionId {
+			continue
+		}
+		if newer != nil {
+			newer.older = objMeta.older
+		} else if objMeta.older != nil {
+			b.objects[objId] = objMeta.older
+		} else {
+			delete(b.objects, objId)
+		}
+		objMeta.older = nil
+		b.memSize -= objMeta.memSize(objId)
+		return objMeta
 	}
+	return nil
+}
 
-	return newMetaSize, newObjSize, nil
+// recordSize returns the size in bytes of the object record in the bucket file
+func (m *objectMetadata) recordSize() int64 {
+	return m.metaSize + 1 // add newline size
 }
 
-// loadDataFromDisk calculates buckets metadata from files in the given store path
-func loadDataFromDisk(storePath string) (map[string]*bucketMetadata, error) {
+// objectInfo returns the information about the object `objId` described by the metadata
+func (m *objectMetadata) objectInfo(objId string) rest.ObjectInfo {
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         m.size,
+		ETag:         m.info.ETag,
+		LastModified: m.info.Modified,
+		ContentType:  m.info.ContentType,
+		Metadata:     m.info.Metadata,
+		VersionId:    m.info.VersionId,
+		DeleteMarker: m.info.DeleteMarker,
+	}
+}
+
+// loadDataFromDisk calculates buckets metadata from files in the given store path, calling `loaded` with each bucket
+// once loaded. Bucket files in the inline format are converted to the current format version before loading them,
+// logging it to `logger`. If `quarantine` is true, the bucket files which cannot be loaded are moved to quarantine
+// rather than failing. It returns the buckets metadata and the buckets moved to quarantine along with any error.
+func loadDataFromDisk(storePath string, quarantine bool, logger log.FieldLogger, loaded func(bucketId string, bucketMeta *bucketMetadata)) (map[string]*bucketMetadata, []rest.QuarantinedBucket, error) {
 	bucketFiles, err := filepath.Glob(path.Join(storePath, "*.dat"))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	buckets := make(map[string]*bucketMetadata)
+	var quarantined []rest.QuarantinedBucket
 	for _, bfPath := range bucketFiles {
 		fileNameParts := strings.Split(path.Base(filepath.ToSlash(bfPath)), ".")
 		bucketId := strings.Join(fileNameParts[:len(fileNameParts)-1], ".")
 		muIndex, err := bucketIdToMutexIndex(bucketId)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
-		bf, err := os.Open(bfPath)
+		converted, err := convertInlineBucketFile(storePath, bfPath)
 		if err != nil {
-			return nil, errors.New("error opening bucket file: " + err.Error())
+			err = fmt.Errorf("cannot convert bucket file from the inline format: %w", err)
+		} else if converted {
+			logger.WithField("bucket", bucketId).Info("Converted bucket file from the inline format, moving the object data to blobs")
+		}
+		var bucketMeta *bucketMetadata
+		if err == nil {
+			bucketMeta, err = loadBucketFile(bfPath)
 		}
-		objectsMeta, lastObject, err := getObjectsMetadata(bf)
-		_ = bf.Close()
 		if err != nil {
-			return nil, err
+			err = fmt.Errorf("error loading bucket file %s: %w", bfPath, err)
+			if !quarantine {
+				return nil, nil, err
+			}
+			qBucket, qErr := quarantineBucketFile(storePath, bucketId, bfPath, err)
+			if qErr != nil {
+				return nil, nil, fmt.Errorf("cannot quarantine bucket file %s: %v", bfPath, qErr)
+			}
+			quarantined = append(quarantined, qBucket)
+			continue
 		}
 
-		if len(objectsMeta) > 0 {
-			buckets[bucketId] = &bucketMetadata{
-				filePath:   bfPath,
-				muIndex:    muIndex,
-				objects:    objectsMeta,
-				lastObject: lastObject,
+		if len(bucketMeta.objects) > 0 {
+			bucketMeta.filePath = bfPath
+			bucketMeta.muIndex = muIndex
+			buckets[bucketId] = bucketMeta
+			if loaded != nil {
+				loaded(bucketId, bucketMeta)
 			}
 		} else {
 			// remove empty bucket file
 			_ = os.Remove(bfPath)
 		}
 	}
-	return buckets, nil
+	if err = removeOrphanIndexes(storePath); err != nil {
+		return nil, nil, err
+	}
+	return buckets, quarantined, nil
 }
 
-// getObjectsMetadata calculates objects metadata of a bucket file starting from the given offset
-func getObjectsMetadata(bf *os.File) (map[string]*objectMetadata, *objectMetadata, error) {
-	objectsMeta := make(map[string]*objectMetadata)
+// loadBucketFile loads the metadata of the bucket file at `bfPath`, from its index file if it is up to date
+func loadBucketFile(bfPath string) (*bucketMetadata, error) {
+	bf, err := os.Open(bfPath)
+	if err != nil {
+		return nil, errors.New("error opening bucket file: " + err.Error())
+	}
+	defer bf.Close()
+
+	fi, err := bf.Stat()
+	if err != nil {
+		return nil, errors.New("error opening bucket file: " + err.Error())
+	}
+	if bucketMeta, err := loadIndex(bfPath, fi); err == nil {
+		return bucketMeta, nil
+	}
+	return getObjectsMetadata(bf)
+}
+
+// loadVersionedBuckets returns the buckets with versioning enabled, marked by versioning files in the given store path
+func loadVersionedBuckets(storePath string) (map[string]bool, error) {
+	versioningFiles, err := filepath.Glob(path.Join(storePath, "*"+versioningFileExt))
+	if err != nil {
+		return nil, err
+	}
 
-	var objOffset int64
-	var lastObjMeta *objectMetadata
+	versioned := make(map[string]bool)
+	for _, vfPath := range versioningFiles {
+		versioned[strings.TrimSuffix(filepath.Base(vfPath), versioningFileExt)] = true
+	}
+	return versioned, nil
+}
+
+// getObjectsMetadata calculates objects metadata of a bucket file replaying its records,
+// along with the size of the file and of the garbage records in it
+func getObjectsMetadata(bf io.Reader) (*bucketMetadata, error) {
+	bucketMeta := &bucketMetadata{objects: make(map[string]*objectMetadata)}
+
+	version, size, err := scanBucketFile(bf, func(objId string, objectMeta *objectMetadata) {
+		bucketMeta.applyRecord(objId, objectMeta)
+	})
+	if err != nil {
+		return nil, err
+	}
+	bucketMeta.version = version
+	bucketMeta.size = size
+
+	return bucketMeta, nil
+}
+
+// applyRecord applies the record of the object `objId` read from the bucket file, updating the garbage size.
+// It returns the metadata of the version replaced by the record, or nil.
+// Records of newer versions follow the older ones, so they must be applied in the bucket file order.
+func (b *bucketMetadata) applyRecord(objId string, objMeta *objectMetadata) *objectMetadata {
+	if objMeta.info.Removed {
+		if removed := b.removeVersion(objId, objMeta.info.VersionId); removed != nil {
+			b.garbage += removed.recordSize()
+		}
+		b.garbage += objMeta.recordSize()
+		return nil
+	}
+
+	replaced := b.addVersion(objId, objMeta)
+	if replaced != nil {
+		b.garbage += replaced.recordSize()
+	}
+	return replaced
+}
+
+// scanBucketFile reads the header and then the records of a bucket file, calling `fn` with each record and its offset.
+// It returns the format version of the file, unknownFormatVersion if the header cannot be read, and the size of the
+// file up to the end of the last valid record along with any error.
+// Bucket files in the inline format are not scanned, returning errInlineFormat: they must be converted first.
+func scanBucketFile(bf io.Reader, fn func(objId string, objMeta *objectMetadata)) (int, int64, error) {
 	r := bufio.NewReader(bf)
+	version, offset, err := readHeader(r)
+	if err != nil {
+		return version, 0, err
+	}
+	if version == inlineFormatVersion {
+		return version, 0, errInlineFormat
+	}
 	for {
-		objId, err := r.ReadString(' ')
+		objId, objMeta, err := readRecord(r)
 		if err != nil {
 			if err == io.EOF {
-				break
+				return version, offset, nil
 			}
-			return nil, nil, err
+			return version, offset, fmt.Errorf("record at offset %d: %w", offset, err)
 		}
-		objId = objId[:len(objId)-1]
+		objMeta.offset = offset
+		fn(objId, objMeta)
+		offset += objMeta.recordSize()
+	}
+}
 
-		objSizeStr, err := r.ReadString(' ')
-		if err != nil {
-			return nil, nil, err
-		}
-		objSizeStr = objSizeStr[:len(objSizeStr)-1]
+// errTruncatedRecord is wrapped by the errors reading a record truncated by the end of the file
+var errTruncatedRecord = errors.New("truncated record")
 
-		objMetaSize := int64(len(objId)+len(objSizeStr)) + 1 // add space size
+// errBadSize is wrapped by the errors reading a record with an invalid size field
+var errBadSize = errors.New("bad size")
 
-		objSize, err := strconv.ParseInt(objSizeStr, 10, 64)
-		if err != nil {
-			return nil, nil, errors.New("error parsing object size: " + err.Error())
-		}
+// readRecord reads an object record, separator included, verifying its checksum if any.
+// It returns the object ID and the metadata of the record, but its offset, along with any error.
+// It returns io.EOF only if there are no more records, a record truncated by the end of the file is reported with an
+// error wrapping errTruncatedRecord. A record not matching its checksum is reported with an error wrapping
+// rest.ErrCorruptedObject.
+func readRecord(r *bufio.Reader) (string, *objectMetadata, error) {
+	h := crc32.New(castagnoli)
 
-		if _, err = r.Discard(int(objSize + 1)); err != nil {
-			return nil, nil, err
+	objId, err := r.ReadString(' ')
+	if err != nil {
+		if err == io.EOF && objId == "" {
+			return "", nil, io.EOF
 		}
+		return "", nil, fmt.Errorf("error parsing object ID: %w", truncatedRecordError(err))
+	}
+	_, _ = h.Write([]byte(objId))
+	objMetaSize := int64(len(objId))
+	objId = objId[:len(objId)-1]
 
-		objectMeta := &objectMetadata{
-			offset:   objOffset,
-			size:     objSize,
-			metaSize: objMetaSize,
-			prev:     lastObjMeta,
-		}
-		if lastObjMeta != nil {
-			lastObjMeta.next = objectMeta
-		}
-		lastObjMeta = objectMeta
-		objectsMeta[objId] = objectMeta
+	objSize, field, err := readSizeField(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing object size: %w", err)
+	}
+	_, _ = h.Write([]byte(field))
+	objMetaSize += int64(len(field))
+
+	infoSize, field, err := readSizeField(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("error parsing object info size: %w", err)
+	}
+	if infoSize > maxInfoSize {
+		return "", nil, fmt.Errorf("%w: object info size %d exceeds maximum size", errBadSize, infoSize)
+	}
+	_, _ = h.Write([]byte(field))
+	objMetaSize += int64(len(field)) + infoSize
+
+	infoBytes := make([]byte, infoSize)
+	if _, err = io.ReadFull(r, infoBytes); err != nil {
+		return "", nil, fmt.Errorf("error reading object info: %w", truncatedRecordError(err))
+	}
+	_, _ = h.Write(infoBytes)
+
+	checksum, hasChecksum, fieldSize, err := readChecksum(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if hasChecksum && checksum != h.Sum32() {
+		return "", nil, fmt.Errorf("%w: checksum mismatch in record of object %s", rest.ErrCorruptedObject, objId)
+	}
+	objMetaSize += fieldSize
 
-		objOffset += objMetaSize + objSize + 2 // add space and newline size
+	// The info is parsed only once the checksum is verified
+	var info objectInfo
+	if err = json.Unmarshal(infoBytes, &info); err != nil {
+		return "", nil, errors.New("error parsing object info: " + err.Error())
 	}
 
-	return objectsMeta, lastObjMeta, nil
+	return objId, &objectMetadata{size: objSize, metaSize: objMetaSize, info: info}, nil
+}
+
+// readSizeField reads a space terminated size field of an object record.
+// It returns the parsed size and the field, trailing space included, along with any error.
+func readSizeField(r *bufio.Reader) (int64, string, error) {
+	field, err := r.ReadString(' ')
+	if err != nil {
+		return 0, "", truncatedRecordError(err)
+	}
+	size, err := strconv.ParseInt(field[:len(field)-1], 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("%w: %v", errBadSize, err)
+	}
+	if size < 0 {
+		return 0, "", fmt.Errorf("%w: negative size %d", errBadSize, size)
+	}
+
+	return size, field, nil
+}
+
+// truncatedRecordError returns errTruncatedRecord if `err` is caused by the end of the file, `err` otherwise
+func truncatedRecordError(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return errTruncatedRecord
+	}
+	return err
 }
 
 // bucketIdToMutexIndex calculates the index in the buckets mutexes array based on a hash of the bucket ID
@@ -1,43 +1,66 @@
 package filestore
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest/storetest"
+	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
+var testTime = time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func init() {
+	now = func() time.Time {
+		return testTime
+	}
+}
+
 type testBucket struct {
 	bucketData     string
 	bucketMetadata *bucketMetadata
+	objects        []string // Data of the bucket objects
 }
 
 var testBuckets = map[string]*testBucket{
 	"testBucket1": {
-		bucketData: "o1a 5 1stob\no2-a 12 2nd nice obj\no3.0a 7 3rd obj\n",
+		bucketData: testRecord("o1a", "1stob") + testRecord("o2-a", "2nd nice obj") + testRecord("o3.0a", "3rd obj"),
 		bucketMetadata: &bucketMetadata{
 			filePath: "testBucket1.dat",
 			muIndex:  8,
 			objects: map[string]*objectMetadata{
-				"o1a":   {offset: 0, size: 5, metaSize: 5},
-				"o2-a":  {offset: 12, size: 12, metaSize: 7},
-				"o3.0a": {offset: 33, size: 7, metaSize: 7},
+				"o1a":   {offset: 0, size: 5, metaSize: 148, info: testInfo("1stob")},
+				"o2-a":  {offset: 149, size: 12, metaSize: 150, info: testInfo("2nd nice obj")},
+				"o3.0a": {offset: 300, size: 7, metaSize: 150, info: testInfo("3rd obj")},
 			},
 		},
+		objects: []string{"1stob", "2nd nice obj", "3rd obj"},
 	},
 	"testBucket2": {
-		bucketData: "obj1b 9 1st obj b\nob02b 8 2nd ob b\no3-0bb 19 3rd obj in bucket b\n",
+		bucketData: testRecord("obj1b", "1st obj b") + testRecord("ob02b", "2nd ob b") + testRecord("o3-0bb", "3rd obj in bucket b"),
 		bucketMetadata: &bucketMetadata{
 			filePath: "testBucket2.dat",
 			muIndex:  11,
 			objects: map[string]*objectMetadata{
-				"obj1b":  {offset: 0, size: 9, metaSize: 7},
-				"ob02b":  {offset: 18, size: 8, metaSize: 7},
-				"o3-0bb": {offset: 35, size: 19, metaSize: 9},
+				"obj1b":  {offset: 0, size: 9, metaSize: 150, info: testInfo("1st obj b")},
+				"ob02b":  {offset: 151, size: 8, metaSize: 150, info: testInfo("2nd ob b")},
+				"o3-0bb": {offset: 302, size: 19, metaSize: 152, info: testInfo("3rd obj in bucket b")},
 			},
 		},
+		objects: []string{"1st obj b", "2nd ob b", "3rd obj in bucket b"},
 	},
 }
 
@@ -61,7 +84,7 @@ func TestFileStore_loadDataFromDisk(t *testing.T) {
 				defer os.Remove(bucketPath)
 			}
 
-			buckets, err := loadDataFromDisk(".")
+			buckets, _, err := loadDataFromDisk(".", false, log.New(), nil)
 			assert.NoError(t, err)
 			for bid, expBucket := range tt.buckets {
 				if !assert.Contains(t, buckets, bid) {
@@ -110,9 +133,10 @@ func TestNewFilestore(t *testing.T) {
 				writeTestBucket(bucketId)
 				bucketPath := bucketMeta.filePath
 				defer os.Remove(bucketPath)
+				defer os.RemoveAll(blobsDir)
 			}
 
-			s, err := NewStore(tt.args.storePath)
+			s, err := NewStore(tt.args.storePath, Options{})
 			if !tt.wantErr(t, err, fmt.Sprintf("NewStore(%v)", tt.args.storePath)) {
 				return
 			}
@@ -143,36 +167,40 @@ func TestFileStore_Store(t *testing.T) {
 		name:          "new bucket",
 		args:          args{obj: []byte("new obj"), objId: "o1", bucketId: "empty"},
 		wantErr:       assert.NoError,
-		bucketContent: "o1 7 new obj\n",
-		bucketObjects: map[string]*objectMetadata{"o1": {offset: 0, size: 7, metaSize: 4}},
+		bucketContent: "#OBJSTORE 2\n" + testRecord("o1", "new obj"),
+		bucketObjects: map[string]*objectMetadata{"o1": {offset: 12, size: 7, metaSize: 147, info: testInfo("new obj")}},
 	}, {
 		name:          "append to bucket",
 		args:          args{obj: []byte("new obj"), objId: "nObj", bucketId: "testBucket1"},
 		wantErr:       assert.NoError,
-		bucketContent: testBuckets["testBucket1"].bucketData + "nObj 7 new obj\n",
+		bucketContent: testBuckets["testBucket1"].bucketData + testRecord("nObj", "new obj"),
 		bucketObjects: map[string]*objectMetadata{
-			"o1a":   {offset: 0, size: 5, metaSize: 5},
-			"o2-a":  {offset: 12, size: 12, metaSize: 7},
-			"o3.0a": {offset: 33, size: 7, metaSize: 7},
-			"nObj":  {offset: 49, size: 7, metaSize: 6},
+			"o1a":   {offset: 0, size: 5, metaSize: 148, info: testInfo("1stob")},
+			"o2-a":  {offset: 149, size: 12, metaSize: 150, info: testInfo("2nd nice obj")},
+			"o3.0a": {offset: 300, size: 7, metaSize: 150, info: testInfo("3rd obj")},
+			"nObj":  {offset: 451, size: 7, metaSize: 149, info: testInfo("new obj")},
 		},
 	}, {
 		name:          "replace same size",
 		args:          args{obj: []byte("same obj"), objId: "ob02b", bucketId: "testBucket2"},
 		wantErr:       assert.NoError,
 		repl:          true,
-		bucketContent: strings.Replace(testBuckets["testBucket2"].bucketData, "2nd ob b", "same obj", 1),
-		bucketObjects: testBuckets["testBucket2"].bucketMetadata.objects,
+		bucketContent: testBuckets["testBucket2"].bucketData + testRecord("ob02b", "same obj"),
+		bucketObjects: map[string]*objectMetadata{
+			"obj1b":  {offset: 0, size: 9, metaSize: 150, info: testInfo("1st obj b")},
+			"ob02b":  {offset: 455, size: 8, metaSize: 150, info: testInfo("same obj")},
+			"o3-0bb": {offset: 302, size: 19, metaSize: 152, info: testInfo("3rd obj in bucket b")},
+		},
 	}, {
 		name:          "replace longer",
 		args:          args{obj: []byte("new long obj"), objId: "o1a", bucketId: "testBucket1"},
 		wantErr:       assert.NoError,
 		repl:          true,
-		bucketContent: strings.Replace(testBuckets["testBucket1"].bucketData, "5 1stob", "12 new long obj", 1),
+		bucketContent: testBuckets["testBucket1"].bucketData + testRecord("o1a", "new long obj"),
 		bucketObjects: map[string]*objectMetadata{
-			"o1a":   {offset: 0, size: 12, metaSize: 6},
-			"o2-a":  {offset: 20, size: 12, metaSize: 7},
-			"o3.0a": {offset: 41, size: 7, metaSize: 7},
+			"o1a":   {offset: 451, size: 12, metaSize: 149, info: testInfo("new long obj")},
+			"o2-a":  {offset: 149, size: 12, metaSize: 150, info: testInfo("2nd nice obj")},
+			"o3.0a": {offset: 300, size: 7, metaSize: 150, info: testInfo("3rd obj")},
 		},
 	}, {
 		name:          "replace shorter",
@@ -180,11 +208,11 @@ func TestFileStore_Store(t *testing.T) {
 		wantErr:       assert.NoError,
 		repl:          true,
 		bucketPath:    "testBucket2.dat",
-		bucketContent: strings.Replace(testBuckets["testBucket2"].bucketData, "8 2nd ob b", "1 o", 1),
+		bucketContent: testBuckets["testBucket2"].bucketData + testRecord("ob02b", "o"),
 		bucketObjects: map[string]*objectMetadata{
-			"obj1b":  {offset: 0, size: 9, metaSize: 7},
-			"ob02b":  {offset: 18, size: 1, metaSize: 7},
-			"o3-0bb": {offset: 28, size: 19, metaSize: 9},
+			"obj1b":  {offset: 0, size: 9, metaSize: 150, info: testInfo("1st obj b")},
+			"ob02b":  {offset: 455, size: 1, metaSize: 150, info: testInfo("o")},
+			"o3-0bb": {offset: 302, size: 19, metaSize: 152, info: testInfo("3rd obj in bucket b")},
 		},
 	}}
 
@@ -192,18 +220,20 @@ func TestFileStore_Store(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			writeTestBucket(tt.args.bucketId)
 			defer os.Remove(tt.args.bucketId + ".dat")
+			defer os.RemoveAll(blobsDir)
 
-			s, err := NewStore(".")
+			s, err := NewStore(".", Options{})
 			if !assert.NoError(t, err) {
 				return
 			}
 
-			repl, err := s.Store(tt.args.obj, tt.args.objId, tt.args.bucketId)
+			info, repl, err := s.Store(bytes.NewReader(tt.args.obj), tt.args.objId, tt.args.bucketId, rest.StoreOptions{})
 
 			if !tt.wantErr(t, err, fmt.Sprintf("Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)) {
 				return
 			}
 			assert.Equalf(t, tt.repl, repl, "Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)
+			assert.Equalf(t, testObjectInfo(tt.args.objId, string(tt.args.obj)), info, "Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)
 
 			bucketContent, err := os.ReadFile(tt.args.bucketId + ".dat")
 			if err != nil {
@@ -211,79 +241,1138 @@ func TestFileStore_Store(t *testing.T) {
 			}
 			assert.Equalf(t, tt.bucketContent, string(bucketContent), "Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)
 			assertObjsMetaEqualf(t, tt.bucketObjects, s.buckets[tt.args.bucketId].objects, "Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)
+
+			blob, err := os.ReadFile(s.blobPath(info.ETag))
+			assert.NoErrorf(t, err, "Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)
+			assert.Equalf(t, tt.args.obj, blob, "Store(%v, %v, %v)", tt.args.obj, tt.args.objId, tt.args.bucketId)
 		})
 	}
 }
 
-func TestFileStore_Retrieve(t *testing.T) {
-	type args struct {
-		objId    string
-		bucketId string
+func TestFileStore_StoreDedup(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket3.dat")
+	defer os.RemoveAll(blobsDir)
+
+	// Unreferenced blobs are deleted at startup
+	orphanPath := filepath.Join(blobsDir, "ab", "abcd")
+	_ = os.MkdirAll(filepath.Dir(orphanPath), 0755)
+	_ = os.WriteFile(orphanPath, []byte("orphan"), 0644)
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoFileExists(t, orphanPath)
+
+	// Objects with the same data share the same blob
+	etag := testInfo("1stob").ETag
+	_, _, err = s.Store(strings.NewReader("1stob"), "o1b", "testBucket3", rest.StoreOptions{})
+	assert.NoError(t, err)
+	_, _, err = s.Store(strings.NewReader("1stob"), "o2-a", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, s.blobRefs[etag])
+	assert.NotContains(t, s.blobRefs, testInfo("2nd nice obj").ETag)
+	assert.NoFileExists(t, s.blobPath(testInfo("2nd nice obj").ETag))
+	blobs, _ := filepath.Glob(filepath.Join(blobsDir, "*", "*"))
+	assert.Len(t, blobs, 2)
+
+	// and the blob is deleted with the last object referring to it
+	for _, obj := range []struct{ objId, bucketId string }{{"o1a", "testBucket1"}, {"o2-a", "testBucket1"}, {"o1b", "testBucket3"}} {
+		assert.FileExists(t, s.blobPath(etag))
+		deleted, err := s.Delete(obj.objId, obj.bucketId, "")
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+	}
+	assert.NoFileExists(t, s.blobPath(etag))
+	assert.NotContains(t, s.blobRefs, etag)
+
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, map[string]int{testInfo("3rd obj").ETag: 1}, s.blobRefs)
+}
+
+func TestFileStore_StoreReadError(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.RemoveAll(blobsDir)
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	readErr := errors.New("read error")
+	_, repl, err := s.Store(iotest.ErrReader(readErr), "o1a", "testBucket1", rest.StoreOptions{})
+	assert.ErrorIs(t, err, readErr)
+	assert.False(t, repl)
+
+	bucketContent, _ := os.ReadFile("testBucket1.dat")
+	assert.Equal(t, testBuckets["testBucket1"].bucketData, string(bucketContent))
+	assertObjsMetaEqualf(t, testBuckets["testBucket1"].bucketMetadata.objects, s.buckets["testBucket1"].objects, "")
+
+	tmpFiles, _ := filepath.Glob("*.tmp")
+	assert.Empty(t, tmpFiles)
+}
+
+func TestFileStore_StoreNewBucketError(t *testing.T) {
+	defer os.Remove(catalogFileName)
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+
+	// The blobs folder cannot be created, so storing objects fails after creating their bucket
+	assert.NoError(t, os.WriteFile(blobsDir, nil, 0644))
+	defer os.Remove(blobsDir)
+
+	_, _, err = s.Store(strings.NewReader("test obj"), "o1a", "testBucket1", rest.StoreOptions{})
+	assert.Error(t, err)
+
+	// The new bucket has been removed
+	_, ok, err := s.List("testBucket1", rest.ListOptions{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.Empty(t, buckets)
+	assert.NoFileExists(t, "testBucket1.dat")
+}
+
+func TestFileStore_Versioning(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove("testBucket1.versioning")
+	versionIds := []string{"v1", "v2"}
+	newVersionId = func() string {
+		id := versionIds[0]
+		versionIds = versionIds[1:]
+		return id
+	}
+	defer func() { newVersionId = rest.NewVersionId }()
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, s.EnableVersioning("testBucket1"))
+	info, replaced, err := s.Store(strings.NewReader("2nd obj v1"), "o2-a", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, "v1", info.VersionId)
+	deleted, err := s.Delete("o1a", "testBucket1", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+
+	// Versions are appended to the bucket file and loaded back
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.True(t, s.versioned["testBucket1"])
+	for versionId, data := range map[string]string{"": "2nd obj v1", rest.NullVersionId: "2nd nice obj"} {
+		r, _, ok, err := s.Retrieve("o2-a", "testBucket1", versionId)
+		if assert.NoError(t, err) && assert.True(t, ok, versionId) {
+			obj, _ := io.ReadAll(r)
+			_ = r.Close()
+			assert.Equal(t, data, string(obj), versionId)
+		}
+	}
+	_, ok, _ := s.Stat("o1a", "testBucket1", "")
+	assert.False(t, ok)
+	objects, _, _ := s.List("testBucket1", rest.ListOptions{})
+	assert.Len(t, objects, 2)
+	buckets, _ := s.Buckets()
+	assert.Equal(t, []rest.BucketInfo{{Id: "testBucket1", Objects: 2, Size: 34, Versioning: true}}, buckets)
+
+	versions, ok, err := s.Versions("o1a", "testBucket1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []rest.ObjectInfo{
+		{Id: "o1a", LastModified: testTime, VersionId: "v2", DeleteMarker: true},
+		testObjectInfo("o1a", "1stob"),
+	}, versions)
+
+	// Deleting the delete marker restores the previous version, deleting a version appends its tombstone
+	deleted, _ = s.Delete("o1a", "testBucket1", "v2")
+	assert.True(t, deleted)
+	deleted, _ = s.Delete("o2-a", "testBucket1", rest.NullVersionId)
+	assert.True(t, deleted)
+	deleted, _ = s.Delete("o2-a", "testBucket1", rest.NullVersionId)
+	assert.False(t, deleted)
+
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	info, ok, _ = s.Stat("o1a", "testBucket1", "")
+	assert.True(t, ok)
+	assert.Equal(t, testObjectInfo("o1a", "1stob"), info)
+	versions, _, _ = s.Versions("o2-a", "testBucket1")
+	assert.Len(t, versions, 1)
+	r, _, ok, err := s.Retrieve("o3.0a", "testBucket1", "")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		obj, _ := io.ReadAll(r)
+		_ = r.Close()
+		assert.Equal(t, "3rd obj", string(obj))
+	}
+}
+
+func TestFileStore_Compact(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+	defer os.Remove("testBucket1.versioning")
+	versionIds := []string{"v1", "v2"}
+	newVersionId = func() string {
+		id := versionIds[0]
+		versionIds = versionIds[1:]
+		return id
+	}
+	defer func() { newVersionId = rest.NewVersionId }()
+
+	s, err := NewStore(".", Options{CompactionRatio: 0.3, CompactionMinGarbage: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	bucketMeta := s.buckets["testBucket1"]
+	bucketMu := &s.bucketsMu[bucketMeta.muIndex]
+
+	// Replaced records are garbage, versions are not
+	_, _, err = s.Store(strings.NewReader("new obj"), "o3.0a", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, s.EnableVersioning("testBucket1"))
+	_, _, err = s.Store(strings.NewReader("1stob v1"), "o1a", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	_, err = s.Delete("o1a", "testBucket1", "")
+	assert.NoError(t, err)
+	bucketMu.RLock()
+	assert.Equal(t, int64(151), bucketMeta.garbage)
+	bucketMu.RUnlock()
+
+	// Removing a version leaves its record and the tombstone as garbage, triggering the compaction
+	_, err = s.Delete("o2-a", "testBucket1", rest.NullVersionId)
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		bucketMu.RLock()
+		defer bucketMu.RUnlock()
+		return bucketMeta.garbage == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// Only the valid records are left, and they are loaded back the same
+	bucketMu.RLock()
+	fi, err := os.Stat("testBucket1.dat")
+	if assert.NoError(t, err) {
+		assert.Equal(t, bucketMeta.size, fi.Size())
+	}
+	bucketMu.RUnlock()
+	versions, _, _ := s.Versions("o1a", "testBucket1")
+	s2, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s2.Close()
+	assertObjsMetaEqualf(t, bucketMeta.objects, s2.buckets["testBucket1"].objects, "")
+	assert.Equal(t, int64(0), s2.buckets["testBucket1"].garbage)
+	reloaded, _, _ := s2.Versions("o1a", "testBucket1")
+	assert.Equal(t, versions, reloaded)
+	r, _, ok, err := s2.Retrieve("o3.0a", "testBucket1", "")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		obj, _ := io.ReadAll(r)
+		_ = r.Close()
+		assert.Equal(t, "new obj", string(obj))
+	}
+}
+
+func TestFileStore_Durability(t *testing.T) {
+	for _, durability := range []Durability{DurabilityFsync, DurabilityGroupCommit} {
+		t.Run(string(durability), func(t *testing.T) {
+			writeTestBucket("testBucket1")
+			defer os.Remove("testBucket1.dat")
+			defer os.RemoveAll(blobsDir)
+			defer os.Remove(catalogFileName)
+			defer os.Remove(walFileName)
+			bucketIds := []string{"testBucket3", "testBucket4", "testBucket5"}
+			for _, bucketId := range bucketIds {
+				defer os.Remove(bucketId + ".dat")
+			}
+
+			s, err := NewStore(".", Options{Durability: durability})
+			if !assert.NoError(t, err) {
+				return
+			}
+			_, _, err = s.Store(strings.NewReader("new obj"), "o4", "testBucket1", rest.StoreOptions{})
+			assert.NoError(t, err)
+			_, err = s.Delete("o2-a", "testBucket1", "")
+			assert.NoError(t, err)
+			// Concurrent writes share the log syncs with group commit
+			var wg sync.WaitGroup
+			for i, bucketId := range bucketIds {
+				for j := 0; j < 5; j++ {
+					wg.Add(1)
+					go func(bucketId, objId string) {
+						defer wg.Done()
+						_, _, err := s.Store(strings.NewReader(objId), objId, bucketId, rest.StoreOptions{})
+						assert.NoError(t, err)
+					}(bucketId, fmt.Sprintf("o%d%d", i, j))
+				}
+			}
+			wg.Wait()
+
+			// Crash losing the bucket files changes, left with an incomplete record, and with an incomplete log entry
+			writeTestBucket("testBucket1")
+			bf, _ := os.OpenFile("testBucket1.dat", os.O_WRONLY|os.O_APPEND, 0644)
+			_, _ = bf.Write([]byte(testRecord("o4", "new obj")[:10]))
+			_ = bf.Close()
+			for _, bucketId := range bucketIds {
+				_ = os.Remove(bucketId + ".dat")
+			}
+			wf, _ := os.OpenFile(walFileName, os.O_WRONLY|os.O_APPEND, 0644)
+			_, _ = wf.Write([]byte("testBucket1 o5 3 "))
+			_ = wf.Close()
+
+			// Acknowledged writes are replayed from the log
+			s, err = NewStore(".", Options{Durability: durability})
+			if !assert.NoError(t, err) {
+				return
+			}
+			info, ok, _ := s.Stat("o4", "testBucket1", "")
+			assert.True(t, ok)
+			assert.Equal(t, testObjectInfo("o4", "new obj"), info)
+			_, ok, _ = s.Stat("o2-a", "testBucket1", "")
+			assert.False(t, ok)
+			_, ok, _ = s.Stat("o5", "testBucket1", "")
+			assert.False(t, ok)
+			for i, bucketId := range bucketIds {
+				objects, _, _ := s.List(bucketId, rest.ListOptions{})
+				assert.Len(t, objects, 5)
+				r, _, ok, err := s.Retrieve(fmt.Sprintf("o%d4", i), bucketId, "")
+				if assert.NoError(t, err) && assert.True(t, ok) {
+					obj, _ := io.ReadAll(r)
+					_ = r.Close()
+					assert.Equal(t, fmt.Sprintf("o%d4", i), string(obj))
+				}
+			}
+
+			// Closing the store checkpoints the log
+			assert.NoError(t, s.Close())
+			fi, err := os.Stat(walFileName)
+			if assert.NoError(t, err) {
+				assert.Zero(t, fi.Size())
+			}
+		})
+	}
+}
+
+func TestFileStore_ReplayCorruptedBucket(t *testing.T) {
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove(walFileName)
+	bucketData := strings.Replace(testBuckets["testBucket1"].bucketData, "o2-a", "o2-b", 1)
+	_ = os.WriteFile("testBucket1.dat", []byte(bucketData), 0644)
+	walData := "testBucket1 " + testRecord("o4", "new obj")
+	_ = os.WriteFile(walFileName, []byte(walData), 0644)
+
+	// A corrupted record in the middle of a bucket file is not truncated, keeping the records after it and the log
+	_, err := replayWAL(".")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+	bucketContent, _ := os.ReadFile("testBucket1.dat")
+	assert.Equal(t, bucketData, string(bucketContent))
+	walContent, _ := os.ReadFile(walFileName)
+	assert.Equal(t, walData, string(walContent))
+
+	// while an incomplete record at its end is
+	_ = os.WriteFile("testBucket1.dat", []byte(testBuckets["testBucket1"].bucketData+testRecord("o5", "5th obj")[:10]), 0644)
+	replayed, err := replayWAL(".")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, replayed)
+	bucketContent, _ = os.ReadFile("testBucket1.dat")
+	assert.Equal(t, testBuckets["testBucket1"].bucketData+testRecord("o4", "new obj"), string(bucketContent))
+}
+
+func TestFileStore_Checkpoint(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+	defer os.Remove(walFileName)
+
+	s, err := NewStore(".", Options{Durability: DurabilityFsync, CheckpointSize: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+
+	_, _, err = s.Store(strings.NewReader("new obj"), "o4", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+
+	// The log is emptied in background once the bucket files are synced
+	assert.Eventually(t, func() bool {
+		fi, err := os.Stat(walFileName)
+		return err == nil && fi.Size() == 0
+	}, time.Second, 10*time.Millisecond)
+	bucketContent, _ := os.ReadFile("testBucket1.dat")
+	assert.Equal(t, testBuckets["testBucket1"].bucketData+testRecord("o4", "new obj"), string(bucketContent))
+}
+
+func TestFileStore_LegacyRecords(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.RemoveAll(blobsDir)
+	_ = os.WriteFile("testBucket1.dat", []byte(testLegacyRecord("o1a", "1stob")+testLegacyRecord("o2-a", "2nd nice obj")), 0644)
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Records without checksums are read without verification, and checksummed records can follow them
+	_, _, err = s.Store(strings.NewReader("new obj"), "o4", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	for objId, data := range map[string]string{"o1a": "1stob", "o2-a": "2nd nice obj", "o4": "new obj"} {
+		r, _, ok, err := s.Retrieve(objId, "testBucket1", "")
+		if assert.NoError(t, err, objId) && assert.True(t, ok, objId) {
+			obj, _ := io.ReadAll(r)
+			_ = r.Close()
+			assert.Equal(t, data, string(obj), objId)
+		}
+	}
+}
+
+func TestFileStore_BaselineFormat(t *testing.T) {
+	storePath := copyBaselineFixture(t)
+	modified := testTime.Add(-time.Hour)
+	for _, bucketId := range []string{"bucket1", "bucket2"} {
+		assert.NoError(t, os.Chtimes(filepath.Join(storePath, bucketId+".dat"), modified, modified))
+	}
+
+	s, err := NewStore(storePath, Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	objects := map[string]map[string]string{
+		"bucket1": {"obj1": "hello", "obj2": "abc", "multi-line": "first line\nsecond line with spaces \n", "obj3": "3rd obj"},
+		"bucket2": {"obj1": "hello", "empty": ""},
+	}
+	assertObjects := func(s *FileStore) {
+		for bucketId, bucketObjects := range objects {
+			listed, ok, err := s.List(bucketId, rest.ListOptions{})
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			assert.Len(t, listed, len(bucketObjects))
+			for objId, data := range bucketObjects {
+				r, info, ok, err := s.Retrieve(objId, bucketId, "")
+				if assert.NoError(t, err, objId) && assert.True(t, ok, objId) {
+					obj, _ := io.ReadAll(r)
+					_ = r.Close()
+					assert.Equal(t, data, string(obj), objId)
+					assert.Equal(t, testInfo(data).ETag, info.ETag, objId)
+				}
+			}
+		}
+	}
+	assertObjects(s)
+	// The objects get the modification time of their bucket file
+	info, _, _ := s.Stat("obj1", "bucket1", "")
+	assert.True(t, modified.Equal(info.LastModified))
+
+	// The bucket files have been converted, moving the object data to the blobs deduplicated
+	bucketContent, _ := os.ReadFile(filepath.Join(storePath, "bucket2.dat"))
+	assert.True(t, strings.HasPrefix(string(bucketContent), string(fileHeader())))
+	assert.NotContains(t, string(bucketContent), "hello")
+	assert.Equal(t, 2, s.blobRefs[testInfo("hello").ETag])
+	tmpFiles, _ := filepath.Glob(filepath.Join(storePath, "*.tmp"))
+	assert.Empty(t, tmpFiles)
+
+	// and the store works as usual
+	_, _, err = s.Store(strings.NewReader("new obj"), "obj4", "bucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	objects["bucket1"]["obj4"] = "new obj"
+	_, err = s.Delete("obj2", "bucket1", "")
+	assert.NoError(t, err)
+	delete(objects["bucket1"], "obj2")
+	assert.NoError(t, s.Close())
+	s, err = NewStore(storePath, Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assertObjects(s)
+}
+
+func TestFileStore_Index(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket1.idx")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = s.Store(strings.NewReader("new obj"), "o4", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	_, _, err = s.Store(strings.NewReader("3rd obj v2"), "o3.0a", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	objects := s.buckets["testBucket1"].objects
+	// Closing the store saves the index
+	assert.NoError(t, s.Close())
+	assert.FileExists(t, "testBucket1.idx")
+
+	// The bucket metadata is loaded from the index when the bucket is used, without reading the bucket file
+	fi, _ := os.Stat("testBucket1.dat")
+	bucketData, _ := os.ReadFile("testBucket1.dat")
+	corrupted := append([]byte{}, bucketData...)
+	corrupted[0] = 'x'
+	_ = os.WriteFile("testBucket1.dat", corrupted, 0644)
+	_ = os.Chtimes("testBucket1.dat", fi.ModTime(), fi.ModTime())
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Nil(t, s.buckets["testBucket1"].objects)
+	assert.NoError(t, s.useBucket("testBucket1", s.buckets["testBucket1"]))
+	assertObjsMetaEqualf(t, objects, s.buckets["testBucket1"].objects, "")
+	assert.Equal(t, int64(151), s.buckets["testBucket1"].garbage)
+	assert.True(t, s.buckets["testBucket1"].indexed)
+	assert.NoError(t, s.Close())
+
+	// unless the bucket file changed since
+	_ = os.WriteFile("testBucket1.dat", append(bucketData, testRecord("o5", "5th obj")...), 0644)
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Contains(t, s.buckets["testBucket1"].objects, "o5")
+	assert.False(t, s.buckets["testBucket1"].indexed)
+
+	// Emptying the bucket removes the index
+	for _, objId := range []string{"o1a", "o2-a", "o3.0a", "o4", "o5"} {
+		_, err = s.Delete(objId, "testBucket1", "")
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, s.Close())
+	assert.NoFileExists(t, "testBucket1.idx")
+}
+
+func TestFileStore_Eviction(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.Remove("testBucket1.idx")
+	defer os.Remove("testBucket2.idx")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+
+	isEvicted := func(s *FileStore, bucketId string) bool {
+		bucketMeta := s.buckets[bucketId]
+		bucketMu := &s.bucketsMu[bucketMeta.muIndex]
+		bucketMu.RLock()
+		defer bucketMu.RUnlock()
+		return bucketMeta.objects == nil
+	}
+
+	// Buckets over budget are evicted at startup, saving their index
+	s, err := NewStore(".", Options{MetadataBudget: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.True(t, isEvicted(s, "testBucket1"))
+	assert.True(t, isEvicted(s, "testBucket2"))
+	assert.FileExists(t, "testBucket1.idx")
+	assert.FileExists(t, "testBucket2.idx")
+
+	// Evicted buckets are still listed
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []rest.BucketInfo{
+		{Id: "testBucket1", Objects: 3, Size: 24},
+		{Id: "testBucket2", Objects: 3, Size: 36},
+	}, buckets)
+
+	// Using a bucket loads it back, the most recently used bucket is kept even if over budget
+	info, ok, err := s.Stat("o2-a", "testBucket1", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, int64(12), info.Size)
+	assert.False(t, isEvicted(s, "testBucket1"))
+
+	// and the least recently used one is evicted in background
+	_, ok, err = s.Stat("ob02b", "testBucket2", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Eventually(t, func() bool {
+		return isEvicted(s, "testBucket1")
+	}, time.Second, 10*time.Millisecond)
+	assert.False(t, isEvicted(s, "testBucket2"))
+
+	_, _, err = s.Store(strings.NewReader("new obj"), "o4", "testBucket1", rest.StoreOptions{})
+	assert.NoError(t, err)
+	buckets, err = s.Buckets()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []rest.BucketInfo{
+		{Id: "testBucket1", Objects: 4, Size: 31},
+		{Id: "testBucket2", Objects: 3, Size: 36},
+	}, buckets)
+}
+
+func TestFileStore_BucketsWhileLoading(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.Remove("testBucket1.idx")
+	defer os.Remove("testBucket2.idx")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+
+	// Buckets are listed while they are loaded, using them alternately over budget
+	s, err := NewStore(".", Options{MetadataBudget: 1})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, ok, err := s.Stat("o2-a", "testBucket1", "")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+			_, ok, err = s.Stat("ob02b", "testBucket2", "")
+			assert.NoError(t, err)
+			assert.True(t, ok)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			buckets, err := s.Buckets()
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []rest.BucketInfo{
+				{Id: "testBucket1", Objects: 3, Size: 24},
+				{Id: "testBucket2", Objects: 3, Size: 36},
+			}, buckets)
+		}
+	}()
+	wg.Wait()
+}
+
+func TestFileStore_Catalog(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.Remove("testBucket1.idx")
+	defer os.Remove("testBucket2.idx")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, _, err = s.Store(strings.NewReader("1stob"), "o4", "testBucket2", rest.StoreOptions{})
+	assert.NoError(t, err)
+	blobRefs := s.blobRefs
+	assert.Equal(t, 2, blobRefs[testInfo("1stob").ETag])
+	buckets, err := s.Buckets()
+	assert.NoError(t, err)
+	// Closing the store saves the catalog
+	assert.NoError(t, s.Close())
+	assert.FileExists(t, catalogFileName)
+
+	// Buckets start evicted, with the blob references from the catalog, which is removed
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoFileExists(t, catalogFileName)
+	assert.Nil(t, s.buckets["testBucket1"].objects)
+	assert.Nil(t, s.buckets["testBucket2"].objects)
+	assert.Equal(t, blobRefs, s.blobRefs)
+	assert.Equal(t, legacyFormatVersion, s.buckets["testBucket1"].version)
+	listed, err := s.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, buckets, listed)
+
+	// and each bucket is loaded when used
+	deleted, err := s.Delete("o4", "testBucket2", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.NotNil(t, s.buckets["testBucket2"].objects)
+	assert.Nil(t, s.buckets["testBucket1"].objects)
+	assert.Equal(t, 1, s.blobRefs[testInfo("1stob").ETag])
+	assert.FileExists(t, blobFilePath(".", testInfo("1stob").ETag))
+	assert.NoError(t, s.Close())
+
+	// The catalog is not used if a bucket file changed since
+	bucketData, _ := os.ReadFile("testBucket1.dat")
+	_ = os.WriteFile("testBucket1.dat", append(bucketData, testTombstone("o1a")...), 0644)
+	s, err = NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.NotContains(t, s.buckets["testBucket1"].objects, "o1a")
+	assert.NotNil(t, s.buckets["testBucket2"].objects)
+	assert.NotContains(t, s.blobRefs, testInfo("1stob").ETag)
+	assert.NoFileExists(t, blobFilePath(".", testInfo("1stob").ETag))
+}
+
+func TestMigrate(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+	legacyData := testLegacyRecord("o1a", "1stob") + testRecord("o2-a", "2nd nice obj")
+	_ = os.WriteFile("testBucket1.dat", []byte(legacyData), 0644)
+
+	// A dry run only reports the bucket files to upgrade
+	migrations, err := Migrate(".", true)
+	assert.NoError(t, err)
+	expMigrations := []Migration{
+		{Bucket: "testBucket1", Version: legacyFormatVersion, Records: 2},
+		{Bucket: "testBucket2", Version: legacyFormatVersion, Records: 3},
+	}
+	assert.Equal(t, expMigrations, migrations)
+	bucketContent, _ := os.ReadFile("testBucket1.dat")
+	assert.Equal(t, legacyData, string(bucketContent))
+
+	// Upgraded bucket files get the header and the missing checksums
+	migrations, err = Migrate(".", false)
+	assert.NoError(t, err)
+	assert.Equal(t, expMigrations, migrations)
+	bucketContent, _ = os.ReadFile("testBucket1.dat")
+	assert.True(t, strings.HasPrefix(string(bucketContent), "#OBJSTORE 2\n"))
+	assert.Contains(t, string(bucketContent), testRecord("o1a", "1stob"))
+	assert.Contains(t, string(bucketContent), testRecord("o2-a", "2nd nice obj"))
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.Equal(t, formatVersion, s.buckets["testBucket1"].version)
+	assert.NoError(t, s.useBucket("testBucket1", s.buckets["testBucket1"]))
+	assert.Equal(t, testInfo("1stob"), s.buckets["testBucket1"].objects["o1a"].info)
+	for objId, data := range map[string]string{"o1a": "1stob", "o2-a": "2nd nice obj"} {
+		r, _, ok, err := s.Retrieve(objId, "testBucket1", "")
+		if assert.NoError(t, err, objId) && assert.True(t, ok, objId) {
+			obj, _ := io.ReadAll(r)
+			_ = r.Close()
+			assert.Equal(t, data, string(obj), objId)
+		}
+	}
+
+	// Nothing is left to upgrade
+	migrations, err = Migrate(".", false)
+	assert.NoError(t, err)
+	assert.Empty(t, migrations)
+
+	// and newer format versions are not read
+	_ = os.WriteFile("testBucket2.dat", []byte("#OBJSTORE 99\n"), 0644)
+	_, err = Migrate(".", true)
+	assert.Error(t, err)
+}
+
+func TestMigrate_BaselineFormat(t *testing.T) {
+	storePath := copyBaselineFixture(t)
+	baselineData, _ := os.ReadFile(filepath.Join(storePath, "bucket1.dat"))
+
+	// A dry run reports the bucket files in the inline format without converting them
+	migrations, err := Migrate(storePath, true)
+	assert.NoError(t, err)
+	expMigrations := []Migration{
+		{Bucket: "bucket1", Version: inlineFormatVersion, Records: 4},
+		{Bucket: "bucket2", Version: inlineFormatVersion, Records: 2},
+	}
+	assert.Equal(t, expMigrations, migrations)
+	bucketContent, _ := os.ReadFile(filepath.Join(storePath, "bucket1.dat"))
+	assert.Equal(t, baselineData, bucketContent)
+	assert.NoDirExists(t, filepath.Join(storePath, blobsDir))
+
+	// Migrating moves the object data to the blobs, with records of the current format version
+	migrations, err = Migrate(storePath, false)
+	assert.NoError(t, err)
+	assert.Equal(t, expMigrations, migrations)
+	bucketContent, _ = os.ReadFile(filepath.Join(storePath, "bucket1.dat"))
+	assert.True(t, strings.HasPrefix(string(bucketContent), string(fileHeader())))
+	assert.NotContains(t, string(bucketContent), "second line with spaces")
+	assert.FileExists(t, blobFilePath(storePath, testInfo("hello").ETag))
+
+	s, err := NewStore(storePath, Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	assert.Equal(t, formatVersion, s.buckets["bucket1"].version)
+	r, _, ok, err := s.Retrieve("multi-line", "bucket1", "")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		obj, _ := io.ReadAll(r)
+		_ = r.Close()
+		assert.Equal(t, "first line\nsecond line with spaces \n", string(obj))
+	}
+
+	// Nothing is left to upgrade
+	migrations, err = Migrate(storePath, true)
+	assert.NoError(t, err)
+	assert.Empty(t, migrations)
+}
+
+func TestCheck(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+	defer os.Remove("testBucket1_0.tmp")
+
+	// A replaced record followed by a truncated one
+	bucket1Data := testBuckets["testBucket1"].bucketData + testRecord("o1a", "1stob") + testRecord("o4", "new obj")[:10]
+	_ = os.WriteFile("testBucket1.dat", []byte(bucket1Data), 0644)
+	// a corrupted record, with the blob of the valid one missing
+	bucket2Data := []byte(testBuckets["testBucket2"].bucketData)
+	bucket2Data[151+len("ob02b 8 137 {\"etag\":\"")] = 'z'
+	_ = os.WriteFile("testBucket2.dat", bucket2Data, 0644)
+	_ = os.Remove(blobFilePath(".", testInfo("1st obj b").ETag))
+	// a blob with corrupted data
+	_ = os.WriteFile(blobFilePath(".", testInfo("2nd nice obj").ETag), []byte("2nd n1ce obj"), 0644)
+	// and a leftover temporary file
+	_ = os.WriteFile("testBucket1_0.tmp", nil, 0644)
+
+	issues := func(result *CheckResult) []Issue {
+		for i := range result.Issues {
+			result.Issues[i].Message = ""
+		}
+		return result.Issues
+	}
+	missingBlob := Issue{Kind: IssueMissingBlob, Path: blobFilePath(".", testInfo("1st obj b").ETag), Object: "obj1b"}
+	corruptedBlob := Issue{Kind: IssueCorrupted, Path: blobFilePath(".", testInfo("2nd nice obj").ETag), Offset: 149, Object: "o2-a"}
+
+	result, err := Check(".", false)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, result.Healthy())
+	assert.Equal(t, 2, result.BucketFiles)
+	assert.Equal(t, 5, result.Records)
+	assert.Equal(t, []Issue{
+		{Kind: IssueTruncated, Path: "testBucket1.dat", Offset: 600},
+		{Kind: IssueDuplicate, Path: "testBucket1.dat", Offset: -1, Object: "o1a"},
+		corruptedBlob,
+		{Kind: IssueCorrupted, Path: "testBucket2.dat", Offset: 151},
+		missingBlob,
+		{Kind: IssueTempFile, Path: "testBucket1_0.tmp", Offset: -1},
+	}, issues(result))
+	bucketContent, _ := os.ReadFile("testBucket1.dat")
+	assert.Equal(t, bucket1Data, string(bucketContent))
+
+	// Repairing truncates the bucket files at the last valid record and removes the temporary files
+	result, err = Check(".", true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, result.Healthy())
+	assert.Equal(t, []Issue{
+		{Kind: IssueTruncated, Path: "testBucket1.dat", Offset: 600, Repaired: true},
+		{Kind: IssueDuplicate, Path: "testBucket1.dat", Offset: -1, Object: "o1a"},
+		corruptedBlob,
+		{Kind: IssueCorrupted, Path: "testBucket2.dat", Offset: 151, Repaired: true},
+		missingBlob,
+		{Kind: IssueTempFile, Path: "testBucket1_0.tmp", Offset: -1, Repaired: true},
+	}, issues(result))
+	bucketContent, _ = os.ReadFile("testBucket1.dat")
+	assert.Equal(t, bucket1Data[:600], string(bucketContent))
+	assert.NoFileExists(t, "testBucket1_0.tmp")
+
+	// leaving only the issues that cannot be repaired
+	result, err = Check(".", false)
+	assert.NoError(t, err)
+	assert.Equal(t, []Issue{
+		{Kind: IssueDuplicate, Path: "testBucket1.dat", Offset: -1, Object: "o1a"},
+		corruptedBlob,
+		missingBlob,
+	}, issues(result))
+	s, err := NewStore(".", Options{})
+	if assert.NoError(t, err) {
+		_ = s.Close()
+	}
+}
+
+func TestCheck_NotTruncated(t *testing.T) {
+	storePath := copyBaselineFixture(t)
+	baselineData, _ := os.ReadFile(filepath.Join(storePath, "bucket1.dat"))
+	// A bucket file whose first record is truncated
+	truncatedData := string(fileHeader()) + testRecord("o1", "1st obj")[:10]
+	_ = os.WriteFile(filepath.Join(storePath, "bucket3.dat"), []byte(truncatedData), 0644)
+
+	// Bucket files in the inline format, or without valid records, are reported but never truncated
+	result, err := Check(storePath, true)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.False(t, result.Healthy())
+	assert.Equal(t, 3, result.BucketFiles)
+	assert.Equal(t, 0, result.Records)
+	for i := range result.Issues {
+		result.Issues[i].Message = ""
+	}
+	assert.Equal(t, []Issue{
+		{Kind: IssueFormat, Path: filepath.Join(storePath, "bucket1.dat"), Offset: -1},
+		{Kind: IssueFormat, Path: filepath.Join(storePath, "bucket2.dat"), Offset: -1},
+		{Kind: IssueTruncated, Path: filepath.Join(storePath, "bucket3.dat"), Offset: int64(len(fileHeader()))},
+	}, result.Issues)
+	bucketContent, _ := os.ReadFile(filepath.Join(storePath, "bucket1.dat"))
+	assert.Equal(t, baselineData, bucketContent)
+	bucketContent, _ = os.ReadFile(filepath.Join(storePath, "bucket3.dat"))
+	assert.Equal(t, truncatedData, string(bucketContent))
+}
+
+func TestFileStore_Corruption(t *testing.T) {
+	writeTestBucket("testBucket1")
+	defer os.Remove("testBucket1.dat")
+	defer os.RemoveAll(blobsDir)
+
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Corrupted object data is not served whole: the read fails before returning its last bytes
+	_ = os.WriteFile(s.blobPath(testInfo("1stob").ETag), []byte("1stOB"), 0644)
+	r, _, ok, err := s.Retrieve("o1a", "testBucket1", "")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		_, err = io.ReadAll(r)
+		assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+		// even after seeking back to the beginning
+		_, _ = r.Seek(0, io.SeekStart)
+		_, err = io.ReadAll(r)
+		assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+		// while the reads of ranges are not verified
+		_, _ = r.Seek(1, io.SeekStart)
+		part := make([]byte, 2)
+		_, err = io.ReadFull(r, part)
+		assert.NoError(t, err)
+		assert.Equal(t, "st", string(part))
+		_ = r.Close()
+	}
+	_ = os.WriteFile(s.blobPath(testInfo("1stob").ETag), []byte("1sto"), 0644)
+	_, _, _, err = s.Retrieve("o1a", "testBucket1", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+	_ = os.Remove(s.blobPath(testInfo("1stob").ETag))
+	_, _, _, err = s.Retrieve("o1a", "testBucket1", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+
+	// nor objects whose record is corrupted
+	bucketData := []byte(testBuckets["testBucket1"].bucketData)
+	bucketData[149+len("o2-a 1")] = '3'
+	_ = os.WriteFile("testBucket1.dat", bucketData, 0644)
+	_, _, _, err = s.Retrieve("o2-a", "testBucket1", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+	r, _, ok, err = s.Retrieve("o3.0a", "testBucket1", "")
+	if assert.NoError(t, err) && assert.True(t, ok) {
+		obj, err := io.ReadAll(r)
+		assert.NoError(t, err)
+		assert.Equal(t, "3rd obj", string(obj))
+		_ = r.Close()
+	}
+
+	// and the bucket file is not loaded
+	_, err = NewStore(".", Options{})
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+}
+
+func TestFileStore_Quarantine(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+	defer os.RemoveAll(quarantineDir)
+	bucketData := []byte(testBuckets["testBucket2"].bucketData)
+	bucketData[151+len("ob02b 8 137 {\"etag\":\"")] = 'z'
+	_ = os.WriteFile("testBucket2.dat", bucketData, 0644)
+
+	// The corrupt bucket file is moved to quarantine and the other buckets are loaded
+	s, err := NewStore(".", Options{Quarantine: true})
+	if !assert.NoError(t, err) {
+		return
 	}
+	assert.Contains(t, s.buckets, "testBucket1")
+	assert.NotContains(t, s.buckets, "testBucket2")
+	assert.NoFileExists(t, "testBucket2.dat")
+	quarantined, err := s.Quarantined()
+	if assert.NoError(t, err) && assert.Len(t, quarantined, 1) {
+		assert.Equal(t, "testBucket2", quarantined[0].Id)
+		assert.Equal(t, testTime, quarantined[0].Time)
+		assert.Contains(t, quarantined[0].Reason, "record at offset 151")
+		qData, _ := os.ReadFile(quarantined[0].Path)
+		assert.Equal(t, bucketData, qData)
+	}
+	_ = s.Close()
+
+	// and its blobs are kept, while it is in quarantine
+	s, err = NewStore(".", Options{Quarantine: true})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	quarantined, _ = s.Quarantined()
+	assert.Len(t, quarantined, 1)
+	for _, obj := range testBuckets["testBucket2"].objects {
+		assert.FileExists(t, s.blobPath(testInfo(obj).ETag))
+	}
+}
+
+func TestFileStore_QuarantineEvicted(t *testing.T) {
+	writeTestBucket("testBucket1")
+	writeTestBucket("testBucket2")
+	defer os.Remove("testBucket1.dat")
+	defer os.Remove("testBucket2.dat")
+	defer os.Remove(indexPath("testBucket1.dat"))
+	defer os.RemoveAll(blobsDir)
+	defer os.Remove(catalogFileName)
+	defer os.RemoveAll(quarantineDir)
+
+	// Closing the store saves the catalog, so the buckets start evicted
+	s, err := NewStore(".", Options{})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, s.Close())
+
+	// Corrupt the bucket file leaving the catalog valid, and drop its index so that the bucket file is read
+	fi, err := os.Stat("testBucket2.dat")
+	if !assert.NoError(t, err) {
+		return
+	}
+	bucketData := []byte(testBuckets["testBucket2"].bucketData)
+	bucketData[151+len("ob02b 8 137 {\"etag\":\"")] = 'z'
+	_ = os.WriteFile("testBucket2.dat", bucketData, 0644)
+	_ = os.Chtimes("testBucket2.dat", fi.ModTime(), fi.ModTime())
+	_ = os.Remove(indexPath("testBucket2.dat"))
+
+	s, err = NewStore(".", Options{Quarantine: true, Durability: DurabilityFsync})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer s.Close()
+	defer os.Remove(walFileName)
+	assert.Contains(t, s.buckets, "testBucket2")
+
+	// The bucket fails loading when first used, and it is moved to quarantine
+	_, _, err = s.Stat("ob02b", "testBucket2", "")
+	assert.ErrorIs(t, err, rest.ErrCorruptedObject)
+	assert.Eventually(t, func() bool {
+		quarantined, err := s.Quarantined()
+		return err == nil && len(quarantined) == 1
+	}, time.Second, 10*time.Millisecond)
+	quarantined, _ := s.Quarantined()
+	assert.Equal(t, "testBucket2", quarantined[0].Id)
+	assert.Contains(t, quarantined[0].Reason, "record at offset 151")
+	qData, _ := os.ReadFile(quarantined[0].Path)
+	assert.Equal(t, bucketData, qData)
+	assert.NoFileExists(t, "testBucket2.dat")
+
+	// leaving the bucket empty, and the other buckets available
+	_, found, err := s.Stat("ob02b", "testBucket2", "")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	buckets, err := s.Buckets()
+	if assert.NoError(t, err) && assert.Len(t, buckets, 1) {
+		assert.Equal(t, "testBucket1", buckets[0].Id)
+	}
+	for _, obj := range testBuckets["testBucket2"].objects {
+		assert.FileExists(t, s.blobPath(testInfo(obj).ETag))
+	}
+}
+
+func TestFileStore_StoreConditional(t *testing.T) {
 	tests := []struct {
-		name    string
-		args    args
-		obj     string
-		retr    bool
-		wantErr assert.ErrorAssertionFunc
+		name     string
+		objId    string
+		bucketId string
+		opts     rest.StoreOptions
+		stored   bool
 	}{{
-		name: "get first",
-		args: args{
-			objId:    "obj1b",
-			bucketId: "testBucket2",
-		},
-		obj:     "1st obj b",
-		retr:    true,
-		wantErr: assert.NoError,
+		name:     "if match",
+		objId:    "o1a",
+		bucketId: "testBucket1",
+		opts:     rest.StoreOptions{IfMatch: []string{testInfo("1stob").ETag}},
+		stored:   true,
 	}, {
-		name: "get middle",
-		args: args{
-			objId:    "ob02b",
-			bucketId: "testBucket2",
-		},
-		obj:     "2nd ob b",
-		retr:    true,
-		wantErr: assert.NoError,
+		name:     "if match changed",
+		objId:    "o1a",
+		bucketId: "testBucket1",
+		opts:     rest.StoreOptions{IfMatch: []string{testInfo("old obj").ETag}},
 	}, {
-		name: "get last",
-		args: args{
-			objId:    "o3-0bb",
-			bucketId: "testBucket2",
-		},
-		obj:     "3rd obj in bucket b",
-		retr:    true,
-		wantErr: assert.NoError,
+		name:     "if match not found",
+		objId:    "o9",
+		bucketId: "testBucket1",
+		opts:     rest.StoreOptions{IfMatch: []string{"*"}},
 	}, {
-		name: "bucket not found",
-		args: args{
-			objId:    "oo1b-",
-			bucketId: "testBucket3",
-		},
-		wantErr: assert.NoError,
+		name:     "if match new bucket",
+		objId:    "o1",
+		bucketId: "testBucket3",
+		opts:     rest.StoreOptions{IfMatch: []string{"*"}},
 	}, {
-		name: "obj not found",
-		args: args{
-			objId:    "objId",
-			bucketId: "testBucket1",
-		},
-		wantErr: assert.NoError,
+		name:     "create only",
+		objId:    "o9",
+		bucketId: "testBucket1",
+		opts:     rest.StoreOptions{IfNoneMatch: []string{"*"}},
+		stored:   true,
+	}, {
+		name:     "create only existing",
+		objId:    "o2-a",
+		bucketId: "testBucket1",
+		opts:     rest.StoreOptions{IfNoneMatch: []string{"*"}},
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			writeTestBucket(tt.args.bucketId)
-			defer os.Remove(tt.args.bucketId + ".dat")
+			writeTestBucket(tt.bucketId)
+			defer os.Remove(tt.bucketId + ".dat")
+			defer os.RemoveAll(blobsDir)
 
-			s, err := NewStore(".")
+			s, err := NewStore(".", Options{})
 			if !assert.NoError(t, err) {
 				return
 			}
 
-			obj, ok, err := s.Retrieve(tt.args.objId, tt.args.bucketId)
-			if !tt.wantErr(t, err, fmt.Sprintf("Retrieve(%v, %v)", tt.args.objId, tt.args.bucketId)) {
+			_, _, err = s.Store(strings.NewReader("test obj"), tt.objId, tt.bucketId, tt.opts)
+			if tt.stored {
+				assert.NoError(t, err)
+				assert.Contains(t, s.buckets[tt.bucketId].objects, tt.objId)
 				return
 			}
-			assert.Equalf(t, tt.obj, string(obj), "Retrieve(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Equalf(t, tt.retr, ok, "Retrieve(%v, %v)", tt.args.objId, tt.args.bucketId)
+
+			assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+			if tb, ok := testBuckets[tt.bucketId]; ok {
+				bucketContent, _ := os.ReadFile(tt.bucketId + ".dat")
+				assert.Equal(t, tb.bucketData, string(bucketContent))
+				assertObjsMetaEqualf(t, tb.bucketMetadata.objects, s.buckets[tt.bucketId].objects, "")
+			} else {
+				assert.NotContains(t, s.buckets, tt.bucketId)
+				assert.NoFileExists(t, tt.bucketId+".dat")
+			}
 		})
 	}
 }
@@ -308,50 +1397,51 @@ func TestFileStore_Delete(t *testing.T) {
 		name:          "obj not found",
 		args:          args{objId: "oo", bucketId: "testBucket1"},
 		wantErr:       assert.NoError,
-		bucketContent: "o1a 5 1stob\no2-a 12 2nd nice obj\no3.0a 7 3rd obj\n",
+		bucketContent: testBuckets["testBucket1"].bucketData,
 		bucketObjects: testBuckets["testBucket1"].bucketMetadata.objects,
 	}, {
 		name:          "remove last",
 		args:          args{objId: "o3.0a", bucketId: "testBucket1"},
 		wantErr:       assert.NoError,
 		deleted:       true,
-		bucketContent: "o1a 5 1stob\no2-a 12 2nd nice obj\n",
+		bucketContent: testBuckets["testBucket1"].bucketData + testTombstone("o3.0a"),
 		bucketObjects: map[string]*objectMetadata{
-			"o1a":  {offset: 0, size: 5, metaSize: 5},
-			"o2-a": {offset: 12, size: 12, metaSize: 7},
+			"o1a":  {offset: 0, size: 5, metaSize: 148, info: testInfo("1stob")},
+			"o2-a": {offset: 149, size: 12, metaSize: 150, info: testInfo("2nd nice obj")},
 		},
 	}, {
 		name:          "remove first",
 		args:          args{objId: "obj1b", bucketId: "testBucket2"},
 		wantErr:       assert.NoError,
 		deleted:       true,
-		bucketContent: "ob02b 8 2nd ob b\no3-0bb 19 3rd obj in bucket b\n",
+		bucketContent: testBuckets["testBucket2"].bucketData + testTombstone("obj1b"),
 		bucketObjects: map[string]*objectMetadata{
-			"ob02b":  {offset: 0, size: 8, metaSize: 7},
-			"o3-0bb": {offset: 17, size: 19, metaSize: 9},
+			"ob02b":  {offset: 151, size: 8, metaSize: 150, info: testInfo("2nd ob b")},
+			"o3-0bb": {offset: 302, size: 19, metaSize: 152, info: testInfo("3rd obj in bucket b")},
 		},
 	}, {
 		name:          "remove middle",
 		args:          args{objId: "o2-a", bucketId: "testBucket1"},
 		wantErr:       assert.NoError,
 		deleted:       true,
-		bucketContent: "o1a 5 1stob\no3.0a 7 3rd obj\n",
+		bucketContent: testBuckets["testBucket1"].bucketData + testTombstone("o2-a"),
 		bucketObjects: map[string]*objectMetadata{
-			"o1a":   {offset: 0, size: 5, metaSize: 5},
-			"o3.0a": {offset: 12, size: 7, metaSize: 7},
+			"o1a":   {offset: 0, size: 5, metaSize: 148, info: testInfo("1stob")},
+			"o3.0a": {offset: 300, size: 7, metaSize: 150, info: testInfo("3rd obj")},
 		},
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			writeTestBucket(tt.args.bucketId)
 			defer os.Remove(tt.args.bucketId + ".dat")
+			defer os.RemoveAll(blobsDir)
 
-			s, err := NewStore(".")
+			s, err := NewStore(".", Options{})
 			if !assert.NoError(t, err) {
 				return
 			}
 
-			repl, err := s.Delete(tt.args.objId, tt.args.bucketId)
+			repl, err := s.Delete(tt.args.objId, tt.args.bucketId, "")
 
 			if !tt.wantErr(t, err, fmt.Sprintf("Delete(%v, %v)", tt.args.objId, tt.args.bucketId)) {
 				return
@@ -378,12 +1468,39 @@ func TestFileStore_Delete(t *testing.T) {
 	}
 }
 
+// copyBaselineFixture copies the bucket files written by the first release of FileStore to a temporary store folder,
+// returning its path
+func copyBaselineFixture(t *testing.T) string {
+	storePath := t.TempDir()
+	fixtures, _ := filepath.Glob(filepath.Join("testdata", "baseline", "*.dat"))
+	if len(fixtures) == 0 {
+		t.Fatal("missing baseline fixtures")
+	}
+	for _, fixture := range fixtures {
+		data, err := os.ReadFile(fixture)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = os.WriteFile(filepath.Join(storePath, filepath.Base(fixture)), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return storePath
+}
+
 func writeTestBucket(bucketId string) {
 	if tb, ok := testBuckets[bucketId]; ok {
 		// write bucket file
 		f, _ := os.Create(tb.bucketMetadata.filePath)
 		_, _ = f.Write([]byte(tb.bucketData))
 		_ = f.Close()
+
+		// and the objects blobs
+		for _, obj := range tb.objects {
+			etag := testInfo(obj).ETag
+			_ = os.MkdirAll(filepath.Join(blobsDir, etag[:2]), 0755)
+			_ = os.WriteFile(filepath.Join(blobsDir, etag[:2], etag), []byte(obj), 0644)
+		}
 	}
 }
 
@@ -426,6 +1543,7 @@ func assertObjsMetaEqualf(t *testing.T, exp, osm map[string]*objectMetadata, msg
 		if assert.Containsf(t, osm, objId, msg, args...) {
 			om := osm[objId]
 			equal = equal && assert.Equalf(t, expObjMeta.offset, om.offset, msg, args...) && assert.Equalf(t, expObjMeta.metaSize, om.metaSize, msg, args...) && assert.Equalf(t, expObjMeta.size, om.size, msg, args...)
+			equal = equal && assert.Equalf(t, expObjMeta.info, om.info, msg, args...)
 		} else {
 			equal = false
 		}
@@ -433,3 +1551,54 @@ func assertObjsMetaEqualf(t *testing.T, exp, osm map[string]*objectMetadata, msg
 
 	return equal
 }
+
+// testRecord returns the bucket file record of the object `obj` stored at testTime
+func testRecord(objId, obj string) string {
+	info := fmt.Sprintf(`{"etag":"%x","modified":"2022-01-02T15:04:05Z","crc32c":"%08x"}`, sha256.Sum256([]byte(obj)), crc32.Checksum([]byte(obj), castagnoli))
+	header := fmt.Sprintf("%s %d %d %s", objId, len(obj), len(info), info)
+	return fmt.Sprintf("%s %08x\n", header, crc32.Checksum([]byte(header), castagnoli))
+}
+
+// testLegacyRecord returns the bucket file record of the object `obj` stored at testTime, without checksums
+func testLegacyRecord(objId, obj string) string {
+	info := fmt.Sprintf(`{"etag":"%x","modified":"2022-01-02T15:04:05Z"}`, sha256.Sum256([]byte(obj)))
+	return fmt.Sprintf("%s %d %d %s\n", objId, len(obj), len(info), info)
+}
+
+// testTombstone returns the bucket file record removing the object `objId` at testTime
+func testTombstone(objId string) string {
+	info := `{"etag":"","modified":"2022-01-02T15:04:05Z","removed":true}`
+	header := fmt.Sprintf("%s 0 %d %s", objId, len(info), info)
+	return fmt.Sprintf("%s %08x\n", header, crc32.Checksum([]byte(header), castagnoli))
+}
+
+// testInfo returns the information stored in the record of the object `obj` stored at testTime
+func testInfo(obj string) objectInfo {
+	etag := sha256.Sum256([]byte(obj))
+	return objectInfo{
+		ETag:     hex.EncodeToString(etag[:]),
+		Modified: testTime,
+		Checksum: fmt.Sprintf("%08x", crc32.Checksum([]byte(obj), castagnoli)),
+	}
+}
+
+// testObjectInfo returns the information about the object `obj` stored at testTime
+func testObjectInfo(objId, obj string) rest.ObjectInfo {
+	etag := sha256.Sum256([]byte(obj))
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         int64(len(obj)),
+		ETag:         hex.EncodeToString(etag[:]),
+		LastModified: testTime,
+	}
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+		s, err := NewStore(dataPath, Options{Durability: DurabilityFsync})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}, storetest.Options{Durable: true})
+}
@@ -0,0 +1,226 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Bucket files start with a header line holding a magic string and the version of their format:
+// <fileMagic> <version>\n
+// Bucket files written before the header was introduced have no header: their version is told by their first record.
+// Changes to the format must increase formatVersion, keeping the older versions readable.
+//
+// Versions:
+// 0. inline, headerless: records hold the object data, with no object info (see inline.go)
+// 1. legacy, headerless: records hold the object info, the data being in blobs, and may have no checksum
+// 2. header and records with checksums
+//
+// Bucket files of the inline version are converted to the current version when loaded. Records can be appended to
+// bucket files of the other versions, since their records format did not change. Bucket files are upgraded to the
+// current version when they are compacted, or by Migrate.
+
+// fileMagic is the magic string starting the header of the bucket files
+const fileMagic = "#OBJSTORE"
+
+// formatVersion is the current version of the bucket files format
+const formatVersion = 2
+
+// legacyFormatVersion is the version of the bucket files without header, with the object info in the records
+const legacyFormatVersion = 1
+
+// inlineFormatVersion is the version of the bucket files without header, with the object data in the records
+const inlineFormatVersion = 0
+
+// unknownFormatVersion is returned as the version of the bucket files whose header cannot be read
+const unknownFormatVersion = -1
+
+// maxHeaderSize is the maximum size of the header of the bucket files
+const maxHeaderSize = 32
+
+// fileHeader returns the header of the bucket files of the current version
+func fileHeader() []byte {
+	return []byte(fmt.Sprintf("%s %d\n", fileMagic, formatVersion))
+}
+
+// readHeader reads the header of a bucket file, if any.
+// It returns the format version of the file, unknownFormatVersion on errors, and the size of its header along with
+// any error.
+func readHeader(r *bufio.Reader) (int, int64, error) {
+	// Object IDs cannot contain spaces, so a headerless record of an object ID equal to the magic string is followed
+	// by the object size and a space, while the header is followed by a newline
+	peeked, err := r.Peek(r.Size())
+	if err != nil && err != io.EOF {
+		return unknownFormatVersion, 0, err
+	}
+	end := bytes.IndexByte(peeked, '\n')
+	if end > maxHeaderSize || !bytes.HasPrefix(peeked, []byte(fileMagic+" ")) || end < 0 {
+		return headerlessVersion(peeked), 0, nil
+	}
+	version, err := strconv.Atoi(string(peeked[len(fileMagic)+1 : end]))
+	if err != nil {
+		return headerlessVersion(peeked), 0, nil
+	}
+	if version <= legacyFormatVersion || version > formatVersion {
+		return unknownFormatVersion, 0, fmt.Errorf("unsupported bucket file format version %d", version)
+	}
+
+	if _, err = r.Discard(end + 1); err != nil {
+		return unknownFormatVersion, 0, err
+	}
+	return version, int64(end + 1), nil
+}
+
+// headerlessVersion returns the format version of a bucket file without header from `peeked`, its beginning:
+// legacyFormatVersion if its first record holds the object info, inlineFormatVersion if it holds the object data.
+// Empty bucket files are legacy ones, records of the current format can be appended to them.
+func headerlessVersion(peeked []byte) int {
+	if len(peeked) == 0 || isInfoRecord(peeked) {
+		return legacyFormatVersion
+	}
+	return inlineFormatVersion
+}
+
+// Migration describes the upgrade of a bucket file to the current format version
+type Migration struct {
+	Bucket  string // ID of the bucket
+	Version int    // Format version of the bucket file before the upgrade
+	Records int    // Number of records in the bucket file before the upgrade
+}
+
+// Migrate upgrades the bucket files in the store path to the current format version, rewriting them in place.
+// The store must not be in use. With `dryRun` the bucket files are only read.
+// It returns the bucket files to upgrade, or upgraded, sorted by bucket ID along with any error.
+//
+// Upgrading a bucket file compacts it, adding the checksums missing in its records. The checksums of the object data
+// are computed from the blobs: if a blob is missing or has the wrong size, its object is left without checksum.
+// Bucket files in the inline format are converted when loading the store, moving the object data to the blobs.
+func Migrate(storePath string, dryRun bool) ([]Migration, error) {
+	bucketFiles, err := filepath.Glob(path.Join(storePath, "*.dat"))
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	for _, bfPath := range bucketFiles {
+		migration, err := checkMigration(bfPath)
+		if err != nil {
+			return nil, fmt.Errorf("error reading bucket file %s: %w", bfPath, err)
+		}
+		if migration.Version < formatVersion {
+			migrations = append(migrations, migration)
+		}
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Bucket < migrations[j].Bucket
+	})
+	if dryRun || len(migrations) == 0 {
+		return migrations, nil
+	}
+
+	// Load the store, replaying any write-ahead log, and compact the bucket files to upgrade
+	s, err := NewStore(storePath, Options{})
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	for _, migration := range migrations {
+		if err = s.upgradeBucket(migration.Bucket); err != nil {
+			return nil, fmt.Errorf("error upgrading bucket %s: %w", migration.Bucket, err)
+		}
+	}
+
+	return migrations, nil
+}
+
+// checkMigration reads the bucket file at `bfPath` and returns its format version and number of records
+func checkMigration(bfPath string) (Migration, error) {
+	migration := Migration{Bucket: strings.TrimSuffix(filepath.Base(bfPath), ".dat")}
+
+	bf, err := os.Open(bfPath)
+	if err != nil {
+		return migration, err
+	}
+	defer bf.Close()
+
+	migration.Version, _, err = scanBucketFile(bf, func(string, *objectMetadata) {
+		migration.Records++
+	})
+	if err != errInlineFormat {
+		return migration, err
+	}
+
+	// Bucket files in the inline format are only counted, they are converted when the store loads them
+	if _, err = bf.Seek(0, io.SeekStart); err != nil {
+		return migration, err
+	}
+	r := bufio.NewReader(bf)
+	if _, _, err = readHeader(r); err != nil {
+		return migration, err
+	}
+	for {
+		_, objSize, _, err := readInlineRecordHeader(r)
+		if err == io.EOF {
+			return migration, nil
+		}
+		if err != nil {
+			return migration, fmt.Errorf("record %d: %w", migration.Records, err)
+		}
+		if _, err = r.Discard(int(objSize) + 1); err != nil {
+			return migration, fmt.Errorf("record %d: error reading object data: %w", migration.Records, truncatedRecordError(err))
+		}
+		migration.Records++
+	}
+}
+
+// upgradeBucket adds the missing checksums of the object data to the records of bucket `bucketId`,
+// computing them from the blobs, and compacts the bucket file to the current format version
+func (f *FileStore) upgradeBucket(bucketId string) error {
+	f.mu.RLock()
+	bucketMeta, ok := f.buckets[bucketId]
+	f.mu.RUnlock()
+	if !ok {
+		// Empty bucket file, removed while loading
+		return nil
+	}
+
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.Lock()
+	if err := f.useBucket(bucketId, bucketMeta); err != nil {
+		bucketMu.Unlock()
+		return err
+	}
+	for _, current := range bucketMeta.objects {
+		for objMeta := current; objMeta != nil; objMeta = objMeta.older {
+			if objMeta.info.Checksum == "" && !objMeta.info.DeleteMarker {
+				objMeta.info.Checksum = f.blobChecksum(objMeta)
+			}
+		}
+	}
+	bucketMu.Unlock()
+
+	return f.compact(bucketId)
+}
+
+// blobChecksum computes the checksum of the data of the object described by `objMeta` from its blob.
+// It returns an empty checksum if the blob cannot be read or it has the wrong size.
+func (f *FileStore) blobChecksum(objMeta *objectMetadata) string {
+	blob, err := os.Open(f.blobPath(objMeta.info.ETag))
+	if err != nil {
+		return ""
+	}
+	defer blob.Close()
+
+	checksum, n, err := dataChecksum(blob)
+	if err != nil || n != objMeta.size {
+		return ""
+	}
+	return checksum
+}
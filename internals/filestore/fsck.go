@@ -0,0 +1,236 @@
+package filestore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+)
+
+// Check verifies the files of a store which is not in use, parsing the bucket files like the store does when loading
+// them. It reports:
+//   - bucket files with an unreadable header or of an unsupported format version
+//   - bucket files in the original inline format, to be converted by Migrate
+//   - records truncated by the end of the bucket file, with invalid size fields or not matching their checksum
+//   - object versions with more than one record in a bucket file
+//   - records referring to missing blobs, or to blobs with a size different from the object size or with data not
+//     matching the object checksum
+//   - temporary files left by interrupted writes or compactions
+//
+// Bucket files are append-only logs, so an object version written more than once has more than one record, the last
+// one being valid, until the bucket file is compacted. These duplicates are reported, but they are not errors.
+//
+// With `repair` the bucket files with invalid records are truncated at the end of their last valid record, dropping
+// the following records, and temporary files are removed. The other issues are only reported: bucket files of an
+// unrecognized format, or without any valid record before the invalid one, are never truncated, since they are more
+// likely to be misread than torn by a crash.
+
+// IssueKind is the kind of issue found by Check
+type IssueKind string
+
+const (
+	// IssueHeader is a bucket file with an unreadable header, or of an unsupported format version
+	IssueHeader IssueKind = "header"
+	// IssueFormat is a bucket file in the original inline format, to be converted
+	IssueFormat IssueKind = "format"
+	// IssueTruncated is a record truncated by the end of the bucket file
+	IssueTruncated IssueKind = "truncated"
+	// IssueBadSize is a record with an invalid size field, or referring to a blob with a different size
+	IssueBadSize IssueKind = "bad-size"
+	// IssueCorrupted is a record not matching its checksum, or otherwise unreadable, or a blob not matching the
+	// checksum of the object data
+	IssueCorrupted IssueKind = "corrupted"
+	// IssueDuplicate is an object version with more than one record in the bucket file
+	IssueDuplicate IssueKind = "duplicate"
+	// IssueMissingBlob is a record referring to a missing blob
+	IssueMissingBlob IssueKind = "missing-blob"
+	// IssueTempFile is a temporary file left by an interrupted write or compaction
+	IssueTempFile IssueKind = "temp-file"
+)
+
+// Issue is an issue found by Check
+type Issue struct {
+	Kind     IssueKind
+	Path     string // Path of the file with the issue
+	Offset   int64  // Offset of the record with the issue in the bucket file, -1 if not a record issue
+	Object   string // ID of the object with the issue, if any
+	Version  string // ID of the object version with the issue, if any
+	Message  string // Description of the issue
+	Repaired bool   // Whether the issue has been repaired
+}
+
+// CheckResult is the result of Check
+type CheckResult struct {
+	BucketFiles int     // Number of bucket files checked
+	Records     int     // Number of valid records read
+	Issues      []Issue // Issues found, in the order of the checked files
+}
+
+// Healthy reports whether no issue has been found, but duplicate records, or all of them have been repaired
+func (c *CheckResult) Healthy() bool {
+	for _, issue := range c.Issues {
+		if issue.Kind != IssueDuplicate && !issue.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+// Check verifies the files in store path `storePath`, repairing them if `repair` is true.
+// It returns the issues found along with any error preventing the check.
+func Check(storePath string, repair bool) (*CheckResult, error) {
+	if _, err := os.Stat(storePath); err != nil {
+		return nil, errors.New("cannot access store folder: " + err.Error())
+	}
+	bucketFiles, err := filepath.Glob(path.Join(storePath, "*.dat"))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &CheckResult{}
+	for _, bfPath := range bucketFiles {
+		if err = result.checkBucketFile(storePath, bfPath, repair); err != nil {
+			return result, err
+		}
+	}
+
+	tmpFiles, err := filepath.Glob(path.Join(storePath, "*_*.tmp"))
+	if err != nil {
+		return result, err
+	}
+	for _, tmpPath := range tmpFiles {
+		issue := Issue{Kind: IssueTempFile, Path: tmpPath, Offset: -1, Message: "leftover temporary file"}
+		if repair {
+			if err = os.Remove(tmpPath); err != nil {
+				return result, err
+			}
+			issue.Repaired = true
+		}
+		result.Issues = append(result.Issues, issue)
+	}
+
+	return result, nil
+}
+
+// checkBucketFile verifies the bucket file at `bfPath` and the blobs of its objects, adding the issues to the result
+func (c *CheckResult) checkBucketFile(storePath, bfPath string, repair bool) error {
+	bf, err := os.Open(bfPath)
+	if err != nil {
+		return err
+	}
+	c.BucketFiles++
+
+	bucketMeta := &bucketMetadata{objects: make(map[string]*objectMetadata)}
+	duplicates := make(map[string]int)
+	records := 0
+	version, size, err := scanBucketFile(bf, func(objId string, objMeta *objectMetadata) {
+		records++
+		if bucketMeta.applyRecord(objId, objMeta) != nil {
+			duplicates[objId]++
+		}
+	})
+	_ = bf.Close()
+	c.Records += records
+
+	if err != nil {
+		issue := Issue{Path: bfPath, Offset: size, Message: err.Error()}
+		switch {
+		case version == unknownFormatVersion:
+			issue.Kind, issue.Offset = IssueHeader, -1
+		case err == errInlineFormat:
+			issue.Kind, issue.Offset = IssueFormat, -1
+			issue.Message += " with the migrate command"
+		case errors.Is(err, errTruncatedRecord):
+			issue.Kind = IssueTruncated
+		case errors.Is(err, errBadSize):
+			issue.Kind = IssueBadSize
+		default:
+			issue.Kind = IssueCorrupted
+		}
+		if issue.Offset < 0 {
+			c.Issues = append(c.Issues, issue)
+			return nil
+		}
+		if repair && records == 0 {
+			issue.Message += ", not truncated since no valid record precedes it"
+		} else if repair {
+			if err = os.Truncate(bfPath, size); err != nil {
+				return fmt.Errorf("cannot truncate bucket file %s: %w", bfPath, err)
+			}
+			issue.Repaired = true
+			issue.Message += fmt.Sprintf(", truncated to %d bytes", size)
+		}
+		c.Issues = append(c.Issues, issue)
+	}
+
+	objIds := make([]string, 0, len(bucketMeta.objects))
+	for objId := range bucketMeta.objects {
+		objIds = append(objIds, objId)
+	}
+	sort.Strings(objIds)
+	for _, objId := range objIds {
+		if n := duplicates[objId]; n > 0 {
+			c.Issues = append(c.Issues, Issue{
+				Kind:    IssueDuplicate,
+				Path:    bfPath,
+				Offset:  -1,
+				Object:  objId,
+				Message: fmt.Sprintf("%d replaced records left until compaction", n),
+			})
+		}
+		for objMeta := bucketMeta.objects[objId]; objMeta != nil; objMeta = objMeta.older {
+			if issue, ok := checkBlob(storePath, objId, objMeta); !ok {
+				c.Issues = append(c.Issues, issue)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkBlob verifies that the blob of the object `objId` described by `objMeta` exists, has the object size and
+// matches the object checksum, if any.
+// It returns the issue found and false if the blob is not valid.
+func checkBlob(storePath, objId string, objMeta *objectMetadata) (Issue, bool) {
+	if objMeta.info.DeleteMarker {
+		return Issue{}, true
+	}
+
+	blobPath := blobFilePath(storePath, objMeta.info.ETag)
+	issue := Issue{Path: blobPath, Offset: objMeta.offset, Object: objId, Version: objMeta.info.VersionId}
+	fi, err := os.Stat(blobPath)
+	if err != nil {
+		issue.Kind = IssueMissingBlob
+		issue.Message = "cannot read object blob: " + err.Error()
+		return issue, false
+	}
+	if fi.Size() != objMeta.size {
+		issue.Kind = IssueBadSize
+		issue.Message = fmt.Sprintf("object blob size %d differs from object size %d", fi.Size(), objMeta.size)
+		return issue, false
+	}
+	if objMeta.info.Checksum == "" {
+		return Issue{}, true
+	}
+	blob, err := os.Open(blobPath)
+	if err != nil {
+		issue.Kind = IssueMissingBlob
+		issue.Message = "cannot read object blob: " + err.Error()
+		return issue, false
+	}
+	defer blob.Close()
+	checksum, _, err := dataChecksum(blob)
+	if err != nil {
+		issue.Kind = IssueCorrupted
+		issue.Message = "cannot read object blob: " + err.Error()
+		return issue, false
+	}
+	if checksum != objMeta.info.Checksum {
+		issue.Kind = IssueCorrupted
+		issue.Message = "object blob does not match the object checksum"
+		return issue, false
+	}
+	return Issue{}, true
+}
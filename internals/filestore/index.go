@@ -0,0 +1,197 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// indexFileExt is the extension of the index files of the buckets
+const indexFileExt = ".idx"
+
+// indexMagic is the magic string starting the index files, followed by their format version
+const indexMagic = "#OBJSTORE-INDEX 1\n"
+
+// Loading a bucket file requires parsing and verifying all its records, garbage included. To speed up the startup,
+// the metadata of each bucket is saved to an index file <bucketId>.idx when the store is closed: the gob encoded
+// bucketIndex, preceded by indexMagic and followed by its CRC-32C checksum (4 bytes, big-endian).
+// The index holds the size and modification time of the bucket file it was saved for, so it is used only if the
+// bucket file has not changed since. Otherwise, or if it cannot be read, the bucket file is fully loaded as usual.
+// Since any change to a bucket file makes its index stale, index files are only written when closing the store, for
+// the buckets changed since loaded, and when evicting a bucket (see eviction.go).
+
+// bucketIndex is the content of an index file
+type bucketIndex struct {
+	DataSize    int64        // Size of the bucket file when indexed
+	DataModTime int64        // Modification time of the bucket file when indexed, in Unix nanoseconds
+	Version     int          // Format version of the bucket file
+	Garbage     int64        // Size of the garbage records in the bucket file
+	Entries     []indexEntry // Object versions, from the oldest to the current one of each object
+}
+
+// indexEntry is the metadata of an object version in an index file
+type indexEntry struct {
+	ObjId    string
+	Offset   int64
+	Size     int64
+	MetaSize int64
+	Info     objectInfo
+}
+
+// indexPath returns the path of the index file of the bucket file at `bfPath`
+func indexPath(bfPath string) string {
+	return strings.TrimSuffix(bfPath, ".dat") + indexFileExt
+}
+
+// loadIndex loads the metadata of the bucket file at `bfPath`, described by `fi`, from its index file.
+// It returns the bucket metadata along with any error, including the index not matching the bucket file.
+func loadIndex(bfPath string, fi os.FileInfo) (*bucketMetadata, error) {
+	data, err := ioutil.ReadFile(indexPath(bfPath))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(indexMagic)+4 || string(data[:len(indexMagic)]) != indexMagic {
+		return nil, errors.New("invalid index file header")
+	}
+	payload := data[len(indexMagic) : len(data)-4]
+	if crc32.Checksum(payload, castagnoli) != binary.BigEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("index file checksum mismatch")
+	}
+
+	var index bucketIndex
+	if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(&index); err != nil {
+		return nil, err
+	}
+	if index.DataSize != fi.Size() || index.DataModTime != fi.ModTime().UnixNano() {
+		return nil, errors.New("stale index file")
+	}
+
+	bucketMeta := &bucketMetadata{
+		version: index.Version,
+		size:    index.DataSize,
+		garbage: index.Garbage,
+		indexed: true,
+		objects: make(map[string]*objectMetadata, len(index.Entries)),
+	}
+	for _, entry := range index.Entries {
+		bucketMeta.addVersion(entry.ObjId, &objectMetadata{
+			offset:   entry.Offset,
+			size:     entry.Size,
+			metaSize: entry.MetaSize,
+			info:     entry.Info,
+		})
+	}
+	return bucketMeta, nil
+}
+
+// saveIndex saves the metadata of bucket `bucketId` to its index file, if it changed since it was last indexed.
+// The caller must hold the bucket lock.
+func saveIndex(bucketId string, bucketMeta *bucketMetadata) error {
+	if bucketMeta.indexed || bucketMeta.objects == nil {
+		return nil
+	}
+	fi, err := os.Stat(bucketMeta.filePath)
+	if err != nil {
+		return err
+	}
+	if fi.Size() != bucketMeta.size {
+		return errors.New("bucket file size does not match its metadata")
+	}
+
+	index := bucketIndex{
+		DataSize:    fi.Size(),
+		DataModTime: fi.ModTime().UnixNano(),
+		Version:     bucketMeta.version,
+		Garbage:     bucketMeta.garbage,
+	}
+	for objId, current := range bucketMeta.objects {
+		first := len(index.Entries)
+		for objMeta := current; objMeta != nil; objMeta = objMeta.older {
+			index.Entries = append(index.Entries, indexEntry{
+				ObjId:    objId,
+				Offset:   objMeta.offset,
+				Size:     objMeta.size,
+				MetaSize: objMeta.metaSize,
+				Info:     objMeta.info,
+			})
+		}
+		// Oldest version first, so that the versions are added back in order
+		versions := index.Entries[first:]
+		for i, j := 0, len(versions)-1; i < j; i, j = i+1, j-1 {
+			versions[i], versions[j] = versions[j], versions[i]
+		}
+	}
+
+	var payload bytes.Buffer
+	if err = gob.NewEncoder(&payload).Encode(&index); err != nil {
+		return err
+	}
+
+	// temporary index file to replace the index file with
+	tmpFile, err := ioutil.TempFile(filepath.Dir(bucketMeta.filePath), bucketId+"_*.tmp")
+	if err != nil {
+		return err
+	}
+	// delete tmp file if anything goes wrong
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	w := bufio.NewWriter(tmpFile)
+	_, _ = w.WriteString(indexMagic)
+	_, _ = w.Write(payload.Bytes())
+	_ = binary.Write(w, binary.BigEndian, crc32.Checksum(payload.Bytes(), castagnoli))
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpFile.Name(), indexPath(bucketMeta.filePath)); err != nil {
+		return err
+	}
+	bucketMeta.indexed = true
+
+	return nil
+}
+
+// saveIndexes saves the index files of the buckets changed since they were last indexed
+func (f *FileStore) saveIndexes() {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	for bucketId, bucketMeta := range f.buckets {
+		bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+		bucketMu.Lock()
+		if err := saveIndex(bucketId, bucketMeta); err != nil {
+			f.logger.WithField("bucket", bucketId).Warnf("Cannot save bucket index: %v", err)
+		}
+		bucketMu.Unlock()
+	}
+}
+
+// removeOrphanIndexes removes the index files in the store path without a bucket file
+func removeOrphanIndexes(storePath string) error {
+	indexFiles, err := filepath.Glob(path.Join(storePath, "*"+indexFileExt))
+	if err != nil {
+		return err
+	}
+	for _, idxPath := range indexFiles {
+		bfPath := strings.TrimSuffix(idxPath, indexFileExt) + ".dat"
+		if _, err = os.Stat(bfPath); os.IsNotExist(err) {
+			if err = os.Remove(idxPath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
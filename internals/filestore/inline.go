@@ -0,0 +1,212 @@
+package filestore
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// The first releases of FileStore stored the object data inline in the bucket files, without header, with a record
+// per object with the following format:
+// <objId> <obj len in bytes> <obj data>\n
+// These bucket files (inlineFormatVersion) are not read as they are: they are converted to the current format version
+// when loading them, moving the data of each object to its blob. The objects get the modification time of the bucket
+// file, and no content type, the only one accepted back then being the default one.
+//
+// A bucket file is converted by writing the blobs first, and then replacing the bucket file with the converted one,
+// so a conversion interrupted by a crash leaves the bucket file untouched, to be converted again. Blobs are synced
+// along with the converted bucket file, since converting them is a one-time operation.
+
+// errInlineFormat is returned when scanning a bucket file in the inline format, which must be converted to be read
+var errInlineFormat = errors.New("bucket file in the original format with inline object data, to be converted")
+
+// inlineRecord is an object record of a bucket file in the inline format, converted to the current format
+type inlineRecord struct {
+	objId string
+	size  int64
+	info  objectInfo
+}
+
+// convertInlineBucketFile converts the bucket file at `bfPath` in the store path `storePath` from the inline format
+// to the current format version, moving the object data to the blobs.
+// It returns whether the bucket file was in the inline format along with any error.
+func convertInlineBucketFile(storePath, bfPath string) (bool, error) {
+	bf, err := os.Open(bfPath)
+	if err != nil {
+		return false, err
+	}
+	defer bf.Close()
+
+	r := bufio.NewReader(bf)
+	if version, _, err := readHeader(r); err != nil || version != inlineFormatVersion {
+		return false, err
+	}
+	fi, err := bf.Stat()
+	if err != nil {
+		return true, err
+	}
+	modified := fi.ModTime().UTC()
+
+	// A record replaces the one of the same object read before, as when the object was replaced in place
+	var records []*inlineRecord
+	byId := make(map[string]*inlineRecord)
+	var offset int64
+	for {
+		objId, objSize, metaSize, err := readInlineRecordHeader(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return true, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		etag, checksum, err := moveInlineData(storePath, r, objSize)
+		if err != nil {
+			return true, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		offset += metaSize + objSize + 2 // add space and newline size
+
+		record := &inlineRecord{
+			objId: objId,
+			size:  objSize,
+			info:  objectInfo{ETag: etag, Checksum: checksum, Modified: modified},
+		}
+		if prev, ok := byId[objId]; ok {
+			*prev = *record
+		} else {
+			byId[objId] = record
+			records = append(records, record)
+		}
+	}
+
+	// temporary bucket file to replace the bucket file with
+	tmpFile, err := ioutil.TempFile(storePath, strings.TrimSuffix(filepath.Base(bfPath), ".dat")+"_*.tmp")
+	if err != nil {
+		return true, err
+	}
+	// delete tmp file if anything goes wrong
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	w := bufio.NewWriter(tmpFile)
+	if _, err = w.Write(fileHeader()); err != nil {
+		return true, err
+	}
+	for _, record := range records {
+		encoded, _, err := encodeRecord(record.size, record.objId, record.info)
+		if err != nil {
+			return true, err
+		}
+		if _, err = w.Write(encoded); err != nil {
+			return true, err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return true, err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return true, err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return true, err
+	}
+	if err = os.Rename(tmpFile.Name(), bfPath); err != nil {
+		return true, err
+	}
+	return true, syncFile(storePath)
+}
+
+// readInlineRecordHeader reads the header of an object record in the inline format, up to the object data.
+// It returns the object ID, the object size and the length of the header, trailing space excluded, along with any
+// error. It returns io.EOF only if there are no more records.
+func readInlineRecordHeader(r *bufio.Reader) (string, int64, int64, error) {
+	objId, err := r.ReadString(' ')
+	if err != nil {
+		if err == io.EOF && objId == "" {
+			return "", 0, 0, io.EOF
+		}
+		return "", 0, 0, fmt.Errorf("error parsing object ID: %w", truncatedRecordError(err))
+	}
+	objSize, field, err := readSizeField(r)
+	if err != nil {
+		return "", 0, 0, fmt.Errorf("error parsing object size: %w", err)
+	}
+
+	return objId[:len(objId)-1], objSize, int64(len(objId) + len(field) - 1), nil
+}
+
+// moveInlineData copies the object data of `objSize` bytes read from `r`, followed by the record separator, to its
+// blob in the store path `storePath`, unless the blob already exists.
+// It returns the ETag and the checksum of the object data along with any error.
+func moveInlineData(storePath string, r *bufio.Reader, objSize int64) (string, string, error) {
+	tmpFile, err := ioutil.TempFile(storePath, "blob_*.tmp")
+	if err != nil {
+		return "", "", err
+	}
+	// delete tmp file if anything goes wrong, or if the blob already exists
+	defer func(f *os.File) {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}(tmpFile)
+
+	h := sha256.New()
+	c := crc32.New(castagnoli)
+	if _, err = io.CopyN(io.MultiWriter(tmpFile, h, c), r, objSize); err != nil {
+		return "", "", fmt.Errorf("error reading object data: %w", truncatedRecordError(err))
+	}
+	if sep, err := r.ReadByte(); err != nil || sep != separator {
+		return "", "", fmt.Errorf("error parsing object record: %w", errBadSize)
+	}
+	etag, checksum := hex.EncodeToString(h.Sum(nil)), formatChecksum(c.Sum32())
+
+	blobPath := blobFilePath(storePath, etag)
+	if _, err = os.Stat(blobPath); err == nil {
+		return etag, checksum, nil
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return "", "", err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return "", "", err
+	}
+	if err = os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return "", "", err
+	}
+	if err = os.Rename(tmpFile.Name(), blobPath); err != nil {
+		return "", "", err
+	}
+	for _, dir := range []string{filepath.Dir(blobPath), filepath.Dir(filepath.Dir(blobPath))} {
+		if err = syncFile(dir); err != nil {
+			return "", "", err
+		}
+	}
+	return etag, checksum, nil
+}
+
+// isInfoRecord reports whether `peeked`, the beginning of a bucket file without header, starts with an object record
+// holding the object info: <objId> <obj len in bytes> <info len in bytes> {"etag":...
+// rather than with a record in the inline format, followed by the object data.
+func isInfoRecord(peeked []byte) bool {
+	fields := bytes.SplitN(peeked, []byte{' '}, 4)
+	return len(fields) == 4 && isNumber(fields[1]) && isNumber(fields[2]) && bytes.HasPrefix(fields[3], []byte(`{"etag":`))
+}
+
+// isNumber reports whether `field` is a non-empty sequence of decimal digits
+func isNumber(field []byte) bool {
+	for _, b := range field {
+		if b < '0' || b > '9' {
+			return false
+		}
+	}
+	return len(field) > 0
+}
@@ -0,0 +1,150 @@
+package filestore
+
+import (
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// quarantineDir is the folder, within the store folder, where the corrupt bucket files are moved to
+const quarantineDir = "quarantine"
+
+// quarantineReasonExt is the extension of the files holding the reason of the quarantine of a bucket file
+const quarantineReasonExt = ".reason"
+
+// With the Quarantine option, a bucket file which cannot be loaded at startup is moved to
+// <quarantineDir>/<bucketId>.<quarantine time in Unix nanoseconds>.dat, along with a .reason file with the same name
+// holding the loading error, and the store starts with the other buckets.
+// The buckets which start evicted, when the store catalog is used, or which are evicted later are loaded when first
+// used (see eviction.go): if their metadata cannot be loaded, the request fails and the quarantiner goroutine is
+// requested to move the bucket to quarantine. It loads the bucket again holding the global lock, to rule out a transient
+// error, checkpoints the write-ahead log, so that the records of the bucket are not replayed to a new bucket file, and
+// then moves the bucket file to quarantine as well, removing the bucket.
+// The quarantined bucket is then empty: storing objects in it creates a new bucket file.
+// Quarantined bucket files are left to the operators, who can repair them (see Check) and move them back while the
+// store is not running.
+// Since the objects of the quarantined bucket files are unknown, blobs are not garbage collected at startup while any
+// bucket file is in quarantine, so that the data of its objects is kept.
+
+// quarantineBucketFile moves the bucket file at `bfPath` of bucket `bucketId` to the quarantine folder,
+// recording `cause` as the reason of the quarantine
+func quarantineBucketFile(storePath, bucketId, bfPath string, cause error) (rest.QuarantinedBucket, error) {
+	qDir := path.Join(storePath, quarantineDir)
+	if err := os.MkdirAll(qDir, 0755); err != nil {
+		return rest.QuarantinedBucket{}, err
+	}
+
+	qTime := now().UTC()
+	qName := fmt.Sprintf("%s.%d", bucketId, qTime.UnixNano())
+	qBucket := rest.QuarantinedBucket{
+		Id:     bucketId,
+		Path:   path.Join(qDir, qName+".dat"),
+		Reason: cause.Error(),
+		Time:   qTime,
+	}
+	if err := ioutil.WriteFile(path.Join(qDir, qName+quarantineReasonExt), []byte(qBucket.Reason), 0644); err != nil {
+		return rest.QuarantinedBucket{}, err
+	}
+	if err := os.Rename(bfPath, qBucket.Path); err != nil {
+		return rest.QuarantinedBucket{}, err
+	}
+	return qBucket, syncFile(storePath)
+}
+
+// quarantiner moves the requested buckets to quarantine until the store is closed
+func (f *FileStore) quarantiner() {
+	defer f.workers.Done()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case bucketId := <-f.quarantines:
+			f.quarantineBucket(bucketId)
+		}
+	}
+}
+
+// quarantineBucket moves the file of bucket `bucketId` to quarantine, removing the bucket, if its metadata cannot be
+// loaded, logging the outcome
+func (f *FileStore) quarantineBucket(bucketId string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	bucketMeta, ok := f.buckets[bucketId]
+	if !ok {
+		// Bucket emptied or quarantined in the meantime
+		return
+	}
+	bucketMu := &f.bucketsMu[bucketMeta.muIndex]
+	bucketMu.Lock()
+	defer bucketMu.Unlock()
+
+	cause := bucketMeta.load()
+	if cause == nil {
+		return
+	}
+	logger := f.logger.WithField("bucket", bucketId)
+	if f.wal != nil {
+		if err := f.checkpoint(); err != nil {
+			logger.Errorf("Cannot checkpoint write-ahead log before moving bucket file to quarantine: %v", err)
+			return
+		}
+	}
+	qBucket, err := quarantineBucketFile(f.storePath, bucketId, bucketMeta.filePath, cause)
+	if err != nil {
+		logger.Errorf("Cannot quarantine bucket file %s: %v", bucketMeta.filePath, err)
+		return
+	}
+	if err = os.Remove(indexPath(bucketMeta.filePath)); err != nil && !os.IsNotExist(err) {
+		logger.Warnf("Cannot remove index of quarantined bucket: %v", err)
+	}
+	delete(f.buckets, bucketId)
+	f.cache.remove(bucketMeta)
+	logger.Errorf("Moved corrupt bucket file to quarantine in %s: %s", qBucket.Path, qBucket.Reason)
+}
+
+// loadQuarantined returns the bucket files in quarantine in the given store path, sorted by bucket ID and time
+func loadQuarantined(storePath string) ([]rest.QuarantinedBucket, error) {
+	qFiles, err := filepath.Glob(path.Join(storePath, quarantineDir, "*.dat"))
+	if err != nil {
+		return nil, err
+	}
+
+	var quarantined []rest.QuarantinedBucket
+	for _, qPath := range qFiles {
+		qName := strings.TrimSuffix(filepath.Base(qPath), ".dat")
+		sep := strings.LastIndexByte(qName, '.')
+		if sep < 0 {
+			continue
+		}
+		nanos, err := strconv.ParseInt(qName[sep+1:], 10, 64)
+		if err != nil {
+			continue
+		}
+		qBucket := rest.QuarantinedBucket{Id: qName[:sep], Path: qPath, Time: time.Unix(0, nanos).UTC()}
+		if reason, err := ioutil.ReadFile(strings.TrimSuffix(qPath, ".dat") + quarantineReasonExt); err == nil {
+			qBucket.Reason = string(reason)
+		}
+		quarantined = append(quarantined, qBucket)
+	}
+	sort.Slice(quarantined, func(i, j int) bool {
+		if quarantined[i].Id != quarantined[j].Id {
+			return quarantined[i].Id < quarantined[j].Id
+		}
+		return quarantined[i].Time.Before(quarantined[j].Time)
+	})
+
+	return quarantined, nil
+}
+
+// Quarantined returns the buckets files in quarantine, sorted by bucket ID and time
+func (f *FileStore) Quarantined() ([]rest.QuarantinedBucket, error) {
+	return loadQuarantined(f.storePath)
+}
@@ -0,0 +1,359 @@
+package filestore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// walFileName is the name of the write-ahead log file in the store folder
+const walFileName = "wal.log"
+
+// defaultCheckpointSize is the default size of the write-ahead log above which it is checkpointed
+const defaultCheckpointSize = 64 << 20 // 64MiB
+
+// Durability is the durability mode of a FileStore, defining when the writes are synced to disk
+type Durability string
+
+const (
+	// DurabilityNone leaves syncing the writes to the operating system: acknowledged writes may be lost on a crash
+	DurabilityNone Durability = "none"
+	// DurabilityFsync syncs the write-ahead log on every write
+	DurabilityFsync Durability = "fsync"
+	// DurabilityGroupCommit syncs the write-ahead log once for all the writes performed concurrently
+	DurabilityGroupCommit Durability = "group-commit"
+)
+
+// ParseDurability parses a durability mode
+func ParseDurability(s string) (Durability, error) {
+	switch d := Durability(s); d {
+	case DurabilityNone, DurabilityFsync, DurabilityGroupCommit:
+		return d, nil
+	default:
+		return "", fmt.Errorf("unknown durability mode %q", s)
+	}
+}
+
+// Unless durability is DurabilityNone, every record is written to the write-ahead log before being appended to its
+// bucket file. Each log entry is made of the bucket ID followed by the record, checksum included (see checksum.go):
+// <bucketId> <objId> <obj len in bytes> <info len in bytes> <info> <checksum>\n
+// where the checksum protects the record only, not the bucket ID.
+// The log is synced before changing the bucket file, and the object data is synced before its record is written,
+// so a write is durable once acknowledged. Bucket files are instead synced only when the log is checkpointed, after it
+// exceeds its checkpoint size and when the store is closed: then the log is emptied.
+//
+// NewStore replays the log, appending its records to their bucket files again. Since a record replaces the previous
+// one of the same object version, replaying the records already in the bucket files gives the same result.
+// The replay stops at the first entry which is incomplete or does not match its checksum, left by a crash while
+// writing it.
+//
+// If syncing the log or applying a logged record fails, the log is failed and all the following writes fail:
+// the logged records are applied by restarting the store.
+
+// writeAheadLog is the write-ahead log of a FileStore
+type writeAheadLog struct {
+	checkpointMu sync.RWMutex    // Held for reading while writing a record and for writing while checkpointing
+	mu           sync.Mutex      // Mutex to handle concurrent access to the log file and state
+	cond         *sync.Cond      // Signals the end of a sync of the log, with mu
+	file         *os.File        // Log file, opened for appending
+	size         int64           // Size in bytes of the log file
+	written      uint64          // Sequence number of the last entry written
+	synced       uint64          // Sequence number of the last entry synced
+	syncing      bool            // Whether the log is being synced
+	err          error           // Error which failed the log, if any
+	dirty        map[string]bool // Buckets changed since the last checkpoint
+}
+
+// openWAL opens the write-ahead log in the store path for appending, creating it if needed
+func openWAL(storePath string) (*writeAheadLog, error) {
+	file, err := os.OpenFile(path.Join(storePath, walFileName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+
+	w := &writeAheadLog{
+		file:  file,
+		size:  fi.Size(),
+		dirty: make(map[string]bool),
+	}
+	w.cond = sync.NewCond(&w.mu)
+	return w, nil
+}
+
+// writeRecord writes the record of bucket `bucketId` to the write-ahead log, if any, according to the durability
+// mode. Then it applies the record to the bucket file calling `apply`.
+func (f *FileStore) writeRecord(bucketId string, record []byte, apply func() error) error {
+	w := f.wal
+	if w == nil {
+		return apply()
+	}
+
+	w.checkpointMu.RLock()
+	defer w.checkpointMu.RUnlock()
+
+	seq, size, err := w.append(bucketId, record)
+	if err != nil {
+		return err
+	}
+	if f.opts.Durability == DurabilityGroupCommit {
+		err = w.groupSync(seq)
+	} else if err = w.file.Sync(); err != nil {
+		w.fail(err)
+	}
+	if err != nil {
+		return err
+	}
+	if err = apply(); err != nil {
+		w.fail(err)
+		return err
+	}
+
+	if size >= f.opts.CheckpointSize {
+		select {
+		case f.checkpoints <- struct{}{}:
+		default:
+			// Checkpoint already requested
+		}
+	}
+
+	return nil
+}
+
+// append appends the entry of the record of bucket `bucketId` to the log.
+// It returns the sequence number of the entry and the log size along with any error.
+func (w *writeAheadLog) append(bucketId string, record []byte) (uint64, int64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err != nil {
+		return 0, 0, w.err
+	}
+
+	entry := make([]byte, 0, len(bucketId)+1+len(record))
+	entry = append(append(append(entry, bucketId...), ' '), record...)
+	if _, err := w.file.Write(entry); err != nil {
+		// Drop any partially written entry
+		if truncErr := w.file.Truncate(w.size); truncErr != nil {
+			w.err = fmt.Errorf("write-ahead log failed: %w", truncErr)
+		}
+		return 0, 0, err
+	}
+	w.size += int64(len(entry))
+	w.written++
+	w.dirty[bucketId] = true
+
+	return w.written, w.size, nil
+}
+
+// groupSync waits until the log is synced up to the entry `seq`. If the log is not being synced it syncs it,
+// covering the entries written by other callers in the meantime, which then do not need to sync it again.
+func (w *writeAheadLog) groupSync(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for w.synced < seq {
+		if w.err != nil {
+			return w.err
+		}
+		if w.syncing {
+			w.cond.Wait()
+			continue
+		}
+
+		w.syncing = true
+		written := w.written
+		w.mu.Unlock()
+		err := w.file.Sync()
+		w.mu.Lock()
+		w.syncing = false
+		if err != nil {
+			w.err = fmt.Errorf("write-ahead log failed: %w", err)
+		} else {
+			w.synced = written
+		}
+		w.cond.Broadcast()
+	}
+
+	return nil
+}
+
+// fail fails the log because of `err`, so that all the following writes fail
+func (w *writeAheadLog) fail(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.err == nil {
+		w.err = fmt.Errorf("write-ahead log failed: %w", err)
+	}
+}
+
+// failed reports whether the log is failed, it is false for a nil log
+func (w *writeAheadLog) failed() bool {
+	if w == nil {
+		return false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.err != nil
+}
+
+// checkpoint syncs the bucket files changed since the last checkpoint and empties the write-ahead log
+func (f *FileStore) checkpoint() error {
+	w := f.wal
+	w.checkpointMu.Lock()
+	defer w.checkpointMu.Unlock()
+
+	// No record is being written, so the log state can be accessed without locking its mutex
+	if w.err != nil || w.size == 0 {
+		return w.err
+	}
+	for bucketId := range w.dirty {
+		if err := syncFile(path.Join(f.storePath, bucketId+".dat")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Sync created, removed and compacted bucket files
+	if err := syncFile(f.storePath); err != nil {
+		return err
+	}
+
+	if err := w.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size = 0
+	w.dirty = make(map[string]bool)
+
+	return nil
+}
+
+// checkpointer checkpoints the write-ahead log when requested until the store is closed
+func (f *FileStore) checkpointer() {
+	defer f.workers.Done()
+	for {
+		select {
+		case <-f.quit:
+			return
+		case <-f.checkpoints:
+			if err := f.checkpoint(); err != nil {
+				f.logger.Errorf("Cannot checkpoint write-ahead log: %v", err)
+			}
+		}
+	}
+}
+
+// replayWAL appends the records in the write-ahead log in the store path to their bucket files, syncs them and
+// removes the log. An incomplete entry at the end of the log, left by a crash while writing it, is ignored.
+// Incomplete records at the end of the bucket files, left by a crash as well, are truncated before appending, while
+// bucket files with other invalid records make the replay fail, keeping the log.
+// It returns the number of replayed records along with any error.
+func replayWAL(storePath string) (int, error) {
+	walPath := path.Join(storePath, walFileName)
+	wf, err := os.Open(walPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer wf.Close()
+
+	bucketFiles := make(map[string]*os.File)
+	defer func() {
+		for _, bf := range bucketFiles {
+			_ = bf.Close()
+		}
+	}()
+
+	replayed := 0
+	r := bufio.NewReader(wf)
+	for {
+		bucketId, err := r.ReadString(' ')
+		if err != nil {
+			break
+		}
+		bucketId = bucketId[:len(bucketId)-1]
+		objId, objMeta, err := readRecord(r)
+		if err != nil {
+			break
+		}
+		record, _, err := encodeRecord(objMeta.size, objId, objMeta.info)
+		if err != nil {
+			return replayed, err
+		}
+
+		bf, ok := bucketFiles[bucketId]
+		if !ok {
+			bfPath := path.Join(storePath, bucketId+".dat")
+			if err = truncateIncompleteRecord(bfPath); err != nil {
+				return replayed, err
+			}
+			if bf, err = os.OpenFile(bfPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+				return replayed, err
+			}
+			bucketFiles[bucketId] = bf
+		}
+		if _, err = bf.Write(record); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+
+	for _, bf := range bucketFiles {
+		if err = bf.Sync(); err != nil {
+			return replayed, err
+		}
+	}
+	if err = os.Remove(walPath); err != nil {
+		return replayed, err
+	}
+	return replayed, syncFile(storePath)
+}
+
+// truncateIncompleteRecord truncates the bucket file at `bfPath`, if any, after its last complete record.
+// Only a record truncated by the end of the file is dropped: any other invalid record is returned as an error, leaving
+// the bucket file untouched, so that the records following it are not lost and the bucket file can be checked.
+func truncateIncompleteRecord(bfPath string) error {
+	bf, err := os.Open(bfPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer bf.Close()
+
+	version, size, err := scanBucketFile(bf, func(string, *objectMetadata) {})
+	if version <= inlineFormatVersion {
+		return err
+	}
+	if errors.Is(err, errTruncatedRecord) {
+		return os.Truncate(bfPath, size)
+	}
+	return err
+}
+
+// syncFile syncs the file, or directory, at `path` to disk
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,346 @@
+package memstore
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"sync"
+)
+
+// objectOverhead is the estimated size in bytes of an object version in memory, its strings excluded
+const objectOverhead = 200
+
+// A MemStore tracks the memory taken by each object and bucket, estimated from the size of the object versions along
+// with their strings. With a memory budget in the Options, storing an object which does not fit in the budget either
+// evicts other objects, with all their versions, or it is rejected with an error wrapping rest.ErrInsufficientStorage,
+// according to the eviction policy:
+//   - EvictLRU evicts the least recently used objects, where storing, retrieving and stating an object uses it
+//   - EvictLFU evicts the least frequently used objects, the least recently used first among the ones used as often
+//   - EvictReject evicts nothing, rejecting the objects which do not fit
+//
+// The budget is a hard limit: the objects larger than the budget are always rejected. Delete markers are accounted
+// but never rejected, so that objects can always be deleted.
+// Evictions are persisted like deletions, and when the content loaded by NewStore exceeds the budget, the objects over
+// budget are evicted right after loading it.
+
+// EvictionPolicy is the policy making room for new objects in a MemStore with a memory budget
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used objects
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used objects
+	EvictLFU EvictionPolicy = "lfu"
+	// EvictReject rejects the objects which do not fit in the budget
+	EvictReject EvictionPolicy = "reject"
+)
+
+// ParseEvictionPolicy parses an eviction policy from its name
+func ParseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(s); p {
+	case EvictLRU, EvictLFU, EvictReject:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy %q", s)
+	}
+}
+
+// objectKey identifies an object in a MemStore
+type objectKey struct {
+	bucketId string
+	objId    string
+}
+
+// usage is the memory taken by an object, along with its position in the eviction order
+type usage struct {
+	key  objectKey
+	size int64         // Estimated memory in bytes taken by the object versions
+	elem *list.Element // Element of the object in the list of its frequency with EvictLFU, or in the LRU list
+	freq *list.Element // Element of the frequency of the object in the frequencies list with EvictLFU
+}
+
+// frequency holds the objects used as many times, from the least recently used one
+type frequency struct {
+	count   int64
+	objects *list.List
+}
+
+// memoryBudget tracks the memory taken by the objects of a MemStore, by bucket, in eviction order.
+// It has its own mutex so that objects can be marked as used holding the store mutex for reading.
+type memoryBudget struct {
+	mu          sync.Mutex
+	limit       int64                // Memory budget in bytes, no limit if 0
+	policy      EvictionPolicy       // Eviction policy
+	used        int64                // Estimated memory in bytes taken by the objects
+	buckets     map[string]int64     // Estimated memory in bytes taken by the objects of each bucket
+	objects     map[objectKey]*usage // Memory taken by each object
+	lru         *list.List           // Objects from the least recently used one, with EvictLRU
+	freqs       *list.List           // Frequencies from the lowest one, with EvictLFU
+	evicted     int64                // Number of evicted objects
+	evictedSize int64                // Estimated memory in bytes freed by the evictions
+	rejected    int64                // Number of rejected objects
+	bucketEvict map[string]int64     // Number of evicted objects of each bucket
+}
+
+// newMemoryBudget creates a memoryBudget with the given limit, no limit if 0, and eviction policy
+func newMemoryBudget(limit int64, policy EvictionPolicy) *memoryBudget {
+	return &memoryBudget{
+		limit:       limit,
+		policy:      policy,
+		buckets:     make(map[string]int64),
+		objects:     make(map[objectKey]*usage),
+		lru:         list.New(),
+		freqs:       list.New(),
+		bucketEvict: make(map[string]int64),
+	}
+}
+
+// versionSize returns the estimated memory in bytes taken by the version `obj` of the object `objId`
+func versionSize(objId string, obj *object) int64 {
+	size := int64(objectOverhead + len(objId) + len(obj.data) + len(obj.etag) + len(obj.contentType) + len(obj.versionId))
+	for key, value := range obj.metadata {
+		size += int64(len(key) + len(value))
+	}
+	return size
+}
+
+// resize changes by `delta` the memory taken by object `key`, which is no longer tracked once it takes no memory,
+// and marks it as used if `used`. It does nothing on a nil memoryBudget.
+func (b *memoryBudget) resize(key objectKey, delta int64, used bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.used += delta
+	if bucketUsed := b.buckets[key.bucketId] + delta; bucketUsed > 0 {
+		b.buckets[key.bucketId] = bucketUsed
+	} else {
+		delete(b.buckets, key.bucketId)
+	}
+
+	u, ok := b.objects[key]
+	if !ok {
+		u = &usage{key: key}
+		b.objects[key] = u
+	}
+	u.size += delta
+	if u.size <= 0 {
+		b.unlink(u)
+		delete(b.objects, key)
+	} else if used {
+		b.use(u)
+	}
+}
+
+// size returns the memory taken by object `key`
+func (b *memoryBudget) size(key objectKey) int64 {
+	if b == nil {
+		return 0
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if u, ok := b.objects[key]; ok {
+		return u.size
+	}
+	return 0
+}
+
+// touch marks object `key` as used, if tracked. It does nothing on a nil memoryBudget.
+func (b *memoryBudget) touch(key objectKey) {
+	if b == nil || b.limit == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if u, ok := b.objects[key]; ok {
+		b.use(u)
+	}
+}
+
+// use moves the object `u` forward in the eviction order.
+// The caller must hold the mutex.
+func (b *memoryBudget) use(u *usage) {
+	switch {
+	case b.limit == 0:
+		// No eviction order needed
+	case b.policy == EvictLFU:
+		// Move the object to the list of the next frequency, creating it if needed
+		count := int64(1)
+		next := b.freqs.Front()
+		if u.freq != nil {
+			count = u.freq.Value.(*frequency).count + 1
+			next = u.freq.Next()
+		}
+		if next == nil || next.Value.(*frequency).count != count {
+			f := &frequency{count: count, objects: list.New()}
+			if u.freq != nil {
+				next = b.freqs.InsertAfter(f, u.freq)
+			} else {
+				next = b.freqs.PushFront(f)
+			}
+		}
+		b.unlink(u)
+		u.freq = next
+		u.elem = next.Value.(*frequency).objects.PushBack(u)
+	default:
+		if u.elem != nil {
+			b.lru.MoveToBack(u.elem)
+		} else {
+			u.elem = b.lru.PushBack(u)
+		}
+	}
+}
+
+// unlink removes the object `u` from the eviction order.
+// The caller must hold the mutex.
+func (b *memoryBudget) unlink(u *usage) {
+	if u.elem == nil {
+		return
+	}
+	if u.freq != nil {
+		f := u.freq.Value.(*frequency)
+		f.objects.Remove(u.elem)
+		if f.objects.Len() == 0 {
+			b.freqs.Remove(u.freq)
+		}
+		u.freq = nil
+	} else {
+		b.lru.Remove(u.elem)
+	}
+	u.elem = nil
+}
+
+// victim returns the next object to evict, other than `skip`, and whether there is any
+func (b *memoryBudget) victim(skip objectKey) (objectKey, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.policy == EvictLFU {
+		for f := b.freqs.Front(); f != nil; f = f.Next() {
+			for e := f.Value.(*frequency).objects.Front(); e != nil; e = e.Next() {
+				if key := e.Value.(*usage).key; key != skip {
+					return key, true
+				}
+			}
+		}
+		return objectKey{}, false
+	}
+	for e := b.lru.Front(); e != nil; e = e.Next() {
+		if key := e.Value.(*usage).key; key != skip {
+			return key, true
+		}
+	}
+	return objectKey{}, false
+}
+
+// exceeded reports whether taking `need` more bytes exceeds the budget
+func (b *memoryBudget) exceeded(need int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.limit > 0 && b.used+need > b.limit
+}
+
+// makeRoom makes room for `need` more bytes to store the object `objId` in bucket `bucketId`, evicting other objects
+// according to the eviction policy. It returns an error wrapping rest.ErrInsufficientStorage if there is no room.
+// The caller must hold the store mutex for writing.
+func (s *MemStore) makeRoom(objId, bucketId string, need int64) error {
+	b := s.budget
+	if b == nil || !b.exceeded(need) {
+		return nil
+	}
+
+	key := objectKey{bucketId: bucketId, objId: objId}
+	if b.policy == EvictReject || need > b.limit {
+		b.mu.Lock()
+		b.rejected++
+		b.mu.Unlock()
+		return fmt.Errorf("memory budget of %d bytes exceeded: %w", b.limit, rest.ErrInsufficientStorage)
+	}
+
+	return s.evict(key, need)
+}
+
+// evict evicts objects, other than `skip`, until `need` more bytes fit in the budget.
+// The caller must hold the store mutex for writing.
+func (s *MemStore) evict(skip objectKey, need int64) error {
+	b := s.budget
+	evicted, freed := 0, int64(0)
+	defer func() {
+		if evicted > 0 {
+			s.logger.WithField("policy", b.policy).Infof("Evicted %d objects, %d bytes, to stay within the memory budget", evicted, freed)
+		}
+	}()
+
+	for b.exceeded(need) {
+		key, ok := b.victim(skip)
+		if !ok {
+			b.mu.Lock()
+			b.rejected++
+			b.mu.Unlock()
+			return fmt.Errorf("memory budget of %d bytes exceeded: %w", b.limit, rest.ErrInsufficientStorage)
+		}
+		if err := s.persist(record{op: opEvict, bucketId: key.bucketId, objId: key.objId}); err != nil {
+			return err
+		}
+		size := b.size(key)
+		s.removeObject(key.objId, key.bucketId)
+		if s.onEvict != nil {
+			s.onEvict(key.objId, key.bucketId)
+		}
+
+		b.mu.Lock()
+		b.evicted++
+		b.evictedSize += size
+		b.bucketEvict[key.bucketId]++
+		b.mu.Unlock()
+		evicted++
+		freed += size
+		s.logger.WithField("bucket", key.bucketId).Debugf("Evicted object %s of %d bytes", key.objId, size)
+	}
+	return nil
+}
+
+// OnEvict sets the function called with each object evicted to stay within the memory budget, while holding the store
+// mutex, so that a cache in front of the store can invalidate it.
+func (s *MemStore) OnEvict(evicted func(objId, bucketId string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.onEvict = evicted
+}
+
+// Stats returns the statistics about the memory taken by the store:
+//   - memory_budget_bytes: the memory budget, 0 if there is no limit
+//   - memory_used_bytes: the estimated memory taken by the objects
+//   - evicted_objects, evicted_bytes: the objects evicted and the memory they took
+//   - rejected_objects: the objects not stored because they did not fit in the budget
+//   - bucket_used_bytes.<bucketId>: the estimated memory taken by the objects of each bucket
+//   - bucket_evicted_objects.<bucketId>: the objects evicted from each bucket
+func (s *MemStore) Stats() map[string]int64 {
+	b := s.budget
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := map[string]int64{
+		"memory_budget_bytes": b.limit,
+		"memory_used_bytes":   b.used,
+		"evicted_objects":     b.evicted,
+		"evicted_bytes":       b.evictedSize,
+		"rejected_objects":    b.rejected,
+	}
+	for bucketId, used := range b.buckets {
+		stats["bucket_used_bytes."+bucketId] = used
+	}
+	for bucketId, evicted := range b.bucketEvict {
+		stats["bucket_evicted_objects."+bucketId] = evicted
+	}
+	return stats
+}
@@ -1,38 +1,299 @@
 package memstore
 
-import "sync"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// now returns the current time, it is a variable to be replaced in tests
+var now = time.Now
+
+// newVersionId returns a new version ID, it is a variable to be replaced in tests
+var newVersionId = rest.NewVersionId
 
 // MemStore implements ObjectStore and stores objects in memory.
-// It stores the objects as strings in a matrix [bucketId][objId].
+// It stores the objects along with their information in a matrix [bucketId][objId].
 // Storing, retrieving and deletion times do not depend on the number of buckets and objects.
+// Since strings are immutable, retrieved objects are read directly from the stored data without any copy.
+//
+// The matrix holds the current version of each object, previous versions are chained from it.
+//
+// With a data path in the Options, the content is persisted to snapshots and an append-only log (see persistence.go).
+// With a memory budget, objects are evicted or rejected to stay within it (see budget.go).
 type MemStore struct {
-	mu      sync.RWMutex                 // Mutex used to modify the buckets data
-	buckets map[string]map[string]string // Map where objects are actually stored
+	mu         sync.RWMutex                  // Mutex used to modify the buckets data
+	buckets    map[string]map[string]*object // Map where objects are actually stored
+	versioned  map[string]bool               // Buckets with versioning enabled
+	opts       Options                       // Options of the store, defaults applied
+	logger     log.FieldLogger               // Logger of the background operations
+	budget     *memoryBudget                 // Memory taken by the objects (see budget.go)
+	log        *appendLog                    // Append-only log, nil unless AppendOnly
+	gen        uint64                        // Generation of the append-only log following the last snapshot
+	changes    int                           // Number of changes since the last snapshot
+	snapshotMu sync.Mutex                    // Held while taking a snapshot
+	snapshots  chan struct{}                 // Requests to take a snapshot
+	quit       chan struct{}                 // Closed when the store is closed to stop the background worker
+	closeOnce  sync.Once                     // Closes quit once
+	workers    sync.WaitGroup                // Background worker, taking the snapshots and syncing the log
+	onEvict    func(objId, bucketId string)  // Called with each evicted object, if not nil
 }
 
-func NewStore() *MemStore {
-	return &MemStore{
-		buckets: make(map[string]map[string]string),
+// Options holds the options of a MemStore
+type Options struct {
+	// DataPath is the path of the existing folder where the content of the store is persisted, and loaded from when
+	// creating it. If empty, the content is not persisted.
+	DataPath string
+	// AppendOnly appends every change to the append-only log, so that it is not lost by a crash
+	AppendOnly bool
+	// AppendFsync is the policy syncing the append-only log to disk. If empty, FsyncEverySecond is used.
+	AppendFsync FsyncPolicy
+	// SnapshotInterval is the interval between the periodic snapshots, taken if something changed. Snapshots are
+	// anyway taken when closing the store without AppendOnly. If 0, there are no periodic snapshots.
+	SnapshotInterval time.Duration
+	// LogRewriteSize is the size in bytes of the append-only log above which a snapshot is taken, starting a new log.
+	// If 0, defaultLogRewriteSize is used.
+	LogRewriteSize int64
+	// MemoryBudget is the memory in bytes available to the objects, beyond which objects are evicted or rejected
+	// according to the EvictionPolicy (see budget.go). If 0, there is no limit.
+	MemoryBudget int64
+	// EvictionPolicy is the policy making room for new objects when the memory budget is exceeded.
+	// If empty, EvictLRU is used.
+	EvictionPolicy EvictionPolicy
+	// Logger logs the background operations of the store, nothing is logged if nil
+	Logger log.FieldLogger
+}
+
+// object is an object stored in memory
+type object struct {
+	data        string            // Object data
+	etag        string            // Hex encoded SHA-256 hash of the object data
+	modified    time.Time         // Time of the last change to the object
+	contentType string            // Media type of the object
+	metadata    map[string]string // User-defined metadata of the object
+	versionId   string            // ID of the object version, empty if stored while versioning was not enabled
+	deleted     bool              // Whether the version is a delete marker
+	previous    *object           // Previous version of the object
+}
+
+// NewStore creates a store, loading its content from the data path in `opts`, if any
+func NewStore(opts Options) (*MemStore, error) {
+	if opts.AppendFsync == "" {
+		opts.AppendFsync = FsyncEverySecond
+	} else if _, err := ParseFsyncPolicy(string(opts.AppendFsync)); err != nil {
+		return nil, err
+	}
+	if opts.EvictionPolicy == "" {
+		opts.EvictionPolicy = EvictLRU
+	} else if _, err := ParseEvictionPolicy(string(opts.EvictionPolicy)); err != nil {
+		return nil, err
+	}
+	if opts.MemoryBudget < 0 {
+		return nil, errors.New("memory budget must not be negative")
+	}
+	if opts.LogRewriteSize == 0 {
+		opts.LogRewriteSize = defaultLogRewriteSize
+	}
+	logger := opts.Logger
+	if logger == nil {
+		discard := log.New()
+		discard.SetOutput(ioutil.Discard)
+		logger = discard
+	}
+
+	s := &MemStore{
+		buckets:   make(map[string]map[string]*object),
+		versioned: make(map[string]bool),
+		budget:    newMemoryBudget(opts.MemoryBudget, opts.EvictionPolicy),
+		opts:      opts,
+		logger:    logger,
+		snapshots: make(chan struct{}, 1),
+		quit:      make(chan struct{}),
+	}
+	if opts.DataPath == "" {
+		return s, nil
+	}
+
+	// Check store folder
+	if _, err := os.Stat(opts.DataPath); err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.New("store folder does not exist")
+		}
+		return nil, errors.New("cannot access store folder: " + err.Error())
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	if opts.AppendOnly {
+		l, err := createLog(opts.DataPath, s.gen)
+		if err != nil {
+			return nil, errors.New("cannot create append-only log: " + err.Error())
+		}
+		s.log = l
+	}
+	// Evict the loaded objects over budget
+	if err := s.evict(objectKey{}, 0); err != nil {
+		return nil, err
 	}
+	if !opts.AppendOnly && s.changes > 0 {
+		// Write the replayed changes to a snapshot, removing their logs
+		if err := s.Snapshot(); err != nil {
+			return nil, errors.New("cannot write snapshot: " + err.Error())
+		}
+	}
+
+	s.workers.Add(1)
+	go s.persister()
+	return s, nil
 }
 
-func (s *MemStore) Store(obj []byte, objId, bucketId string) (bool, error) {
+// Close stops the background snapshots, waiting for the running one to complete. Then it syncs and closes the
+// append-only log, or without AppendOnly it takes a snapshot if something changed since the last one.
+// The store must not be used after closing it.
+func (s *MemStore) Close() error {
+	if s.opts.DataPath == "" {
+		return nil
+	}
+	s.closeOnce.Do(func() {
+		close(s.quit)
+	})
+	s.workers.Wait()
+
+	if s.log != nil {
+		return closeLog(s.log)
+	}
+	if s.changes > 0 {
+		return s.Snapshot()
+	}
+	return nil
+}
+
+func (s *MemStore) Store(r io.Reader, objId, bucketId string, opts rest.StoreOptions) (rest.ObjectInfo, bool, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	etag := sha256.Sum256(data)
+	obj := &object{
+		data:        string(data),
+		etag:        hex.EncodeToString(etag[:]),
+		modified:    now().UTC(),
+		contentType: opts.ContentType,
+		metadata:    opts.Metadata,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldObj, ok := s.getObject(objId, bucketId, "")
+	var oldETag string
+	if ok {
+		oldETag = oldObj.etag
+	}
+	if err := opts.CheckPreconditions(oldETag, ok); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+
+	if s.versioned[bucketId] {
+		obj.versionId = newVersionId()
+	}
+	need := versionSize(objId, obj)
+	if obj.versionId == "" {
+		// The current versions are replaced
+		need -= s.budget.size(objectKey{bucketId: bucketId, objId: objId})
+	}
+	if err := s.makeRoom(objId, bucketId, need); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	if err := s.persist(record{op: opStore, bucketId: bucketId, objId: objId, versionId: obj.versionId, obj: obj}); err != nil {
+		return rest.ObjectInfo{}, false, err
+	}
+	s.put(objId, bucketId, obj)
+
+	return obj.info(objId), ok, nil
+}
+
+func (s *MemStore) Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, rest.ObjectInfo, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.getObject(objId, bucketId, versionId)
+	if !ok {
+		return nil, rest.ObjectInfo{}, false, nil
+	}
+	s.budget.touch(objectKey{bucketId: bucketId, objId: objId})
+
+	return readSeekNopCloser{strings.NewReader(obj.data)}, obj.info(objId), true, nil
+}
+
+func (s *MemStore) Stat(objId, bucketId, versionId string) (rest.ObjectInfo, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok := s.getObject(objId, bucketId, versionId)
+	if !ok {
+		return rest.ObjectInfo{}, false, nil
+	}
+	s.budget.touch(objectKey{bucketId: bucketId, objId: objId})
+
+	return obj.info(objId), true, nil
+}
+
+func (s *MemStore) Delete(objId, bucketId, versionId string) (bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	bucket, ok := s.buckets[bucketId]
 	if !ok {
-		bucket = make(map[string]string)
-		s.buckets[bucketId] = bucket
+		return false, nil
 	}
 
-	_, ok = bucket[objId]
-	bucket[objId] = string(obj)
+	current, ok := bucket[objId]
+	if !ok {
+		return false, nil
+	}
+
+	if versionId == "" {
+		if s.versioned[bucketId] {
+			if current.deleted {
+				return false, nil
+			}
+			// Mark the object as deleted keeping its versions
+			marker := &object{
+				modified:  now().UTC(),
+				versionId: newVersionId(),
+				deleted:   true,
+			}
+			if err := s.persist(record{op: opStore, bucketId: bucketId, objId: objId, versionId: marker.versionId, obj: marker}); err != nil {
+				return false, err
+			}
+			s.put(objId, bucketId, marker)
+			return true, nil
+		}
+		versionId = rest.NullVersionId
+	}
+
+	if _, _, ok := findVersion(current, versionId); !ok {
+		return false, nil
+	}
+	if err := s.persist(record{op: opRemove, bucketId: bucketId, objId: objId, versionId: versionId}); err != nil {
+		return false, err
+	}
+	s.remove(objId, bucketId, versionId)
 
-	return ok, nil
+	return true, nil
 }
 
-func (s *MemStore) Retrieve(objId, bucketId string) ([]byte, bool, error) {
+func (s *MemStore) Versions(objId, bucketId string) ([]rest.ObjectInfo, bool, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
 
@@ -40,34 +301,201 @@ func (s *MemStore) Retrieve(objId, bucketId string) ([]byte, bool, error) {
 	if !ok {
 		return nil, false, nil
 	}
-
-	obj, ok := bucket[objId]
+	current, ok := bucket[objId]
 	if !ok {
 		return nil, false, nil
 	}
 
-	return []byte(obj), true, nil
+	var versions []rest.ObjectInfo
+	for obj := current; obj != nil; obj = obj.previous {
+		versions = append(versions, obj.info(objId))
+	}
+
+	return versions, true, nil
 }
 
-func (s *MemStore) Delete(objId, bucketId string) (bool, error) {
+func (s *MemStore) EnableVersioning(bucketId string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.versioned[bucketId] {
+		return nil
+	}
+	if err := s.persist(record{op: opVersioning, bucketId: bucketId}); err != nil {
+		return err
+	}
+	s.versioned[bucketId] = true
+	return nil
+}
+
+func (s *MemStore) List(bucketId string, opts rest.ListOptions) ([]rest.ObjectInfo, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	bucket, ok := s.buckets[bucketId]
 	if !ok {
-		return false, nil
+		return nil, false, nil
+	}
+
+	var objects []rest.ObjectInfo
+	for objId, obj := range bucket {
+		if !obj.deleted && strings.HasPrefix(objId, opts.Prefix) && objId > opts.StartAfter {
+			objects = append(objects, obj.info(objId))
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Id < objects[j].Id
+	})
+	if opts.Limit > 0 && len(objects) > opts.Limit {
+		objects = objects[:opts.Limit]
 	}
 
-	_, ok = bucket[objId]
+	return objects, true, nil
+}
+
+func (s *MemStore) Buckets() ([]rest.BucketInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	buckets := make([]rest.BucketInfo, 0, len(s.buckets))
+	for bucketId, bucket := range s.buckets {
+		bucketInfo := rest.BucketInfo{Id: bucketId, Versioning: s.versioned[bucketId]}
+		for _, current := range bucket {
+			if !current.deleted {
+				bucketInfo.Objects++
+			}
+			for obj := current; obj != nil; obj = obj.previous {
+				bucketInfo.Size += int64(len(obj.data))
+			}
+		}
+		buckets = append(buckets, bucketInfo)
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Id < buckets[j].Id
+	})
+
+	return buckets, nil
+}
+
+// put stores `obj` as the current version of the object `objId` in bucket `bucketId`, creating the bucket if needed.
+// If `obj` has a version ID the previous versions are kept, delete marker included, otherwise they are replaced.
+// The caller must hold the store mutex for writing.
+func (s *MemStore) put(objId, bucketId string, obj *object) {
+	bucket, ok := s.buckets[bucketId]
 	if !ok {
-		return false, nil
+		bucket = make(map[string]*object)
+		s.buckets[bucketId] = bucket
+	}
+	delta := versionSize(objId, obj)
+	if obj.versionId != "" {
+		obj.previous = bucket[objId]
+	} else {
+		for replaced := bucket[objId]; replaced != nil; replaced = replaced.previous {
+			delta -= versionSize(objId, replaced)
+		}
+	}
+	bucket[objId] = obj
+	s.budget.resize(objectKey{bucketId: bucketId, objId: objId}, delta, true)
+}
+
+// remove removes the version `versionId` of the object `objId` in bucket `bucketId`, if found, removing the bucket if
+// emptied. The caller must hold the store mutex for writing.
+func (s *MemStore) remove(objId, bucketId, versionId string) {
+	bucket := s.buckets[bucketId]
+	obj, next, ok := findVersion(bucket[objId], versionId)
+	if !ok {
+		return
+	}
+
+	s.budget.resize(objectKey{bucketId: bucketId, objId: objId}, -versionSize(objId, obj), false)
+
+	// Unlink the version from the chain of versions
+	if next != nil {
+		next.previous = obj.previous
+	} else if obj.previous != nil {
+		bucket[objId] = obj.previous
+	} else {
+		delete(bucket, objId)
 	}
-	delete(bucket, objId)
 
 	// if bucket has been emptied, delete it
 	if len(bucket) == 0 {
 		delete(s.buckets, bucketId)
 	}
+}
 
-	return true, nil
+// removeObject removes the object `objId` in bucket `bucketId` with all its versions, if found, removing the bucket if
+// emptied. The caller must hold the store mutex for writing.
+func (s *MemStore) removeObject(objId, bucketId string) {
+	bucket := s.buckets[bucketId]
+	current, ok := bucket[objId]
+	if !ok {
+		return
+	}
+
+	delta := int64(0)
+	for obj := current; obj != nil; obj = obj.previous {
+		delta -= versionSize(objId, obj)
+	}
+	s.budget.resize(objectKey{bucketId: bucketId, objId: objId}, delta, false)
+
+	delete(bucket, objId)
+	if len(bucket) == 0 {
+		delete(s.buckets, bucketId)
+	}
+}
+
+// findVersion finds the version `versionId` in the chain of versions starting from `current`, returning it along with
+// the following one, nil if it is the current one, and whether it has been found
+func findVersion(current *object, versionId string) (*object, *object, bool) {
+	var next *object
+	for obj := current; obj != nil; next, obj = obj, obj.previous {
+		if rest.VersionMatches(obj.versionId, versionId) {
+			return obj, next, true
+		}
+	}
+	return nil, nil, false
+}
+
+// getObject returns the version `versionId` of the object `objId` in bucket `bucketId`, the current one if empty,
+// and whether it has been found. Delete markers are never returned.
+// The caller must hold the store mutex.
+func (s *MemStore) getObject(objId, bucketId, versionId string) (*object, bool) {
+	bucket, ok := s.buckets[bucketId]
+	if !ok {
+		return nil, false
+	}
+
+	obj, ok := bucket[objId]
+	for ok && versionId != "" && !rest.VersionMatches(obj.versionId, versionId) {
+		obj = obj.previous
+		ok = obj != nil
+	}
+	if !ok || obj.deleted {
+		return nil, false
+	}
+	return obj, true
+}
+
+// info returns the information about the object
+func (o *object) info(objId string) rest.ObjectInfo {
+	return rest.ObjectInfo{
+		Id:           objId,
+		Size:         int64(len(o.data)),
+		ETag:         o.etag,
+		LastModified: o.modified,
+		ContentType:  o.contentType,
+		Metadata:     o.metadata,
+		VersionId:    o.versionId,
+		DeleteMarker: o.deleted,
+	}
+}
+
+// readSeekNopCloser wraps an io.ReadSeeker adding a no-op Close method
+type readSeekNopCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekNopCloser) Close() error {
+	return nil
 }
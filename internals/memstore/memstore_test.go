@@ -1,214 +1,413 @@
 package memstore
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest/storetest"
 	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
+var testTime = time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+
+func init() {
+	now = func() time.Time {
+		return testTime
+	}
+}
+
 func TestNewStore(t *testing.T) {
-	s := NewStore()
-	assert.IsType(t, sync.RWMutex{}, s.mu)
+	s, err := NewStore(Options{})
+	assert.NoError(t, err)
+	assert.IsType(t, &sync.RWMutex{}, &s.mu)
 	assert.NotNil(t, s.buckets)
 }
 
-func Test_memStore_Store(t *testing.T) {
-	type fields struct {
-		buckets map[string]map[string]string
-	}
-	type args struct {
-		obj      []byte
-		objId    string
-		bucketId string
+// newTestObject returns the object with the given data as stored at testTime
+func newTestObject(data string) *object {
+	etag := sha256.Sum256([]byte(data))
+	return &object{
+		data:     data,
+		etag:     hex.EncodeToString(etag[:]),
+		modified: testTime,
 	}
-	tests := []struct {
-		name       string
-		fields     fields
-		args       args
-		replaced   bool
-		bucketSize int
-	}{{
-		name:   "empty store",
-		fields: fields{buckets: make(map[string]map[string]string)},
-		args: args{
-			[]byte("test obj"),
-			"oid",
-			"bid",
-		},
-		bucketSize: 1,
-	}, {
-		name: "non empty store",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid2": "old obj"}},
-		},
-		args: args{
-			[]byte("test obj"),
-			"oid",
-			"bid",
-		},
-		bucketSize: 2,
-	}, {
-		name: "replace",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "old obj"}},
-		},
-		args: args{
-			[]byte("test obj"),
-			"oid",
-			"bid",
-		},
-		replaced:   true,
-		bucketSize: 1,
-	}, {
-		name: "replace",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "old obj"}},
-		},
-		args: args{
-			[]byte("test obj"),
-			"oid",
-			"bid",
-		},
-		replaced:   true,
-		bucketSize: 1,
-	}}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			s := MemStore{
-				buckets: tt.fields.buckets,
-			}
-			replaced, err := s.Store(tt.args.obj, tt.args.objId, tt.args.bucketId)
-			assert.NoErrorf(t, err, "Store(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Equalf(t, tt.replaced, replaced, "Store(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Equalf(t, string(tt.args.obj), s.buckets[tt.args.bucketId][tt.args.objId], "Store(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Lenf(t, s.buckets[tt.args.bucketId], tt.bucketSize, "Store(%v, %v)", tt.args.objId, tt.args.bucketId)
+}
+
+func TestConformance(t *testing.T) {
+	storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+		s, _ := NewStore(Options{})
+		return s
+	}, storetest.Options{})
+
+	for name, opts := range map[string]Options{
+		"append only": {AppendOnly: true, AppendFsync: FsyncAlways},
+		"snapshots":   {SnapshotInterval: time.Hour},
+	} {
+		opts := opts
+		t.Run(name, func(t *testing.T) {
+			storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+				opts.DataPath = dataPath
+				s, err := NewStore(opts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return s
+			}, storetest.Options{Durable: true})
 		})
 	}
 }
 
-func Test_memStore_Retrieve(t *testing.T) {
-	type fields struct {
-		buckets map[string]map[string]string
+// crash stops the background worker of the persistent store `s` and closes its append-only log, without syncing it
+// or taking a snapshot, as if the process crashed
+func crash(s *MemStore) {
+	close(s.quit)
+	s.workers.Wait()
+	if s.log != nil {
+		_ = s.log.file.Close()
 	}
-	type args struct {
-		objId    string
-		bucketId string
+}
+
+func newPersistentStore(t *testing.T, opts Options) *MemStore {
+	s, err := NewStore(opts)
+	if err != nil {
+		t.Fatal(err)
 	}
-	tests := []struct {
-		name      string
-		fields    fields
-		args      args
-		obj       string
-		retrieved bool
-	}{{
-		name: "ok",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj"}},
-		},
-		args:      args{objId: "oid", bucketId: "bid"},
-		obj:       "test obj",
-		retrieved: true,
-	}, {
-		name: "empty store",
-		fields: fields{
-			buckets: make(map[string]map[string]string),
-		},
-		args: args{objId: "oid", bucketId: "bid"},
-	}, {
-		name: "obj not found",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj"}},
-		},
-		args: args{objId: "oid1", bucketId: "bid"},
-	}, {
-		name: "bucket not found",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj"}},
-		},
-		args: args{objId: "oid", bucketId: "bid1"},
-	}}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			s := MemStore{
-				buckets: tt.fields.buckets,
-			}
-			obj, retrieved, err := s.Retrieve(tt.args.objId, tt.args.bucketId)
-			assert.NoErrorf(t, err, "Retrieve(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Equalf(t, tt.retrieved, retrieved, "Retrieve(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Equalf(t, tt.obj, string(obj), "Retrieve(%v, %v)", tt.args.objId, tt.args.bucketId)
-		})
+	return s
+}
+
+func storeTestObjects(t *testing.T, s *MemStore) {
+	_, _, err := s.Store(strings.NewReader("obj v0"), "oid", "bid", rest.StoreOptions{Metadata: map[string]string{"author": "me"}})
+	assert.NoError(t, err)
+	assert.NoError(t, s.EnableVersioning("bid"))
+	assert.NoError(t, s.EnableVersioning("bid2"))
+	_, _, err = s.Store(strings.NewReader("obj v1"), "oid", "bid", rest.StoreOptions{ContentType: "text/plain"})
+	assert.NoError(t, err)
+	_, _, err = s.Store(strings.NewReader("obj v2"), "oid", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	_, _, err = s.Store(strings.NewReader("obj"), "oid2", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	_, err = s.Delete("oid", "bid", "v1")
+	assert.NoError(t, err)
+	_, err = s.Delete("oid2", "bid", "")
+	assert.NoError(t, err)
+	_, _, err = s.Store(strings.NewReader("deleted"), "oid", "bid3", rest.StoreOptions{})
+	assert.NoError(t, err)
+	_, err = s.Delete("oid", "bid3", "")
+	assert.NoError(t, err)
+}
+
+// assertStoresEqual asserts the stores hold the same buckets, objects and versions
+func assertStoresEqual(t *testing.T, want, got *MemStore) {
+	assert.Equal(t, want.versioned, got.versioned)
+	if !assert.Len(t, got.buckets, len(want.buckets)) {
+		return
+	}
+	for bucketId, bucket := range want.buckets {
+		for objId := range bucket {
+			wantVersions, _, _ := want.Versions(objId, bucketId)
+			gotVersions, _, _ := got.Versions(objId, bucketId)
+			assert.Equal(t, wantVersions, gotVersions, "%s/%s", bucketId, objId)
+		}
+		assert.Len(t, got.buckets[bucketId], len(bucket))
+	}
+}
+
+func TestMemStore_AppendOnly(t *testing.T) {
+	versions := 0
+	newVersionId = func() string {
+		versions++
+		return fmt.Sprintf("v%d", versions)
+	}
+	defer func() { newVersionId = rest.NewVersionId }()
+
+	dataPath := t.TempDir()
+	opts := Options{DataPath: dataPath, AppendOnly: true, AppendFsync: FsyncNo}
+	s := newPersistentStore(t, opts)
+	storeTestObjects(t, s)
+	crash(s)
+	assert.NoFileExists(t, filepath.Join(dataPath, snapshotFileName))
+	assert.FileExists(t, logPath(dataPath, 0))
+
+	// The changes are replayed from the log, continuing in a new one
+	s2 := newPersistentStore(t, opts)
+	assertStoresEqual(t, s, s2)
+	assert.Equal(t, uint64(1), s2.gen)
+	assert.FileExists(t, logPath(dataPath, 1))
+	_, _, err := s2.Store(strings.NewReader("new obj"), "oid3", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, s2.Close())
+
+	// An incomplete record at the end of the log is truncated
+	logFile, err := os.OpenFile(logPath(dataPath, 1), os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	fi, _ := logFile.Stat()
+	record := encodeRecord(record{op: opRemove, bucketId: "bid", objId: "oid3", versionId: "v6"})
+	_, _ = logFile.Write(record[:len(record)-1])
+	_ = logFile.Close()
+
+	s3 := newPersistentStore(t, opts)
+	assertStoresEqual(t, s2, s3)
+	fi2, err := os.Stat(logPath(dataPath, 1))
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Size(), fi2.Size())
+	assert.NoError(t, s3.Close())
+
+	// A corrupted record is reported
+	logFile, _ = os.OpenFile(logPath(dataPath, 0), os.O_WRONLY, 0644)
+	_, _ = logFile.WriteAt([]byte{0xff}, headerSize+recordHeaderSize+1)
+	_ = logFile.Close()
+	_, err = NewStore(opts)
+	assert.Error(t, err)
+}
+
+func TestMemStore_Snapshot(t *testing.T) {
+	versions := 0
+	newVersionId = func() string {
+		versions++
+		return fmt.Sprintf("v%d", versions)
 	}
+	defer func() { newVersionId = rest.NewVersionId }()
+
+	dataPath := t.TempDir()
+	opts := Options{DataPath: dataPath, AppendOnly: true}
+	s := newPersistentStore(t, opts)
+	storeTestObjects(t, s)
+
+	// The snapshot replaces the log
+	assert.NoError(t, s.Snapshot())
+	assert.FileExists(t, filepath.Join(dataPath, snapshotFileName))
+	assert.NoFileExists(t, logPath(dataPath, 0))
+	assert.FileExists(t, logPath(dataPath, 1))
+	_, _, err := s.Store(strings.NewReader("new obj"), "oid3", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	crash(s)
+
+	s2 := newPersistentStore(t, opts)
+	assertStoresEqual(t, s, s2)
+	assert.NoError(t, s2.Close())
+
+	// Without append-only log, the snapshot taken when closing the store replaces the logs
+	opts.AppendOnly = false
+	s3 := newPersistentStore(t, opts)
+	assertStoresEqual(t, s, s3)
+	logs, _ := listLogs(dataPath)
+	assert.Empty(t, logs)
+	_, err = s3.Delete("oid3", "bid", "")
+	assert.NoError(t, err)
+	assert.NoError(t, s3.Close())
+
+	s4 := newPersistentStore(t, opts)
+	assertStoresEqual(t, s3, s4)
+	// Changes after the last snapshot are lost by a crash
+	_, _, err = s4.Store(strings.NewReader("lost obj"), "oid4", "bid", rest.StoreOptions{})
+	assert.NoError(t, err)
+	crash(s4)
+	s5 := newPersistentStore(t, opts)
+	assertStoresEqual(t, s3, s5)
+	assert.NoError(t, s5.Close())
 }
 
-func Test_memStore_Delete(t *testing.T) {
-	type fields struct {
-		buckets map[string]map[string]string
+func TestMemStore_LogRewrite(t *testing.T) {
+	dataPath := t.TempDir()
+	s := newPersistentStore(t, Options{DataPath: dataPath, AppendOnly: true, LogRewriteSize: 1024})
+	defer s.Close()
+
+	data := strings.Repeat("x", 600)
+	for i := 0; i < 2; i++ {
+		_, _, err := s.Store(strings.NewReader(data), "oid", "bid", rest.StoreOptions{})
+		assert.NoError(t, err)
 	}
-	type args struct {
-		objId    string
-		bucketId string
+	assert.Eventually(t, func() bool {
+		logs, _ := listLogs(dataPath)
+		return len(logs) == 1 && logs[0] == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.FileExists(t, filepath.Join(dataPath, snapshotFileName))
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	for _, p := range []FsyncPolicy{FsyncAlways, FsyncEverySecond, FsyncNo} {
+		parsed, err := ParseFsyncPolicy(string(p))
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
 	}
+	_, err := ParseFsyncPolicy("sometimes")
+	assert.Error(t, err)
+	_, err = NewStore(Options{AppendFsync: "sometimes"})
+	assert.Error(t, err)
+}
+
+func TestMemStore_MemoryBudget(t *testing.T) {
+	data := strings.Repeat("x", 1000)
+	objSize := versionSize("o1", &object{data: data, etag: newTestObject(data).etag})
 	tests := []struct {
-		name        string
-		fields      fields
-		args        args
-		deleted     bool
-		bucketsSize map[string]int
+		name    string
+		policy  EvictionPolicy
+		use     []string // Objects retrieved after storing o1, o2 and o3
+		store   []string // Objects stored then
+		want    []string // Objects left
+		evicted int64
 	}{{
-		name: "emptied",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj"}},
-		},
-		args:    args{objId: "oid", bucketId: "bid"},
-		deleted: true,
-	}, {
-		name: "not emptied",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj", "oid2": "test obj2"}, "bid1": {"oid": "test obj3"}},
-		},
-		args:        args{objId: "oid", bucketId: "bid"},
-		deleted:     true,
-		bucketsSize: map[string]int{"bid": 1, "bid1": 1},
+		name:    "lru",
+		policy:  EvictLRU,
+		use:     []string{"o1"},
+		store:   []string{"o4", "o5"},
+		want:    []string{"o1", "o4", "o5"},
+		evicted: 2,
 	}, {
-		name: "empty",
-		fields: fields{
-			buckets: make(map[string]map[string]string),
-		},
-		args: args{objId: "oid", bucketId: "bid"},
+		name:    "lfu",
+		policy:  EvictLFU,
+		use:     []string{"o2", "o1", "o2", "o3"},
+		store:   []string{"o4", "o5"},
+		want:    []string{"o2", "o3", "o5"},
+		evicted: 2,
 	}, {
-		name: "obj not found",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj"}},
-		},
-		args:        args{objId: "oid1", bucketId: "bid"},
-		bucketsSize: map[string]int{"bid": 1},
-	}, {
-		name: "bucket not found",
-		fields: fields{
-			buckets: map[string]map[string]string{"bid": {"oid": "test obj"}},
-		},
-		args:        args{objId: "oid", bucketId: "bid1"},
-		bucketsSize: map[string]int{"bid": 1},
+		name:   "reject",
+		policy: EvictReject,
+		use:    []string{"o1"},
+		store:  []string{"o4"},
+		want:   []string{"o1", "o2", "o3"},
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			s := MemStore{
-				buckets: tt.fields.buckets,
+			s := newPersistentStore(t, Options{MemoryBudget: 3*objSize + objSize/2, EvictionPolicy: tt.policy})
+			for _, objId := range []string{"o1", "o2", "o3"} {
+				_, _, err := s.Store(strings.NewReader(data), objId, "bid", rest.StoreOptions{})
+				assert.NoError(t, err)
 			}
-			deleted, err := s.Delete(tt.args.objId, tt.args.bucketId)
-			assert.NoErrorf(t, err, "Delete(%v, %v)", tt.args.objId, tt.args.bucketId)
-			assert.Equalf(t, tt.deleted, deleted, "Delete(%v, %v)", tt.args.objId, tt.args.bucketId)
-			if tt.bucketsSize == nil {
-				assert.Empty(t, s.buckets)
-			} else {
-				for bucketId, bucketSize := range tt.bucketsSize {
-					assert.Lenf(t, s.buckets[bucketId], bucketSize, "Store(%v, %v)", tt.args.objId, tt.args.bucketId)
-					if bucketSize == 0 {
-						// If bucket has been emptied, it should have been removed from the map
-						assert.Zerof(t, s.buckets[bucketId], "Store(%v, %v)", tt.args.objId, tt.args.bucketId)
-					}
+			for _, objId := range tt.use {
+				_, ok, _ := s.Stat(objId, "bid", "")
+				assert.True(t, ok)
+			}
+			for _, objId := range tt.store {
+				_, _, err := s.Store(strings.NewReader(data), objId, "bid", rest.StoreOptions{})
+				if tt.policy == EvictReject {
+					assert.ErrorIs(t, err, rest.ErrInsufficientStorage)
+				} else {
+					assert.NoError(t, err)
 				}
 			}
+
+			objects, _, _ := s.List("bid", rest.ListOptions{})
+			var ids []string
+			for _, obj := range objects {
+				ids = append(ids, obj.Id)
+			}
+			assert.Equal(t, tt.want, ids)
+			stats := s.Stats()
+			assert.Equal(t, 3*objSize, stats["memory_used_bytes"])
+			assert.Equal(t, 3*objSize, stats["bucket_used_bytes.bid"])
+			assert.Equal(t, tt.evicted, stats["evicted_objects"])
+			assert.Equal(t, tt.evicted*objSize, stats["evicted_bytes"])
+			assert.Len(t, s.budget.objects, 3)
+			if tt.evicted > 0 {
+				assert.Equal(t, tt.evicted, stats["bucket_evicted_objects.bid"])
+			} else {
+				assert.Equal(t, int64(len(tt.store)), stats["rejected_objects"])
+			}
 		})
 	}
 }
+
+func TestMemStore_MemoryBudgetAccounting(t *testing.T) {
+	versions := 0
+	newVersionId = func() string {
+		versions++
+		return fmt.Sprintf("v%d", versions)
+	}
+	defer func() { newVersionId = rest.NewVersionId }()
+
+	s := newPersistentStore(t, Options{MemoryBudget: 5000})
+	store := func(objId, bucketId, data string) error {
+		_, _, err := s.Store(strings.NewReader(data), objId, bucketId, rest.StoreOptions{})
+		return err
+	}
+	assert.NoError(t, store("o1", "b1", strings.Repeat("x", 1000)))
+	assert.NoError(t, s.EnableVersioning("b2"))
+	assert.NoError(t, store("o1", "b2", strings.Repeat("x", 1000)))
+	assert.NoError(t, store("o1", "b2", strings.Repeat("y", 1000)))
+	_, err := s.Delete("o1", "b2", "")
+	assert.NoError(t, err)
+
+	// Each bucket accounts for all the versions of its objects
+	null := versionSize("o1", s.buckets["b1"]["o1"])
+	v1 := versionSize("o1", s.buckets["b2"]["o1"].previous.previous)
+	marker := versionSize("o1", s.buckets["b2"]["o1"])
+	stats := s.Stats()
+	assert.Equal(t, null, stats["bucket_used_bytes.b1"])
+	assert.Equal(t, 2*v1+marker, stats["bucket_used_bytes.b2"])
+	assert.Equal(t, null+2*v1+marker, stats["memory_used_bytes"])
+
+	// Replacing an object frees its memory first, the object itself is never evicted
+	assert.NoError(t, store("o1", "b1", strings.Repeat("z", 1400)))
+	assert.Equal(t, int64(0), s.Stats()["evicted_objects"])
+	// Objects larger than the budget are rejected
+	err = store("o2", "b1", strings.Repeat("x", 5000))
+	assert.ErrorIs(t, err, rest.ErrInsufficientStorage)
+	assert.Equal(t, int64(1), s.Stats()["rejected_objects"])
+
+	// Evicting the versioned object frees all its versions
+	assert.NoError(t, store("o3", "b1", strings.Repeat("x", 1000)))
+	_, ok, _ := s.Versions("o1", "b2")
+	assert.False(t, ok)
+	stats = s.Stats()
+	assert.Equal(t, int64(1), stats["bucket_evicted_objects.b2"])
+	assert.Equal(t, 2*v1+marker, stats["evicted_bytes"])
+	assert.NotContains(t, stats, "bucket_used_bytes.b2")
+
+	// Deleting objects frees their memory
+	for _, objId := range []string{"o1", "o3"} {
+		_, err = s.Delete(objId, "b1", "")
+		assert.NoError(t, err)
+	}
+	stats = s.Stats()
+	assert.Equal(t, int64(0), stats["memory_used_bytes"])
+	assert.NotContains(t, stats, "bucket_used_bytes.b1")
+	assert.Empty(t, s.budget.objects)
+	assert.Zero(t, s.budget.lru.Len())
+}
+
+func TestMemStore_MemoryBudgetPersistence(t *testing.T) {
+	dataPath := t.TempDir()
+	data := strings.Repeat("x", 1000)
+	opts := Options{DataPath: dataPath, AppendOnly: true, MemoryBudget: 3000}
+	s := newPersistentStore(t, opts)
+	for _, objId := range []string{"o1", "o2", "o3"} {
+		_, _, err := s.Store(strings.NewReader(data), objId, "bid", rest.StoreOptions{})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, int64(1), s.Stats()["evicted_objects"])
+	assert.NoError(t, s.Close())
+
+	// Evictions are replayed
+	s = newPersistentStore(t, opts)
+	objects, _, _ := s.List("bid", rest.ListOptions{})
+	assert.Len(t, objects, 2)
+	assert.NoError(t, s.Close())
+
+	// The objects over a smaller budget are evicted when loading them
+	opts.MemoryBudget = 2000
+	s = newPersistentStore(t, opts)
+	objects, _, _ = s.List("bid", rest.ListOptions{})
+	assert.Len(t, objects, 1)
+	assert.Equal(t, int64(1), s.Stats()["evicted_objects"])
+	assert.NoError(t, s.Close())
+}
+
+func TestParseEvictionPolicy(t *testing.T) {
+	for _, p := range []EvictionPolicy{EvictLRU, EvictLFU, EvictReject} {
+		parsed, err := ParseEvictionPolicy(string(p))
+		assert.NoError(t, err)
+		assert.Equal(t, p, parsed)
+	}
+	_, err := ParseEvictionPolicy("random")
+	assert.Error(t, err)
+	_, err = NewStore(Options{EvictionPolicy: "random"})
+	assert.Error(t, err)
+}
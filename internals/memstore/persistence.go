@@ -0,0 +1,697 @@
+package memstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A MemStore with a data path persists its content, similarly to Redis: the whole content is written to a snapshot
+// file, periodically and when the store is closed, and with AppendOnly every change is also appended to an append-only
+// log before being applied. NewStore loads the last snapshot and replays the changes logged after it, so the changes
+// lost by a crash are the ones after the last snapshot, or with AppendOnly the ones not synced yet according to the
+// AppendFsync policy.
+//
+// Snapshots and logs are sequences of records, each changing the content of the store:
+// <payload len uint64> <payload crc32c uint32> <payload>
+// The payload starts with the operation, followed by its fields (see encodeRecord). A snapshot holds a record storing
+// each object version, oldest first, along with a record enabling versioning on each versioned bucket.
+//
+// Logs are numbered by generation, starting a new log each time a snapshot is taken. The snapshot header holds the
+// generation of the log started with it, so the logs before it are removed once the snapshot is written, and the logs
+// from it on are replayed after loading the snapshot. A snapshot is also taken when the log exceeds LogRewriteSize,
+// to bound its replay time.
+// An incomplete record at the end of a log, left by a crash while writing it, is truncated when loading it.
+
+const (
+	snapshotFileName    = "snapshot.dat"
+	snapshotTmpFileName = "snapshot.dat.tmp"
+	logFilePrefix       = "appendonly."
+	logFileExt          = ".log"
+
+	snapshotMagic = "MEMSNAP1"
+	logMagic      = "MEMLOG01"
+	headerSize    = 16 // Magic and generation
+
+	recordHeaderSize = 12 // Payload size and checksum
+)
+
+// defaultLogRewriteSize is the default size in bytes of the append-only log above which a snapshot is taken
+const defaultLogRewriteSize = 64 << 20 // 64MiB
+
+// FsyncPolicy is the policy syncing the append-only log to disk
+type FsyncPolicy string
+
+const (
+	// FsyncAlways syncs the log at each change, before acknowledging it
+	FsyncAlways FsyncPolicy = "always"
+	// FsyncEverySecond syncs the log once a second, losing at most the last second of changes on a system crash
+	FsyncEverySecond FsyncPolicy = "everysec"
+	// FsyncNo leaves syncing the log to the operating system
+	FsyncNo FsyncPolicy = "no"
+)
+
+// ParseFsyncPolicy parses a fsync policy from its name
+func ParseFsyncPolicy(s string) (FsyncPolicy, error) {
+	switch p := FsyncPolicy(s); p {
+	case FsyncAlways, FsyncEverySecond, FsyncNo:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown fsync policy %q", s)
+	}
+}
+
+// Operations of the records
+const (
+	opStore      byte = iota + 1 // Stores an object version, keeping the previous ones if it has a version ID
+	opRemove                     // Removes an object version
+	opVersioning                 // Enables versioning on a bucket
+	opEvict                      // Evicts an object, with all its versions
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord is returned reading an incomplete record at the end of a file
+var errTornRecord = errors.New("incomplete record")
+
+// record is a change to the content of the store
+type record struct {
+	op        byte
+	bucketId  string
+	objId     string
+	versionId string
+	obj       *object // Stored object version, for opStore
+}
+
+// appendLog is the append-only log of a MemStore, guarded by the store mutex
+type appendLog struct {
+	file *os.File
+	gen  uint64 // Generation of the log
+	size int64  // Size in bytes of the log file
+	err  error  // Error which failed the log, if any
+}
+
+// persist persists the change `rec` to the append-only log, if any, before it is applied.
+// The caller must hold the store mutex for writing.
+func (s *MemStore) persist(rec record) error {
+	if s.opts.DataPath == "" {
+		return nil
+	}
+	s.changes++
+
+	l := s.log
+	if l == nil {
+		return nil
+	}
+	if l.err != nil {
+		return l.err
+	}
+
+	buf := encodeRecord(rec)
+	if _, err := l.file.Write(buf); err != nil {
+		// Drop any partially written record
+		if truncErr := l.file.Truncate(l.size); truncErr != nil {
+			l.err = fmt.Errorf("append-only log failed: %w", truncErr)
+		}
+		return err
+	}
+	l.size += int64(len(buf))
+	if s.opts.AppendFsync == FsyncAlways {
+		if err := l.file.Sync(); err != nil {
+			l.err = fmt.Errorf("append-only log failed: %w", err)
+			return l.err
+		}
+	}
+
+	if l.size >= s.opts.LogRewriteSize {
+		select {
+		case s.snapshots <- struct{}{}:
+		default:
+			// Snapshot already requested
+		}
+	}
+	return nil
+}
+
+// Snapshot writes the content of the store to its snapshot file, starting a new append-only log.
+// It is called periodically and when the log grows too much, calling it otherwise is only needed to bound the changes
+// lost by a crash of a store without AppendOnly.
+func (s *MemStore) Snapshot() error {
+	if s.opts.DataPath == "" {
+		return errors.New("memory store without data path")
+	}
+
+	s.snapshotMu.Lock()
+	defer s.snapshotMu.Unlock()
+
+	// Take the records and start the new log at the same point in time
+	s.mu.Lock()
+	records := s.records()
+	gen := s.gen + 1
+	oldLog := s.log
+	if oldLog != nil {
+		newLog, err := createLog(s.opts.DataPath, gen)
+		if err != nil {
+			s.mu.Unlock()
+			return fmt.Errorf("cannot create append-only log: %w", err)
+		}
+		s.log = newLog
+	}
+	s.gen = gen
+	changes := s.changes
+	s.changes = 0
+	s.mu.Unlock()
+
+	if oldLog != nil {
+		// The changes in the old log are in the snapshot, they are kept until it is written
+		if err := closeLog(oldLog); err != nil {
+			s.logger.Warnf("Cannot close append-only log: %v", err)
+		}
+	}
+	if err := writeSnapshot(s.opts.DataPath, gen, records); err != nil {
+		s.mu.Lock()
+		s.changes += changes
+		s.mu.Unlock()
+		return err
+	}
+
+	logGens, err := listLogs(s.opts.DataPath)
+	if err != nil {
+		return err
+	}
+	for _, logGen := range logGens {
+		if logGen < gen {
+			if err = os.Remove(logPath(s.opts.DataPath, logGen)); err != nil {
+				return err
+			}
+		}
+	}
+	s.logger.Debugf("Written snapshot of %d records", len(records))
+	return nil
+}
+
+// records returns the records rebuilding the content of the store.
+// The caller must hold the store mutex.
+func (s *MemStore) records() []record {
+	var records []record
+	for bucketId, versioned := range s.versioned {
+		if versioned {
+			records = append(records, record{op: opVersioning, bucketId: bucketId})
+		}
+	}
+	for bucketId, bucket := range s.buckets {
+		for objId, current := range bucket {
+			first := len(records)
+			for obj := current; obj != nil; obj = obj.previous {
+				records = append(records, record{op: opStore, bucketId: bucketId, objId: objId, versionId: obj.versionId, obj: obj})
+			}
+			// Oldest version first
+			for i, j := first, len(records)-1; i < j; i, j = i+1, j-1 {
+				records[i], records[j] = records[j], records[i]
+			}
+		}
+	}
+	return records
+}
+
+// apply applies the change `rec` to the content of the store.
+// The caller must hold the store mutex for writing.
+func (s *MemStore) apply(rec record) {
+	switch rec.op {
+	case opStore:
+		s.put(rec.objId, rec.bucketId, rec.obj)
+	case opRemove:
+		s.remove(rec.objId, rec.bucketId, rec.versionId)
+	case opVersioning:
+		s.versioned[rec.bucketId] = true
+	case opEvict:
+		s.removeObject(rec.objId, rec.bucketId)
+	}
+}
+
+// load loads the snapshot and replays the append-only logs in the data path
+func (s *MemStore) load() error {
+	dataPath := s.opts.DataPath
+	if err := os.Remove(path.Join(dataPath, snapshotTmpFileName)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	snapshotPath := path.Join(dataPath, snapshotFileName)
+	gen, records, err := readFile(snapshotPath, snapshotMagic, false, s.apply)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot load snapshot: %w", err)
+	}
+	if records > 0 {
+		s.logger.Infof("Loaded snapshot of %d records", records)
+	}
+	s.gen = gen
+
+	logGens, err := listLogs(dataPath)
+	if err != nil {
+		return err
+	}
+	for _, logGen := range logGens {
+		if logGen < s.gen {
+			// Left by a crash before removing it after the snapshot
+			if err = os.Remove(logPath(dataPath, logGen)); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, records, err = readFile(logPath(dataPath, logGen), logMagic, true, s.apply); err != nil {
+			return fmt.Errorf("cannot replay append-only log %d: %w", logGen, err)
+		}
+		s.logger.Infof("Replayed %d records from append-only log %d", records, logGen)
+		s.gen = logGen + 1
+		s.changes += records
+	}
+	return nil
+}
+
+// readFile reads the records of the snapshot or log file at `filePath`, starting with the header `magic`, calling
+// `apply` for each of them. If `truncate`, an incomplete record at the end of the file is truncated.
+// It returns the generation in the header and the number of records read along with any error.
+func readFile(filePath, magic string, truncate bool, apply func(record)) (uint64, int, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(file)
+	header := make([]byte, headerSize)
+	if _, err = io.ReadFull(r, header); err != nil || string(header[:8]) != magic {
+		if truncate && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			// Log being created
+			return 0, 0, os.Truncate(filePath, 0)
+		}
+		return 0, 0, errors.New("invalid header")
+	}
+	gen := binary.BigEndian.Uint64(header[8:])
+
+	offset := int64(headerSize)
+	records := 0
+	for {
+		rec, size, err := readRecord(r, fi.Size()-offset)
+		if err == io.EOF {
+			return gen, records, nil
+		}
+		if err == errTornRecord && truncate {
+			return gen, records, os.Truncate(filePath, offset)
+		}
+		if err != nil {
+			return gen, records, fmt.Errorf("record at offset %d: %w", offset, err)
+		}
+		apply(rec)
+		offset += size
+		records++
+	}
+}
+
+// readRecord reads a record from `r`, with `remaining` bytes left, returning it along with its size in bytes and any
+// error. It returns io.EOF at the end of `r`, and errTornRecord if the record is incomplete.
+func readRecord(r *bufio.Reader, remaining int64) (record, int64, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTornRecord
+		}
+		return record{}, 0, err
+	}
+	size := binary.BigEndian.Uint64(header)
+	if size > uint64(remaining-recordHeaderSize) {
+		return record{}, 0, errTornRecord
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errTornRecord
+		}
+		return record{}, 0, err
+	}
+	if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[8:]) {
+		if _, err := r.Peek(1); err == io.EOF {
+			// The last record has been partially synced
+			return record{}, 0, errTornRecord
+		}
+		return record{}, 0, errors.New("checksum mismatch")
+	}
+
+	rec, err := decodeRecord(payload)
+	return rec, int64(recordHeaderSize + len(payload)), err
+}
+
+// encodeRecord encodes `rec` with its header, the payload is made of:
+// <op> <bucketId> <objId> <versionId>
+// followed for opStore by:
+// <deleted> <modified unix nanoseconds> <etag> <content type> <metadata pairs count> [<key> <value>...] <data>
+// where strings are prefixed by their length, and integers are varints.
+func encodeRecord(rec record) []byte {
+	size := recordPayloadSize(rec)
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+size)
+	buf = append(buf, rec.op)
+	buf = appendString(appendString(appendString(buf, rec.bucketId), rec.objId), rec.versionId)
+	if rec.op == opStore {
+		obj := rec.obj
+		deleted := byte(0)
+		if obj.deleted {
+			deleted = 1
+		}
+		buf = append(buf, deleted)
+		buf = appendVarint(buf, obj.modified.UnixNano())
+		buf = appendString(appendString(buf, obj.etag), obj.contentType)
+		buf = appendUvarint(buf, uint64(len(obj.metadata)))
+		for _, key := range sortedKeys(obj.metadata) {
+			buf = appendString(appendString(buf, key), obj.metadata[key])
+		}
+		buf = appendString(buf, obj.data)
+	}
+
+	payload := buf[recordHeaderSize:]
+	binary.BigEndian.PutUint64(buf, uint64(len(payload)))
+	binary.BigEndian.PutUint32(buf[8:], crc32.Checksum(payload, crcTable))
+	return buf
+}
+
+// recordPayloadSize returns the size in bytes of the payload of the encoded `rec`
+func recordPayloadSize(rec record) int {
+	size := 1 + stringSize(rec.bucketId) + stringSize(rec.objId) + stringSize(rec.versionId)
+	if rec.op == opStore {
+		obj := rec.obj
+		size += 1 + varintSize(obj.modified.UnixNano()) + stringSize(obj.etag) + stringSize(obj.contentType)
+		size += uvarintSize(uint64(len(obj.metadata)))
+		for key, value := range obj.metadata {
+			size += stringSize(key) + stringSize(value)
+		}
+		size += stringSize(obj.data)
+	}
+	return size
+}
+
+// decodeRecord decodes the record from its payload
+func decodeRecord(payload []byte) (record, error) {
+	d := decoder{buf: payload}
+	rec := record{op: d.byte()}
+	rec.bucketId, rec.objId, rec.versionId = d.string(), d.string(), d.string()
+	switch rec.op {
+	case opStore:
+		obj := &object{versionId: rec.versionId}
+		obj.deleted = d.byte() == 1
+		obj.modified = time.Unix(0, d.varint()).UTC()
+		obj.etag, obj.contentType = d.string(), d.string()
+		if n := d.uvarint(); n > 0 && d.err == nil {
+			obj.metadata = make(map[string]string)
+			for i := uint64(0); i < n && d.err == nil; i++ {
+				key := d.string()
+				obj.metadata[key] = d.string()
+			}
+		}
+		obj.data = d.string()
+		rec.obj = obj
+	case opRemove, opVersioning, opEvict:
+	default:
+		return record{}, fmt.Errorf("unknown operation %d", rec.op)
+	}
+	if d.err == nil && len(d.buf) > 0 {
+		d.err = errors.New("trailing bytes")
+	}
+	return rec, d.err
+}
+
+// decoder decodes the fields of a record payload, keeping the first error
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.fail()
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if d.err != nil || n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) varint() int64 {
+	v, n := binary.Varint(d.buf)
+	if d.err != nil || n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.buf)) {
+		d.fail()
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errors.New("truncated record")
+	}
+}
+
+func appendString(buf []byte, s string) []byte {
+	return append(appendUvarint(buf, uint64(len(s))), s...)
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func appendVarint(buf []byte, v int64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutVarint(b[:], v)]...)
+}
+
+func stringSize(s string) int {
+	return uvarintSize(uint64(len(s))) + len(s)
+}
+
+func uvarintSize(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
+
+func varintSize(v int64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutVarint(buf[:], v)
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeHeader writes the file header with `magic` and generation `gen` to `w`
+func writeHeader(w io.Writer, magic string, gen uint64) error {
+	header := make([]byte, headerSize)
+	copy(header, magic)
+	binary.BigEndian.PutUint64(header[8:], gen)
+	_, err := w.Write(header)
+	return err
+}
+
+// writeSnapshot writes the snapshot of `records`, followed by the log of generation `gen`, to a temporary file and
+// then moves it in place of the snapshot file in `dataPath`
+func writeSnapshot(dataPath string, gen uint64, records []record) error {
+	tmpPath := path.Join(dataPath, snapshotTmpFileName)
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+
+	w := bufio.NewWriterSize(file, 1<<20)
+	err = writeHeader(w, snapshotMagic, gen)
+	for i := 0; i < len(records) && err == nil; i++ {
+		_, err = w.Write(encodeRecord(records[i]))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(tmpPath, path.Join(dataPath, snapshotFileName)); err != nil {
+		return err
+	}
+	return syncFile(dataPath)
+}
+
+// createLog creates the append-only log of generation `gen` in `dataPath`
+func createLog(dataPath string, gen uint64) (*appendLog, error) {
+	file, err := os.OpenFile(logPath(dataPath, gen), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeHeader(file, logMagic, gen); err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = syncFile(dataPath)
+	}
+	if err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	return &appendLog{file: file, gen: gen, size: headerSize}, nil
+}
+
+// closeLog syncs and closes the append-only log
+func closeLog(l *appendLog) error {
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// syncLog syncs the append-only log, once a second with FsyncEverySecond
+func (s *MemStore) syncLog() error {
+	s.mu.RLock()
+	l := s.log
+	s.mu.RUnlock()
+
+	err := l.file.Sync()
+	if err == nil || errors.Is(err, os.ErrClosed) {
+		// Closed if replaced by a snapshot, which synced it
+		return nil
+	}
+	s.mu.Lock()
+	if l.err == nil {
+		l.err = fmt.Errorf("append-only log failed: %w", err)
+	}
+	s.mu.Unlock()
+	return err
+}
+
+// logPath returns the path of the append-only log of generation `gen` in `dataPath`
+func logPath(dataPath string, gen uint64) string {
+	return path.Join(dataPath, logFilePrefix+strconv.FormatUint(gen, 10)+logFileExt)
+}
+
+// listLogs returns the sorted generations of the append-only logs in `dataPath`
+func listLogs(dataPath string) ([]uint64, error) {
+	entries, err := os.ReadDir(dataPath)
+	if err != nil {
+		return nil, err
+	}
+	var gens []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, logFilePrefix) || !strings.HasSuffix(name, logFileExt) {
+			continue
+		}
+		gen, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, logFilePrefix), logFileExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		gens = append(gens, gen)
+	}
+	sort.Slice(gens, func(i, j int) bool {
+		return gens[i] < gens[j]
+	})
+	return gens, nil
+}
+
+// syncFile syncs the file, or directory, at `path` to disk
+func syncFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// persister takes the snapshots, periodically and when requested, and syncs the append-only log once a second with
+// FsyncEverySecond, until the store is closed
+func (s *MemStore) persister() {
+	defer s.workers.Done()
+
+	var snapshotTicks, syncTicks <-chan time.Time
+	if s.opts.SnapshotInterval > 0 {
+		ticker := time.NewTicker(s.opts.SnapshotInterval)
+		defer ticker.Stop()
+		snapshotTicks = ticker.C
+	}
+	if s.opts.AppendOnly && s.opts.AppendFsync == FsyncEverySecond {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		syncTicks = ticker.C
+	}
+
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-syncTicks:
+			if err := s.syncLog(); err != nil {
+				s.logger.Errorf("Cannot sync append-only log: %v", err)
+			}
+		case <-snapshotTicks:
+			s.mu.RLock()
+			changed := s.changes > 0
+			s.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			if err := s.Snapshot(); err != nil {
+				s.logger.Errorf("Cannot write snapshot: %v", err)
+			}
+		case <-s.snapshots:
+			if err := s.Snapshot(); err != nil {
+				s.logger.Errorf("Cannot write snapshot: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package rest
+
+import (
+	"net/http"
+	"time"
+)
+
+// QuarantinedBucket holds the information about a bucket taken offline because its stored data is corrupted
+type QuarantinedBucket struct {
+	Id     string    `json:"id"`
+	Path   string    `json:"path"`           // Path where the bucket data has been moved to
+	Reason string    `json:"reason"`         // Error which caused the quarantine
+	Time   time.Time `json:"quarantined_at"` // Time of the quarantine
+}
+
+// Quarantiner is implemented by the object stores which quarantine buckets with corrupted data,
+// keeping the other buckets available.
+//
+// Quarantined returns the buckets in quarantine sorted by bucket ID, along with any error encountered in the process.
+type Quarantiner interface {
+	Quarantined() ([]QuarantinedBucket, error)
+}
+
+type quarantineResponse struct {
+	Buckets []QuarantinedBucket `json:"buckets"`
+}
+
+// HandleQuarantined lists the buckets in quarantine, if the store quarantines buckets
+func (h *Handler) HandleQuarantined(w http.ResponseWriter, _ *http.Request) {
+	var buckets []QuarantinedBucket
+	if q, ok := h.store.(Quarantiner); ok {
+		var err error
+		if buckets, err = q.Quarantined(); err != nil {
+			http.Error(w, "Error listing quarantined buckets: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if buckets == nil {
+		buckets = []QuarantinedBucket{}
+	}
+
+	writeJSON(w, http.StatusOK, quarantineResponse{Buckets: buckets})
+}
+
+// StatsReporter is implemented by the object stores reporting statistics about their operation, like the memory they
+// use or their cache hits.
+//
+// Stats returns the current value of each statistic by name. Statistics about a bucket are named
+// <statistic>.<bucketId>.
+type StatsReporter interface {
+	Stats() map[string]int64
+}
+
+type statsResponse struct {
+	Stats map[string]int64 `json:"stats"`
+}
+
+// HandleStats reports the statistics of the store, if the store reports any
+func (h *Handler) HandleStats(w http.ResponseWriter, _ *http.Request) {
+	var stats map[string]int64
+	if sr, ok := h.store.(StatsReporter); ok {
+		stats = sr.Stats()
+	}
+	if stats == nil {
+		stats = map[string]int64{}
+	}
+
+	writeJSON(w, http.StatusOK, statsResponse{Stats: stats})
+}
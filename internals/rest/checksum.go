@@ -0,0 +1,68 @@
+package rest
+
+import (
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// castagnoli is the CRC-32C table used to compute the checksums of the object data
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// checksumReader reads an object from a section of the data it is stored in, verifying it against its checksum.
+// The object data is verified while it is read sequentially from the beginning, even after seeking back to where the
+// verified data ends or to the beginning: the last bytes of the object are returned only if the data matches its
+// checksum, otherwise the read fails with an error wrapping ErrCorruptedObject, so that corrupted objects are never
+// served whole. Reads elsewhere, like the ones of range requests, are not verified.
+type checksumReader struct {
+	*io.SectionReader
+	io.Closer
+	objId    string
+	checksum string      // Checksum of the object data, empty if none
+	hash     hash.Hash32 // Checksum of the data verified so far
+	pos      int64       // Position of the reader
+	verified int64       // Size of the data verified so far, from the beginning
+}
+
+// NewChecksumReader returns a reader of the object `objId` of `size` bytes read from `r`, at offset 0, which closes
+// `closer` when closed. The object data is verified against `checksum`, the hex encoded CRC-32C checksum of the data
+// as 8 digits, while it is read from the beginning to the end. No verification is done if `checksum` is empty.
+func NewChecksumReader(r io.ReaderAt, closer io.Closer, objId string, size int64, checksum string) io.ReadSeekCloser {
+	return &checksumReader{
+		SectionReader: io.NewSectionReader(r, 0, size),
+		Closer:        closer,
+		objId:         objId,
+		checksum:      checksum,
+		hash:          crc32.New(castagnoli),
+	}
+}
+
+func (r *checksumReader) Read(p []byte) (int, error) {
+	pos := r.pos
+	if pos == 0 && r.verified > 0 {
+		// Reading from the beginning again, verify the data again
+		r.hash.Reset()
+		r.verified = 0
+	}
+	n, err := r.SectionReader.Read(p)
+	r.pos += int64(n)
+	if r.checksum == "" || pos != r.verified || n == 0 {
+		return n, err
+	}
+
+	_, _ = r.hash.Write(p[:n])
+	r.verified += int64(n)
+	if r.verified == r.Size() && fmt.Sprintf("%08x", r.hash.Sum32()) != r.checksum {
+		return 0, fmt.Errorf("%w: data of object %s does not match its checksum", ErrCorruptedObject, r.objId)
+	}
+	return n, err
+}
+
+func (r *checksumReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := r.SectionReader.Seek(offset, whence)
+	if err == nil {
+		r.pos = pos
+	}
+	return pos, err
+}
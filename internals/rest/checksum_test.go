@@ -0,0 +1,40 @@
+package rest
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestNewChecksumReader(t *testing.T) {
+	data := "test obj"
+	checksum := fmt.Sprintf("%08x", crc32.Checksum([]byte(data), castagnoli))
+
+	r := NewChecksumReader(strings.NewReader(data), io.NopCloser(nil), "oid", int64(len(data)), checksum)
+	read, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(read))
+
+	// Corrupted data fails the last read, also when read again from the beginning
+	r = NewChecksumReader(strings.NewReader("Test obj"), io.NopCloser(nil), "oid", int64(len(data)), checksum)
+	for i := 0; i < 2; i++ {
+		_, _ = r.Seek(0, io.SeekStart)
+		_, err = io.ReadAll(r)
+		assert.ErrorIs(t, err, ErrCorruptedObject)
+	}
+	// while range reads are not verified
+	_, _ = r.Seek(5, io.SeekStart)
+	read, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "obj", string(read))
+
+	// and data without checksum is not verified
+	r = NewChecksumReader(strings.NewReader("Test obj"), io.NopCloser(nil), "oid", int64(len(data)), "")
+	read, err = io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "Test obj", string(read))
+	assert.NoError(t, r.Close())
+}
@@ -0,0 +1,94 @@
+package rest
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrPreconditionFailed is returned by ObjectStore.Store when the conditions in the StoreOptions are not satisfied
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// StoreOptions holds the options of a store operation
+type StoreOptions struct {
+	// ContentType is the media type of the object, stored along with it
+	ContentType string
+	// Metadata is the user-defined metadata of the object, stored along with it
+	Metadata map[string]string
+	// IfMatch lists the ETags the object currently stored must match to be replaced, "*" matches any object.
+	// If empty, the object is stored regardless of the object currently stored.
+	IfMatch []string
+	// IfNoneMatch lists the ETags the object currently stored must not match to be replaced, "*" matches any
+	// object so that an object is only created and never replaced.
+	IfNoneMatch []string
+}
+
+// CheckPreconditions checks whether an object can be stored according to the options, given the ETag of the
+// object currently stored and whether it exists. It returns ErrPreconditionFailed if it cannot be stored.
+// Stores must call it holding the lock used to store the object, so that checking and storing are atomic.
+func (o StoreOptions) CheckPreconditions(etag string, found bool) error {
+	if len(o.IfMatch) > 0 && (!found || !matchETag(o.IfMatch, etag, false)) {
+		return ErrPreconditionFailed
+	}
+	if len(o.IfNoneMatch) > 0 && found && matchETag(o.IfNoneMatch, etag, true) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+// checkReadPreconditions evaluates the conditional headers of a read request of the object described by info.
+// It returns the status code to reply with if a condition is not satisfied, or 0 if the object can be read.
+func checkReadPreconditions(r *http.Request, info ObjectInfo) int {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && !matchETag(parseETags(ifMatch), info.ETag, false) {
+		return http.StatusPreconditionFailed
+	}
+
+	// If-Modified-Since is ignored when If-None-Match is present
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchETag(parseETags(ifNoneMatch), info.ETag, true) {
+			return http.StatusNotModified
+		}
+	} else if ifModifiedSince := r.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		t, err := http.ParseTime(ifModifiedSince)
+		// Last-Modified has a resolution of one second
+		if err == nil && !info.LastModified.Truncate(time.Second).After(t) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// parseETags parses the comma separated list of entity tags of an If-Match or If-None-Match header.
+// The tags are returned without quotes, weak tags keep the W/ prefix.
+func parseETags(header string) []string {
+	var tags []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "" {
+			continue
+		}
+		weak := strings.HasPrefix(tag, "W/")
+		tag = strings.Trim(strings.TrimPrefix(tag, "W/"), `"`)
+		if weak {
+			tag = "W/" + tag
+		}
+		tags = append(tags, tag)
+	}
+	return tags
+}
+
+// matchETag reports whether etag matches any of the entity tags.
+// With the strong comparison weak tags never match, with the weak one they match as if they were strong.
+func matchETag(tags []string, etag string, weak bool) bool {
+	for _, tag := range tags {
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
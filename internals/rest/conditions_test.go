@@ -0,0 +1,102 @@
+package rest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestStoreOptions_CheckPreconditions(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    StoreOptions
+		etag    string
+		found   bool
+		wantErr assert.ErrorAssertionFunc
+	}{{
+		name:    "no conditions",
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.NoError,
+	}, {
+		name:    "if match",
+		opts:    StoreOptions{IfMatch: []string{"xyz", "abc"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.NoError,
+	}, {
+		name:    "if match any",
+		opts:    StoreOptions{IfMatch: []string{"*"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.NoError,
+	}, {
+		name:    "if match weak",
+		opts:    StoreOptions{IfMatch: []string{"W/abc"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.Error,
+	}, {
+		name:    "if match changed",
+		opts:    StoreOptions{IfMatch: []string{"xyz"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.Error,
+	}, {
+		name:    "if match not found",
+		opts:    StoreOptions{IfMatch: []string{"*"}},
+		wantErr: assert.Error,
+	}, {
+		name:    "if none match not found",
+		opts:    StoreOptions{IfNoneMatch: []string{"*"}},
+		wantErr: assert.NoError,
+	}, {
+		name:    "if none match any",
+		opts:    StoreOptions{IfNoneMatch: []string{"*"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.Error,
+	}, {
+		name:    "if none match weak",
+		opts:    StoreOptions{IfNoneMatch: []string{"W/abc"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.Error,
+	}, {
+		name:    "if none match changed",
+		opts:    StoreOptions{IfNoneMatch: []string{"xyz"}},
+		etag:    "abc",
+		found:   true,
+		wantErr: assert.NoError,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.CheckPreconditions(tt.etag, tt.found)
+			if tt.wantErr(t, err, "CheckPreconditions(%v, %v)", tt.etag, tt.found) && err != nil {
+				assert.ErrorIs(t, err, ErrPreconditionFailed)
+			}
+		})
+	}
+}
+
+func Test_parseETags(t *testing.T) {
+	tests := []struct {
+		header string
+		tags   []string
+	}{{
+		header: "",
+	}, {
+		header: "*",
+		tags:   []string{"*"},
+	}, {
+		header: `"abc"`,
+		tags:   []string{"abc"},
+	}, {
+		header: ` "abc",W/"def" ,, "" `,
+		tags:   []string{"abc", "W/def", ""},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			assert.Equal(t, tt.tags, parseETags(tt.header))
+		})
+	}
+}
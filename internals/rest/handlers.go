@@ -1,48 +1,174 @@
 package rest
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/gorilla/mux"
 	"io"
+	"mime"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// defaultMaxMem is the default maximum memory usable for an object read from the PUT request
+// defaultMaxMem is the default maximum size of an object read from the PUT request
 const defaultMaxMem = 10 << 20 // 10MiB
 
+// maxListLimit is the maximum number of objects returned by a single list request
+const maxListLimit = 1000
+
+// defaultContentType is the content type of objects stored without a Content-Type header
+const defaultContentType = "application/octet-stream"
+
+// legacyContentType is the content type of objects stored without content type, when only text/plain was accepted
+const legacyContentType = "text/plain"
+
+// errObjectTooLarge is returned when reading an object bigger than the maximum allowed size
+var errObjectTooLarge = errors.New("object too large")
+
+// ErrCorruptedObject is returned by ObjectStore.Retrieve, or by the reader it returns, when the stored object fails
+// its integrity checks
+var ErrCorruptedObject = errors.New("corrupted object")
+
+// ErrInsufficientStorage is returned by ObjectStore.Store when the store has no room left for the object
+var ErrInsufficientStorage = errors.New("insufficient storage")
+
+// corruptedObjectCode is the error code of the responses about corrupted objects, in the errorCodeHeader
+const corruptedObjectCode = "CorruptedObject"
+
+// errorCodeHeader is the header holding the error code of error responses, when they have one
+const errorCodeHeader = "X-Error-Code"
+
 // ObjectStore is the interface representing an object store. It exposes methods to manipulate stored objects.
+// Objects are streamed in and out of the store so that they never need to be held entirely in memory.
+//
+// Store stores the object read from r until EOF using the provided object ID and bucket ID.
+// If reading from r fails, the object is not stored and the read error is returned.
+// If the object currently stored does not satisfy the conditions in opts, the object is not stored
+// and ErrPreconditionFailed is returned. If the store has no room left for the object, an error wrapping
+// ErrInsufficientStorage is returned.
+// It returns the information about the stored object and whether an object with the same ID has now been replaced
+// along with any error encountered in the process.
+// If versioning is enabled on the bucket, the replaced object is kept as a previous version of the object.
 //
-// Store stores the given object as a bytes array using the provided object ID and bucket ID.
-// It returns whether an object with the same ID has now been replaced along with any error encountered in the process.
+// Retrieve retrieves the version versionId of the object identified by objId and bucketId, the current version if
+// versionId is empty. It returns a reader of the retrieved object or nil, the object information, whether the object
+// has been found in the storage, along with any error encountered in the process. The returned reader must be closed
+// by the caller and it is not affected by subsequent changes to the object.
+// Delete markers are never retrieved: if the requested version is a delete marker the object is not found.
+// If the stored object is corrupted, an error wrapping ErrCorruptedObject is returned rather than the corrupted data.
+// Stores verifying the data while it is read return the error from the reader instead, before the last bytes of the
+// object, so that a corrupted object is never read whole.
 //
-// Retrieve retrieves the object identified by objId and bucketId. It returns the retrieved object or its null value,
-// whether the object has been found in the storage, along with any error encountered in the process.
+// Stat returns the information about the version versionId of the object identified by objId and bucketId, as
+// Retrieve does, without retrieving its data, whether the object has been found in the storage, along with any error
+// encountered in the process.
 //
-// Delete deletes the object identified by objId and bucketId. It returns whether the object was stored
+// Delete deletes the object identified by objId and bucketId. If versionId is empty the current version is deleted,
+// unless versioning is enabled on the bucket: then a delete marker is stored as the current version and the previous
+// versions are kept. Otherwise versionId is permanently deleted. It returns whether the object (or version) was stored
 // and it was actually deleted, along with any error encountered in the process.
 //
+// Versions returns all the versions of the object identified by objId and bucketId, delete markers included,
+// from the most to the least recent, whether the object has been found in the storage, along with any error
+// encountered in the process.
+//
+// EnableVersioning enables versioning on bucketId, even if it does not exist yet. Versioning cannot be disabled.
+//
+// List lists the objects in bucketId filtered according to opts and sorted by object ID. It returns the listed
+// objects, whether the bucket has been found in the storage, along with any error encountered in the process.
+//
+// Buckets returns the information about all buckets in the storage sorted by bucket ID,
+// along with any error encountered in the process.
+//
+// Objects stored while versioning was not enabled have an empty version ID, and NullVersionId identifies them.
+//
 // NOTE: both objId and bucketId will match this regex `[a-z0-9_-]+`
 type ObjectStore interface {
-	Store(obj []byte, objId, bucketId string) (bool, error)
-	Retrieve(objId, bucketId string) ([]byte, bool, error)
-	Delete(objId, bucketId string) (bool, error)
+	Store(r io.Reader, objId, bucketId string, opts StoreOptions) (ObjectInfo, bool, error)
+	Retrieve(objId, bucketId, versionId string) (io.ReadSeekCloser, ObjectInfo, bool, error)
+	Stat(objId, bucketId, versionId string) (ObjectInfo, bool, error)
+	Delete(objId, bucketId, versionId string) (bool, error)
+	Versions(objId, bucketId string) ([]ObjectInfo, bool, error)
+	EnableVersioning(bucketId string) error
+	List(bucketId string, opts ListOptions) ([]ObjectInfo, bool, error)
+	Buckets() ([]BucketInfo, error)
+}
+
+// ObjectInfo holds the information about a stored object
+type ObjectInfo struct {
+	Id           string            `json:"id"`
+	Size         int64             `json:"size"`
+	ETag         string            `json:"etag"`                    // Hex encoded SHA-256 hash of the object data
+	LastModified time.Time         `json:"last_modified"`           // Time of the last change to the object
+	ContentType  string            `json:"content_type,omitempty"`  // Media type of the object
+	Metadata     map[string]string `json:"metadata,omitempty"`      // User-defined metadata of the object
+	VersionId    string            `json:"version_id,omitempty"`    // ID of the object version, if versioned
+	DeleteMarker bool              `json:"delete_marker,omitempty"` // Whether the version marks the object as deleted
+}
+
+// BucketInfo holds the information about a bucket and the objects it contains
+type BucketInfo struct {
+	Id         string `json:"id"`
+	Objects    int    `json:"objects"`    // Number of objects in the bucket, previous versions excluded
+	Size       int64  `json:"size"`       // Total size in bytes of the objects in the bucket, previous versions included
+	Versioning bool   `json:"versioning"` // Whether versioning is enabled on the bucket
+}
+
+// ListOptions holds the options to filter the objects listed from a bucket
+type ListOptions struct {
+	Prefix     string // List only objects whose ID starts with Prefix
+	StartAfter string // List only objects whose ID follows StartAfter in lexicographical order
+	Limit      int    // Maximum number of objects to list, no limit if <= 0
 }
 
 type storedResponse struct {
 	Id string `json:"id"`
 }
 
+type bucketsResponse struct {
+	Buckets []BucketInfo `json:"buckets"`
+}
+
+type versionsResponse struct {
+	Bucket   string       `json:"bucket"`
+	Id       string       `json:"id"`
+	Versions []ObjectInfo `json:"versions"`
+}
+
+type versioningResponse struct {
+	Bucket     string `json:"bucket"`
+	Versioning bool   `json:"versioning"`
+}
+
+type listResponse struct {
+	Bucket                string       `json:"bucket"`
+	Prefix                string       `json:"prefix,omitempty"`
+	Objects               []ObjectInfo `json:"objects"`
+	Truncated             bool         `json:"truncated"`
+	NextContinuationToken string       `json:"next_continuation_token,omitempty"`
+}
+
 // Handler is the
 type Handler struct {
-	store  ObjectStore
-	maxMem int64
+	store               ObjectStore
+	maxMem              int64
+	allowedContentTypes []string // Media types allowed for the stored objects, lowercase, any if empty
 }
 
 func (h *Handler) HandleStore(w http.ResponseWriter, r *http.Request) {
 	bucketId, objectId := getBucketObjectId(r)
-	if ct := r.Header.Get("Content-Type"); ct != "text/plain" {
-		http.Error(w, fmt.Sprintf("Content typwe %q not supported", ct), http.StatusUnsupportedMediaType)
+	contentType, err := h.parseContentType(r.Header.Get("Content-Type"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+		return
+	}
+	metadata, err := parseMetadata(r.Header)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	if r.Body == nil {
@@ -54,38 +180,55 @@ func (h *Handler) HandleStore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	body, err := io.ReadAll(io.LimitReader(r.Body, h.maxMem))
-	if err != nil {
-		http.Error(w, "Cannot read object: "+err.Error(), http.StatusInternalServerError)
-		return
+	// The content length may be unknown (e.g. chunked requests), so the size is checked while reading too
+	body := &limitedReader{r: r.Body, n: h.maxMem}
+	opts := StoreOptions{
+		ContentType: contentType,
+		Metadata:    metadata,
+		IfMatch:     parseETags(r.Header.Get("If-Match")),
+		IfNoneMatch: parseETags(r.Header.Get("If-None-Match")),
 	}
-
-	replaced, err := h.store.Store(body, objectId, bucketId)
+	info, replaced, err := h.store.Store(body, objectId, bucketId, opts)
 	if err != nil {
+		if errors.Is(err, errObjectTooLarge) {
+			http.Error(w, "Object size exceeds maximum size of "+formatSizeBinary(h.maxMem), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if errors.Is(err, ErrPreconditionFailed) {
+			http.Error(w, fmt.Sprintf("Object %s/%s does not satisfy the request preconditions", bucketId, objectId), http.StatusPreconditionFailed)
+			return
+		}
+		if errors.Is(err, ErrInsufficientStorage) {
+			http.Error(w, "Error storing object: "+err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		http.Error(w, "Error storing object: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	resBody, err := json.Marshal(storedResponse{Id: objectId})
-	if err != nil {
-		http.Error(w, "Error marshalling response"+err.Error(), http.StatusInternalServerError)
-	}
-	w.Header().Set("Content-Type", "application/json")
-
+	statusCode := http.StatusCreated
 	if replaced {
 		// The exercise said to return a 201, but, in case the object was replaced,
 		// a 200 might be a better status code
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusCreated)
+		statusCode = http.StatusOK
 	}
-	_, _ = w.Write(resBody)
+	w.Header().Set("ETag", formatETag(info.ETag))
+	w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	if info.VersionId != "" {
+		w.Header().Set(versionIdHeader, info.VersionId)
+	}
+	writeJSON(w, statusCode, storedResponse{Id: objectId})
 }
 
 func (h *Handler) HandleRetrieve(w http.ResponseWriter, r *http.Request) {
 	bucketId, objectId := getBucketObjectId(r)
-	obj, ok, err := h.store.Retrieve(objectId, bucketId)
+	obj, info, ok, err := h.store.Retrieve(objectId, bucketId, r.URL.Query().Get("versionId"))
 
+	if errors.Is(err, ErrCorruptedObject) {
+		w.Header().Set(errorCodeHeader, corruptedObjectCode)
+		http.Error(w, fmt.Sprintf("Object %s/%s is corrupted: %v", bucketId, objectId, err), http.StatusInternalServerError)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error retrieving object: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -97,13 +240,40 @@ func (h *Handler) HandleRetrieve(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	_, _ = w.Write(obj)
+	defer obj.Close()
+
+	// ServeContent handles range and conditional requests seeking the object reader,
+	// so only the requested bytes are read
+	setObjectHeaders(w, info)
+	http.ServeContent(w, r, objectId, info.LastModified, obj)
+}
+
+// HandleStat replies to HEAD requests with the headers of the object, without its content
+func (h *Handler) HandleStat(w http.ResponseWriter, r *http.Request) {
+	bucketId, objectId := getBucketObjectId(r)
+	info, ok, err := h.store.Stat(objectId, bucketId, r.URL.Query().Get("versionId"))
+
+	if err != nil {
+		http.Error(w, "Error retrieving object: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Object %s/%s not found", bucketId, objectId), http.StatusNotFound)
+		return
+	}
+
+	setObjectHeaders(w, info)
+	if statusCode := checkReadPreconditions(r, info); statusCode != 0 {
+		w.WriteHeader(statusCode)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size, 10))
+	w.WriteHeader(http.StatusOK)
 }
 
 func (h *Handler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 	bucketId, objectId := getBucketObjectId(r)
-	ok, err := h.store.Delete(objectId, bucketId)
+	ok, err := h.store.Delete(objectId, bucketId, r.URL.Query().Get("versionId"))
 	if err != nil {
 		http.Error(w, "Error deleting object: "+err.Error(), http.StatusInternalServerError)
 		return
@@ -116,11 +286,201 @@ func (h *Handler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+// HandleVersions lists all the versions of an object, from the most recent one
+func (h *Handler) HandleVersions(w http.ResponseWriter, r *http.Request) {
+	bucketId, objectId := getBucketObjectId(r)
+	versions, ok, err := h.store.Versions(objectId, bucketId)
+	if err != nil {
+		http.Error(w, "Error listing object versions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Object %s/%s not found", bucketId, objectId), http.StatusNotFound)
+		return
+	}
+
+	for i := range versions {
+		versions[i].VersionId = formatVersionId(versions[i].VersionId)
+	}
+	writeJSON(w, http.StatusOK, versionsResponse{Bucket: bucketId, Id: objectId, Versions: versions})
+}
+
+// HandleVersioning enables versioning on a bucket. Versioning cannot be disabled once enabled.
+func (h *Handler) HandleVersioning(w http.ResponseWriter, r *http.Request) {
+	bucketId := mux.Vars(r)["bucket"]
+	if v := r.URL.Query().Get("versioning"); v != "" && v != "enabled" {
+		http.Error(w, fmt.Sprintf("Invalid versioning status %q, versioning can only be enabled", v), http.StatusBadRequest)
+		return
+	}
+
+	if err := h.store.EnableVersioning(bucketId); err != nil {
+		http.Error(w, "Error enabling versioning: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, versioningResponse{Bucket: bucketId, Versioning: true})
+}
+
+// HandleList lists the objects in a bucket. The listing is paginated: at most `limit` objects are returned and,
+// if there are more, the response is marked as truncated and holds a token to pass as `continuation-token`
+// to get the following page.
+func (h *Handler) HandleList(w http.ResponseWriter, r *http.Request) {
+	bucketId := mux.Vars(r)["bucket"]
+	query := r.URL.Query()
+
+	limit := maxListLimit
+	if limitStr := query.Get("limit"); limitStr != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitStr); err != nil || limit <= 0 || limit > maxListLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q, it must be a number between 1 and %d", limitStr, maxListLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := ListOptions{
+		Prefix:     query.Get("prefix"),
+		StartAfter: query.Get("start-after"),
+		// List one more object to know whether there are more objects after the returned ones
+		Limit: limit + 1,
+	}
+	if token := query.Get("continuation-token"); token != "" {
+		startAfter, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			http.Error(w, "Invalid continuation token", http.StatusBadRequest)
+			return
+		}
+		opts.StartAfter = string(startAfter)
+	}
+
+	objects, ok, err := h.store.List(bucketId, opts)
+	if err != nil {
+		http.Error(w, "Error listing objects: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf("Bucket %s not found", bucketId), http.StatusNotFound)
+		return
+	}
+
+	res := listResponse{
+		Bucket:  bucketId,
+		Prefix:  opts.Prefix,
+		Objects: objects,
+	}
+	if len(objects) > limit {
+		res.Objects = objects[:limit]
+		res.Truncated = true
+		res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(objects[limit-1].Id))
+	}
+	if res.Objects == nil {
+		res.Objects = []ObjectInfo{}
+	}
+
+	writeJSON(w, http.StatusOK, res)
+}
+
+// HandleBuckets lists all the buckets along with the number and the total size of the objects they contain
+func (h *Handler) HandleBuckets(w http.ResponseWriter, _ *http.Request) {
+	buckets, err := h.store.Buckets()
+	if err != nil {
+		http.Error(w, "Error listing buckets: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if buckets == nil {
+		buckets = []BucketInfo{}
+	}
+
+	writeJSON(w, http.StatusOK, bucketsResponse{Buckets: buckets})
+}
+
+// writeJSON writes the given response body as JSON with the given status code
+func writeJSON(w http.ResponseWriter, statusCode int, body interface{}) {
+	resBody, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, "Error marshalling response: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	_, _ = w.Write(resBody)
+}
+
+// parseContentType parses the Content-Type header of a store request and checks whether it is allowed.
+// It returns the normalized content type along with any error.
+func (h *Handler) parseContentType(header string) (string, error) {
+	if header == "" {
+		header = defaultContentType
+	}
+	mediaType, params, err := mime.ParseMediaType(header)
+	if err != nil {
+		return "", fmt.Errorf("Invalid content type %q: %v", header, err)
+	}
+
+	if len(h.allowedContentTypes) == 0 {
+		return mime.FormatMediaType(mediaType, params), nil
+	}
+	for _, allowed := range h.allowedContentTypes {
+		// Allowed types may have a wildcard subtype, like `image/*`, or be `*/*`
+		if allowed == mediaType || allowed == "*/*" ||
+			(strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*"))) {
+			return mime.FormatMediaType(mediaType, params), nil
+		}
+	}
+
+	return "", fmt.Errorf("Content type %q not supported", mediaType)
+}
+
+// setObjectHeaders sets the response headers describing the object.
+// Content-Length is not set since it depends on the requested range.
+func setObjectHeaders(w http.ResponseWriter, info ObjectInfo) {
+	contentType := info.ContentType
+	if contentType == "" {
+		contentType = legacyContentType
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("ETag", formatETag(info.ETag))
+	w.Header().Set("Last-Modified", info.LastModified.UTC().Format(http.TimeFormat))
+	if info.VersionId != "" {
+		w.Header().Set(versionIdHeader, info.VersionId)
+	}
+	setMetadataHeaders(w, info.Metadata)
+}
+
+// formatETag formats the object ETag as a strong entity tag header value
+func formatETag(etag string) string {
+	return `"` + etag + `"`
+}
+
 func getBucketObjectId(r *http.Request) (string, string) {
 	vars := mux.Vars(r)
 	return vars["bucket"], vars["objectId"]
 }
 
+// limitedReader reads from r up to n bytes. Differently from io.LimitReader, it fails with errObjectTooLarge
+// if r holds more than n bytes instead of silently truncating the data.
+type limitedReader struct {
+	r io.Reader
+	n int64 // Remaining bytes that can be read
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errObjectTooLarge
+	}
+	// Read one more byte than allowed to detect whether the limit is exceeded
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.n {
+		l.n = -1
+		return 0, errObjectTooLarge
+	}
+	l.n -= int64(n)
+	return n, err
+}
+
 // formatSizeBinary formats a number representing a size in bytes to a string with binary unit
 func formatSizeBinary(b int64) string {
 	const unit = 1024
@@ -1,42 +1,96 @@
 package rest
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"github.com/stretchr/testify/assert"
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
+var testTime = time.Date(2022, 1, 2, 15, 4, 5, 0, time.UTC)
+
 type mockStore struct {
-	obj []byte
-	ok  bool
-	err error
+	obj        []byte
+	info       ObjectInfo
+	objects    []ObjectInfo
+	buckets    []BucketInfo
+	storeOpts  StoreOptions
+	listOpts   ListOptions
+	versionId  string
+	versioning bool
+	ok         bool
+	err        error
 }
 
-func (s *mockStore) Store(obj []byte, _, _ string) (bool, error) {
+func (s *mockStore) Store(r io.Reader, _, _ string, opts StoreOptions) (ObjectInfo, bool, error) {
+	s.storeOpts = opts
+	obj, err := io.ReadAll(r)
+	if err != nil {
+		return ObjectInfo{}, false, err
+	}
 	s.obj = obj
-	return s.ok, s.err
+	return s.info, s.ok, s.err
+}
+
+func (s *mockStore) Retrieve(_, _, versionId string) (io.ReadSeekCloser, ObjectInfo, bool, error) {
+	s.versionId = versionId
+	if s.obj == nil {
+		return nil, s.info, s.ok, s.err
+	}
+	return nopCloser{bytes.NewReader(s.obj)}, s.info, s.ok, s.err
 }
 
-func (s *mockStore) Retrieve(_, _ string) ([]byte, bool, error) {
-	return s.obj, s.ok, s.err
+func (s *mockStore) Stat(_, _, versionId string) (ObjectInfo, bool, error) {
+	s.versionId = versionId
+	return s.info, s.ok, s.err
 }
 
-func (s *mockStore) Delete(_, _ string) (bool, error) {
+func (s *mockStore) Delete(_, _, versionId string) (bool, error) {
+	s.versionId = versionId
 	s.obj = nil
 	return s.ok, s.err
 }
 
+func (s *mockStore) Versions(_, _ string) ([]ObjectInfo, bool, error) {
+	return s.objects, s.ok, s.err
+}
+
+func (s *mockStore) EnableVersioning(_ string) error {
+	s.versioning = true
+	return s.err
+}
+
+func (s *mockStore) List(_ string, opts ListOptions) ([]ObjectInfo, bool, error) {
+	s.listOpts = opts
+	objects := s.objects
+	if opts.Limit > 0 && len(objects) > opts.Limit {
+		objects = objects[:opts.Limit]
+	}
+	return objects, s.ok, s.err
+}
+
+func (s *mockStore) Buckets() ([]BucketInfo, error) {
+	return s.buckets, s.err
+}
+
 func TestHandler_HandleStore(t *testing.T) {
 	tests := []struct {
-		name       string
-		obj        string
-		store      *mockStore
-		maxMem     int64
-		statusCode int
+		name        string
+		obj         string
+		store       *mockStore
+		maxMem      int64
+		allowed     []string
+		unknownSize bool
+		headers     map[string]string
+		storeOpts   StoreOptions
+		statusCode  int
 	}{{
 		name:       "createNew",
 		obj:        "test obj",
@@ -62,10 +116,114 @@ func TestHandler_HandleStore(t *testing.T) {
 		store:      &mockStore{},
 		maxMem:     5,
 		statusCode: http.StatusRequestEntityTooLarge,
+	}, {
+		name:        "tooLargeUnknownSize",
+		obj:         "not so long object",
+		store:       &mockStore{},
+		maxMem:      5,
+		unknownSize: true,
+		statusCode:  http.StatusRequestEntityTooLarge,
+	}, {
+		name:        "maxSizeUnknownSize",
+		obj:         "short",
+		store:       &mockStore{},
+		maxMem:      5,
+		unknownSize: true,
+		statusCode:  http.StatusCreated,
+	}, {
+		name:       "ifMatch",
+		obj:        "test obj",
+		store:      &mockStore{ok: true},
+		headers:    map[string]string{"If-Match": `"abc", W/"def"`},
+		storeOpts:  StoreOptions{IfMatch: []string{"abc", "W/def"}},
+		statusCode: http.StatusOK,
+	}, {
+		name:       "ifNoneMatch",
+		obj:        "test obj",
+		store:      &mockStore{},
+		headers:    map[string]string{"If-None-Match": "*"},
+		storeOpts:  StoreOptions{IfNoneMatch: []string{"*"}},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "preconditionFailed",
+		obj:        "test obj",
+		store:      &mockStore{err: ErrPreconditionFailed},
+		headers:    map[string]string{"If-None-Match": "*"},
+		storeOpts:  StoreOptions{IfNoneMatch: []string{"*"}},
+		statusCode: http.StatusPreconditionFailed,
+	}, {
+		name:       "insufficientStorage",
+		obj:        "test obj",
+		store:      &mockStore{err: fmt.Errorf("memory budget exceeded: %w", ErrInsufficientStorage)},
+		statusCode: http.StatusInsufficientStorage,
+	}, {
+		name:       "contentType",
+		obj:        "test obj",
+		store:      &mockStore{},
+		headers:    map[string]string{"Content-Type": "Application/JSON; charset=UTF-8"},
+		storeOpts:  StoreOptions{ContentType: "application/json; charset=UTF-8"},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "noContentType",
+		obj:        "test obj",
+		store:      &mockStore{},
+		headers:    map[string]string{"Content-Type": ""},
+		storeOpts:  StoreOptions{ContentType: "application/octet-stream"},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "invalidContentType",
+		obj:        "test obj",
+		store:      &mockStore{},
+		headers:    map[string]string{"Content-Type": "text/"},
+		statusCode: http.StatusUnsupportedMediaType,
+	}, {
+		name:       "allowedContentType",
+		obj:        "test obj",
+		store:      &mockStore{},
+		allowed:    []string{"text/plain", "image/*"},
+		headers:    map[string]string{"Content-Type": "image/png"},
+		storeOpts:  StoreOptions{ContentType: "image/png"},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "allowedContentTypeCase",
+		obj:        "test obj",
+		store:      &mockStore{},
+		allowed:    []string{"Text/Plain", "IMAGE/*"},
+		headers:    map[string]string{"Content-Type": "image/PNG"},
+		storeOpts:  StoreOptions{ContentType: "image/png"},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "allowedAnyContentType",
+		obj:        "test obj",
+		store:      &mockStore{},
+		allowed:    []string{"*/*"},
+		headers:    map[string]string{"Content-Type": "video/mp4"},
+		storeOpts:  StoreOptions{ContentType: "video/mp4"},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "notAllowedContentType",
+		obj:        "test obj",
+		store:      &mockStore{},
+		allowed:    []string{"text/plain", "image/*"},
+		headers:    map[string]string{"Content-Type": "imagery/png"},
+		statusCode: http.StatusUnsupportedMediaType,
+	}, {
+		name:       "metadata",
+		obj:        "test obj",
+		store:      &mockStore{},
+		headers:    map[string]string{"X-Object-Meta-Author": "me", "x-object-meta-Song-Title": "Yellow Submarine", "X-Object-Meta-": "no key"},
+		storeOpts:  StoreOptions{Metadata: map[string]string{"author": "me", "song-title": "Yellow Submarine"}},
+		statusCode: http.StatusCreated,
+	}, {
+		name:       "metadataTooLarge",
+		obj:        "test obj",
+		store:      &mockStore{},
+		headers:    map[string]string{"X-Object-Meta-Key": strings.Repeat("v", maxMetadataSize)},
+		statusCode: http.StatusBadRequest,
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := NewRouter(tt.store, tt.maxMem, nil)
+			r := NewRouter(tt.store, tt.maxMem, tt.allowed, nil)
 
 			var body io.Reader
 			if tt.obj != "" {
@@ -74,11 +232,21 @@ func TestHandler_HandleStore(t *testing.T) {
 
 			req, _ := http.NewRequest("PUT", "/objects/bid/oid", body)
 			req.Header.Set("Content-Type", "text/plain")
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			if tt.unknownSize {
+				req.ContentLength = -1
+			}
 
 			res := executeRequest(req, r)
 			assert.Equal(t, tt.statusCode, res.Code)
 			if tt.statusCode < http.StatusBadRequest {
+				if tt.storeOpts.ContentType == "" {
+					tt.storeOpts.ContentType = "text/plain"
+				}
 				assert.Equal(t, tt.obj, string(tt.store.obj))
+				assert.Equal(t, tt.storeOpts, tt.store.storeOpts)
 			}
 		})
 	}
@@ -86,13 +254,21 @@ func TestHandler_HandleStore(t *testing.T) {
 
 func TestHandler_HandleRetrieve(t *testing.T) {
 	tests := []struct {
-		name       string
-		store      *mockStore
-		statusCode int
+		name        string
+		store       *mockStore
+		contentType string
+		statusCode  int
+		errorCode   string
 	}{{
-		name:       "retrieve",
-		store:      &mockStore{obj: []byte("test obj"), ok: true},
-		statusCode: http.StatusOK,
+		name:        "retrieve",
+		store:       &mockStore{obj: []byte("test obj"), info: ObjectInfo{Size: 8, ETag: "abc", LastModified: testTime, ContentType: "application/json", Metadata: map[string]string{"author": "me"}}, ok: true},
+		contentType: "application/json",
+		statusCode:  http.StatusOK,
+	}, {
+		name:        "retrieveLegacy",
+		store:       &mockStore{obj: []byte("test obj"), info: ObjectInfo{Size: 8, ETag: "abc", LastModified: testTime}, ok: true},
+		contentType: "text/plain",
+		statusCode:  http.StatusOK,
 	}, {
 		name:       "notFound",
 		store:      &mockStore{},
@@ -101,17 +277,206 @@ func TestHandler_HandleRetrieve(t *testing.T) {
 		name:       "errorRetrieve",
 		store:      &mockStore{err: errors.New("retrieve error")},
 		statusCode: http.StatusInternalServerError,
+	}, {
+		name:       "corrupted",
+		store:      &mockStore{err: fmt.Errorf("%w: checksum mismatch", ErrCorruptedObject)},
+		statusCode: http.StatusInternalServerError,
+		errorCode:  "CorruptedObject",
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := NewRouter(tt.store, 0, nil)
+			r := NewRouter(tt.store, 0, nil, nil)
 
 			req, _ := http.NewRequest("GET", "/objects/bid/oid", nil)
 			res := executeRequest(req, r)
 			assert.Equal(t, tt.statusCode, res.Code)
+			assert.Equal(t, tt.errorCode, res.Header().Get("X-Error-Code"))
 
 			if tt.store.obj != nil {
 				assert.Equal(t, string(tt.store.obj), res.Body.String())
+				assert.Equal(t, strconv.Itoa(len(tt.store.obj)), res.Header().Get("Content-Length"))
+				assert.Equal(t, `"abc"`, res.Header().Get("ETag"))
+				assert.Equal(t, "Sun, 02 Jan 2022 15:04:05 GMT", res.Header().Get("Last-Modified"))
+				assert.Equal(t, "bytes", res.Header().Get("Accept-Ranges"))
+				assert.Equal(t, tt.contentType, res.Header().Get("Content-Type"))
+				assert.Equal(t, tt.store.info.Metadata["author"], res.Header().Get("X-Object-Meta-Author"))
+			}
+		})
+	}
+}
+
+func TestHandler_HandleRetrieveRange(t *testing.T) {
+	tests := []struct {
+		name          string
+		rangeHeader   string
+		statusCode    int
+		contentRange  string
+		contentType   string
+		contentLength string
+		body          []string // Body or parts of a multipart body
+	}{{
+		name:          "single",
+		rangeHeader:   "bytes=5-7",
+		statusCode:    http.StatusPartialContent,
+		contentRange:  "bytes 5-7/8",
+		contentType:   "text/plain",
+		contentLength: "3",
+		body:          []string{"obj"},
+	}, {
+		name:          "suffix",
+		rangeHeader:   "bytes=-4",
+		statusCode:    http.StatusPartialContent,
+		contentRange:  "bytes 4-7/8",
+		contentType:   "text/plain",
+		contentLength: "4",
+		body:          []string{" obj"},
+	}, {
+		name:        "multiple",
+		rangeHeader: "bytes=0-3,5-",
+		statusCode:  http.StatusPartialContent,
+		contentType: "multipart/byteranges",
+		body:        []string{"Content-Range: bytes 0-3/8", "test", "Content-Range: bytes 5-7/8", "obj"},
+	}, {
+		name:         "unsatisfiable",
+		rangeHeader:  "bytes=10-20",
+		statusCode:   http.StatusRequestedRangeNotSatisfiable,
+		contentRange: "bytes */8",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &mockStore{obj: []byte("test obj"), info: ObjectInfo{Size: 8, ETag: "abc", LastModified: testTime}, ok: true}
+			r := NewRouter(store, 0, nil, nil)
+
+			req, _ := http.NewRequest("GET", "/objects/bid/oid", nil)
+			req.Header.Set("Range", tt.rangeHeader)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			assert.Equal(t, tt.contentRange, res.Header().Get("Content-Range"))
+			if tt.contentType != "" {
+				assert.True(t, strings.HasPrefix(res.Header().Get("Content-Type"), tt.contentType))
+			}
+			if tt.contentLength != "" {
+				assert.Equal(t, tt.contentLength, res.Header().Get("Content-Length"))
+			}
+			for _, part := range tt.body {
+				assert.Contains(t, res.Body.String(), part)
+			}
+		})
+	}
+}
+
+func TestHandler_HandleRetrieveConditional(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		headers    map[string]string
+		statusCode int
+	}{{
+		name:       "ifNoneMatch",
+		method:     "GET",
+		headers:    map[string]string{"If-None-Match": `"xyz", "abc"`},
+		statusCode: http.StatusNotModified,
+	}, {
+		name:       "ifNoneMatchWeak",
+		method:     "GET",
+		headers:    map[string]string{"If-None-Match": `W/"abc"`},
+		statusCode: http.StatusNotModified,
+	}, {
+		name:       "ifNoneMatchChanged",
+		method:     "GET",
+		headers:    map[string]string{"If-None-Match": `"xyz"`},
+		statusCode: http.StatusOK,
+	}, {
+		name:       "ifModifiedSince",
+		method:     "GET",
+		headers:    map[string]string{"If-Modified-Since": "Sun, 02 Jan 2022 15:04:05 GMT"},
+		statusCode: http.StatusNotModified,
+	}, {
+		name:       "ifModifiedSinceChanged",
+		method:     "GET",
+		headers:    map[string]string{"If-Modified-Since": "Sun, 02 Jan 2022 15:04:04 GMT"},
+		statusCode: http.StatusOK,
+	}, {
+		name:       "ifNoneMatchPrecedence",
+		method:     "GET",
+		headers:    map[string]string{"If-None-Match": `"xyz"`, "If-Modified-Since": "Sun, 02 Jan 2022 15:04:05 GMT"},
+		statusCode: http.StatusOK,
+	}, {
+		name:       "ifMatchChanged",
+		method:     "GET",
+		headers:    map[string]string{"If-Match": `"xyz"`},
+		statusCode: http.StatusPreconditionFailed,
+	}, {
+		name:       "headIfNoneMatch",
+		method:     "HEAD",
+		headers:    map[string]string{"If-None-Match": `"abc"`},
+		statusCode: http.StatusNotModified,
+	}, {
+		name:       "headIfModifiedSince",
+		method:     "HEAD",
+		headers:    map[string]string{"If-Modified-Since": "Sun, 02 Jan 2022 15:04:05 GMT"},
+		statusCode: http.StatusNotModified,
+	}, {
+		name:       "headIfMatchChanged",
+		method:     "HEAD",
+		headers:    map[string]string{"If-Match": `"xyz"`},
+		statusCode: http.StatusPreconditionFailed,
+	}, {
+		name:       "headIfMatch",
+		method:     "HEAD",
+		headers:    map[string]string{"If-Match": `"abc"`},
+		statusCode: http.StatusOK,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &mockStore{obj: []byte("test obj"), info: ObjectInfo{Size: 8, ETag: "abc", LastModified: testTime.Add(time.Millisecond)}, ok: true}
+			r := NewRouter(store, 0, nil, nil)
+
+			req, _ := http.NewRequest(tt.method, "/objects/bid/oid", nil)
+			for header, value := range tt.headers {
+				req.Header.Set(header, value)
+			}
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			if tt.statusCode == http.StatusNotModified {
+				assert.Empty(t, res.Body.String())
+				assert.Equal(t, `"abc"`, res.Header().Get("ETag"))
+			}
+		})
+	}
+}
+
+func TestHandler_HandleStat(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *mockStore
+		statusCode int
+	}{{
+		name:       "stat",
+		store:      &mockStore{info: ObjectInfo{Size: 8, ETag: "abc", LastModified: testTime}, ok: true},
+		statusCode: http.StatusOK,
+	}, {
+		name:       "notFound",
+		store:      &mockStore{},
+		statusCode: http.StatusNotFound,
+	}, {
+		name:       "errorStat",
+		store:      &mockStore{err: errors.New("stat error")},
+		statusCode: http.StatusInternalServerError,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("HEAD", "/objects/bid/oid", nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+
+			if tt.statusCode == http.StatusOK {
+				assert.Empty(t, res.Body.String())
+				assert.Equal(t, "8", res.Header().Get("Content-Length"))
+				assert.Equal(t, `"abc"`, res.Header().Get("ETag"))
+				assert.Equal(t, "Sun, 02 Jan 2022 15:04:05 GMT", res.Header().Get("Last-Modified"))
 			}
 		})
 	}
@@ -137,7 +502,7 @@ func TestHandler_HandleDelete(t *testing.T) {
 	}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			r := NewRouter(tt.store, 0, nil)
+			r := NewRouter(tt.store, 0, nil, nil)
 
 			req, _ := http.NewRequest("DELETE", "/objects/bid/oid", nil)
 			res := executeRequest(req, r)
@@ -148,6 +513,333 @@ func TestHandler_HandleDelete(t *testing.T) {
 	}
 }
 
+type nopCloser struct {
+	io.ReadSeeker
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func TestHandler_HandleList(t *testing.T) {
+	objects := []ObjectInfo{
+		{Id: "a", Size: 1, ETag: "e1", LastModified: testTime},
+		{Id: "b", Size: 2, ETag: "e2", LastModified: testTime},
+		{Id: "c", Size: 3, ETag: "e3", LastModified: testTime},
+	}
+	objectsJSON := []string{
+		`{"id":"a","size":1,"etag":"e1","last_modified":"2022-01-02T15:04:05Z"}`,
+		`{"id":"b","size":2,"etag":"e2","last_modified":"2022-01-02T15:04:05Z"}`,
+		`{"id":"c","size":3,"etag":"e3","last_modified":"2022-01-02T15:04:05Z"}`,
+	}
+	tests := []struct {
+		name       string
+		query      string
+		store      *mockStore
+		statusCode int
+		listOpts   ListOptions
+		res        string
+	}{{
+		name:       "list",
+		store:      &mockStore{objects: objects, ok: true},
+		statusCode: http.StatusOK,
+		listOpts:   ListOptions{Limit: maxListLimit + 1},
+		res:        `{"bucket":"bid","objects":[` + strings.Join(objectsJSON, ",") + `],"truncated":false}`,
+	}, {
+		name:       "empty",
+		query:      "?prefix=x",
+		store:      &mockStore{ok: true},
+		statusCode: http.StatusOK,
+		listOpts:   ListOptions{Prefix: "x", Limit: maxListLimit + 1},
+		res:        `{"bucket":"bid","prefix":"x","objects":[],"truncated":false}`,
+	}, {
+		name:       "truncated",
+		query:      "?limit=2&start-after=0",
+		store:      &mockStore{objects: objects, ok: true},
+		statusCode: http.StatusOK,
+		listOpts:   ListOptions{StartAfter: "0", Limit: 3},
+		res:        `{"bucket":"bid","objects":[` + strings.Join(objectsJSON[:2], ",") + `],"truncated":true,"next_continuation_token":"Yg"}`,
+	}, {
+		name:       "continuation",
+		query:      "?limit=2&start-after=0&continuation-token=Yg",
+		store:      &mockStore{objects: objects[2:], ok: true},
+		statusCode: http.StatusOK,
+		listOpts:   ListOptions{StartAfter: "b", Limit: 3},
+		res:        `{"bucket":"bid","objects":[` + objectsJSON[2] + `],"truncated":false}`,
+	}, {
+		name:       "invalidLimit",
+		query:      "?limit=0",
+		store:      &mockStore{ok: true},
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "limitTooHigh",
+		query:      "?limit=1001",
+		store:      &mockStore{ok: true},
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "invalidToken",
+		query:      "?continuation-token=$$",
+		store:      &mockStore{ok: true},
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "notFound",
+		store:      &mockStore{},
+		statusCode: http.StatusNotFound,
+		listOpts:   ListOptions{Limit: maxListLimit + 1},
+	}, {
+		name:       "errorList",
+		store:      &mockStore{err: errors.New("list error")},
+		statusCode: http.StatusInternalServerError,
+		listOpts:   ListOptions{Limit: maxListLimit + 1},
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("GET", "/objects/bid"+tt.query, nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			assert.Equal(t, tt.listOpts, tt.store.listOpts)
+			if tt.res != "" {
+				assert.JSONEq(t, tt.res, res.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_HandleBuckets(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *mockStore
+		statusCode int
+		res        string
+	}{{
+		name:       "buckets",
+		store:      &mockStore{buckets: []BucketInfo{{Id: "b1", Objects: 2, Size: 10, Versioning: true}, {Id: "b2", Objects: 1, Size: 0}}},
+		statusCode: http.StatusOK,
+		res:        `{"buckets":[{"id":"b1","objects":2,"size":10,"versioning":true},{"id":"b2","objects":1,"size":0,"versioning":false}]}`,
+	}, {
+		name:       "empty",
+		store:      &mockStore{},
+		statusCode: http.StatusOK,
+		res:        `{"buckets":[]}`,
+	}, {
+		name:       "errorBuckets",
+		store:      &mockStore{err: errors.New("buckets error")},
+		statusCode: http.StatusInternalServerError,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("GET", "/objects", nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			if tt.res != "" {
+				assert.JSONEq(t, tt.res, res.Body.String())
+			}
+		})
+	}
+}
+
+// mockQuarantiner is a mockStore quarantining buckets
+type mockQuarantiner struct {
+	mockStore
+	quarantined []QuarantinedBucket
+}
+
+func (s *mockQuarantiner) Quarantined() ([]QuarantinedBucket, error) {
+	return s.quarantined, s.err
+}
+
+func TestHandler_HandleQuarantined(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      ObjectStore
+		statusCode int
+		res        string
+	}{{
+		name: "quarantined",
+		store: &mockQuarantiner{quarantined: []QuarantinedBucket{
+			{Id: "b1", Path: "/data/quarantine/b1.1641135845000000000.dat", Reason: "corrupted", Time: testTime},
+		}},
+		statusCode: http.StatusOK,
+		res:        `{"buckets":[{"id":"b1","path":"/data/quarantine/b1.1641135845000000000.dat","reason":"corrupted","quarantined_at":"2022-01-02T15:04:05Z"}]}`,
+	}, {
+		name:       "none",
+		store:      &mockQuarantiner{},
+		statusCode: http.StatusOK,
+		res:        `{"buckets":[]}`,
+	}, {
+		name:       "no quarantine",
+		store:      &mockStore{},
+		statusCode: http.StatusOK,
+		res:        `{"buckets":[]}`,
+	}, {
+		name:       "errorQuarantined",
+		store:      &mockQuarantiner{mockStore: mockStore{err: errors.New("quarantine error")}},
+		statusCode: http.StatusInternalServerError,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("GET", "/admin/quarantine", nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			if tt.res != "" {
+				assert.JSONEq(t, tt.res, res.Body.String())
+			}
+		})
+	}
+}
+
+// mockStatsReporter is a mockStore reporting statistics
+type mockStatsReporter struct {
+	mockStore
+	stats map[string]int64
+}
+
+func (s *mockStatsReporter) Stats() map[string]int64 {
+	return s.stats
+}
+
+func TestHandler_HandleStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		store ObjectStore
+		res   string
+	}{{
+		name:  "stats",
+		store: &mockStatsReporter{stats: map[string]int64{"memory_used_bytes": 1024, "bucket_used_bytes.b1": 1024}},
+		res:   `{"stats":{"memory_used_bytes":1024,"bucket_used_bytes.b1":1024}}`,
+	}, {
+		name:  "no stats",
+		store: &mockStore{},
+		res:   `{"stats":{}}`,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("GET", "/admin/stats", nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, http.StatusOK, res.Code)
+			assert.JSONEq(t, tt.res, res.Body.String())
+		})
+	}
+}
+
+func TestHandler_HandleVersionId(t *testing.T) {
+	tests := []struct {
+		method     string
+		statusCode int
+	}{
+		{method: "GET", statusCode: http.StatusOK},
+		{method: "HEAD", statusCode: http.StatusOK},
+		{method: "DELETE", statusCode: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			store := &mockStore{obj: []byte("test obj"), info: ObjectInfo{Size: 8, ETag: "abc", VersionId: "v1"}, ok: true}
+			r := NewRouter(store, 0, nil, nil)
+
+			req, _ := http.NewRequest(tt.method, "/objects/bid/oid?versionId=v1", nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			assert.Equal(t, "v1", store.versionId)
+			if tt.method != "DELETE" {
+				assert.Equal(t, "v1", res.Header().Get("X-Object-Version-Id"))
+			}
+		})
+	}
+}
+
+func TestHandler_HandleVersions(t *testing.T) {
+	tests := []struct {
+		name       string
+		store      *mockStore
+		statusCode int
+		res        string
+	}{{
+		name: "versions",
+		store: &mockStore{objects: []ObjectInfo{
+			{Id: "oid", VersionId: "v2", LastModified: testTime, DeleteMarker: true},
+			{Id: "oid", Size: 3, ETag: "e1", LastModified: testTime},
+		}, ok: true},
+		statusCode: http.StatusOK,
+		res: `{"bucket":"bid","id":"oid","versions":[` +
+			`{"id":"oid","size":0,"etag":"","last_modified":"2022-01-02T15:04:05Z","version_id":"v2","delete_marker":true},` +
+			`{"id":"oid","size":3,"etag":"e1","last_modified":"2022-01-02T15:04:05Z","version_id":"null"}]}`,
+	}, {
+		name:       "notFound",
+		store:      &mockStore{},
+		statusCode: http.StatusNotFound,
+	}, {
+		name:       "errorVersions",
+		store:      &mockStore{err: errors.New("versions error")},
+		statusCode: http.StatusInternalServerError,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("GET", "/objects/bid/oid?versions", nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			if tt.res != "" {
+				assert.JSONEq(t, tt.res, res.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandler_HandleVersioning(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		store      *mockStore
+		statusCode int
+		enabled    bool
+	}{{
+		name:       "enable",
+		query:      "versioning",
+		store:      &mockStore{},
+		statusCode: http.StatusOK,
+		enabled:    true,
+	}, {
+		name:       "enabled",
+		query:      "versioning=enabled",
+		store:      &mockStore{},
+		statusCode: http.StatusOK,
+		enabled:    true,
+	}, {
+		name:       "disable",
+		query:      "versioning=disabled",
+		store:      &mockStore{},
+		statusCode: http.StatusBadRequest,
+	}, {
+		name:       "errorVersioning",
+		query:      "versioning",
+		store:      &mockStore{err: errors.New("versioning error")},
+		statusCode: http.StatusInternalServerError,
+		enabled:    true,
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRouter(tt.store, 0, nil, nil)
+
+			req, _ := http.NewRequest("PUT", "/objects/bid?"+tt.query, nil)
+			res := executeRequest(req, r)
+			assert.Equal(t, tt.statusCode, res.Code)
+			assert.Equal(t, tt.enabled, tt.store.versioning)
+			if tt.statusCode == http.StatusOK {
+				assert.JSONEq(t, `{"bucket":"bid","versioning":true}`, res.Body.String())
+			}
+		})
+	}
+}
+
 func executeRequest(req *http.Request, r http.Handler) *httptest.ResponseRecorder {
 	rr := httptest.NewRecorder()
 	r.ServeHTTP(rr, req)
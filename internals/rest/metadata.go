@@ -0,0 +1,45 @@
+package rest
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// metadataHeaderPrefix is the prefix of the headers carrying the user-defined metadata of an object
+const metadataHeaderPrefix = "X-Object-Meta-"
+
+// maxMetadataSize is the maximum total size of the user-defined metadata of an object, keys and values included
+const maxMetadataSize = 2 << 10 // 2KiB
+
+// parseMetadata returns the user-defined metadata in the `X-Object-Meta-*` headers of a store request.
+// Keys are lowercase, the values of repeated headers are joined by commas.
+// It returns nil if there is no metadata, and an error if the metadata is too large.
+func parseMetadata(header http.Header) (map[string]string, error) {
+	var metadata map[string]string
+	size := 0
+	for name, values := range header {
+		// Header names are in canonical form, so the prefix case is known
+		if !strings.HasPrefix(name, metadataHeaderPrefix) || len(name) == len(metadataHeaderPrefix) {
+			continue
+		}
+		key := strings.ToLower(strings.TrimPrefix(name, metadataHeaderPrefix))
+		value := strings.Join(values, ",")
+		size += len(key) + len(value)
+		if size > maxMetadataSize {
+			return nil, fmt.Errorf("Object metadata exceeds maximum size of %s", formatSizeBinary(maxMetadataSize))
+		}
+		if metadata == nil {
+			metadata = make(map[string]string)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+// setMetadataHeaders sets the `X-Object-Meta-*` response headers with the user-defined metadata of the object
+func setMetadataHeaders(w http.ResponseWriter, metadata map[string]string) {
+	for key, value := range metadata {
+		w.Header().Set(metadataHeaderPrefix+key, value)
+	}
+}
@@ -4,29 +4,48 @@ import (
 	"github.com/gorilla/mux"
 	log "github.com/sirupsen/logrus"
 	"net/http"
+	"strings"
 )
 
 var logger *log.Logger
 
-func NewRouter(s ObjectStore, maxMem int64, l *log.Logger) http.Handler {
-	r := mux.NewRouter().PathPrefix("/objects").Subrouter()
+// NewRouter creates the router of the REST API serving the objects in the store `s`, along with the admin endpoints.
+// Objects bigger than `maxMem` bytes (or defaultMaxMem if 0) and whose content type is not in
+// `allowedContentTypes` (if not empty), matched case-insensitively, cannot be stored.
+func NewRouter(s ObjectStore, maxMem int64, allowedContentTypes []string, l *log.Logger) http.Handler {
+	root := mux.NewRouter()
+	r := root.PathPrefix("/objects").Subrouter()
+	admin := root.PathPrefix("/admin").Subrouter()
 	if l != nil {
 		logger = l
-		r.Use(loggingMiddleware)
+		root.Use(loggingMiddleware)
 	}
 
 	if maxMem == 0 {
 		maxMem = defaultMaxMem
 	}
+	// Media types are case-insensitive, and parsed ones are lowercase
+	allowed := make([]string, len(allowedContentTypes))
+	for i, contentType := range allowedContentTypes {
+		allowed[i] = strings.ToLower(contentType)
+	}
 	h := Handler{
-		store:  s,
-		maxMem: maxMem,
+		store:               s,
+		maxMem:              maxMem,
+		allowedContentTypes: allowed,
 	}
 	r.HandleFunc("/{bucket:[a-z0-9_-]+}/{objectId:[a-z0-9_-]+}", h.HandleStore).Methods("PUT")
+	r.HandleFunc("/{bucket:[a-z0-9_-]+}/{objectId:[a-z0-9_-]+}", h.HandleVersions).Methods("GET").Queries("versions", "")
 	r.HandleFunc("/{bucket:[a-z0-9_-]+}/{objectId:[a-z0-9_-]+}", h.HandleRetrieve).Methods("GET")
+	r.HandleFunc("/{bucket:[a-z0-9_-]+}/{objectId:[a-z0-9_-]+}", h.HandleStat).Methods("HEAD")
 	r.HandleFunc("/{bucket:[a-z0-9_-]+}/{objectId:[a-z0-9_-]+}", h.HandleDelete).Methods("DELETE")
+	r.HandleFunc("/{bucket:[a-z0-9_-]+}", h.HandleVersioning).Methods("PUT").Queries("versioning", "")
+	r.HandleFunc("/{bucket:[a-z0-9_-]+}", h.HandleList).Methods("GET")
+	r.HandleFunc("", h.HandleBuckets).Methods("GET")
+	admin.HandleFunc("/quarantine", h.HandleQuarantined).Methods("GET")
+	admin.HandleFunc("/stats", h.HandleStats).Methods("GET")
 
-	return r
+	return root
 }
 
 func loggingMiddleware(next http.Handler) http.Handler {
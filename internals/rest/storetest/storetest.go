@@ -0,0 +1,680 @@
+// Package storetest provides a conformance test suite for the rest.ObjectStore implementations.
+//
+// Each implementation runs the suite from its tests, passing a constructor of its stores:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T, dataPath string) rest.ObjectStore {
+//			return NewStore(dataPath)
+//		}, storetest.Options{Durable: true})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+)
+
+// largeObjectSize is the size of the large objects stored by the suite, larger than the buffers of the stores
+const largeObjectSize = 8<<20 + 13
+
+// NewStore creates a store keeping its data in the existing folder `dataPath`, failing the test if it cannot.
+// Stores implementing io.Closer are closed by the suite.
+type NewStore func(t *testing.T, dataPath string) rest.ObjectStore
+
+// Options holds the options of the suite
+type Options struct {
+	// Durable reports that the stores keep their objects in the data path, so that a store created on the data path
+	// of a closed one holds the same objects. The suite then tests the objects are kept across restarts.
+	Durable bool
+}
+
+// Run runs the conformance suite against the stores created by `newStore`, each test on a new empty data path
+func Run(t *testing.T, newStore NewStore, opts Options) {
+	s := suite{newStore: newStore}
+	tests := []struct {
+		name string
+		test func(t *testing.T, store rest.ObjectStore)
+	}{
+		{"Store", s.testStore},
+		{"StoreReadError", s.testStoreReadError},
+		{"StorePreconditions", s.testStorePreconditions},
+		{"EmptyObject", s.testEmptyObject},
+		{"LargeObject", s.testLargeObject},
+		{"Retrieve", s.testRetrieve},
+		{"Delete", s.testDelete},
+		{"List", s.testList},
+		{"Buckets", s.testBuckets},
+		{"Versioning", s.testVersioning},
+		{"DeleteVersions", s.testDeleteVersions},
+		{"Concurrency", s.testConcurrency},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.test(t, s.open(t, t.TempDir()))
+		})
+	}
+	if opts.Durable {
+		t.Run("Restart", s.testRestart)
+	}
+}
+
+type suite struct {
+	newStore NewStore
+}
+
+// open creates a store on `dataPath`, closed at the end of the test
+func (s suite) open(t *testing.T, dataPath string) rest.ObjectStore {
+	store := s.newStore(t, dataPath)
+	if closer, ok := store.(io.Closer); ok {
+		var once sync.Once
+		t.Cleanup(func() {
+			once.Do(func() {
+				_ = closer.Close()
+			})
+		})
+	}
+	return store
+}
+
+// closeStore closes `store`, if it has to
+func closeStore(t *testing.T, store rest.ObjectStore) {
+	if closer, ok := store.(io.Closer); ok {
+		require.NoError(t, closer.Close())
+	}
+}
+
+func etag(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+// store stores `data` as the object `objId` in bucket `bucketId`, failing the test if it cannot
+func store(t *testing.T, store rest.ObjectStore, objId, bucketId, data string) rest.ObjectInfo {
+	info, _, err := store.Store(strings.NewReader(data), objId, bucketId, rest.StoreOptions{})
+	require.NoError(t, err)
+	return info
+}
+
+// retrieve returns the data of the version `versionId` of the object `objId` in bucket `bucketId`, failing the test
+// if it is not found
+func retrieve(t *testing.T, store rest.ObjectStore, objId, bucketId, versionId string) string {
+	r, _, ok, err := store.Retrieve(objId, bucketId, versionId)
+	require.NoError(t, err)
+	require.True(t, ok, "object %s/%s version %q not found", bucketId, objId, versionId)
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// assertNotFound asserts the version `versionId` of the object `objId` in bucket `bucketId` is not found
+func assertNotFound(t *testing.T, store rest.ObjectStore, objId, bucketId, versionId string) {
+	r, _, ok, err := store.Retrieve(objId, bucketId, versionId)
+	assert.NoError(t, err)
+	assert.False(t, ok, "object %s/%s version %q found", bucketId, objId, versionId)
+	assert.Nil(t, r)
+	_, ok, err = store.Stat(objId, bucketId, versionId)
+	assert.NoError(t, err)
+	assert.False(t, ok, "object %s/%s version %q found", bucketId, objId, versionId)
+}
+
+// listIds returns the IDs of the objects listed from bucket `bucketId` and whether it has been found
+func listIds(t *testing.T, store rest.ObjectStore, bucketId string, opts rest.ListOptions) ([]string, bool) {
+	objects, ok, err := store.List(bucketId, opts)
+	require.NoError(t, err)
+	ids := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		ids = append(ids, obj.Id)
+	}
+	return ids, ok
+}
+
+// bucket returns the information about bucket `bucketId` and whether it is listed by Buckets
+func bucket(t *testing.T, store rest.ObjectStore, bucketId string) (rest.BucketInfo, bool) {
+	buckets, err := store.Buckets()
+	require.NoError(t, err)
+	for _, b := range buckets {
+		if b.Id == bucketId {
+			return b, true
+		}
+	}
+	return rest.BucketInfo{}, false
+}
+
+func (s suite) testStore(t *testing.T, st rest.ObjectStore) {
+	opts := rest.StoreOptions{ContentType: "text/plain", Metadata: map[string]string{"key": "value"}}
+	info, replaced, err := st.Store(strings.NewReader("test obj"), "oid", "bid", opts)
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, "oid", info.Id)
+	assert.Equal(t, int64(8), info.Size)
+	assert.Equal(t, etag("test obj"), info.ETag)
+	assert.Equal(t, "text/plain", info.ContentType)
+	assert.Equal(t, map[string]string{"key": "value"}, info.Metadata)
+	assert.False(t, info.LastModified.IsZero())
+	assert.Empty(t, info.VersionId)
+	assert.False(t, info.DeleteMarker)
+
+	stat, ok, err := st.Stat("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, info, stat)
+	assert.Equal(t, "test obj", retrieve(t, st, "oid", "bid", ""))
+
+	// Replacing the object
+	info, replaced, err = st.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, etag("new obj"), info.ETag)
+	assert.Empty(t, info.ContentType)
+	assert.Empty(t, info.Metadata)
+	assert.Equal(t, "new obj", retrieve(t, st, "oid", "bid", ""))
+
+	// Other objects and buckets are not replaced
+	_, replaced, err = st.Store(strings.NewReader("other obj"), "oid2", "bid", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	_, replaced, err = st.Store(strings.NewReader("other bucket"), "oid", "bid2", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, "new obj", retrieve(t, st, "oid", "bid", ""))
+	assert.Equal(t, "other obj", retrieve(t, st, "oid2", "bid", ""))
+	assert.Equal(t, "other bucket", retrieve(t, st, "oid", "bid2", ""))
+}
+
+func (s suite) testStoreReadError(t *testing.T, st rest.ObjectStore) {
+	readErr := errors.New("read error")
+	_, replaced, err := st.Store(iotest.ErrReader(readErr), "oid", "bid", rest.StoreOptions{})
+	assert.ErrorIs(t, err, readErr)
+	assert.False(t, replaced)
+	assertNotFound(t, st, "oid", "bid", "")
+	_, ok := bucket(t, st, "bid")
+	assert.False(t, ok)
+	_, ok = listIds(t, st, "bid", rest.ListOptions{})
+	assert.False(t, ok)
+
+	// A partially read object does not replace the stored one
+	store(t, st, "oid", "bid", "test obj")
+	r := io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(readErr))
+	_, replaced, err = st.Store(r, "oid", "bid", rest.StoreOptions{})
+	assert.ErrorIs(t, err, readErr)
+	assert.False(t, replaced)
+	assert.Equal(t, "test obj", retrieve(t, st, "oid", "bid", ""))
+}
+
+func (s suite) testStorePreconditions(t *testing.T, st rest.ObjectStore) {
+	createOnly := rest.StoreOptions{IfNoneMatch: []string{"*"}}
+	_, _, err := st.Store(strings.NewReader("test obj"), "oid", "bid", rest.StoreOptions{IfMatch: []string{"*"}})
+	assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+	assertNotFound(t, st, "oid", "bid", "")
+	_, ok := listIds(t, st, "bid", rest.ListOptions{})
+	assert.False(t, ok)
+	_, replaced, err := st.Store(strings.NewReader("test obj"), "oid", "bid", createOnly)
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+
+	_, _, err = st.Store(strings.NewReader("new obj"), "oid", "bid", createOnly)
+	assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+	_, _, err = st.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{IfMatch: []string{etag("other")}})
+	assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+	_, _, err = st.Store(strings.NewReader("new obj"), "oid", "bid", rest.StoreOptions{IfNoneMatch: []string{etag("test obj")}})
+	assert.ErrorIs(t, err, rest.ErrPreconditionFailed)
+	assert.Equal(t, "test obj", retrieve(t, st, "oid", "bid", ""))
+
+	ifMatch := rest.StoreOptions{IfMatch: []string{etag("other"), etag("test obj")}}
+	_, replaced, err = st.Store(strings.NewReader("new obj"), "oid", "bid", ifMatch)
+	assert.NoError(t, err)
+	assert.True(t, replaced)
+	assert.Equal(t, "new obj", retrieve(t, st, "oid", "bid", ""))
+}
+
+func (s suite) testEmptyObject(t *testing.T, st rest.ObjectStore) {
+	info, replaced, err := st.Store(strings.NewReader(""), "oid", "bid", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.False(t, replaced)
+	assert.Equal(t, int64(0), info.Size)
+	assert.Equal(t, etag(""), info.ETag)
+	assert.Equal(t, "", retrieve(t, st, "oid", "bid", ""))
+
+	ids, ok := listIds(t, st, "bid", rest.ListOptions{})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"oid"}, ids)
+	b, ok := bucket(t, st, "bid")
+	assert.True(t, ok)
+	assert.Equal(t, rest.BucketInfo{Id: "bid", Objects: 1}, b)
+
+	_, replaced, err = st.Store(strings.NewReader(""), "oid", "bid", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.True(t, replaced)
+}
+
+func (s suite) testLargeObject(t *testing.T, st rest.ObjectStore) {
+	data := bytes.Repeat([]byte("0123456789abcdefghijklmnopqrstuvwxyz"), largeObjectSize/36+1)[:largeObjectSize]
+	info, _, err := st.Store(iotest.HalfReader(bytes.NewReader(data)), "oid", "bid", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(largeObjectSize), info.Size)
+	assert.Equal(t, etag(string(data)), info.ETag)
+
+	r, _, ok, err := st.Retrieve("oid", "bid", "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	defer r.Close()
+	retrieved, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.True(t, bytes.Equal(data, retrieved), "retrieved large object differs")
+
+	// The reader can seek within the object
+	_, err = r.Seek(largeObjectSize-10, io.SeekStart)
+	require.NoError(t, err)
+	tail, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, data[largeObjectSize-10:], tail)
+}
+
+func (s suite) testRetrieve(t *testing.T, st rest.ObjectStore) {
+	stored := store(t, st, "oid", "bid", "test obj")
+	r, info, ok, err := st.Retrieve("oid", "bid", "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, stored, info)
+
+	// The reader is not affected by later changes
+	store(t, st, "oid", "bid", "new obj")
+	_, err = st.Delete("oid", "bid", "")
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "test obj", string(data))
+	assert.NoError(t, r.Close())
+
+	store(t, st, "oid", "bid", "test obj")
+	assertNotFound(t, st, "oid2", "bid", "")
+	assertNotFound(t, st, "oid", "bid2", "")
+	assertNotFound(t, st, "oid", "bid", "1234")
+	assert.Equal(t, "test obj", retrieve(t, st, "oid", "bid", rest.NullVersionId))
+}
+
+func (s suite) testDelete(t *testing.T, st rest.ObjectStore) {
+	store(t, st, "oid", "bid", "test obj")
+	store(t, st, "oid2", "bid", "test obj 2")
+
+	for _, missing := range [][3]string{{"oid3", "bid", ""}, {"oid", "bid2", ""}, {"oid", "bid", "1234"}} {
+		deleted, err := st.Delete(missing[0], missing[1], missing[2])
+		assert.NoError(t, err)
+		assert.False(t, deleted, missing)
+	}
+
+	deleted, err := st.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assertNotFound(t, st, "oid", "bid", "")
+	deleted, err = st.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, "test obj 2", retrieve(t, st, "oid2", "bid", ""))
+
+	// Emptying the bucket removes it
+	deleted, err = st.Delete("oid2", "bid", rest.NullVersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, ok := listIds(t, st, "bid", rest.ListOptions{})
+	assert.False(t, ok)
+	_, ok = bucket(t, st, "bid")
+	assert.False(t, ok)
+
+	// and storing to it creates it again
+	store(t, st, "oid", "bid", "test obj")
+	ids, ok := listIds(t, st, "bid", rest.ListOptions{})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"oid"}, ids)
+}
+
+func (s suite) testList(t *testing.T, st rest.ObjectStore) {
+	for _, objId := range []string{"c", "a", "b2", "b1", "b10", "d"} {
+		store(t, st, objId, "bid", "obj "+objId)
+	}
+	store(t, st, "a", "bid2", "other bucket")
+
+	tests := []struct {
+		name string
+		opts rest.ListOptions
+		want []string
+	}{
+		{"all", rest.ListOptions{}, []string{"a", "b1", "b10", "b2", "c", "d"}},
+		{"prefix", rest.ListOptions{Prefix: "b1"}, []string{"b1", "b10"}},
+		{"no match", rest.ListOptions{Prefix: "e"}, []string{}},
+		{"start after", rest.ListOptions{StartAfter: "b10"}, []string{"b2", "c", "d"}},
+		{"start after missing", rest.ListOptions{StartAfter: "b3"}, []string{"c", "d"}},
+		{"limit", rest.ListOptions{Limit: 2}, []string{"a", "b1"}},
+		{"all options", rest.ListOptions{Prefix: "b", StartAfter: "b1", Limit: 1}, []string{"b10"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ids, ok := listIds(t, st, "bid", tt.opts)
+			assert.True(t, ok)
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+
+	objects, _, err := st.List("bid", rest.ListOptions{Prefix: "c"})
+	require.NoError(t, err)
+	if assert.Len(t, objects, 1) {
+		stat, _, _ := st.Stat("c", "bid", "")
+		assert.Equal(t, stat, objects[0])
+	}
+
+	_, ok := listIds(t, st, "bid3", rest.ListOptions{})
+	assert.False(t, ok)
+}
+
+func (s suite) testBuckets(t *testing.T, st rest.ObjectStore) {
+	buckets, err := st.Buckets()
+	assert.NoError(t, err)
+	assert.Empty(t, buckets)
+
+	store(t, st, "oid", "bid2", "test obj")
+	store(t, st, "oid2", "bid2", "obj")
+	store(t, st, "oid", "bid1", "obj")
+	require.NoError(t, st.EnableVersioning("bid1"))
+	store(t, st, "oid", "bid1", "obj v2")
+	// Versioned buckets without objects are not listed
+	require.NoError(t, st.EnableVersioning("bid3"))
+
+	buckets, err = st.Buckets()
+	assert.NoError(t, err)
+	assert.Equal(t, []rest.BucketInfo{
+		{Id: "bid1", Objects: 1, Size: 9, Versioning: true},
+		{Id: "bid2", Objects: 2, Size: 11},
+	}, buckets)
+
+	// Delete markers are not counted as objects
+	_, err = st.Delete("oid", "bid1", "")
+	require.NoError(t, err)
+	b, ok := bucket(t, st, "bid1")
+	assert.True(t, ok)
+	assert.Equal(t, rest.BucketInfo{Id: "bid1", Objects: 0, Size: 9, Versioning: true}, b)
+}
+
+func (s suite) testVersioning(t *testing.T, st rest.ObjectStore) {
+	null := store(t, st, "oid", "bid", "null obj")
+	// Versioning can be enabled before the bucket exists
+	require.NoError(t, st.EnableVersioning("bid"))
+	require.NoError(t, st.EnableVersioning("bid2"))
+
+	v1, replaced, err := st.Store(strings.NewReader("obj v1"), "oid", "bid", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.True(t, replaced)
+	assert.NotEmpty(t, v1.VersionId)
+	assert.NotEqual(t, rest.NullVersionId, v1.VersionId)
+	v2 := store(t, st, "oid", "bid", "obj v2")
+	assert.NotEqual(t, v1.VersionId, v2.VersionId)
+	new2 := store(t, st, "oid", "bid2", "new obj")
+	assert.NotEmpty(t, new2.VersionId)
+
+	versions, ok, err := st.Versions("oid", "bid")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, []rest.ObjectInfo{v2, v1, null}, versions)
+	assert.Equal(t, "obj v2", retrieve(t, st, "oid", "bid", ""))
+	assert.Equal(t, "obj v1", retrieve(t, st, "oid", "bid", v1.VersionId))
+	assert.Equal(t, "null obj", retrieve(t, st, "oid", "bid", rest.NullVersionId))
+	stat, ok, err := st.Stat("oid", "bid", v1.VersionId)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, v1, stat)
+	_, ok, err = st.Versions("oid2", "bid")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// Deleting the object stores a delete marker, keeping the versions
+	deleted, err := st.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assertNotFound(t, st, "oid", "bid", "")
+	deleted, err = st.Delete("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	versions, ok, err = st.Versions("oid", "bid")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	require.Len(t, versions, 4)
+	marker := versions[0]
+	assert.True(t, marker.DeleteMarker)
+	assert.NotEmpty(t, marker.VersionId)
+	assert.Equal(t, []rest.ObjectInfo{v2, v1, null}, versions[1:])
+	assertNotFound(t, st, "oid", "bid", marker.VersionId)
+	assert.Equal(t, "obj v2", retrieve(t, st, "oid", "bid", v2.VersionId))
+	ids, ok := listIds(t, st, "bid", rest.ListOptions{})
+	assert.True(t, ok)
+	assert.Empty(t, ids)
+
+	// Storing over a delete marker does not replace an object
+	_, replaced, err = st.Store(strings.NewReader("obj v3"), "oid", "bid", rest.StoreOptions{IfNoneMatch: []string{"*"}})
+	assert.NoError(t, err)
+	assert.False(t, replaced)
+	versions, _, _ = st.Versions("oid", "bid")
+	assert.Len(t, versions, 5)
+}
+
+func (s suite) testDeleteVersions(t *testing.T, st rest.ObjectStore) {
+	require.NoError(t, st.EnableVersioning("bid"))
+	v1 := store(t, st, "oid", "bid", "obj v1")
+	v2 := store(t, st, "oid", "bid", "obj v2")
+	v3 := store(t, st, "oid", "bid", "obj v3")
+	_, err := st.Delete("oid", "bid", "")
+	require.NoError(t, err)
+	versions, _, _ := st.Versions("oid", "bid")
+	marker := versions[0]
+
+	// Deleting the delete marker restores the previous version
+	deleted, err := st.Delete("oid", "bid", marker.VersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, "obj v3", retrieve(t, st, "oid", "bid", ""))
+
+	// Deleting a previous version keeps the current one
+	deleted, err = st.Delete("oid", "bid", v2.VersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	deleted, err = st.Delete("oid", "bid", v2.VersionId)
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assertNotFound(t, st, "oid", "bid", v2.VersionId)
+	versions, _, _ = st.Versions("oid", "bid")
+	assert.Equal(t, []rest.ObjectInfo{v3, v1}, versions)
+
+	// Deleting the current version makes the previous one current
+	deleted, err = st.Delete("oid", "bid", v3.VersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	stat, ok, err := st.Stat("oid", "bid", "")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, v1, stat)
+	b, _ := bucket(t, st, "bid")
+	assert.Equal(t, rest.BucketInfo{Id: "bid", Objects: 1, Size: 6, Versioning: true}, b)
+
+	// Deleting the last version deletes the object and the emptied bucket, which stays versioned
+	deleted, err = st.Delete("oid", "bid", v1.VersionId)
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	_, ok, err = st.Versions("oid", "bid")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	_, ok = bucket(t, st, "bid")
+	assert.False(t, ok)
+	v4 := store(t, st, "oid", "bid", "obj v4")
+	assert.NotEmpty(t, v4.VersionId)
+}
+
+func (s suite) testConcurrency(t *testing.T, st rest.ObjectStore) {
+	const workers = 8
+	const rounds = 20
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*rounds*4)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			bucketId := fmt.Sprintf("bid%d", w%2)
+			own := fmt.Sprintf("own%d", w)
+			for i := 0; i < rounds; i++ {
+				data := fmt.Sprintf("obj %d %d", w, i)
+				// Objects of the worker, then an object shared by all the workers
+				for _, objId := range []string{own, "shared"} {
+					if _, _, err := st.Store(strings.NewReader(data), objId, bucketId, rest.StoreOptions{}); err != nil {
+						errs <- err
+						continue
+					}
+					r, info, ok, err := st.Retrieve(objId, bucketId, "")
+					if err != nil || !ok {
+						errs <- fmt.Errorf("retrieving %s/%s: found %v, %v", bucketId, objId, ok, err)
+						continue
+					}
+					retrieved, err := io.ReadAll(r)
+					_ = r.Close()
+					if err != nil {
+						errs <- err
+					} else if etag(string(retrieved)) != info.ETag {
+						errs <- fmt.Errorf("retrieved %s/%s does not match its ETag", bucketId, objId)
+					} else if objId == own && string(retrieved) != data {
+						errs <- fmt.Errorf("retrieved %q instead of %q", retrieved, data)
+					}
+				}
+				if _, _, err := st.List(bucketId, rest.ListOptions{}); err != nil {
+					errs <- err
+				}
+				if _, err := st.Buckets(); err != nil {
+					errs <- err
+				}
+			}
+			if i := w % 4; i < 2 {
+				if deleted, err := st.Delete(own, bucketId, ""); err != nil || !deleted {
+					errs <- fmt.Errorf("deleting %s/%s: deleted %v, %v", bucketId, own, deleted, err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		assert.NoError(t, err)
+	}
+
+	// Workers 0, 1, 4, 5 deleted their objects
+	for _, bucketId := range []string{"bid0", "bid1"} {
+		ids, ok := listIds(t, st, bucketId, rest.ListOptions{})
+		assert.True(t, ok)
+		want := []string{"shared"}
+		for w := 0; w < workers; w++ {
+			if fmt.Sprintf("bid%d", w%2) == bucketId && w%4 >= 2 {
+				want = append(want, fmt.Sprintf("own%d", w))
+			}
+		}
+		sort.Strings(want)
+		assert.Equal(t, want, ids)
+		shared := retrieve(t, st, "shared", bucketId, "")
+		assert.True(t, strings.HasPrefix(shared, "obj "), shared)
+	}
+	buckets, err := st.Buckets()
+	assert.NoError(t, err)
+	assert.Len(t, buckets, 2)
+}
+
+func (s suite) testRestart(t *testing.T) {
+	dataPath := t.TempDir()
+	st := s.open(t, dataPath)
+	opts := rest.StoreOptions{ContentType: "application/json", Metadata: map[string]string{"key": "value"}}
+	_, _, err := st.Store(strings.NewReader("{}"), "meta", "bid", opts)
+	require.NoError(t, err)
+	store(t, st, "oid", "bid", "obj")
+	store(t, st, "oid", "bid", "replaced obj")
+	store(t, st, "oid2", "bid", "")
+	store(t, st, "deleted", "bid", "deleted obj")
+	_, err = st.Delete("deleted", "bid", "")
+	require.NoError(t, err)
+	require.NoError(t, st.EnableVersioning("vbid"))
+	store(t, st, "oid", "vbid", "obj v1")
+	store(t, st, "oid", "vbid", "obj v2")
+	store(t, st, "oid2", "vbid", "obj")
+	_, err = st.Delete("oid2", "vbid", "")
+	require.NoError(t, err)
+	require.NoError(t, st.EnableVersioning("empty"))
+
+	wantBuckets, err := st.Buckets()
+	require.NoError(t, err)
+	wantObjects := make(map[string][]rest.ObjectInfo)
+	wantVersions := make(map[string][]rest.ObjectInfo)
+	for _, b := range wantBuckets {
+		objects, _, err := st.List(b.Id, rest.ListOptions{})
+		require.NoError(t, err)
+		wantObjects[b.Id] = objects
+		for _, objId := range []string{"oid", "oid2"} {
+			versions, _, err := st.Versions(objId, b.Id)
+			require.NoError(t, err)
+			wantVersions[b.Id+"/"+objId] = versions
+		}
+	}
+	closeStore(t, st)
+
+	st = s.open(t, dataPath)
+	buckets, err := st.Buckets()
+	require.NoError(t, err)
+	assert.Equal(t, wantBuckets, buckets)
+	for _, b := range wantBuckets {
+		objects, _, err := st.List(b.Id, rest.ListOptions{})
+		require.NoError(t, err)
+		assertInfosEqual(t, wantObjects[b.Id], objects)
+		for _, objId := range []string{"oid", "oid2"} {
+			versions, _, err := st.Versions(objId, b.Id)
+			require.NoError(t, err)
+			assertInfosEqual(t, wantVersions[b.Id+"/"+objId], versions)
+		}
+	}
+	assert.Equal(t, "replaced obj", retrieve(t, st, "oid", "bid", ""))
+	assert.Equal(t, "", retrieve(t, st, "oid2", "bid", ""))
+	// The content type and the metadata are kept
+	info, ok, err := st.Stat("meta", "bid", "")
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, opts.ContentType, info.ContentType)
+	assert.Equal(t, opts.Metadata, info.Metadata)
+	assert.Equal(t, "{}", retrieve(t, st, "meta", "bid", ""))
+	assertNotFound(t, st, "deleted", "bid", "")
+	assert.Equal(t, "obj v1", retrieve(t, st, "oid", "vbid", wantVersions["vbid/oid"][1].VersionId))
+	assertNotFound(t, st, "oid2", "vbid", "")
+
+	// Versioning is kept, even on buckets without objects
+	v, _, err := st.Store(strings.NewReader("obj"), "oid", "empty", rest.StoreOptions{})
+	require.NoError(t, err)
+	assert.NotEmpty(t, v.VersionId)
+}
+
+// assertInfosEqual asserts the object information are equal, comparing the modification times as instants
+func assertInfosEqual(t *testing.T, want, got []rest.ObjectInfo) {
+	if !assert.Len(t, got, len(want)) {
+		return
+	}
+	for i := range want {
+		assert.True(t, want[i].LastModified.Equal(got[i].LastModified), "LastModified of %s", want[i].Id)
+		w, g := want[i], got[i]
+		w.LastModified = g.LastModified
+		if len(w.Metadata) == 0 && len(g.Metadata) == 0 {
+			w.Metadata, g.Metadata = nil, nil
+		}
+		assert.Equal(t, w, g)
+	}
+}
@@ -0,0 +1,35 @@
+package rest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NullVersionId identifies the version of an object stored while versioning was not enabled on its bucket.
+// Stores keep such versions with an empty version ID.
+const NullVersionId = "null"
+
+// versionIdHeader is the header holding the version ID of an object in versioned buckets
+const versionIdHeader = "X-Object-Version-Id"
+
+// NewVersionId returns a new random version ID
+func NewVersionId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("cannot generate version ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// VersionMatches reports whether the object version with ID `id` is the one identified by `versionId`
+func VersionMatches(id, versionId string) bool {
+	return id == versionId || (id == "" && versionId == NullVersionId)
+}
+
+// formatVersionId formats the version ID of an object for the API responses
+func formatVersionId(id string) string {
+	if id == "" {
+		return NullVersionId
+	}
+	return id
+}
@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/boltstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// BoltConfig is the configuration of the bolt storage, storing the objects in an embedded database
+type BoltConfig struct {
+	DataPath string `mapstructure:"data_path" usage:"Path to folder of persistent data"`
+	Fsync    bool   `mapstructure:"fsync" usage:"Sync each write to disk before acknowledging it"`
+}
+
+func init() {
+	Register("bolt", Backend{
+		NewConfig: func() interface{} {
+			return &BoltConfig{
+				DataPath: ".",
+			}
+		},
+		Open: func(config interface{}, logger log.FieldLogger) (rest.ObjectStore, error) {
+			c := config.(*BoltConfig)
+			if err := os.MkdirAll(c.DataPath, 0755); err != nil {
+				return nil, err
+			}
+			return boltstore.NewStore(c.DataPath, boltstore.Options{
+				Fsync: c.Fsync,
+			})
+		},
+	})
+}
+
+func (c *BoltConfig) Validate() error {
+	if c.DataPath == "" {
+		return errors.New("data_path is required")
+	}
+	return nil
+}
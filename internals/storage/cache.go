@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/cachestore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	"github.com/spf13/viper"
+)
+
+// CacheConfig is the configuration of the read cache in front of any storage backend, the `storage.cache` section
+type CacheConfig struct {
+	Size          int64 `mapstructure:"size" usage:"Memory in bytes for the read cache in front of the storage, caching the retrieved objects, 0 for no cache"`
+	MaxObjectSize int64 `mapstructure:"max_object_size" usage:"Size in bytes of the largest object cached, an eighth of the cache size if 0"`
+}
+
+func (c *CacheConfig) Validate() error {
+	if c.Size < 0 {
+		return errors.New("size must not be negative")
+	}
+	if c.MaxObjectSize < 0 {
+		return errors.New("max_object_size must not be negative")
+	}
+	return nil
+}
+
+// decodeCacheConfig decodes and validates the configuration of the read cache from `v`
+func decodeCacheConfig(v *viper.Viper) (*CacheConfig, error) {
+	config := &CacheConfig{}
+	if err := decodeConfig(v, "storage.cache", config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// withCache wraps `store` in a read cache, if configured
+func withCache(store rest.ObjectStore, config *CacheConfig) (rest.ObjectStore, error) {
+	if config.Size == 0 {
+		return store, nil
+	}
+	return cachestore.NewStore(store, cachestore.Options{Size: config.Size, MaxObjectSize: config.MaxObjectSize})
+}
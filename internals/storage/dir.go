@@ -0,0 +1,41 @@
+package storage
+
+import (
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/dirstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// DirConfig is the configuration of the dir storage, storing each object in its own file
+type DirConfig struct {
+	DataPath string `mapstructure:"data_path" usage:"Path to folder of persistent data"`
+	Fsync    bool   `mapstructure:"fsync" usage:"Sync each write to disk before acknowledging it"`
+}
+
+func init() {
+	Register("dir", Backend{
+		NewConfig: func() interface{} {
+			return &DirConfig{
+				DataPath: ".",
+			}
+		},
+		Open: func(config interface{}, logger log.FieldLogger) (rest.ObjectStore, error) {
+			c := config.(*DirConfig)
+			if err := os.MkdirAll(c.DataPath, 0755); err != nil {
+				return nil, err
+			}
+			return dirstore.NewStore(c.DataPath, dirstore.Options{
+				Fsync: c.Fsync,
+			})
+		},
+	})
+}
+
+func (c *DirConfig) Validate() error {
+	if c.DataPath == "" {
+		return errors.New("data_path is required")
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/filestore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"os"
+)
+
+// FileConfig is the configuration of the file storage, storing the objects of each bucket in a bucket file
+type FileConfig struct {
+	DataPath             string  `mapstructure:"data_path" usage:"Path to folder of persistent data"`
+	Durability           string  `mapstructure:"durability" usage:"Durability of persistent writes: none, fsync or group-commit"`
+	CompactionRatio      float64 `mapstructure:"compaction_ratio" usage:"Fraction of garbage in a bucket file above which it is compacted"`
+	CompactionMinGarbage int64   `mapstructure:"compaction_min_garbage" usage:"Minimum size in bytes of the garbage in a bucket file to compact it"`
+	Quarantine           bool    `mapstructure:"quarantine" usage:"Move corrupt bucket files to quarantine instead of failing"`
+	MetadataBudget       int64   `mapstructure:"metadata_budget" usage:"Memory budget in bytes for the bucket metadata, evicting the least recently used buckets, 0 for no limit"`
+}
+
+func init() {
+	Register("file", Backend{
+		NewConfig: func() interface{} {
+			return &FileConfig{
+				DataPath:             ".",
+				Durability:           string(filestore.DurabilityNone),
+				CompactionRatio:      0.5,
+				CompactionMinGarbage: 1 << 20,
+			}
+		},
+		Open: func(config interface{}, logger log.FieldLogger) (rest.ObjectStore, error) {
+			c := config.(*FileConfig)
+			if err := os.MkdirAll(c.DataPath, 0755); err != nil {
+				return nil, err
+			}
+			return filestore.NewStore(c.DataPath, filestore.Options{
+				Durability:           filestore.Durability(c.Durability),
+				CompactionRatio:      c.CompactionRatio,
+				CompactionMinGarbage: c.CompactionMinGarbage,
+				Quarantine:           c.Quarantine,
+				MetadataBudget:       c.MetadataBudget,
+				Logger:               logger,
+			})
+		},
+	})
+}
+
+func (c *FileConfig) Validate() error {
+	if c.DataPath == "" {
+		return errors.New("data_path is required")
+	}
+	if _, err := filestore.ParseDurability(c.Durability); err != nil {
+		return err
+	}
+	if c.CompactionRatio <= 0 || c.CompactionRatio > 1 {
+		return errors.New("compaction_ratio must be greater than 0 and at most 1")
+	}
+	if c.CompactionMinGarbage <= 0 {
+		return errors.New("compaction_min_garbage must be positive")
+	}
+	if c.MetadataBudget < 0 {
+		return errors.New("metadata_budget must not be negative")
+	}
+	return nil
+}
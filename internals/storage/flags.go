@@ -0,0 +1,129 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// The command line flags of the storage options are derived from the configuration structs of the registered backends
+// and of the read cache: each option has a flag named as the option with dashes instead of underscores, like
+// --data-path for data_path, the flags of the read cache options being prefixed by cache-, like --cache-size.
+// Backends with an option of the same name share its flag, which overrides the option of the chosen backend only.
+
+// cacheFlagPrefix is the prefix of the flags of the read cache options
+const cacheFlagPrefix = "cache-"
+
+// AddFlags defines on `flags` a flag for each option of the registered backends and of the read cache.
+// The flag of an option shared by more backends has the usage of the first backend by name, and the default they have
+// in common, if any, or else the zero value. It returns an error if backends share an option with different types.
+func AddFlags(flags *pflag.FlagSet) error {
+	var names []string
+	fields := make(map[string]configField)
+	for _, backend := range Backends() {
+		backendFields, err := backendConfigFields(backend)
+		if err != nil {
+			return err
+		}
+		for _, field := range backendFields {
+			name := flagName("", field.name)
+			shared, ok := fields[name]
+			if !ok {
+				names = append(names, name)
+				fields[name] = field
+				continue
+			}
+			if shared.value.Type() != field.value.Type() {
+				return fmt.Errorf("option %s of %s storage has type %s instead of %s", field.name, backend,
+					field.value.Type(), shared.value.Type())
+			}
+			if shared.value.Interface() != field.value.Interface() {
+				shared.value = reflect.Zero(shared.value.Type())
+				fields[name] = shared
+			}
+		}
+	}
+	cacheFields, err := configFields(&CacheConfig{})
+	if err != nil {
+		return err
+	}
+	for _, field := range cacheFields {
+		name := flagName(cacheFlagPrefix, field.name)
+		names = append(names, name)
+		fields[name] = field
+	}
+
+	for _, name := range names {
+		if err = addFlag(flags, name, fields[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BindFlags binds the flags defined by AddFlags on `flags` to the options of the backend `name` and of the read cache
+// in `v`, so that the flags set override them. The flags of the options of the other backends are ignored.
+func BindFlags(v *viper.Viper, flags *pflag.FlagSet, name string) error {
+	if err := bindFlags(v, flags, "storage.cache", cacheFlagPrefix, &CacheConfig{}); err != nil {
+		return err
+	}
+	backend, ok := lookupBackend(name)
+	if !ok {
+		// Reported by Open
+		return nil
+	}
+	return bindFlags(v, flags, "storage."+name, "", backend.NewConfig())
+}
+
+// bindFlags binds the flags on `flags` named after the options of `config`, prefixed by `prefix`, to the options in
+// the `section` of `v`
+func bindFlags(v *viper.Viper, flags *pflag.FlagSet, section, prefix string, config interface{}) error {
+	fields, err := configFields(config)
+	if err != nil {
+		return err
+	}
+	for _, field := range fields {
+		if flag := flags.Lookup(flagName(prefix, field.name)); flag != nil {
+			if err = v.BindPFlag(section+"."+field.name, flag); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// backendConfigFields returns the options of the configuration of the registered backend `name`
+func backendConfigFields(name string) ([]configField, error) {
+	backend, ok := lookupBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q", name)
+	}
+	return configFields(backend.NewConfig())
+}
+
+// flagName returns the name of the flag of option `option`, prefixed by `prefix`
+func flagName(prefix, option string) string {
+	return prefix + strings.ReplaceAll(option, "_", "-")
+}
+
+// addFlag defines on `flags` the flag `name` of the option `field`, of the type of the option
+func addFlag(flags *pflag.FlagSet, name string, field configField) error {
+	switch value := field.value.Interface().(type) {
+	case string:
+		flags.String(name, value, field.usage)
+	case bool:
+		flags.Bool(name, value, field.usage)
+	case int64:
+		flags.Int64(name, value, field.usage)
+	case float64:
+		flags.Float64(name, value, field.usage)
+	case time.Duration:
+		flags.Duration(name, value, field.usage)
+	default:
+		return fmt.Errorf("option %s has unsupported type %s", field.name, field.value.Type())
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"errors"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/memstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"time"
+)
+
+// MemoryConfig is the configuration of the memory storage, persisting its content only with a data path
+type MemoryConfig struct {
+	DataPath         string        `mapstructure:"data_path" usage:"Path to folder of persistent data, not persisted if empty"`
+	AppendOnly       bool          `mapstructure:"append_only" usage:"Log every change of the memory storage to the append-only log in the data path"`
+	AppendFsync      string        `mapstructure:"append_fsync" usage:"Policy syncing the append-only log of the memory storage: always, everysec or no"`
+	SnapshotInterval time.Duration `mapstructure:"snapshot_interval" usage:"Interval between the snapshots of the memory storage in the data path, 0 for none"`
+	LogRewriteSize   int64         `mapstructure:"log_rewrite_size" usage:"Size in bytes of the append-only log above which a snapshot of the memory storage is taken"`
+	MemoryBudget     int64         `mapstructure:"memory_budget" usage:"Memory budget in bytes for the objects of the memory storage, 0 for no limit"`
+	EvictionPolicy   string        `mapstructure:"eviction_policy" usage:"Policy making room for new objects over the memory budget: lru, lfu or reject"`
+}
+
+func init() {
+	Register("memory", Backend{
+		NewConfig: func() interface{} {
+			return &MemoryConfig{
+				AppendFsync:      string(memstore.FsyncEverySecond),
+				SnapshotInterval: 5 * time.Minute,
+				LogRewriteSize:   64 << 20,
+				EvictionPolicy:   string(memstore.EvictLRU),
+			}
+		},
+		Open: func(config interface{}, logger log.FieldLogger) (rest.ObjectStore, error) {
+			c := config.(*MemoryConfig)
+			if c.DataPath != "" {
+				if err := os.MkdirAll(c.DataPath, 0755); err != nil {
+					return nil, err
+				}
+			}
+			return memstore.NewStore(memstore.Options{
+				DataPath:         c.DataPath,
+				AppendOnly:       c.AppendOnly,
+				AppendFsync:      memstore.FsyncPolicy(c.AppendFsync),
+				SnapshotInterval: c.SnapshotInterval,
+				LogRewriteSize:   c.LogRewriteSize,
+				MemoryBudget:     c.MemoryBudget,
+				EvictionPolicy:   memstore.EvictionPolicy(c.EvictionPolicy),
+				Logger:           logger,
+			})
+		},
+	})
+}
+
+func (c *MemoryConfig) Validate() error {
+	if _, err := memstore.ParseFsyncPolicy(c.AppendFsync); err != nil {
+		return err
+	}
+	if c.SnapshotInterval < 0 {
+		return errors.New("snapshot_interval must not be negative")
+	}
+	if c.LogRewriteSize <= 0 {
+		return errors.New("log_rewrite_size must be positive")
+	}
+	if c.MemoryBudget < 0 {
+		return errors.New("memory_budget must not be negative")
+	}
+	if _, err := memstore.ParseEvictionPolicy(c.EvictionPolicy); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Storage backends register themselves by name, usually in an init function of their file in this package, along
+// with the constructor of their typed configuration. The configuration of a backend is the `storage.<name>` section of
+// the service configuration: Open decodes it into the configuration returned by the constructor, whose fields are named
+// by their `mapstructure` tags and hold the defaults, validates it and opens the store. The command line flags of the
+// options are derived from the same fields, described by their `usage` tags (see flags.go). So adding a backend only
+// requires registering it, the service is agnostic of the backends and of their options.
+// The `storage.cache` section configures the read cache put by Open in front of any backend, see CacheConfig.
+
+// Backend is a storage backend, creating object stores from its configuration
+type Backend struct {
+	// NewConfig returns a pointer to a new configuration struct of the backend, holding the defaults. If the struct
+	// has a `Validate() error` method, it is called once the configuration is decoded.
+	NewConfig func() interface{}
+	// Open opens an object store from the decoded configuration. If the returned store implements io.Closer, it
+	// must be closed once done.
+	Open func(config interface{}, logger log.FieldLogger) (rest.ObjectStore, error)
+}
+
+// validator is implemented by the backend configurations with constraints to check
+type validator interface {
+	Validate() error
+}
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]Backend)
+)
+
+// Register makes a storage backend available by the provided name.
+// It panics if a backend is registered twice with the same name, or without constructors.
+func Register(name string, backend Backend) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+
+	if backend.NewConfig == nil || backend.Open == nil {
+		panic("storage: Register backend " + name + " without constructors")
+	}
+	if _, dup := backends[name]; dup {
+		panic("storage: Register called twice for backend " + name)
+	}
+	backends[name] = backend
+}
+
+// Backends returns the sorted names of the registered backends
+func Backends() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupBackend returns the backend registered by the name `name`, if any
+func lookupBackend(name string) (Backend, bool) {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	backend, ok := backends[name]
+	return backend, ok
+}
+
+// Open opens an object store with the backend `name`, configured by the `storage.<name>` section of `v`.
+// The store is wrapped in a read cache if the `storage.cache` section sets its size.
+// Unknown backends, unknown options, options of the wrong type and invalid configurations are reported as errors.
+func Open(v *viper.Viper, name string, logger log.FieldLogger) (rest.ObjectStore, error) {
+	backend, ok := lookupBackend(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown storage type %q, available types: %s", name, strings.Join(Backends(), ", "))
+	}
+
+	config := backend.NewConfig()
+	if err := decodeConfig(v, "storage."+name, config); err != nil {
+		return nil, fmt.Errorf("invalid configuration of %s storage: %w", name, err)
+	}
+	if val, ok := config.(validator); ok {
+		if err := val.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid configuration of %s storage: %w", name, err)
+		}
+	}
+	cacheConfig, err := decodeCacheConfig(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration of storage cache: %w", err)
+	}
+
+	store, err := backend.Open(config, logger)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s storage: %w", name, err)
+	}
+	cached, err := withCache(store, cacheConfig)
+	if err != nil {
+		if closer, ok := store.(io.Closer); ok {
+			_ = closer.Close()
+		}
+		return nil, fmt.Errorf("cannot open storage cache: %w", err)
+	}
+	return cached, nil
+}
+
+// HasOption reports whether the backend `name` is registered with the option `option`
+func HasOption(name, option string) bool {
+	backend, ok := lookupBackend(name)
+	if !ok {
+		return false
+	}
+	options, err := configOptions(backend.NewConfig())
+	return err == nil && options[option]
+}
+
+// decodeConfig decodes the options set in the `section` of `v` into the configuration struct pointed by `config`,
+// leaving the other fields to their defaults. Config files, env variables and flags bound to `v` are all taken into
+// account, and the options set in the section which are not fields of the struct are reported as errors.
+func decodeConfig(v *viper.Viper, section string, config interface{}) error {
+	options, err := configOptions(config)
+	if err != nil {
+		return err
+	}
+
+	set := viper.New()
+	for option := range options {
+		if key := section + "." + option; v.IsSet(key) {
+			set.Set(option, v.Get(key))
+		}
+	}
+	var unknown []string
+	for _, key := range v.AllKeys() {
+		option := strings.TrimPrefix(key, section+".")
+		if option != key && !options[option] && v.IsSet(key) {
+			unknown = append(unknown, option)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown options %s", strings.Join(unknown, ", "))
+	}
+
+	return set.Unmarshal(config)
+}
+
+// configOptions returns the options of the configuration struct pointed by `config`, named by the `mapstructure` tags
+// of its fields, or else by their lowercase names
+func configOptions(config interface{}) (map[string]bool, error) {
+	fields, err := configFields(config)
+	if err != nil {
+		return nil, err
+	}
+
+	options := make(map[string]bool, len(fields))
+	for _, field := range fields {
+		options[field.name] = true
+	}
+	return options, nil
+}
+
+// configField is an option of a configuration struct
+type configField struct {
+	name  string        // Name of the option
+	usage string        // Description of the option, from the `usage` tag
+	value reflect.Value // Value of the field, holding the default
+}
+
+// configFields returns the options of the configuration struct pointed by `config`, in the order of its fields,
+// named by the `mapstructure` tags of the fields, or else by their lowercase names
+func configFields(config interface{}) ([]configField, error) {
+	t := reflect.TypeOf(config)
+	if t.Kind() != reflect.Ptr || t.Elem().Kind() != reflect.Struct {
+		return nil, errors.New("configuration is not a pointer to a struct")
+	}
+	t = t.Elem()
+	value := reflect.ValueOf(config).Elem()
+
+	fields := make([]configField, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// Unexported
+			continue
+		}
+		name := strings.Split(field.Tag.Get("mapstructure"), ",")[0]
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields = append(fields, configField{name: name, usage: field.Tag.Get("usage"), value: value.Field(i)})
+	}
+	return fields, nil
+}
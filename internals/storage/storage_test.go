@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/boltstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/cachestore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/dirstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/filestore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/memstore"
+	"github.com/flaviopicci/simple-objectstore-restapi/internals/rest"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBackends(t *testing.T) {
+	assert.Equal(t, []string{"bolt", "dir", "file", "memory"}, Backends())
+	assert.Panics(t, func() {
+		Register("memory", Backend{
+			NewConfig: func() interface{} { return &MemoryConfig{} },
+			Open:      func(interface{}, log.FieldLogger) (rest.ObjectStore, error) { return nil, nil },
+		})
+	})
+	assert.Panics(t, func() {
+		Register("nothing", Backend{})
+	})
+}
+
+func TestOpen(t *testing.T) {
+	dataPath := t.TempDir()
+	tests := []struct {
+		name     string
+		backend  string
+		settings map[string]interface{}
+		want     rest.ObjectStore
+		wantErr  string
+	}{{
+		name:    "memory",
+		backend: "memory",
+		want:    &memstore.MemStore{},
+	}, {
+		name:     "persistent memory",
+		backend:  "memory",
+		settings: map[string]interface{}{"storage.memory.data_path": dataPath + "/memory", "storage.memory.append_only": true, "storage.memory.snapshot_interval": "1m", "storage.memory.memory_budget": 1 << 30, "storage.memory.eviction_policy": "lfu"},
+		want:     &memstore.MemStore{},
+	}, {
+		name:     "file",
+		backend:  "file",
+		settings: map[string]interface{}{"storage.file.data_path": dataPath, "storage.file.compaction_ratio": "0.3"},
+		want:     &filestore.FileStore{},
+	}, {
+		name:     "dir",
+		backend:  "dir",
+		settings: map[string]interface{}{"storage.dir.data_path": dataPath + "/dir", "storage.dir.fsync": true},
+		want:     &dirstore.DirStore{},
+	}, {
+		name:     "bolt",
+		backend:  "bolt",
+		settings: map[string]interface{}{"storage.bolt.data_path": dataPath + "/bolt", "storage.dir.quarantine": true},
+		want:     &boltstore.BoltStore{},
+	}, {
+		name:     "cached",
+		backend:  "file",
+		settings: map[string]interface{}{"storage.file.data_path": dataPath + "/cached", "storage.cache.size": "1048576", "storage.cache.max_object_size": 4096},
+		want:     &cachestore.CacheStore{},
+	}, {
+		name:    "unknown backend",
+		backend: "tape",
+		wantErr: `unknown storage type "tape", available types: bolt, dir, file, memory`,
+	}, {
+		name:     "unknown options",
+		backend:  "dir",
+		settings: map[string]interface{}{"storage.dir.data_path": dataPath, "storage.dir.quarantine": true, "storage.dir.size": 1},
+		wantErr:  "invalid configuration of dir storage: unknown options quarantine, size",
+	}, {
+		name:     "wrong type",
+		backend:  "file",
+		settings: map[string]interface{}{"storage.file.metadata_budget": "lots"},
+		wantErr:  "invalid configuration of file storage",
+	}, {
+		name:     "invalid value",
+		backend:  "file",
+		settings: map[string]interface{}{"storage.file.compaction_ratio": 2},
+		wantErr:  "invalid configuration of file storage: compaction_ratio must be greater than 0 and at most 1",
+	}, {
+		name:     "invalid memory value",
+		backend:  "memory",
+		settings: map[string]interface{}{"storage.memory.append_fsync": "sometimes"},
+		wantErr:  `invalid configuration of memory storage: unknown fsync policy "sometimes"`,
+	}, {
+		name:     "invalid eviction policy",
+		backend:  "memory",
+		settings: map[string]interface{}{"storage.memory.eviction_policy": "random"},
+		wantErr:  `invalid configuration of memory storage: unknown eviction policy "random"`,
+	}, {
+		name:     "invalid cache value",
+		backend:  "memory",
+		settings: map[string]interface{}{"storage.cache.size": -1},
+		wantErr:  "invalid configuration of storage cache: size must not be negative",
+	}, {
+		name:     "unknown cache options",
+		backend:  "memory",
+		settings: map[string]interface{}{"storage.cache.policy": "lru"},
+		wantErr:  "invalid configuration of storage cache: unknown options policy",
+	}, {
+		name:     "open error",
+		backend:  "bolt",
+		settings: map[string]interface{}{"storage.bolt.data_path": "/dev/null/bolt"},
+		wantErr:  "cannot open bolt storage",
+	}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := viper.New()
+			for key, value := range tt.settings {
+				v.Set(key, value)
+			}
+			store, err := Open(v, tt.backend, nil)
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.IsType(t, tt.want, store)
+			if closer, ok := store.(io.Closer); ok {
+				assert.NoError(t, closer.Close())
+			}
+		})
+	}
+}
+
+func Test_decodeConfig(t *testing.T) {
+	v := viper.New()
+	v.Set("storage.file.data_path", "/tmp/data")
+	v.Set("storage.file.quarantine", "true")
+	v.Set("storage.dir.data_path", "/tmp/other")
+	// Env variables are taken into account as well
+	v.AutomaticEnv()
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	_ = os.Setenv("STORAGE_FILE_METADATA_BUDGET", "1024")
+	defer os.Unsetenv("STORAGE_FILE_METADATA_BUDGET")
+
+	config := &FileConfig{DataPath: ".", Durability: "fsync", CompactionRatio: 0.5}
+	assert.NoError(t, decodeConfig(v, "storage.file", config))
+	assert.Equal(t, &FileConfig{
+		DataPath:        "/tmp/data",
+		Durability:      "fsync",
+		CompactionRatio: 0.5,
+		Quarantine:      true,
+		MetadataBudget:  1024,
+	}, config)
+
+	assert.Error(t, decodeConfig(v, "storage.file", FileConfig{}))
+}
+
+func TestAddFlags(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	if !assert.NoError(t, AddFlags(flags)) {
+		return
+	}
+
+	// Flags are named after the options, with the default shared by the backends having them
+	for name, defValue := range map[string]string{
+		"data-path":             "",
+		"durability":            "none",
+		"fsync":                 "false",
+		"compaction-ratio":      "0.5",
+		"quarantine":            "false",
+		"snapshot-interval":     "5m0s",
+		"log-rewrite-size":      "67108864",
+		"cache-size":            "0",
+		"cache-max-object-size": "0",
+	} {
+		if flag := flags.Lookup(name); assert.NotNil(t, flag, name) {
+			assert.Equal(t, defValue, flag.DefValue, name)
+			assert.NotEmpty(t, flag.Usage, name)
+		}
+	}
+
+	// and the flags set override the options of the chosen backend only
+	dataPath := t.TempDir()
+	assert.NoError(t, flags.Parse([]string{"--data-path", dataPath, "--compaction-ratio", "0.3", "--cache-size", "1024"}))
+	v := viper.New()
+	assert.NoError(t, BindFlags(v, flags, "file"))
+	assert.NoError(t, BindFlags(viper.New(), flags, "tape"))
+	config := &FileConfig{}
+	assert.NoError(t, decodeConfig(v, "storage.file", config))
+	assert.Equal(t, &FileConfig{DataPath: dataPath, CompactionRatio: 0.3}, config)
+	assert.False(t, v.IsSet("storage.dir.data_path"))
+
+	store, err := Open(v, "file", nil)
+	if assert.NoError(t, err) {
+		assert.IsType(t, &cachestore.CacheStore{}, store)
+		assert.NoError(t, store.(io.Closer).Close())
+	}
+}
+
+func TestHasOption(t *testing.T) {
+	assert.True(t, HasOption("file", "data_path"))
+	assert.True(t, HasOption("memory", "memory_budget"))
+	assert.False(t, HasOption("dir", "quarantine"))
+	assert.False(t, HasOption("tape", "data_path"))
+}